@@ -0,0 +1,405 @@
+// Package azure is a small client for Azure Blob Storage using Shared
+// Key or SAS token authentication.
+package azure
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DefaultBlockSize is the largest blob uploaded with a single Put Blob
+// request and the size of the blocks of larger blobs.
+const DefaultBlockSize = 4 * 1024 * 1024
+
+// Config is the "Azure" section of a bucket JSON file.  Set either
+// AccessKey (the base64 account key) for Shared Key authentication or
+// SAS to a shared access signature query string.  Endpoint defaults to
+// https://<account>.blob.core.windows.net; for Azurite, use a URL like
+// http://127.0.0.1:10000/devstoreaccount1.
+type Config struct {
+	Account   string
+	Container string
+	AccessKey string
+	SAS       string
+	Endpoint  string
+}
+
+type Service struct {
+	Account  string
+	Endpoint string       // without a trailing slash
+	Client   *http.Client `json:"-"`
+
+	key []byte     // for Shared Key authentication
+	sas url.Values // for SAS authentication
+}
+
+func NewService(conf *Config) (*Service, error) {
+	if conf.Account == "" {
+		return nil, errors.New("missing Account")
+	}
+	s := &Service{
+		Account:  conf.Account,
+		Endpoint: strings.TrimSuffix(conf.Endpoint, "/"),
+	}
+	if s.Endpoint == "" {
+		s.Endpoint = "https://" + conf.Account + ".blob.core.windows.net"
+	}
+	if _, err := url.Parse(s.Endpoint); err != nil {
+		return nil, fmt.Errorf("invalid endpoint %q: %s", s.Endpoint, err)
+	}
+
+	switch {
+	case conf.AccessKey != "" && conf.SAS != "":
+		return nil, errors.New("expecting AccessKey or SAS, not both")
+	case conf.AccessKey != "":
+		key, err := base64.StdEncoding.DecodeString(conf.AccessKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid AccessKey: %s", err)
+		}
+		s.key = key
+	case conf.SAS != "":
+		sas, err := url.ParseQuery(strings.TrimPrefix(conf.SAS, "?"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid SAS: %s", err)
+		}
+		if sas.Get("sig") == "" {
+			return nil, errors.New("invalid SAS: missing sig")
+		}
+		s.sas = sas
+	default:
+		return nil, errors.New("missing AccessKey or SAS")
+	}
+	return s, nil
+}
+
+type Container struct {
+	Service   *Service
+	Name      string
+	BlockSize int
+
+	ctx context.Context
+}
+
+// WithContext returns a shallow copy of c whose requests use ctx.
+func (c *Container) WithContext(ctx context.Context) *Container {
+	c2 := *c
+	c2.ctx = ctx
+	return &c2
+}
+
+func (c *Container) context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
+// NewContainerFromFile reads a JSON file of the form
+//
+//	{"Azure": {"Account": "...", "Container": "...", "AccessKey": "..."}}
+func NewContainerFromFile(path string) (*Container, error) {
+	conf, err := ReadConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if conf.Container == "" {
+		return nil, errors.New("missing Container")
+	}
+	s, err := NewService(conf)
+	if err != nil {
+		return nil, err
+	}
+	return &Container{Service: s, Name: conf.Container, BlockSize: DefaultBlockSize}, nil
+}
+
+// ReadConfigFile reads the "Azure" section of a JSON file.
+func ReadConfigFile(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var conf struct {
+		Azure *Config
+	}
+	if err := json.Unmarshal(data, &conf); err != nil {
+		return nil, fmt.Errorf("json decoding error: %s", err)
+	}
+	if conf.Azure == nil {
+		return nil, errors.New("missing Azure configuration")
+	}
+	return conf.Azure, nil
+}
+
+// URL returns the URL of a blob, or of the container if blob is empty.
+func (c *Container) URL(blob string, values url.Values) *url.URL {
+	u, _ := url.Parse(c.Service.Endpoint)
+	u.Path += "/" + c.Name
+	if blob != "" {
+		u.Path += "/" + blob
+	}
+	q := url.Values{}
+	for k, vs := range values {
+		q[k] = vs
+	}
+	for k, vs := range c.Service.sas {
+		q[k] = vs
+	}
+	u.RawQuery = q.Encode()
+	return u
+}
+
+func (c *Container) newRequest(method, blob string, values url.Values, body []byte) (*http.Request, error) {
+	var req *http.Request
+	var err error
+	if body == nil {
+		req, err = http.NewRequestWithContext(c.context(), method, c.URL(blob, values).String(), nil)
+	} else {
+		req, err = http.NewRequestWithContext(c.context(), method, c.URL(blob, values).String(), bytes.NewReader(body))
+		sum := md5.Sum(body)
+		req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+	}
+	return req, err
+}
+
+// Put uploads a block blob, in blocks if it is larger than BlockSize.
+func (c *Container) Put(blob string, data []byte) error {
+	blockSize := c.BlockSize
+	if blockSize <= 0 {
+		blockSize = DefaultBlockSize
+	}
+	if len(data) <= blockSize {
+		return c.putBlob(blob, data)
+	}
+
+	var ids []string
+	for i := 0; i < len(data); i += blockSize {
+		end := i + blockSize
+		if end > len(data) {
+			end = len(data)
+		}
+		// Block IDs must have the same length within a blob.
+		id := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("block-%08d", len(ids))))
+		if err := c.putBlock(blob, id, data[i:end]); err != nil {
+			return err
+		}
+		ids = append(ids, id)
+	}
+	return c.putBlockList(blob, ids)
+}
+
+func (c *Container) putBlob(blob string, data []byte) error {
+	if data == nil {
+		data = []byte{}
+	}
+	req, err := c.newRequest("PUT", blob, nil, data)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("x-ms-blob-type", "BlockBlob")
+	resp, err := c.Service.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (c *Container) putBlock(blob, id string, data []byte) error {
+	vals := url.Values{}
+	vals.Set("comp", "block")
+	vals.Set("blockid", id)
+	req, err := c.newRequest("PUT", blob, vals, data)
+	if err != nil {
+		return err
+	}
+	resp, err := c.Service.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+type blockList struct {
+	XMLName xml.Name `xml:"BlockList"`
+	Latest  []string
+}
+
+func (c *Container) putBlockList(blob string, ids []string) error {
+	data, err := xml.Marshal(&blockList{Latest: ids})
+	if err != nil {
+		return err
+	}
+	vals := url.Values{}
+	vals.Set("comp", "blocklist")
+	req, err := c.newRequest("PUT", blob, vals, data)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/xml")
+	resp, err := c.Service.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (c *Container) Get(blob string) ([]byte, error) {
+	req, err := c.newRequest("GET", blob, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.Service.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
+
+// BlobProperties is the subset of blob properties that we use.
+type BlobProperties struct {
+	Size         int64
+	LastModified time.Time
+}
+
+// Properties returns the properties of blob, using a HEAD request.
+func (c *Container) Properties(blob string) (*BlobProperties, error) {
+	req, err := c.newRequest("HEAD", blob, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.Service.do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	props := &BlobProperties{Size: resp.ContentLength}
+	if lm := resp.Header.Get("Last-Modified"); lm != "" {
+		if props.LastModified, err = http.ParseTime(lm); err != nil {
+			return nil, fmt.Errorf("invalid Last-Modified header: %q", lm)
+		}
+	}
+	return props, nil
+}
+
+func (c *Container) Delete(blob string) error {
+	req, err := c.newRequest("DELETE", blob, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.Service.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+type ListResult struct {
+	Blobs      []string `xml:"Blobs>Blob>Name"`
+	Prefixes   []string `xml:"Blobs>BlobPrefix>Name"`
+	NextMarker string
+}
+
+// List returns one page of the blobs whose names start with prefix.
+// Pass the NextMarker of the previous page to get the next page.
+func (c *Container) List(prefix, delimiter, marker string) (*ListResult, error) {
+	vals := url.Values{}
+	vals.Set("restype", "container")
+	vals.Set("comp", "list")
+	if prefix != "" {
+		vals.Set("prefix", prefix)
+	}
+	if delimiter != "" {
+		vals.Set("delimiter", delimiter)
+	}
+	if marker != "" {
+		vals.Set("marker", marker)
+	}
+	req, err := c.newRequest("GET", "", vals, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.Service.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	list := new(ListResult)
+	if err := xml.NewDecoder(resp.Body).Decode(list); err != nil {
+		return nil, fmt.Errorf("unable to decode response body: %s", err)
+	}
+	return list, nil
+}
+
+// Error is an unsuccessful response from the blob service.
+type Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *Error) Error() string {
+	s := fmt.Sprintf("%s (Azure error %d)", e.Code, e.StatusCode)
+	if e.Message != "" {
+		s += ": " + strings.SplitN(e.Message, "\n", 2)[0]
+	}
+	return s
+}
+
+func (s *Service) client() *http.Client {
+	if s.Client == nil {
+		return http.DefaultClient
+	}
+	return s.Client
+}
+
+func (s *Service) do(req *http.Request) (*http.Response, error) {
+	if s.key != nil {
+		s.sign(req)
+	} else {
+		req.Header.Set("x-ms-version", Version)
+	}
+
+	resp, err := s.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	// HEAD responses have no body, so the code is also in a header.
+	e := &Error{StatusCode: resp.StatusCode, Code: resp.Header.Get("x-ms-error-code")}
+	body, _ := ioutil.ReadAll(resp.Body)
+	var x struct {
+		Code    string
+		Message string
+	}
+	if xml.Unmarshal(body, &x) == nil {
+		if x.Code != "" {
+			e.Code = x.Code
+		}
+		e.Message = x.Message
+	}
+	if e.Code == "" {
+		e.Code = http.StatusText(resp.StatusCode)
+	}
+	return nil, e
+}
@@ -0,0 +1,88 @@
+package azure
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Version is the storage service version we speak.
+const Version = "2020-04-08"
+
+// signedHeaders are the standard headers in a Shared Key string to
+// sign, in order.
+var signedHeaders = []string{
+	"Content-Encoding",
+	"Content-Language",
+	"Content-Length",
+	"Content-MD5",
+	"Content-Type",
+	"Date",
+	"If-Modified-Since",
+	"If-Match",
+	"If-None-Match",
+	"If-Unmodified-Since",
+	"Range",
+}
+
+// sign adds the date, version and Shared Key authorization headers.
+func (s *Service) sign(r *http.Request) {
+	r.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	r.Header.Set("x-ms-version", Version)
+
+	h := hmac.New(sha256.New, s.key)
+	s.stringToSign(h, r)
+	sig := base64.StdEncoding.EncodeToString(h.Sum(nil))
+	r.Header.Set("Authorization", "SharedKey "+s.Account+":"+sig)
+}
+
+func (s *Service) stringToSign(w io.Writer, r *http.Request) {
+	io.WriteString(w, r.Method+"\n")
+	for _, k := range signedHeaders {
+		v := r.Header.Get(k)
+		if k == "Content-Length" && r.ContentLength > 0 {
+			v = strconv.FormatInt(r.ContentLength, 10)
+		}
+		io.WriteString(w, v+"\n")
+	}
+	canonicalHeaders(w, r.Header)
+	s.canonicalResource(w, r)
+}
+
+func canonicalHeaders(w io.Writer, header http.Header) {
+	var ks []string
+	for k := range header {
+		k = strings.ToLower(k)
+		if strings.HasPrefix(k, "x-ms-") {
+			ks = append(ks, k)
+		}
+	}
+	sort.Strings(ks)
+	for _, k := range ks {
+		io.WriteString(w, k+":"+strings.TrimSpace(header.Get(k))+"\n")
+	}
+}
+
+// canonicalResource writes "/<account><path>" followed by the query
+// parameters, sorted by name, one per line.
+func (s *Service) canonicalResource(w io.Writer, r *http.Request) {
+	io.WriteString(w, "/"+s.Account+r.URL.EscapedPath())
+
+	q := r.URL.Query()
+	ks := make([]string, 0, len(q))
+	for k := range q {
+		ks = append(ks, k)
+	}
+	sort.Strings(ks)
+	for _, k := range ks {
+		vs := q[k]
+		sort.Strings(vs)
+		io.WriteString(w, "\n"+strings.ToLower(k)+":"+strings.Join(vs, ","))
+	}
+}
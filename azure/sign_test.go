@@ -0,0 +1,85 @@
+package azure
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// The well-known Azurite development account.
+var testConfig = &Config{
+	Account:   "devstoreaccount1",
+	AccessKey: "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw==",
+	Endpoint:  "http://127.0.0.1:10000/devstoreaccount1",
+}
+
+func TestStringToSign(t *testing.T) {
+	s, err := NewService(testConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := "http://127.0.0.1:10000/devstoreaccount1/kebab/dir/%E4%B8%96%E7%95%8C%20?comp=block&blockid=YmxvY2s="
+	req, err := http.NewRequest("PUT", u, strings.NewReader("hello world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-MD5", "XrY7u+Ae7tCTyyK7j1rNww==")
+	req.Header.Set("x-ms-blob-type", "BlockBlob")
+	req.Header.Set("x-ms-date", "Fri, 26 Jun 2015 23:39:12 GMT")
+	req.Header.Set("x-ms-version", Version)
+
+	buf := new(bytes.Buffer)
+	s.stringToSign(buf, req)
+	expected := "PUT\n\n\n11\nXrY7u+Ae7tCTyyK7j1rNww==\n\n\n\n\n\n\n\n" +
+		"x-ms-blob-type:BlockBlob\n" +
+		"x-ms-date:Fri, 26 Jun 2015 23:39:12 GMT\n" +
+		"x-ms-version:2020-04-08\n" +
+		"/devstoreaccount1/devstoreaccount1/kebab/dir/%E4%B8%96%E7%95%8C%20\n" +
+		"blockid:YmxvY2s=\n" +
+		"comp:block"
+	if buf.String() != expected {
+		t.Fatalf("expected: %q\nactually: %q", expected, buf.String())
+	}
+
+	h := hmac.New(sha256.New, s.key)
+	h.Write(buf.Bytes())
+	sig := base64.StdEncoding.EncodeToString(h.Sum(nil))
+	if sig != "63OXFII7UBLqKZgsYsJQ7fr+XIZnI3RsEgdVpCo/reU=" {
+		t.Fatalf("unexpected signature: %s", sig)
+	}
+}
+
+func TestSASURL(t *testing.T) {
+	s, err := NewService(&Config{
+		Account: "kebab",
+		SAS:     "?sv=2020-04-08&sr=c&sp=racwdl&sig=abc%2Fdef",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Container{Service: s, Name: "backups"}
+	u := c.URL("dir/key", nil).String()
+	expected := "https://kebab.blob.core.windows.net/backups/dir/key?sig=abc%2Fdef&sp=racwdl&sr=c&sv=2020-04-08"
+	if u != expected {
+		t.Fatalf("expected %s, got %s", expected, u)
+	}
+}
+
+func TestInvalidConfig(t *testing.T) {
+	configs := []*Config{
+		{Container: "c", AccessKey: testConfig.AccessKey},
+		{Account: "a", Container: "c"},
+		{Account: "a", Container: "c", AccessKey: "not base64!"},
+		{Account: "a", Container: "c", AccessKey: testConfig.AccessKey, SAS: "sig=x"},
+		{Account: "a", Container: "c", SAS: "sv=2020-04-08"},
+	}
+	for _, conf := range configs {
+		if _, err := NewService(conf); err == nil {
+			t.Errorf("expected error for %+v", conf)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package bucket
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/davidlazar/kebab/azure"
+)
+
+type azureBucket struct {
+	container *azure.Container
+	prefix    string
+}
+
+func init() {
+	Register("azure", openAzureURL)
+}
+
+// openAzureURL opens a location of the form
+// azure://account/container/prefix?config=<file>, where the config file
+// holds the credentials as for NewAzureBucketFromFile and need not name
+// the account or container.
+func openAzureURL(u *url.URL) (Bucket, error) {
+	config, err := configParam(u)
+	if err != nil {
+		return nil, err
+	}
+	p := strings.TrimPrefix(u.Path, "/")
+	container := p
+	if i := strings.Index(p, "/"); i >= 0 {
+		container, p = p[:i], p[i:]
+	} else {
+		p = ""
+	}
+	if u.Host == "" || container == "" {
+		return nil, fmt.Errorf("expecting azure://account/container/prefix")
+	}
+	conf, err := azure.ReadConfigFile(config)
+	if err != nil {
+		return nil, err
+	}
+	if conf.Account != "" && conf.Account != u.Host {
+		return nil, fmt.Errorf("config is for account %q", conf.Account)
+	}
+	conf.Account = u.Host
+	s, err := azure.NewService(conf)
+	if err != nil {
+		return nil, err
+	}
+	c := &azure.Container{Service: s, Name: container, BlockSize: azure.DefaultBlockSize}
+	return DescendPath(NewAzureBucket(c), p)
+}
+
+func NewAzureBucket(c *azure.Container) Bucket {
+	return &azureBucket{container: c}
+}
+
+func NewAzureBucketFromFile(path string) (Bucket, error) {
+	c, err := azure.NewContainerFromFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewAzureBucket(c), nil
+}
+
+func (b *azureBucket) WithContext(ctx context.Context) Bucket {
+	return &azureBucket{container: b.container.WithContext(ctx), prefix: b.prefix}
+}
+
+func (b *azureBucket) Abs(key string) string {
+	return b.prefix + key
+}
+
+func (b *azureBucket) Put(key string, data []byte) error {
+	return b.container.Put(b.Abs(key), data)
+}
+
+func (b *azureBucket) Get(key string) ([]byte, error) {
+	return b.container.Get(b.Abs(key))
+}
+
+func (b *azureBucket) Stat(key string) (*Info, error) {
+	props, err := b.container.Properties(b.Abs(key))
+	if err != nil {
+		return nil, err
+	}
+	return &Info{Size: props.Size, ModTime: props.LastModified}, nil
+}
+
+func (b *azureBucket) Delete(key string) error {
+	if err := b.container.Delete(b.Abs(key)); err != nil && !IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (b *azureBucket) List() (keys []string, children []string, err error) {
+	return listAll(b.ListPages())
+}
+
+func (b *azureBucket) ListPages() PageIterator {
+	return &pageIterator{
+		next: func(marker string) (keys, children []string, next string, err error) {
+			list, err := b.container.List(b.prefix, "/", marker)
+			if err != nil {
+				return nil, nil, "", fmt.Errorf("List(%q, %q): %s", b.prefix, "/", err)
+			}
+			for _, name := range list.Blobs {
+				keys = append(keys, strings.TrimPrefix(name, b.prefix))
+			}
+			for _, p := range list.Prefixes {
+				children = append(children, strings.TrimPrefix(strings.TrimSuffix(p, "/"), b.prefix))
+			}
+			return keys, children, list.NextMarker, nil
+		},
+	}
+}
+
+func (b *azureBucket) Descend(child string) (Bucket, error) {
+	if !strings.HasSuffix(child, "/") {
+		child += "/"
+	}
+	return &azureBucket{
+		container: b.container,
+		prefix:    b.prefix + child,
+	}, nil
+}
+
+func (b *azureBucket) Destroy() error {
+	for {
+		list, err := b.container.List(b.prefix, "", "")
+		if err != nil {
+			return fmt.Errorf("List(%q, %q): %s", b.prefix, "", err)
+		}
+		if len(list.Blobs) == 0 {
+			return nil
+		}
+
+		for _, name := range list.Blobs {
+			if err := b.container.Delete(name); err != nil && !IsNotExist(err) {
+				return fmt.Errorf("Delete(%q): %s", name, err)
+			}
+		}
+	}
+}
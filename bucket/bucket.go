@@ -1,8 +1,12 @@
 package bucket
 
 import (
+	"net/http"
 	"os"
+	"time"
 
+	"github.com/davidlazar/kebab/azure"
+	"github.com/davidlazar/kebab/gcs"
 	"github.com/davidlazar/kebab/s3"
 )
 
@@ -10,15 +14,47 @@ type Bucket interface {
 	Abs(key string) string
 	Put(key string, data []byte) error
 	Get(key string) ([]byte, error)
+	// Stat describes the value of key without reading it.  The error
+	// satisfies IsNotExist if there is no such value.
+	Stat(key string) (*Info, error)
+	// Delete removes the value of key.  Deleting a value that does not
+	// exist is not an error.
+	Delete(key string) error
 	List() (keys, children []string, err error)
 	Descend(child string) (Bucket, error)
 	Destroy() error
 }
 
+// Info describes a stored value.  Wrappers that transform values, like
+// the encrypted bucket, report the size of the stored value.  ModTime is
+// zero if the storage does not report it.
+type Info struct {
+	Size    int64
+	ModTime time.Time
+}
+
+// Exists reports whether b has a value for key.
+func Exists(b Bucket, key string) (bool, error) {
+	_, err := b.Stat(key)
+	if err == nil {
+		return true, nil
+	}
+	if IsNotExist(err) {
+		return false, nil
+	}
+	return false, err
+}
+
 func IsNotExist(err error) bool {
 	switch e := err.(type) {
 	case *s3.ServiceError:
 		return e.Code == "NoSuchKey"
+	case *azure.Error:
+		return e.Code == "BlobNotFound"
+	case *gcs.Error:
+		return e.Code == http.StatusNotFound
+	case *WebDAVError:
+		return e.StatusCode == http.StatusNotFound
 	default:
 		return os.IsNotExist(err)
 	}
@@ -2,15 +2,39 @@ package bucket_test
 
 import (
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	golog "log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/davidlazar/go-crypto/secretkey"
+	"github.com/davidlazar/kebab/azure"
 	"github.com/davidlazar/kebab/bucket"
+	"github.com/davidlazar/kebab/gcs"
 	"github.com/davidlazar/kebab/internal/testutil"
+	"github.com/davidlazar/kebab/s3"
 )
 
 func TestMain(m *testing.M) {
@@ -36,6 +60,1183 @@ func TestUpgradedFileBucket(t *testing.T) {
 	b.allTests()
 }
 
+func TestEncryptedNamesFileBucket(t *testing.T) {
+	raw := testutil.TempFileBucket("EncryptedNamesFileBucket")
+	b := &TestBucket{
+		bucket: testutil.UpgradeNames(raw),
+		t:      t,
+	}
+	b.allTests()
+
+	child := b.CheckDescend("email-2015-03-14")
+	child.CheckPut("meta", []byte("hello"))
+	child.CheckPut("00000", []byte("world"))
+	b.CheckList(nil, []string{"email-2015-03-14"})
+	child.CheckList([]string{"00000", "meta"}, nil)
+
+	keys, children, err := raw.List()
+	if err != nil {
+		t.Fatalf("List failed: %s", err)
+	}
+	if len(keys) != 0 || len(children) != 1 || strings.Contains(children[0], "email") {
+		t.Fatalf("underlying bucket reveals names: (%v, %v)", keys, children)
+	}
+
+	// Names that are not ours are skipped.
+	other := &TestBucket{
+		bucket: testutil.UpgradeNames(raw),
+		t:      t,
+	}
+	other.CheckList(nil, nil)
+
+	// Encrypted names must fit in a file name.
+	long := strings.Repeat("x", 95)
+	b.CheckDescend(long).CheckPut(long, []byte("hello"))
+	if _, err := b.bucket.Descend(long + "x"); err == nil {
+		t.Fatalf("expected an error for a name that is too long")
+	}
+	if err := b.bucket.Put(long+"x", []byte("hello")); err == nil {
+		t.Fatalf("expected an error for a key that is too long")
+	} else if _, ok := err.(*bucket.NameTooLongError); !ok {
+		t.Fatalf("expected a *NameTooLongError, got %v", err)
+	}
+	if abs := b.bucket.Abs(long + "x"); !strings.Contains(abs, "at most 95 bytes") {
+		t.Fatalf("Abs of a key that is too long does not say so: %q", abs)
+	}
+	b.CheckDestroy()
+}
+
+func TestFileBucketAtomicWrites(t *testing.T) {
+	dir := filepath.Join(testutil.TempDir, "FileBucketAtomicWrites")
+	if err := os.MkdirAll(filepath.Join(dir, "child"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	// Left over from a crash: the old one is removed when its directory
+	// is next written to, the recent one may belong to a write in
+	// progress.
+	stale := filepath.Join(dir, "child", ".00000.tmp-123")
+	recent := filepath.Join(dir, ".meta.tmp-456")
+	for _, p := range []string{stale, recent} {
+		if err := ioutil.WriteFile(p, []byte("trunc"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(stale, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	fb, err := bucket.NewFileBucketWithOptions(dir, bucket.FileOptions{NoOverwrite: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := &TestBucket{bucket: fb, t: t}
+	b.CheckList(nil, []string{"child"})
+	b.CheckPut("meta", []byte("hello"))
+	if err := fb.Put("meta", []byte("world")); !os.IsExist(err) {
+		t.Fatalf("expected an exist error when overwriting, got %v", err)
+	}
+	if err := bucket.Stream(fb).PutStream("meta", bytes.NewReader([]byte("world"))); !os.IsExist(err) {
+		t.Fatalf("expected an exist error when overwriting a stream, got %v", err)
+	}
+	b.CheckGet("meta", []byte("hello"))
+
+	// The option is kept by children.
+	child := b.CheckDescend("child")
+	child.CheckPut("00000", []byte("box"))
+	if err := child.bucket.Put("00000", nil); !os.IsExist(err) {
+		t.Fatalf("expected an exist error in child, got %v", err)
+	}
+	child.CheckList([]string{"00000"}, nil)
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Fatalf("stale temp file not removed: %v", err)
+	}
+	if _, err := os.Stat(recent); err != nil {
+		t.Fatalf("recent temp file removed: %v", err)
+	}
+
+	names, err := filepath.Glob(filepath.Join(dir, "*", ".*.tmp-*"))
+	if err != nil || len(names) != 0 {
+		t.Fatalf("temp files left behind: %v %v", names, err)
+	}
+	b.CheckList([]string{"meta"}, []string{"child"})
+	os.Remove(recent)
+	b.CheckDestroy()
+}
+
+func TestChunkedBoxes(t *testing.T) {
+	key := secretkey.New()
+	mem := bucket.NewMemoryBucket()
+	e := bucket.NewEncryptedBucket(mem, key)
+	for _, n := range []int{0, 1, bucket.ChunkSize - 1, bucket.ChunkSize, bucket.ChunkSize + 1, 3 * bucket.ChunkSize} {
+		data := testutil.RandomBytes(n)
+		if err := e.Put("key", data); err != nil {
+			t.Fatal(err)
+		}
+		box, _ := mem.Get("key")
+		if int64(len(box)) != bucket.SealedSize(int64(n)) {
+			t.Fatalf("%d bytes: box has size %d, expected %d", n, len(box), bucket.SealedSize(int64(n)))
+		}
+		if x, err := e.Get("key"); err != nil || !bytes.Equal(x, data) {
+			t.Fatalf("%d bytes: Get: %v", n, err)
+		}
+		rc, err := e.(bucket.StreamBucket).GetStream("key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		x, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil || !bytes.Equal(x, data) {
+			t.Fatalf("%d bytes: GetStream: %v", n, err)
+		}
+	}
+
+	// The box is 3 full chunks and an empty final chunk.
+	box, _ := mem.Get("key")
+	const header, sealed = 24, bucket.ChunkSize + 16
+	tampered := map[string][]byte{
+		"dropped final chunk": box[:len(box)-16],
+		"truncated chunk":     box[:header+sealed+100],
+		"swapped chunks":      append(append(append([]byte(nil), box[:header]...), box[header+sealed:header+2*sealed]...), box[header:header+sealed]...),
+		"flipped bit":         append(append([]byte(nil), box[:len(box)-1]...), box[len(box)-1]^1),
+	}
+	for what, box := range tampered {
+		mem.Put("key", box)
+		if _, err := e.Get("key"); err != bucket.ErrAuth {
+			t.Errorf("%s: expected ErrAuth, got %v", what, err)
+		}
+	}
+
+	// Boxes sealed in one piece by older versions are still read.
+	var nonce [24]byte
+	rand.Read(nonce[:])
+	data := testutil.RandomBytes(1000)
+	mem.Put("old", secretbox.Seal(nonce[:], data, &nonce, (*[32]byte)(key)))
+	if x, err := e.Get("old"); err != nil || !bytes.Equal(x, data) {
+		t.Fatalf("Get of unchunked box: %v", err)
+	}
+	mem.Put("short", nonce[:])
+	if _, err := e.Get("short"); err == nil {
+		t.Fatal("expected error for short box")
+	}
+}
+
+func TestStreamBucket(t *testing.T) {
+	cache, err := bucket.OpenCache(filepath.Join(testutil.TempDir, "StreamCache"), 1<<30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lim := bucket.NewLimiter(bucket.Schedule{Rate: 1 << 30})
+	mirror := func(name string) bucket.Bucket {
+		m, err := bucket.NewMirrorBucket([]bucket.Replica{
+			{Name: "a", Bucket: testutil.TempFileBucket(name + "A")},
+			{Name: "b", Bucket: testutil.TempFileBucket(name + "B")},
+		}, 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	erasure, err := bucket.NewErasureBucket([]bucket.Bucket{
+		bucket.NewMemoryBucket(), bucket.NewMemoryBucket(), bucket.NewMemoryBucket(),
+	}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, b := range []bucket.Bucket{
+		testutil.TempFileBucket("StreamBucket"),
+		bucket.NewMemoryBucket(),
+		testutil.TempS3Bucket("StreamBucket"),
+		testutil.Upgrade(testutil.TempS3Bucket("UpgradedStreamBucket")),
+		bucket.NewCacheBucket(testutil.TempFileBucket("CachedStreamBucket"), cache),
+		bucket.NewRateLimitedBucket(testutil.TempFileBucket("RateLimitedStreamBucket"), lim, lim),
+		mirror("MirrorStreamBucket"),
+		erasure,
+		testutil.Upgrade(bucket.NewRateLimitedBucket(bucket.NewCacheBucket(mirror("UpgradedMirrorStreamBucket"), cache), lim, lim)),
+	} {
+		sb := bucket.Stream(b)
+		data := testutil.RandomBytes(3*bucket.ChunkSize + 10)
+		if err := sb.PutStream("seekable", bytes.NewReader(data)); err != nil {
+			t.Fatalf("PutStream: %s", err)
+		}
+		// A reader that is not an io.Seeker.
+		if err := sb.PutStream("stream", io.MultiReader(bytes.NewReader(data))); err != nil {
+			t.Fatalf("PutStream: %s", err)
+		}
+		for _, key := range []string{"seekable", "stream"} {
+			if x, err := b.Get(key); err != nil || !bytes.Equal(x, data) {
+				t.Fatalf("Get(%q): %v", key, err)
+			}
+			rc, err := sb.GetStream(key)
+			if err != nil {
+				t.Fatalf("GetStream(%q): %s", key, err)
+			}
+			x, err := ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil || !bytes.Equal(x, data) {
+				t.Fatalf("GetStream(%q): %v", key, err)
+			}
+		}
+		if _, err := sb.GetStream("nonexistent"); !bucket.IsNotExist(err) {
+			t.Fatalf("expected nonexistent key error, got %v", err)
+		}
+	}
+}
+
+// seekRecorder records whether the readers passed to PutStream are
+// seekable.
+type seekRecorder struct {
+	bucket.Bucket
+	seekable []bool
+}
+
+func (b *seekRecorder) PutStream(key string, r io.Reader) error {
+	_, ok := r.(io.Seeker)
+	b.seekable = append(b.seekable, ok)
+	return bucket.Stream(b.Bucket).PutStream(key, r)
+}
+
+func (b *seekRecorder) GetStream(key string) (io.ReadCloser, error) {
+	return bucket.Stream(b.Bucket).GetStream(key)
+}
+
+func TestStreamWrappers(t *testing.T) {
+	// Wrappers keep a stream seekable, so that it can be retried below
+	// them.
+	rec := &seekRecorder{Bucket: bucket.NewMemoryBucket()}
+	cache, err := bucket.OpenCache(filepath.Join(testutil.TempDir, "StreamWrappers"), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lim := bucket.NewLimiter(bucket.Schedule{Rate: 1 << 30})
+	m, err := bucket.NewMirrorBucket([]bucket.Replica{{Name: "a", Bucket: rec}, {Name: "b", Bucket: rec}}, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := bucket.WithContext(context.Background(), bucket.NewRateLimitedBucket(bucket.NewCacheBucket(m, cache), lim, lim))
+	data := testutil.RandomBytes(1000)
+	if err := bucket.Stream(b).PutStream("key", bytes.NewReader(data)); err != nil {
+		t.Fatalf("PutStream: %s", err)
+	}
+	if !reflect.DeepEqual(rec.seekable, []bool{true, true}) {
+		t.Fatalf("expected seekable streams on both replicas, got %v", rec.seekable)
+	}
+
+	// A stream read to the end fills the cache.
+	rc, err := bucket.Stream(b).GetStream("key")
+	if err != nil {
+		t.Fatalf("GetStream: %s", err)
+	}
+	x, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil || !bytes.Equal(x, data) {
+		t.Fatalf("GetStream: %v", err)
+	}
+	if size := cache.Size(); size < int64(len(data)) {
+		t.Fatalf("expected the value in the cache, cache size is %d", size)
+	}
+	if err := rec.Delete("key"); err != nil {
+		t.Fatal(err)
+	}
+	if x, err := b.Get("key"); err != nil || !bytes.Equal(x, data) {
+		t.Fatalf("Get from the cache: %v", err)
+	}
+}
+
+func TestSFTPBucket(t *testing.T) {
+	b := &TestBucket{
+		bucket: testutil.TempSFTPBucket("SFTPBucket"),
+		t:      t,
+	}
+	b.allTests()
+}
+
+func TestUpgradedSFTPBucket(t *testing.T) {
+	b := &TestBucket{
+		bucket: testutil.Upgrade(testutil.TempSFTPBucket("UpgradedSFTPBucket")),
+		t:      t,
+	}
+	b.allTests()
+}
+
+func TestSFTPHostKeyMismatch(t *testing.T) {
+	u := testutil.StartSFTPServer(testutil.TempDir)
+	q := u.Query()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := ssh.NewPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := filepath.Join(testutil.TempDir, "other_known_hosts")
+	line := knownhosts.Line([]string{u.Host}, pub) + "\n"
+	if err := ioutil.WriteFile(other, []byte(line), 0600); err != nil {
+		t.Fatal(err)
+	}
+	q.Set("known_hosts", other)
+	u.RawQuery = q.Encode()
+	_, err = bucket.NewSFTPBucketFromURL(u)
+	if err == nil || !strings.Contains(err.Error(), "key mismatch") {
+		t.Fatalf("expected host key mismatch, got %v", err)
+	}
+}
+
+func TestWebDAVBucket(t *testing.T) {
+	server := testutil.StartWebDAVServer()
+	defer server.Close()
+
+	basic := bucket.WebDAVConfig{Username: testutil.WebDAVUser, Password: testutil.WebDAVPassword}
+	b := &TestBucket{
+		bucket: testutil.TempWebDAVBucket(server, "WebDAVBucket", basic),
+		t:      t,
+	}
+	b.allTests()
+
+	bearer := bucket.WebDAVConfig{Token: testutil.WebDAVToken}
+	b = &TestBucket{
+		bucket: testutil.Upgrade(testutil.TempWebDAVBucket(server, "dav/UpgradedWebDAVBucket", bearer)),
+		t:      t,
+	}
+	b.allTests()
+
+	// Descend creates the collection, and descending again is fine.
+	root := testutil.TempWebDAVBucket(server, "WebDAVDescend", basic)
+	for i := 0; i < 2; i++ {
+		if _, err := root.Descend("a/b"); err != nil {
+			t.Fatalf("Descend: %s", err)
+		}
+	}
+	a := &TestBucket{bucket: root, t: t}
+	a.CheckList(nil, []string{"a"})
+	a.CheckDescend("a").CheckList(nil, []string{"b"})
+
+	wrong := bucket.WebDAVConfig{Username: testutil.WebDAVUser, Password: "wrong"}
+	bb := testutil.TempWebDAVBucket(server, "WebDAVBucket", wrong)
+	if _, _, err := bb.List(); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("expected authentication failure, got %v", err)
+	}
+}
+
+func TestMemoryBucket(t *testing.T) {
+	b := &TestBucket{
+		bucket: bucket.NewMemoryBucket(),
+		t:      t,
+	}
+	b.allTests()
+}
+
+func TestUpgradedMemoryBucket(t *testing.T) {
+	b := &TestBucket{
+		bucket: testutil.Upgrade(bucket.NewMemoryBucket()),
+		t:      t,
+	}
+	b.allTests()
+}
+
+func TestMemoryBucketSnapshot(t *testing.T) {
+	root := bucket.NewMemoryBucket()
+	child, err := root.Descend("child")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			child.Put(fmt.Sprintf("key%d", i), []byte{byte(i)})
+		}(i)
+	}
+	wg.Wait()
+
+	data := []byte("root")
+	root.Put("top", data)
+	data[0] = 'X' // Put copies its argument
+
+	snap := root.Snapshot()
+	if len(snap) != 11 || string(snap["top"]) != "root" || !bytes.Equal(snap["child/key7"], []byte{7}) {
+		t.Fatalf("unexpected snapshot: %v", snap)
+	}
+	childSnap := child.(*bucket.MemoryBucket).Snapshot()
+	if len(childSnap) != 10 || !bytes.Equal(childSnap["key3"], []byte{3}) {
+		t.Fatalf("unexpected child snapshot: %v", childSnap)
+	}
+
+	// Snapshots are copies.
+	snap["top"][0] = 'Y'
+	if x, _ := root.Get("top"); string(x) != "root" {
+		t.Fatalf("snapshot aliases bucket contents: %q", x)
+	}
+}
+
+func TestCacheBucket(t *testing.T) {
+	cache, err := bucket.OpenCache(filepath.Join(testutil.TempDir, "CacheBucket"), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &TestBucket{
+		bucket: bucket.NewCacheBucket(testutil.TempFileBucket("CachedFileBucket"), cache),
+		t:      t,
+	}
+	b.allTests()
+}
+
+func TestUpgradedCacheBucket(t *testing.T) {
+	cache, err := bucket.OpenCache(filepath.Join(testutil.TempDir, "UpgradedCacheBucket"), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &TestBucket{
+		bucket: testutil.Upgrade(bucket.NewCacheBucket(bucket.NewMemoryBucket(), cache)),
+		t:      t,
+	}
+	b.allTests()
+}
+
+func TestCacheEviction(t *testing.T) {
+	dir := filepath.Join(testutil.TempDir, "CacheEviction")
+	cache, err := bucket.OpenCache(dir, 3500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := false
+	mem := bucket.NewMemoryBucket()
+	b := bucket.NewCacheBucket(&flakyBucket{Bucket: mem, down: &down}, cache)
+	child, err := b.Descend("child")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := testutil.RandomBytes(1000)
+	for _, key := range []string{"a", "b", "c"} {
+		if err := child.Put(key, data); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := child.Get(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Using "a" makes "b" the least recently used value.
+	child.Get("a")
+	child.Put("d", data)
+	child.Get("d")
+	if size := cache.Size(); size > 3500 {
+		t.Fatalf("cache size %d exceeds its limit", size)
+	}
+
+	// Values survive reopening the cache.
+	cache, err = bucket.OpenCache(dir, 3500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b = bucket.NewCacheBucket(&flakyBucket{Bucket: mem, down: &down}, cache)
+	child, _ = b.Descend("child")
+	down = true
+	for _, key := range []string{"a", "c", "d"} {
+		if x, err := child.Get(key); err != nil || !bytes.Equal(x, data) {
+			t.Fatalf("Get(%q) from cache: %v", key, err)
+		}
+	}
+	if _, err := child.Get("b"); err == nil {
+		t.Fatal("expected least recently used value to be evicted")
+	}
+
+	// The uncached view reads from the bucket and refreshes the cache.
+	down = false
+	mem.Put("child/a", []byte("new"))
+	if x, _ := child.Get("a"); !bytes.Equal(x, data) {
+		t.Fatalf("expected cached value, got %q", x)
+	}
+	fresh, ok := bucket.Uncached(testutil.Upgrade(child))
+	if !ok {
+		t.Fatal("expected a cache below the upgraded bucket")
+	}
+	if _, ok := bucket.Uncached(testutil.Upgrade(mem)); ok {
+		t.Fatal("expected no cache below the memory bucket")
+	}
+	fresh, _ = bucket.Uncached(child)
+	if x, err := fresh.Get("a"); err != nil || string(x) != "new" {
+		t.Fatalf("uncached Get: %q, %v", x, err)
+	}
+	if x, _ := child.Get("a"); string(x) != "new" {
+		t.Fatalf("cache not refreshed: %q", x)
+	}
+
+	if err := child.Destroy(); err != nil {
+		t.Fatal(err)
+	}
+	if size := cache.Size(); size != 0 {
+		t.Fatalf("Destroy left %d bytes in the cache", size)
+	}
+}
+
+func TestRateLimitedBucket(t *testing.T) {
+	up := bucket.NewLimiter(bucket.Schedule{Rate: 100000})
+	b := &TestBucket{
+		bucket: bucket.NewRateLimitedBucket(testutil.TempFileBucket("RateLimitedBucket"), up, nil),
+		t:      t,
+	}
+	b.allTests()
+
+	// The burst of one second is used up by the third Put, so the
+	// fourth and fifth wait half a second each.  Children share the
+	// limiter.
+	up = bucket.NewLimiter(bucket.Schedule{Rate: 100000})
+	rl := bucket.NewRateLimitedBucket(bucket.NewMemoryBucket(), up, up)
+	data := testutil.RandomBytes(50000)
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		child, err := rl.Descend(fmt.Sprintf("child%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := child.Put("key", data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d < 900*time.Millisecond || d > 5*time.Second {
+		t.Fatalf("5 puts of 50 KB at 100 KB/s took %s", d)
+	}
+
+	// S3 reads a seekable stream twice, to hash it and to send it, but
+	// only the bytes sent are charged: after the burst, the remaining
+	// 200 KB take two seconds.
+	up = bucket.NewLimiter(bucket.Schedule{Rate: 100000})
+	s3b := bucket.Stream(bucket.NewRateLimitedBucket(testutil.TempS3Bucket("RateLimitedBucket"), up, nil))
+	data = testutil.RandomBytes(300000)
+	start = time.Now()
+	if err := s3b.PutStream("key", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 1500*time.Millisecond || d > 3500*time.Millisecond {
+		t.Fatalf("a stream of 300 KB at 100 KB/s to S3 took %s", d)
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	s := &bucket.Schedule{
+		Rate: 1000,
+		Windows: []bucket.Window{
+			{Start: 1 * time.Hour, End: 6 * time.Hour, Rate: 0},
+			{Start: 22 * time.Hour, End: 2 * time.Hour, Rate: 5000},
+		},
+	}
+	tests := []struct {
+		hour, min int
+		rate      int64
+	}{
+		{0, 0, 5000},
+		{1, 0, 0},
+		{5, 59, 0},
+		{6, 0, 1000},
+		{21, 59, 1000},
+		{22, 0, 5000},
+		{23, 30, 5000},
+	}
+	for _, test := range tests {
+		at := time.Date(2020, 3, 14, test.hour, test.min, 0, 0, time.Local)
+		if rate := s.RateAt(at); rate != test.rate {
+			t.Errorf("rate at %02d:%02d: got %d, expected %d", test.hour, test.min, rate, test.rate)
+		}
+	}
+}
+
+func TestContextBucket(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	b := &TestBucket{
+		bucket: bucket.WithContext(ctx, testutil.Upgrade(testutil.TempS3Bucket("ContextBucket"))),
+		t:      t,
+	}
+	b.allTests()
+
+	// Buckets without context support are wrapped, and every layer
+	// fails once the context is cancelled.
+	cancel()
+	for _, bb := range []bucket.Bucket{
+		bucket.NewMemoryBucket(),
+		testutil.TempS3Bucket("CancelledBucket"),
+		testutil.Upgrade(testutil.TempS3Bucket("CancelledUpgradedBucket")),
+		bucket.NewRateLimitedBucket(bucket.NewMemoryBucket(), nil, nil),
+	} {
+		cb := bucket.WithContext(ctx, bb)
+		if err := cb.Put("key", []byte("value")); err == nil {
+			t.Fatalf("Put with cancelled context succeeded")
+		}
+		if _, err := cb.Get("key"); err == nil {
+			t.Fatalf("Get with cancelled context succeeded")
+		}
+		if _, _, err := cb.List(); err == nil {
+			t.Fatalf("List with cancelled context succeeded")
+		}
+	}
+}
+
+func TestContextStuckS3(t *testing.T) {
+	// The server never answers, like a stuck connection.
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+	s3b, err := s3.NewBucketFromFile(testutil.WriteS3Config(testutil.TempDir, server, "StuckS3", true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	b := bucket.WithContext(ctx, bucket.NewS3Bucket(s3b))
+
+	start := time.Now()
+	if err := b.Put("key", []byte("value")); err == nil {
+		t.Fatalf("Put to stuck server succeeded")
+	}
+	if _, err := b.Get("key"); err == nil {
+		t.Fatalf("Get from stuck server succeeded")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("deadline of 200ms took %s", d)
+	}
+}
+
+func TestContextRecoverableBucket(t *testing.T) {
+	// A failing Put is retried after 5 seconds, unless the context is
+	// cancelled while waiting.
+	down := true
+	log := &bucket.PromptLogger{Logger: golog.New(ioutil.Discard, "", 0)}
+	rb := bucket.NewRecoverableBucket(&flakyBucket{Bucket: bucket.NewMemoryBucket(), down: &down}, log)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	b := bucket.WithContext(ctx, rb)
+
+	start := time.Now()
+	if err := b.Put("key", []byte("value")); err == nil {
+		t.Fatalf("Put to down bucket succeeded")
+	}
+	if _, err := b.Get("key"); err == nil {
+		t.Fatalf("Get from down bucket succeeded")
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatalf("cancelled retries took %s", d)
+	}
+}
+
+// failingBucket fails the first fails calls to Put and Get with err.
+type failingBucket struct {
+	bucket.Bucket
+	fails int
+	err   error
+	calls int
+}
+
+func (b *failingBucket) Put(key string, data []byte) error {
+	if b.calls++; b.calls <= b.fails {
+		return b.err
+	}
+	return b.Bucket.Put(key, data)
+}
+
+func (b *failingBucket) Get(key string) ([]byte, error) {
+	if b.calls++; b.calls <= b.fails {
+		return nil, b.err
+	}
+	return b.Bucket.Get(key)
+}
+
+func TestRetryPolicy(t *testing.T) {
+	log := &bucket.PromptLogger{Logger: golog.New(ioutil.Discard, "", 0)}
+	policy := bucket.RetryPolicy{
+		MaxAttempts: 3,
+		Backoff:     time.Millisecond,
+		MaxBackoff:  4 * time.Millisecond,
+		Jitter:      0.5,
+	}
+	down := errors.New("connection reset")
+	tests := []struct {
+		mode  bucket.RetryMode
+		fails int
+		err   error
+		calls int
+		ok    bool
+	}{
+		{bucket.RetryNonInteractive, 2, down, 3, true},
+		{bucket.RetryNonInteractive, 5, down, 3, false},
+		// stdin is not a terminal, so there is no one to ask.
+		{bucket.RetryInteractive, 5, down, 3, false},
+		{bucket.RetryFailFast, 5, down, 1, false},
+		{bucket.RetryNonInteractive, 5, bucket.ErrAuth, 1, false},
+		{bucket.RetryNonInteractive, 5, &s3.ServiceError{Code: "AccessDenied", StatusCode: 403}, 1, false},
+		{bucket.RetryNonInteractive, 5, &s3.ServiceError{Code: "SlowDown", StatusCode: 503}, 3, false},
+	}
+	for i, test := range tests {
+		policy.Mode = test.mode
+		fb := &failingBucket{Bucket: bucket.NewMemoryBucket(), fails: test.fails, err: test.err}
+		b := bucket.NewRecoverableBucketWithPolicy(fb, log, policy)
+		err := b.Put("key", []byte("value"))
+		if (err == nil) != test.ok || fb.calls != test.calls {
+			t.Fatalf("test %d: Put made %d calls (expected %d) and returned %v", i, fb.calls, test.calls, err)
+		}
+		if !test.ok && !bucket.IsRetryable(test.err) && err != test.err {
+			t.Fatalf("test %d: expected the error as it is, got %v", i, err)
+		}
+	}
+
+	// Missing keys are not retried.
+	fb := &failingBucket{Bucket: bucket.NewMemoryBucket()}
+	b := bucket.NewRecoverableBucketWithPolicy(fb, log, policy)
+	if _, err := b.Get("nonexistent"); !bucket.IsNotExist(err) || fb.calls != 1 {
+		t.Fatalf("Get made %d calls and returned %v", fb.calls, err)
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		err       error
+		retryable bool
+	}{
+		{errors.New("connection reset by peer"), true},
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, true},
+		{bucket.ErrAuth, false},
+		{context.Canceled, false},
+		{&os.PathError{Op: "open", Path: "x", Err: os.ErrNotExist}, false},
+		{&os.PathError{Op: "open", Path: "x", Err: os.ErrPermission}, false},
+		{&s3.ServiceError{Code: "InternalError", StatusCode: 500}, true},
+		{&s3.ServiceError{Code: "SlowDown"}, true},
+		{&s3.ServiceError{Code: "SignatureDoesNotMatch", StatusCode: 403}, false},
+		{&s3.ServiceError{Code: "NoSuchKey", StatusCode: 404}, false},
+		{&azure.Error{Code: "ServerBusy", StatusCode: 503}, true},
+		{&azure.Error{Code: "AuthenticationFailed", StatusCode: 403}, false},
+		{&gcs.Error{Code: 429}, true},
+		{&gcs.Error{Code: 401}, false},
+		{&bucket.WebDAVError{StatusCode: 502}, true},
+		{&bucket.WebDAVError{StatusCode: 401}, false},
+		{&bucket.NameTooLongError{Name: "x"}, false},
+	}
+	for _, test := range tests {
+		if r := bucket.IsRetryable(test.err); r != test.retryable {
+			t.Errorf("IsRetryable(%#v) = %v", test.err, r)
+		}
+	}
+}
+
+func TestLimiterWait(t *testing.T) {
+	l := bucket.NewLimiter(bucket.Schedule{Rate: 1000})
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	// The first wait uses up the burst and goes into debt, so the
+	// second would wait a minute.
+	if err := l.Wait(ctx, 60000); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Wait(ctx, 1000); err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatalf("cancelled wait took %s", d)
+	}
+}
+
+func TestOpenLocation(t *testing.T) {
+	dir := filepath.Join(testutil.TempDir, "OpenLocation")
+	_, s3Server := testutil.StartS3Server("open-s3", false)
+	defer s3Server.Close()
+	gcsFake, gcsServer := testutil.StartGCSServer("open-gcs")
+	defer gcsServer.Close()
+	_, azureServer := testutil.StartAzureServer("open-azure")
+	defer azureServer.Close()
+
+	s3Config := testutil.WriteS3Config(testutil.TempDir, s3Server, "open-s3", true)
+	gcsConfig := testutil.WriteGCSConfig(testutil.TempDir, gcsFake, gcsServer, "open-gcs")
+	azureConfig := testutil.WriteAzureConfig(testutil.TempDir, azureServer, "open-azure", false)
+	s3Raw, err := bucket.NewS3BucketFromFile(s3Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcsRaw, err := bucket.NewGCSBucketFromFile(gcsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	azureRaw, err := bucket.NewAzureBucketFromFile(azureConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		location string
+		raw      bucket.Bucket
+		key      string
+	}{
+		{"file://" + filepath.ToSlash(dir) + "/sub", testutil.TempFileBucket("OpenLocation"), "sub/key"},
+		{"s3://open-s3/pre/fix?config=" + s3Config, s3Raw, "pre/fix/key"},
+		{"gs://open-gcs/prefix/?config=" + gcsConfig, gcsRaw, "prefix/key"},
+		{"azure://" + testutil.AzureAccount + "/open-azure/prefix?config=" + azureConfig, azureRaw, "prefix/key"},
+		{"azure://" + testutil.AzureAccount + "/open-azure?config=" + azureConfig, azureRaw, "key"},
+	}
+	for _, test := range tests {
+		if !bucket.IsLocation(test.location) {
+			t.Fatalf("IsLocation(%q) = false", test.location)
+		}
+		b, err := bucket.Open(test.location)
+		if err != nil {
+			t.Fatalf("Open(%q): %s", test.location, err)
+		}
+		data := testutil.RandomBytes(100)
+		if err := b.Put("key", data); err != nil {
+			t.Fatalf("%s: Put: %s", test.location, err)
+		}
+		if x, err := test.raw.Get(test.key); err != nil || !bytes.Equal(x, data) {
+			t.Fatalf("%s: expected key at %q: %v", test.location, test.key, err)
+		}
+		if err := test.raw.Put(test.key, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, location := range []string{
+		"ftp://example.com/backups",
+		"s3://open-s3/prefix",
+		"s3:///prefix?config=" + s3Config,
+		"azure://" + testutil.AzureAccount + "?config=" + azureConfig,
+		"azure://other/open-azure?config=" + azureConfig,
+		"file://example.com/backups",
+	} {
+		if _, err := bucket.Open(location); err == nil {
+			t.Errorf("Open(%q): expected error", location)
+		}
+	}
+	for _, path := range []string{"/backups", "backups", "C:\\backups", "a/b://c"} {
+		if bucket.IsLocation(path) {
+			t.Errorf("IsLocation(%q) = true", path)
+		}
+	}
+}
+
+func TestMirrorBucket(t *testing.T) {
+	replicas := []bucket.Replica{
+		{Name: "a", Bucket: bucket.NewMemoryBucket()},
+		{Name: "b", Bucket: testutil.TempFileBucket("MirrorBucket")},
+	}
+	m, err := bucket.NewMirrorBucket(replicas, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &TestBucket{
+		bucket: m,
+		t:      t,
+	}
+	b.allTests()
+}
+
+func TestUpgradedMirrorBucket(t *testing.T) {
+	replicas := []bucket.Replica{
+		{Name: "a", Bucket: bucket.NewMemoryBucket()},
+		{Name: "b", Bucket: bucket.NewMemoryBucket()},
+	}
+	m, err := bucket.NewMirrorBucket(replicas, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &TestBucket{
+		bucket: testutil.Upgrade(m),
+		t:      t,
+	}
+	b.allTests()
+}
+
+// flakyBucket fails every Put and Get while down is set.
+type flakyBucket struct {
+	bucket.Bucket
+	down *bool
+}
+
+func (b *flakyBucket) Put(key string, data []byte) error {
+	if *b.down {
+		return fmt.Errorf("replica is down")
+	}
+	return b.Bucket.Put(key, data)
+}
+
+func (b *flakyBucket) Get(key string) ([]byte, error) {
+	if *b.down {
+		return nil, fmt.Errorf("replica is down")
+	}
+	return b.Bucket.Get(key)
+}
+
+func (b *flakyBucket) Descend(child string) (bucket.Bucket, error) {
+	bb, err := b.Bucket.Descend(child)
+	if err != nil {
+		return nil, err
+	}
+	return &flakyBucket{Bucket: bb, down: b.down}, nil
+}
+
+func TestMirrorQuorumAndRepair(t *testing.T) {
+	down := false
+	a := bucket.NewMemoryBucket()
+	b := bucket.NewMemoryBucket()
+	replicas := []bucket.Replica{
+		{Name: "a", Bucket: &flakyBucket{Bucket: a, down: &down}},
+		{Name: "b", Bucket: b},
+	}
+	journalPath := filepath.Join(testutil.TempDir, "mirror-journal.json")
+	journal, err := bucket.OpenJournal(journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := bucket.NewMirrorBucket(replicas, 1, journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	child, err := m.Descend("backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	child.Put("key", []byte("old"))
+	down = true
+	if err := child.Put("key", []byte("new")); err != nil {
+		t.Fatalf("Put with quorum 1 failed: %s", err)
+	}
+	if err := child.Put("other", []byte("other")); err != nil {
+		t.Fatalf("Put with quorum 1 failed: %s", err)
+	}
+	down = false
+
+	// The stale copy in a must not be returned.
+	if data, err := child.Get("key"); err != nil || string(data) != "new" {
+		t.Fatalf("Get: %q, %v", data, err)
+	}
+
+	// The journal survives a restart.
+	journal, err = bucket.OpenJournal(journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := journal.Entries()
+	if len(entries) != 2 || entries[0].Replica != "a" || entries[0].Key != "backup/key" {
+		t.Fatalf("unexpected journal: %+v", entries)
+	}
+
+	m, err = bucket.NewMirrorBucket(replicas, 1, journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := m.Repair()
+	if err != nil {
+		t.Fatalf("Repair: %s", err)
+	}
+	if n != 2 || len(journal.Entries()) != 0 {
+		t.Fatalf("repaired %d keys, journal: %+v", n, journal.Entries())
+	}
+	if !reflect.DeepEqual(a.Snapshot(), b.Snapshot()) {
+		t.Fatalf("replicas differ after repair:\n%q\n%q", a.Snapshot(), b.Snapshot())
+	}
+
+	// A replica that was written after it missed a write, such as by
+	// an interrupted repair, is not copied to again.
+	if err := journal.Add("a", "backup/key", fmt.Errorf("replica is down")); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Put("backup/key", []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := m.Repair(); err != nil || n != 0 || len(journal.Entries()) != 0 {
+		t.Fatalf("repaired %d keys (err %v), journal: %+v", n, err, journal.Entries())
+	}
+
+	// Without a quorum, Put fails.
+	m, err = bucket.NewMirrorBucket(replicas, 2, journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	down = true
+	if err := m.Put("key", nil); err == nil {
+		t.Fatal("expected Put to fail without a quorum")
+	}
+}
+
+func TestJournalShared(t *testing.T) {
+	path := filepath.Join(testutil.TempDir, "shared-journal.json")
+	// Two runs that opened the journal before either wrote to it.
+	j1, err := bucket.OpenJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j2, err := bucket.OpenJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i, j := range []*bucket.Journal{j1, j2} {
+		wg.Add(1)
+		go func(i int, j *bucket.Journal) {
+			defer wg.Done()
+			for k := 0; k < 20; k++ {
+				if err := j.Add("a", fmt.Sprintf("%d/%d", i, k), fmt.Errorf("down")); err != nil {
+					t.Error(err)
+				}
+			}
+		}(i, j)
+	}
+	wg.Wait()
+	if err := j1.RemovePrefix("a", "0/"); err != nil {
+		t.Fatal(err)
+	}
+	if !j2.Missed("a", "1/19") || j2.Missed("a", "0/0") {
+		t.Fatalf("j2 does not see the changes of j1: %+v", j2.Entries())
+	}
+
+	j, err := bucket.OpenJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(j.Entries()); n != 20 {
+		t.Fatalf("expected 20 entries, got %d: %+v", n, j.Entries())
+	}
+	if matches, _ := filepath.Glob(path + ".tmp*"); len(matches) != 0 {
+		t.Fatalf("temporary files left behind: %q", matches)
+	}
+}
+
+// replicatedOnly hides the methods of a mirror but those of Bucket and
+// Replicated, so that it is wrapped by WithContext.
+type replicatedOnly struct {
+	bucket.Bucket
+	bucket.Replicated
+}
+
+func TestMirrorAuthFallback(t *testing.T) {
+	cache, err := bucket.OpenCache(filepath.Join(testutil.TempDir, "MirrorAuthFallback"), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lim := bucket.NewLimiter(bucket.Schedule{Rate: 1 << 30})
+	wrappers := map[string]func(*bucket.MirrorBucket) bucket.Bucket{
+		"mirror": func(m *bucket.MirrorBucket) bucket.Bucket { return m },
+		"cached": func(m *bucket.MirrorBucket) bucket.Bucket {
+			return bucket.NewCacheBucket(m, cache)
+		},
+		"rate-limited": func(m *bucket.MirrorBucket) bucket.Bucket {
+			return bucket.NewRateLimitedBucket(bucket.NewCacheBucket(m, cache), lim, lim)
+		},
+		"context": func(m *bucket.MirrorBucket) bucket.Bucket {
+			return bucket.WithContext(context.Background(), replicatedOnly{m, m})
+		},
+	}
+	for what, wrap := range wrappers {
+		a := bucket.NewMemoryBucket()
+		b := bucket.NewMemoryBucket()
+		m, err := bucket.NewMirrorBucket([]bucket.Replica{{Name: "a", Bucket: a}, {Name: "b", Bucket: b}}, 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e := bucket.NewEncryptedBucket(wrap(m), secretkey.New())
+		if err := e.Put(what, []byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+
+		box, _ := a.Get(what)
+		box[len(box)-1] ^= 1
+		a.Put(what, box)
+		if data, err := e.Get(what); err != nil || string(data) != "hello" {
+			t.Fatalf("%s: Get: %q, %v", what, data, err)
+		}
+
+		b.Put(what, box)
+		if _, err := e.Get(what); err != bucket.ErrAuth {
+			t.Fatalf("%s: expected ErrAuth, got %v", what, err)
+		}
+	}
+}
+
+func TestErasureBucket(t *testing.T) {
+	buckets := []bucket.Bucket{
+		bucket.NewMemoryBucket(),
+		testutil.TempFileBucket("ErasureBucket"),
+		bucket.NewMemoryBucket(),
+	}
+	e, err := bucket.NewErasureBucket(buckets, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &TestBucket{
+		bucket: e,
+		t:      t,
+	}
+	b.allTests()
+}
+
+func TestUpgradedErasureBucket(t *testing.T) {
+	var buckets []bucket.Bucket
+	for i := 0; i < 5; i++ {
+		buckets = append(buckets, bucket.NewMemoryBucket())
+	}
+	e, err := bucket.NewErasureBucket(buckets, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &TestBucket{
+		bucket: testutil.Upgrade(e),
+		t:      t,
+	}
+	b.allTests()
+}
+
+func TestErasureBucketLoss(t *testing.T) {
+	down := make([]bool, 5)
+	var mems []*bucket.MemoryBucket
+	var buckets []bucket.Bucket
+	for i := range down {
+		m := bucket.NewMemoryBucket()
+		mems = append(mems, m)
+		buckets = append(buckets, &flakyBucket{Bucket: m, down: &down[i]})
+	}
+	e, err := bucket.NewErasureBucket(buckets, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := testutil.RandomBytes(10000)
+	if err := e.Put("key", data); err != nil {
+		t.Fatal(err)
+	}
+
+	// Lose a data shard and corrupt another.
+	down[0] = true
+	shard, _ := mems[2].Get("key")
+	shard[len(shard)-1] ^= 1
+	mems[2].Put("key", shard)
+	if x, err := e.Get("key"); err != nil || !bytes.Equal(x, data) {
+		t.Fatalf("Get with 2 of 5 shards lost: %v", err)
+	}
+
+	// Shards of an older value are not mixed with the current ones.
+	old := mems[1].Snapshot()["key"]
+	if err := e.Put("key", data[:5000]); err == nil {
+		t.Fatal("expected Put to fail with a bucket down")
+	}
+	mems[1].Put("key", old)
+	if x, err := e.Get("key"); err != nil || !bytes.Equal(x, data[:5000]) {
+		t.Fatalf("Get with a stale shard: %v", err)
+	}
+
+	down[3] = true
+	if _, err := e.Get("key"); err == nil || bucket.IsNotExist(err) {
+		t.Fatalf("expected Get to fail with 3 of 5 shards lost, got %v", err)
+	}
+	down[0], down[3] = false, false
+	if _, err := e.Get("nonexistent"); !bucket.IsNotExist(err) {
+		t.Fatalf("expected nonexistent key error, got %v", err)
+	}
+}
+
 func TestS3Bucket(t *testing.T) {
 	if testutil.SkipS3 {
 		t.SkipNow()
@@ -47,6 +1248,76 @@ func TestS3Bucket(t *testing.T) {
 	b.allTests()
 }
 
+func TestS3BucketPagination(t *testing.T) {
+	b, fake, server := testutil.TempFakeS3Bucket("s3pages", false, true)
+	defer server.Close()
+	fake.MaxKeys = 2 // exercise pagination
+	bb := &TestBucket{
+		bucket: b,
+		t:      t,
+	}
+	bb.allTests()
+
+	// More keys than fit in one list or delete request.
+	fake.MaxKeys = 1000
+	child, err := b.Descend("many")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected []string
+	for i := 0; i < 2100; i++ {
+		key := fmt.Sprintf("%04d", i)
+		if err := child.Put(key, []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+		expected = append(expected, key)
+	}
+	keys, _, err := child.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Fatalf("List returned %d keys, expected %d", len(keys), len(expected))
+	}
+
+	it := bucket.ListPages(child)
+	pages, n := 0, 0
+	for {
+		ks, _, err := it.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages++
+		n += len(ks)
+	}
+	if pages != 3 || n != len(expected) {
+		t.Fatalf("ListPages: got %d keys in %d pages, expected %d in 3", n, pages, len(expected))
+	}
+
+	if err := child.Destroy(); err != nil {
+		t.Fatal(err)
+	}
+	if keys, _, err := child.List(); err != nil || len(keys) != 0 {
+		t.Fatalf("Destroy left %d keys (err %v)", len(keys), err)
+	}
+
+	// A truncated list without a continuation token is an error, not
+	// the end of the keys.
+	fake.MaxKeys = 2
+	fake.NoContinuationToken = true
+	for _, key := range []string{"a", "b", "c"} {
+		if err := child.Put(key, []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := child.Destroy(); err == nil || !strings.Contains(err.Error(), "continuation token") {
+		t.Fatalf("expected an error for a truncated list, got %v", err)
+	}
+}
+
 func TestUpgradedS3Bucket(t *testing.T) {
 	if testutil.SkipS3 {
 		t.SkipNow()
@@ -58,6 +1329,165 @@ func TestUpgradedS3Bucket(t *testing.T) {
 	b.allTests()
 }
 
+func TestS3BucketTLS(t *testing.T) {
+	b, _, server := testutil.TempFakeS3Bucket("s3-tls", true, true)
+	defer server.Close()
+	bb := &TestBucket{
+		bucket: b,
+		t:      t,
+	}
+	bb.allTests()
+}
+
+func TestS3BucketVirtualHost(t *testing.T) {
+	b, _, server := testutil.TempFakeS3Bucket("s3-virtual", false, false)
+	defer server.Close()
+	bb := &TestBucket{
+		bucket: testutil.Upgrade(b),
+		t:      t,
+	}
+	bb.allTests()
+}
+
+func TestS3BucketUntrustedCertificate(t *testing.T) {
+	_, server := testutil.StartS3Server("s3-untrusted", true)
+	defer server.Close()
+	path := testutil.WriteS3Config(testutil.TempDir, server, "s3-untrusted", true)
+
+	// Trust a different certificate than the one the server uses.
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caFile := filepath.Join(testutil.TempDir, "s3-untrusted-ca.pem")
+	err = ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := bucket.NewS3BucketFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := b.List(); err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Fatalf("expected certificate error, got %v", err)
+	}
+}
+
+func TestGCSBucket(t *testing.T) {
+	b, fake, server := testutil.TempGCSBucket("gcs")
+	defer server.Close()
+	fake.MaxResults = 2 // exercise pagination
+	bb := &TestBucket{
+		bucket: b,
+		t:      t,
+	}
+	bb.allTests()
+}
+
+func TestGCSDestroy(t *testing.T) {
+	fake, server := testutil.StartGCSServer("gcs-destroy")
+	defer server.Close()
+	root, err := bucket.NewGCSBucketFromFile(testutil.WriteGCSConfig(testutil.TempDir, fake, server, "gcs-destroy"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := root.Destroy(); err == nil {
+		t.Fatalf("destroyed a whole bucket")
+	}
+
+	b, err := root.Descend("child")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Put("key", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	fake.KeepDeleted = true
+	done := make(chan error, 1)
+	go func() { done <- b.Destroy() }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatalf("Destroy succeeded without deleting anything")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Destroy does not give up when deletes do nothing")
+	}
+}
+
+func TestUpgradedGCSBucket(t *testing.T) {
+	b, _, server := testutil.TempGCSBucket("gcs-upgraded")
+	defer server.Close()
+	bb := &TestBucket{
+		bucket: testutil.Upgrade(b),
+		t:      t,
+	}
+	bb.allTests()
+}
+
+func TestGCSWrongKey(t *testing.T) {
+	_, server := testutil.StartGCSServer("gcs-wrong-key")
+	defer server.Close()
+	// Credentials for a different server's key.
+	other := testutil.NewFakeGCS()
+	b, err := bucket.NewGCSBucketFromFile(testutil.WriteGCSConfig(testutil.TempDir, other, server, "gcs-wrong-key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := b.List(); err == nil || !strings.Contains(err.Error(), "invalid_grant") {
+		t.Fatalf("expected invalid_grant error, got %v", err)
+	}
+}
+
+func TestAzureBucket(t *testing.T) {
+	b, fake, server := testutil.TempAzureBucket("azure", false, 100)
+	defer server.Close()
+	fake.MaxResults = 2 // exercise pagination
+	bb := &TestBucket{
+		bucket: b,
+		t:      t,
+	}
+	bb.allTests()
+}
+
+func TestUpgradedAzureBucket(t *testing.T) {
+	b, _, server := testutil.TempAzureBucket("azure-upgraded", true, 100)
+	defer server.Close()
+	bb := &TestBucket{
+		bucket: testutil.Upgrade(b),
+		t:      t,
+	}
+	bb.allTests()
+}
+
+func TestAzureWrongSAS(t *testing.T) {
+	_, server := testutil.StartAzureServer("azure-wrong-sas")
+	defer server.Close()
+	path := filepath.Join(testutil.TempDir, "azure-wrong-sas.json")
+	conf := fmt.Sprintf(`{"Azure": {"Account": %q, "Container": "azure-wrong-sas", "Endpoint": %q, "SAS": "sv=2020-04-08&sig=wrong"}}`,
+		testutil.AzureAccount, server.URL+"/"+testutil.AzureAccount)
+	if err := ioutil.WriteFile(path, []byte(conf), 0600); err != nil {
+		t.Fatal(err)
+	}
+	b, err := bucket.NewAzureBucketFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := b.List(); err == nil || !strings.Contains(err.Error(), "AuthenticationFailed") {
+		t.Fatalf("expected authentication failure, got %v", err)
+	}
+}
+
 type TestBucket struct {
 	bucket bucket.Bucket
 	t      *testing.T
@@ -95,6 +1525,16 @@ func (b *TestBucket) basicTests() {
 	b.CheckGet(key2, nil)
 	b.CheckList([]string{key0, key2, key1}, nil)
 
+	b.CheckStat(key0, len(data2))
+	b.CheckStat(key2, 0)
+	b.CheckStatNonexistent("nonexistent")
+	b.CheckDelete(key1)
+	b.CheckGetNonexistent(key1)
+	b.CheckStatNonexistent(key1)
+	b.CheckDelete(key1)
+	b.CheckList([]string{key0, key2}, nil)
+	b.CheckPut(key1, data)
+
 	b.CheckDestroy()
 	b.CheckList(nil, nil)
 	b.CheckDestroy()
@@ -161,6 +1601,40 @@ func (b *TestBucket) CheckGet(key string, expected []byte) {
 	}
 }
 
+// CheckStat checks that key exists, was just written (if the bucket
+// reports when), and takes at least size bytes (more if the bucket
+// encrypts or encodes values).
+func (b *TestBucket) CheckStat(key string, size int) {
+	info, err := b.bucket.Stat(key)
+	if err != nil {
+		b.t.Fatalf("Stat(%q) failed: %s", key, err)
+	}
+	if info.Size < int64(size) {
+		b.t.Fatalf("Stat(%q): size %d, expected at least %d", key, info.Size, size)
+	}
+	if d := time.Since(info.ModTime); !info.ModTime.IsZero() && (d < -time.Minute || d > time.Minute) {
+		b.t.Fatalf("Stat(%q): modified %s ago", key, d)
+	}
+	if ok, err := bucket.Exists(b.bucket, key); !ok || err != nil {
+		b.t.Fatalf("Exists(%q): %v, %v", key, ok, err)
+	}
+}
+
+func (b *TestBucket) CheckStatNonexistent(key string) {
+	if _, err := b.bucket.Stat(key); !bucket.IsNotExist(err) {
+		b.t.Fatalf("Stat(%q): expected nonexistent key error, got %v", key, err)
+	}
+	if ok, err := bucket.Exists(b.bucket, key); ok || err != nil {
+		b.t.Fatalf("Exists(%q): %v, %v", key, ok, err)
+	}
+}
+
+func (b *TestBucket) CheckDelete(key string) {
+	if err := b.bucket.Delete(key); err != nil {
+		b.t.Fatalf("Delete(%q) failed: %s", key, err)
+	}
+}
+
 func (b *TestBucket) CheckGetNonexistent(key string) {
 	if _, err := b.bucket.Get(key); !bucket.IsNotExist(err) {
 		b.t.Fatalf("Get(%q): expected nonexistent key error, got %q", key, err)
@@ -0,0 +1,488 @@
+package bucket
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Uncacher is implemented by buckets that may serve reads from a cache.
+// Uncached returns a view of the bucket that reads from the underlying
+// bucket instead, and refreshes the cache with what it reads, or nil if
+// there is no cache below the bucket.
+type Uncacher interface {
+	Uncached() Bucket
+}
+
+// Uncached returns a view of b that bypasses any read cache, and
+// whether there is a cache to bypass.  Use it for values that must not
+// be stale, and to retry reads of cached values that fail validation.
+func Uncached(b Bucket) (Bucket, bool) {
+	if u, ok := b.(Uncacher); ok {
+		if ub := u.Uncached(); ub != nil {
+			return ub, true
+		}
+	}
+	return b, false
+}
+
+// uncachedOrNil is the Uncached method of wrapper buckets.
+func uncachedOrNil(b Bucket) Bucket {
+	ub, ok := Uncached(b)
+	if !ok {
+		return nil
+	}
+	return ub
+}
+
+// Cache is a directory of cached values, bounded in total size by
+// evicting the least recently used values.  It is safe for concurrent
+// use.  Each file holds the name of the value followed by the value, so
+// that the cache survives restarts.
+type Cache struct {
+	dir   string
+	limit int64
+
+	mu      sync.Mutex
+	size    int64
+	lru     *list.List               // of *cacheEntry, most recent first
+	entries map[string]*list.Element // by name
+}
+
+type cacheEntry struct {
+	name string
+	size int64
+}
+
+// OpenCache opens the cache in dir, creating the directory if needed,
+// and evicts values until it is at most limit bytes.
+func OpenCache(dir string, limit int64) (*Cache, error) {
+	if limit <= 0 {
+		return nil, fmt.Errorf("invalid cache size limit: %d", limit)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	c := &Cache{
+		dir:     dir,
+		limit:   limit,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	// Files are touched when they are used, so the most recently
+	// modified files are the most recently used.
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ModTime().After(infos[j].ModTime())
+	})
+	for _, info := range infos {
+		path := filepath.Join(dir, info.Name())
+		if !info.Mode().IsRegular() || strings.HasSuffix(info.Name(), ".tmp") {
+			os.Remove(path)
+			continue
+		}
+		name, err := readCacheName(path)
+		if err != nil || c.file(name) != path {
+			os.Remove(path)
+			continue
+		}
+		c.entries[name] = c.lru.PushBack(&cacheEntry{name: name, size: info.Size()})
+		c.size += info.Size()
+	}
+	c.mu.Lock()
+	c.evict()
+	c.mu.Unlock()
+	return c, nil
+}
+
+func (c *Cache) file(name string) string {
+	h := sha256.Sum256([]byte(name))
+	return filepath.Join(c.dir, fmt.Sprintf("%x", h[:16]))
+}
+
+func readCacheName(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	var n uint16
+	if err := binary.Read(f, binary.BigEndian, &n); err != nil {
+		return "", err
+	}
+	name := make([]byte, n)
+	if _, err := f.Read(name); err != nil {
+		return "", err
+	}
+	return string(name), nil
+}
+
+// Get returns the cached value of name, if any.
+func (c *Cache) Get(name string) ([]byte, bool) {
+	c.mu.Lock()
+	e, ok := c.entries[name]
+	if ok {
+		c.lru.MoveToFront(e)
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	path := c.file(name)
+	buf, err := ioutil.ReadFile(path)
+	if err != nil || len(buf) < 2+len(name) || string(buf[2:2+len(name)]) != name {
+		c.Remove(name)
+		return nil, false
+	}
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return buf[2+len(name):], true
+}
+
+// Put caches a value, unless it is larger than the cache.
+func (c *Cache) Put(name string, data []byte) error {
+	w, err := c.create(name)
+	if err == errTooLarge {
+		c.Remove(name)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		w.abort()
+		if err == errTooLarge {
+			c.Remove(name)
+			return nil
+		}
+		return err
+	}
+	return w.commit()
+}
+
+// open returns a reader of the cached value of name, like Get.
+func (c *Cache) open(name string) (io.ReadCloser, bool) {
+	c.mu.Lock()
+	e, ok := c.entries[name]
+	if ok {
+		c.lru.MoveToFront(e)
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	path := c.file(name)
+	f, err := os.Open(path)
+	if err != nil {
+		c.Remove(name)
+		return nil, false
+	}
+	if n, err := readCacheName(path); err != nil || n != name {
+		f.Close()
+		c.Remove(name)
+		return nil, false
+	}
+	if _, err := f.Seek(int64(2+len(name)), io.SeekStart); err != nil {
+		f.Close()
+		c.Remove(name)
+		return nil, false
+	}
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return f, true
+}
+
+// A cacheWriter writes a value to a temporary file, which commit adds
+// to the cache.
+type cacheWriter struct {
+	c    *Cache
+	name string
+	f    *os.File
+	size int64
+}
+
+func (c *Cache) create(name string) (*cacheWriter, error) {
+	if len(name) > 0xffff {
+		return nil, errors.New("cache: name too long")
+	}
+	hdr := make([]byte, 2, 2+len(name))
+	binary.BigEndian.PutUint16(hdr, uint16(len(name)))
+	hdr = append(hdr, name...)
+	if int64(len(hdr)) > c.limit {
+		return nil, errTooLarge
+	}
+	f, err := ioutil.TempFile(c.dir, "*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	w := &cacheWriter{c: c, name: name, f: f}
+	if _, err := w.Write(hdr); err != nil {
+		w.abort()
+		return nil, err
+	}
+	return w, nil
+}
+
+// Write fails once the value is larger than the cache, so that it is
+// not written in full for nothing.
+func (w *cacheWriter) Write(p []byte) (int, error) {
+	if w.size+int64(len(p)) > w.c.limit {
+		return 0, errTooLarge
+	}
+	n, err := w.f.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+var errTooLarge = errors.New("cache: value larger than the cache")
+
+func (w *cacheWriter) abort() {
+	w.f.Close()
+	os.Remove(w.f.Name())
+}
+
+func (w *cacheWriter) commit() error {
+	c := w.c
+	tmp := w.f.Name()
+	if err := w.f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := os.Rename(tmp, c.file(w.name)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if e, ok := c.entries[w.name]; ok {
+		c.size -= e.Value.(*cacheEntry).size
+		c.lru.Remove(e)
+	}
+	c.entries[w.name] = c.lru.PushFront(&cacheEntry{name: w.name, size: w.size})
+	c.size += w.size
+	c.evict()
+	return nil
+}
+
+// evict removes the least recently used values until the cache fits in
+// its limit.  The caller must hold c.mu.
+func (c *Cache) evict() {
+	for c.size > c.limit {
+		e := c.lru.Back()
+		c.removeEntry(e)
+	}
+}
+
+func (c *Cache) removeEntry(e *list.Element) {
+	entry := e.Value.(*cacheEntry)
+	c.lru.Remove(e)
+	delete(c.entries, entry.name)
+	c.size -= entry.size
+	os.Remove(c.file(entry.name))
+}
+
+// Remove drops the cached value of name, if any.
+func (c *Cache) Remove(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[name]; ok {
+		c.removeEntry(e)
+	}
+}
+
+// RemovePrefix drops the cached values whose names start with prefix.
+func (c *Cache) RemovePrefix(prefix string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for name, e := range c.entries {
+		if strings.HasPrefix(name, prefix) {
+			c.removeEntry(e)
+		}
+	}
+}
+
+// Size returns the total size of the cached values.
+func (c *Cache) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
+
+type cacheBucket struct {
+	bucket Bucket
+	cache  *Cache
+	prefix string // path relative to the root of the cache
+	bypass bool   // read from bucket, but still fill the cache
+}
+
+// NewCacheBucket keeps the values read from b in cache.  Values that are
+// written are not cached, but they replace any cached value.  Cached
+// values are not validated, so use it below an encrypted bucket, and
+// use Uncached to read values that must be fresh.
+func NewCacheBucket(b Bucket, cache *Cache) Bucket {
+	return &cacheBucket{bucket: b, cache: cache}
+}
+
+func (b *cacheBucket) Abs(key string) string {
+	return b.bucket.Abs(key)
+}
+
+func (b *cacheBucket) Put(key string, data []byte) error {
+	b.cache.Remove(b.prefix + key)
+	return b.bucket.Put(key, data)
+}
+
+func (b *cacheBucket) Get(key string) ([]byte, error) {
+	if !b.bypass {
+		if data, ok := b.cache.Get(b.prefix + key); ok {
+			return data, nil
+		}
+	}
+	data, err := b.bucket.Get(key)
+	if err != nil {
+		if IsNotExist(err) {
+			b.cache.Remove(b.prefix + key)
+		}
+		return nil, err
+	}
+	// The cache is only an optimization, so errors are ignored.
+	b.cache.Put(b.prefix+key, data)
+	return data, nil
+}
+
+func (b *cacheBucket) PutStream(key string, r io.Reader) error {
+	b.cache.Remove(b.prefix + key)
+	return Stream(b.bucket).PutStream(key, r)
+}
+
+// GetStream fills the cache as the value is read, if it is read to the
+// end.
+func (b *cacheBucket) GetStream(key string) (io.ReadCloser, error) {
+	if !b.bypass {
+		if rc, ok := b.cache.open(b.prefix + key); ok {
+			return rc, nil
+		}
+	}
+	rc, err := Stream(b.bucket).GetStream(key)
+	if err != nil {
+		if IsNotExist(err) {
+			b.cache.Remove(b.prefix + key)
+		}
+		return nil, err
+	}
+	w, err := b.cache.create(b.prefix + key)
+	if err != nil {
+		return rc, nil
+	}
+	return &cacheFiller{rc: rc, w: w}, nil
+}
+
+// cacheFiller copies what is read from rc to w, and commits w at EOF.
+// The cache is only an optimization, so errors writing w are ignored.
+type cacheFiller struct {
+	rc io.ReadCloser
+	w  *cacheWriter
+}
+
+func (f *cacheFiller) Read(p []byte) (int, error) {
+	n, err := f.rc.Read(p)
+	if f.w != nil && n > 0 {
+		if _, werr := f.w.Write(p[:n]); werr != nil {
+			f.w.abort()
+			f.w = nil
+		}
+	}
+	if f.w != nil && err == io.EOF {
+		f.w.commit()
+		f.w = nil
+	} else if f.w != nil && err != nil {
+		f.w.abort()
+		f.w = nil
+	}
+	return n, err
+}
+
+func (f *cacheFiller) Close() error {
+	if f.w != nil {
+		f.w.abort()
+		f.w = nil
+	}
+	return f.rc.Close()
+}
+
+func (b *cacheBucket) Stat(key string) (*Info, error) {
+	return b.bucket.Stat(key)
+}
+
+func (b *cacheBucket) Delete(key string) error {
+	b.cache.Remove(b.prefix + key)
+	return b.bucket.Delete(key)
+}
+
+func (b *cacheBucket) List() (keys, children []string, err error) {
+	return b.bucket.List()
+}
+
+func (b *cacheBucket) ListPages() PageIterator {
+	return ListPages(b.bucket)
+}
+
+func (b *cacheBucket) Descend(child string) (Bucket, error) {
+	bb, err := b.bucket.Descend(child)
+	if err != nil {
+		return nil, err
+	}
+	return &cacheBucket{
+		bucket: bb,
+		cache:  b.cache,
+		prefix: b.prefix + strings.TrimSuffix(child, "/") + "/",
+		bypass: b.bypass,
+	}, nil
+}
+
+func (b *cacheBucket) Destroy() error {
+	b.cache.RemovePrefix(b.prefix)
+	return b.bucket.Destroy()
+}
+
+func (b *cacheBucket) WithContext(ctx context.Context) Bucket {
+	return &cacheBucket{
+		bucket: WithContext(ctx, b.bucket),
+		cache:  b.cache,
+		prefix: b.prefix,
+		bypass: b.bypass,
+	}
+}
+
+// Replicas are read without the cache, since they are used to find an
+// intact copy of a value.
+func (b *cacheBucket) Replicas() []Bucket {
+	return Replicas(b.bucket)
+}
+
+func (b *cacheBucket) Uncached() Bucket {
+	return &cacheBucket{
+		bucket: b.bucket,
+		cache:  b.cache,
+		prefix: b.prefix,
+		bypass: true,
+	}
+}
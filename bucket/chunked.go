@@ -0,0 +1,223 @@
+package bucket
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/nacl/secretbox"
+
+	"github.com/davidlazar/go-crypto/secretkey"
+)
+
+// A chunked box is sealed in chunks, so that it can be encrypted and
+// decrypted as a stream.  It starts with a header:
+//
+//	magic [4]byte      "kCB1"
+//	chunkSize uint32   size of the plaintext of every chunk but the last
+//	prefix [16]byte    random nonce prefix
+//
+// followed by the chunks, each sealed with secretbox under the nonce
+// prefix || uint64(2*index + final).  The last chunk, and only the last
+// chunk, is shorter than chunkSize (it may be empty), and it is marked
+// final in its nonce, so chunks can not be reordered, dropped or
+// truncated without failing authentication.
+//
+// Boxes written before chunking are a nonce followed by a single
+// secretbox; they are still read.
+const chunkHeaderSize = 4 + 4 + 16
+
+var chunkMagic = []byte("kCB1")
+
+// ChunkSize is the size of the plaintext of each chunk of a box.
+const ChunkSize = 64 * 1024
+
+// maxChunkSize bounds the chunk size accepted in a header, so that a
+// corrupt header can not cause a huge allocation.
+const maxChunkSize = 16 * 1024 * 1024
+
+// SealedSize returns the size of a box holding n bytes.  It depends only
+// on n, so boxes of the same size stay the same size when encrypted.
+func SealedSize(n int64) int64 {
+	return chunkHeaderSize + n + (n/ChunkSize+1)*secretbox.Overhead
+}
+
+func chunkNonce(prefix *[16]byte, index uint64, final bool) *[24]byte {
+	var nonce [24]byte
+	copy(nonce[:16], prefix[:])
+	n := index << 1
+	if final {
+		n |= 1
+	}
+	binary.BigEndian.PutUint64(nonce[16:], n)
+	return &nonce
+}
+
+// sealer encrypts a stream of plaintext into a chunked box.  If the
+// plaintext is an io.Seeker, so is the sealer, for seeking to its start
+// or its end (to find the size of the box).
+type sealer struct {
+	src    io.Reader
+	key    *[32]byte
+	prefix [16]byte
+
+	start  int64 // offset of the plaintext in src, if src is an io.Seeker
+	header []byte
+	plain  []byte
+	sealed []byte
+	out    []byte // sealed bytes not yet read
+	index  uint64
+	pos    int64
+	done   bool
+}
+
+func newSealer(src io.Reader, key *secretkey.Key) io.Reader {
+	s := &sealer{
+		src:    src,
+		key:    (*[32]byte)(key),
+		plain:  make([]byte, ChunkSize),
+		sealed: make([]byte, 0, ChunkSize+secretbox.Overhead),
+	}
+	if _, err := rand.Read(s.prefix[:]); err != nil {
+		panic("rand.Read error: " + err.Error())
+	}
+	s.reset()
+	if seeker, ok := src.(io.Seeker); ok {
+		var err error
+		if s.start, err = seeker.Seek(0, io.SeekCurrent); err == nil {
+			return &seekableSealer{s}
+		}
+	}
+	return s
+}
+
+func (s *sealer) reset() {
+	s.header = make([]byte, chunkHeaderSize)
+	copy(s.header, chunkMagic)
+	binary.BigEndian.PutUint32(s.header[4:8], ChunkSize)
+	copy(s.header[8:], s.prefix[:])
+	s.out = s.header
+	s.index = 0
+	s.pos = 0
+	s.done = false
+}
+
+func (s *sealer) Read(p []byte) (int, error) {
+	for len(s.out) == 0 {
+		if s.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(s.src, s.plain)
+		final := false
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			final = true
+		} else if err != nil {
+			return 0, err
+		}
+		s.out = secretbox.Seal(s.sealed[:0], s.plain[:n], chunkNonce(&s.prefix, s.index, final), s.key)
+		s.index++
+		s.done = final
+	}
+	n := copy(p, s.out)
+	s.out = s.out[n:]
+	s.pos += int64(n)
+	return n, nil
+}
+
+type seekableSealer struct {
+	*sealer
+}
+
+// Seek supports seeking to the start or the end of the box, and finding
+// the current position.  Seeking to the start seals the plaintext again
+// with the same nonces, so the box is the same.
+func (s *seekableSealer) Seek(offset int64, whence int) (int64, error) {
+	seeker := s.src.(io.Seeker)
+	switch {
+	case offset == 0 && whence == io.SeekCurrent:
+		return s.pos, nil
+	case offset == 0 && whence == io.SeekStart:
+		if _, err := seeker.Seek(s.start, io.SeekStart); err != nil {
+			return 0, err
+		}
+		s.reset()
+		return 0, nil
+	case offset == 0 && whence == io.SeekEnd:
+		end, err := seeker.Seek(0, io.SeekEnd)
+		if err != nil {
+			return 0, err
+		}
+		s.out = nil
+		s.done = true
+		s.pos = SealedSize(end - s.start)
+		return s.pos, nil
+	}
+	return 0, fmt.Errorf("sealer: unsupported seek to %d from %d", offset, whence)
+}
+
+// opener decrypts a chunked box.
+type opener struct {
+	src    io.Reader
+	key    *[32]byte
+	prefix [16]byte
+
+	sealed []byte
+	plain  []byte
+	out    []byte // plaintext not yet read
+	index  uint64
+	done   bool
+	err    error
+}
+
+// newOpener returns an opener for a box that starts with header, which
+// must have been checked with isChunked.
+func newOpener(header []byte, src io.Reader, key *secretkey.Key) (*opener, error) {
+	chunkSize := binary.BigEndian.Uint32(header[4:8])
+	if chunkSize == 0 || chunkSize > maxChunkSize {
+		return nil, ErrAuth
+	}
+	o := &opener{
+		src:    src,
+		key:    (*[32]byte)(key),
+		sealed: make([]byte, int(chunkSize)+secretbox.Overhead),
+		plain:  make([]byte, 0, chunkSize),
+	}
+	copy(o.prefix[:], header[8:chunkHeaderSize])
+	return o, nil
+}
+
+func isChunked(header []byte) bool {
+	return len(header) == chunkHeaderSize && bytes.Equal(header[:4], chunkMagic)
+}
+
+func (o *opener) Read(p []byte) (int, error) {
+	for len(o.out) == 0 {
+		if o.err != nil {
+			return 0, o.err
+		}
+		if o.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(o.src, o.sealed)
+		final := false
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			final = true
+		} else if err != nil {
+			o.err = err
+			return 0, err
+		}
+		var ok bool
+		o.out, ok = secretbox.Open(o.plain[:0], o.sealed[:n], chunkNonce(&o.prefix, o.index, final), o.key)
+		if !ok {
+			o.err = ErrAuth
+			return 0, ErrAuth
+		}
+		o.index++
+		o.done = final
+	}
+	n := copy(p, o.out)
+	o.out = o.out[n:]
+	return n, nil
+}
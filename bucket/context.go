@@ -0,0 +1,152 @@
+package bucket
+
+import (
+	"context"
+	"io"
+)
+
+// ContextBucket is implemented by buckets whose operations can be bound
+// to a context.  WithContext returns a view of the bucket whose
+// operations, and those of the buckets it descends to, give up once ctx
+// is done.
+type ContextBucket interface {
+	WithContext(ctx context.Context) Bucket
+}
+
+// WithContext returns a view of b bound to ctx.  Buckets that do not
+// implement ContextBucket are wrapped so that every operation checks
+// ctx before it starts.
+func WithContext(ctx context.Context, b Bucket) Bucket {
+	if cb, ok := b.(ContextBucket); ok {
+		return cb.WithContext(ctx)
+	}
+	return &contextBucket{bucket: b, ctx: ctx}
+}
+
+type contextBucket struct {
+	bucket Bucket
+	ctx    context.Context
+}
+
+func (b *contextBucket) Abs(key string) string {
+	return b.bucket.Abs(key)
+}
+
+func (b *contextBucket) Put(key string, data []byte) error {
+	if err := b.ctx.Err(); err != nil {
+		return err
+	}
+	return b.bucket.Put(key, data)
+}
+
+func (b *contextBucket) Get(key string) ([]byte, error) {
+	if err := b.ctx.Err(); err != nil {
+		return nil, err
+	}
+	return b.bucket.Get(key)
+}
+
+func (b *contextBucket) Stat(key string) (*Info, error) {
+	if err := b.ctx.Err(); err != nil {
+		return nil, err
+	}
+	return b.bucket.Stat(key)
+}
+
+func (b *contextBucket) Delete(key string) error {
+	if err := b.ctx.Err(); err != nil {
+		return err
+	}
+	return b.bucket.Delete(key)
+}
+
+func (b *contextBucket) PutStream(key string, r io.Reader) error {
+	if err := b.ctx.Err(); err != nil {
+		return err
+	}
+	return Stream(b.bucket).PutStream(key, seekThrough(&contextReader{ctx: b.ctx, r: r}, r))
+}
+
+func (b *contextBucket) GetStream(key string) (io.ReadCloser, error) {
+	if err := b.ctx.Err(); err != nil {
+		return nil, err
+	}
+	rc, err := Stream(b.bucket).GetStream(key)
+	if err != nil {
+		return nil, err
+	}
+	return readCloser{&contextReader{ctx: b.ctx, r: rc}, rc}, nil
+}
+
+func (b *contextBucket) List() (keys, children []string, err error) {
+	if err := b.ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	return b.bucket.List()
+}
+
+func (b *contextBucket) ListPages() PageIterator {
+	return &contextPages{ctx: b.ctx, it: ListPages(b.bucket)}
+}
+
+func (b *contextBucket) Descend(child string) (Bucket, error) {
+	if err := b.ctx.Err(); err != nil {
+		return nil, err
+	}
+	bb, err := b.bucket.Descend(child)
+	if err != nil {
+		return nil, err
+	}
+	return WithContext(b.ctx, bb), nil
+}
+
+func (b *contextBucket) Destroy() error {
+	if err := b.ctx.Err(); err != nil {
+		return err
+	}
+	return b.bucket.Destroy()
+}
+
+func (b *contextBucket) Replicas() []Bucket {
+	rs := Replicas(b.bucket)
+	for i, rb := range rs {
+		rs[i] = WithContext(b.ctx, rb)
+	}
+	return rs
+}
+
+// contextReader fails reads once ctx is done, so that copying a stream
+// can be cancelled.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// contextPages stops listing once ctx is done.
+type contextPages struct {
+	ctx context.Context
+	it  PageIterator
+}
+
+func (p *contextPages) Next() (keys, children []string, err error) {
+	if err := p.ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	return p.it.Next()
+}
+
+// contextOrBackground returns ctx, or the background context if ctx is
+// nil, for buckets that have not been bound to a context.
+func contextOrBackground(ctx context.Context) context.Context {
+	if ctx == nil {
+		return context.Background()
+	}
+	return ctx
+}
@@ -1,9 +1,13 @@
 package bucket
 
 import (
-	"crypto/rand"
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
 
 	"golang.org/x/crypto/nacl/secretbox"
 
@@ -12,11 +16,14 @@ import (
 
 var ErrAuth = errors.New("integrity check failure")
 
+// BoxOverhead is the overhead of an unchunked box, as written by older
+// versions; see SealedSize for chunked boxes.
 const BoxOverhead = 24 + secretbox.Overhead // nonce+mac
 
 type encryptedBucket struct {
 	bucket     Bucket
 	privateKey *secretkey.Key
+	names      *nameCipher // nil if names are stored in plaintext
 }
 
 func NewEncryptedBucket(bucket Bucket, key *secretkey.Key) Bucket {
@@ -26,44 +33,205 @@ func NewEncryptedBucket(bucket Bucket, key *secretkey.Key) Bucket {
 	}
 }
 
+// NewEncryptedNamesBucket is like NewEncryptedBucket, but the names of
+// keys and children are also encrypted, so that the underlying bucket
+// does not reveal backup ids.  Names in the underlying bucket that do
+// not decrypt with key are left out of listings.
+func NewEncryptedNamesBucket(bucket Bucket, key *secretkey.Key) Bucket {
+	return &encryptedBucket{
+		bucket:     bucket,
+		privateKey: key,
+		names:      newNameCipher(key),
+	}
+}
+
+// name returns the name of key in the underlying bucket.
+func (b *encryptedBucket) name(key string) (string, error) {
+	if b.names == nil {
+		return key, nil
+	}
+	return b.names.encryptPath(key)
+}
+
+// Abs returns the path of key in the underlying bucket.  If key is too
+// long to be stored with encrypted names, the error follows the path.
 func (b *encryptedBucket) Abs(key string) string {
-	return b.bucket.Abs(key)
+	name, err := b.name(key)
+	if err != nil {
+		return fmt.Sprintf("%s (%s)", b.bucket.Abs(name), err)
+	}
+	return b.bucket.Abs(name)
 }
 
 func (b *encryptedBucket) Put(key string, data []byte) error {
-	box := sealBox(data, b.privateKey)
-	return b.bucket.Put(key, box)
+	return b.PutStream(key, bytes.NewReader(data))
+}
+
+// PutStream seals r in chunks as it is written to the underlying
+// bucket.  If r is an io.Seeker, the sealed stream is too, so that the
+// underlying bucket can find its size and retry.
+func (b *encryptedBucket) PutStream(key string, r io.Reader) error {
+	name, err := b.name(key)
+	if err != nil {
+		return err
+	}
+	return Stream(b.bucket).PutStream(name, newSealer(r, b.privateKey))
 }
 
 func (b *encryptedBucket) Get(key string) ([]byte, error) {
-	box, err := b.bucket.Get(key)
+	name, err := b.name(key)
 	if err != nil {
 		return nil, err
 	}
-	if len(box) < BoxOverhead {
-		return nil, fmt.Errorf("short box")
+	data, err := b.get(b.bucket, name)
+	if err == nil || IsNotExist(err) {
+		return data, err
+	}
+
+	// Another replica may have an intact copy of the box.
+	for _, rb := range Replicas(b.bucket) {
+		if data, rerr := b.get(rb, name); rerr == nil {
+			return data, nil
+		}
+	}
+	return nil, err
+}
+
+// get reads and opens a box from bb.  The box is decrypted as it is
+// read, so only the plaintext is held in memory in full.
+func (b *encryptedBucket) get(bb Bucket, name string) ([]byte, error) {
+	rc, err := Stream(bb).GetStream(name)
+	if err != nil {
+		return nil, err
+	}
+	r, chunked, err := b.open(rc)
+	if err == nil {
+		var data []byte
+		data, err = ioutil.ReadAll(r)
+		if err == nil {
+			rc.Close()
+			return data, nil
+		}
+	}
+	rc.Close()
+	if err != ErrAuth || !chunked {
+		return nil, err
+	}
+	// An unchunked box starts with a random nonce, which may look like
+	// a chunk header by chance.
+	box, gerr := bb.Get(name)
+	if gerr != nil || len(box) < BoxOverhead {
+		return nil, err
+	}
+	if data, ok := openBox(box, b.privateKey); ok {
+		return data, nil
+	}
+	return nil, err
+}
+
+func (b *encryptedBucket) GetStream(key string) (io.ReadCloser, error) {
+	name, err := b.name(key)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := Stream(b.bucket).GetStream(name)
+	if err != nil {
+		return nil, err
+	}
+	r, _, err := b.open(rc)
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	return readCloser{r, rc}, nil
+}
+
+// open returns a reader of the plaintext of the box in r, and whether
+// the box is chunked.  Unchunked boxes are read into memory and opened
+// at once.
+func (b *encryptedBucket) open(r io.Reader) (io.Reader, bool, error) {
+	header := make([]byte, chunkHeaderSize)
+	n, err := io.ReadFull(r, header)
+	if err == nil && isChunked(header) {
+		o, err := newOpener(header, r, b.privateKey)
+		return o, true, err
+	} else if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, false, err
 	}
 
+	rest, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, false, err
+	}
+	box := append(header[:n], rest...)
+	if len(box) < BoxOverhead {
+		return nil, false, fmt.Errorf("short box")
+	}
 	data, ok := openBox(box, b.privateKey)
 	if !ok {
-		return nil, ErrAuth
+		return nil, false, ErrAuth
 	}
+	return bytes.NewReader(data), false, nil
+}
 
-	return data, nil
+func (b *encryptedBucket) Stat(key string) (*Info, error) {
+	name, err := b.name(key)
+	if err != nil {
+		return nil, err
+	}
+	return b.bucket.Stat(name)
+}
+
+func (b *encryptedBucket) Delete(key string) error {
+	name, err := b.name(key)
+	if err != nil {
+		return err
+	}
+	return b.bucket.Delete(name)
 }
 
 func (b *encryptedBucket) List() (keys, children []string, err error) {
-	return b.bucket.List()
+	keys, children, err = b.bucket.List()
+	if err != nil || b.names == nil {
+		return
+	}
+	return b.decryptNames(keys), b.decryptNames(children), nil
+}
+
+// ListPages decrypts names page by page, so each page is sorted, but
+// the pages together may not be.
+func (b *encryptedBucket) ListPages() PageIterator {
+	it := ListPages(b.bucket)
+	if b.names == nil {
+		return it
+	}
+	return &mapPages{it: it, f: b.decryptNames}
+}
+
+func (b *encryptedBucket) decryptNames(names []string) []string {
+	var out []string
+	for _, s := range names {
+		if name, err := b.names.decrypt(s); err == nil {
+			out = append(out, name)
+		}
+	}
+	sort.Strings(out)
+	return out
 }
 
 func (b *encryptedBucket) Descend(child string) (Bucket, error) {
-	bb, err := b.bucket.Descend(child)
+	name, err := b.name(child)
+	if err != nil {
+		return nil, err
+	}
+	bb, err := b.bucket.Descend(name)
 	if err != nil {
 		return nil, err
 	}
 	return &encryptedBucket{
 		bucket:     bb,
 		privateKey: b.privateKey,
+		names:      b.names,
 	}, nil
 }
 
@@ -71,16 +239,42 @@ func (b *encryptedBucket) Destroy() error {
 	return b.bucket.Destroy()
 }
 
+func (b *encryptedBucket) WithContext(ctx context.Context) Bucket {
+	return &encryptedBucket{
+		bucket:     WithContext(ctx, b.bucket),
+		privateKey: b.privateKey,
+		names:      b.names,
+	}
+}
+
+func (b *encryptedBucket) Uncached() Bucket {
+	bb := uncachedOrNil(b.bucket)
+	if bb == nil {
+		return nil
+	}
+	return &encryptedBucket{
+		bucket:     bb,
+		privateKey: b.privateKey,
+		names:      b.names,
+	}
+}
+
+// Replicas returns views of the replicas below b that decrypt with the
+// same key, to read each copy of a box on its own.
+func (b *encryptedBucket) Replicas() []Bucket {
+	rs := Replicas(b.bucket)
+	for i, rb := range rs {
+		rs[i] = &encryptedBucket{
+			bucket:     rb,
+			privateKey: b.privateKey,
+			names:      b.names,
+		}
+	}
+	return rs
+}
+
 func openBox(box []byte, key *secretkey.Key) ([]byte, bool) {
 	var nonce [24]byte
 	copy(nonce[:], box[0:24])
 	return secretbox.Open(nil, box[24:], &nonce, (*[32]byte)(key))
 }
-
-func sealBox(data []byte, key *secretkey.Key) []byte {
-	var nonce [24]byte
-	if _, err := rand.Read(nonce[:]); err != nil {
-		panic("rand.Read error: " + err.Error())
-	}
-	return secretbox.Seal(nonce[:], data, &nonce, (*[32]byte)(key))
-}
@@ -0,0 +1,389 @@
+package bucket
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/davidlazar/kebab/internal/erasure"
+)
+
+// Every shard starts with a header:
+//
+//	magic [4]byte      "kRS1"
+//	k, m, index byte
+//	size uint64        length of the original data
+//	dataHash [32]byte  sha256 of the original data
+//	shardHash [32]byte sha256 of the rest of the shard
+const shardHeaderSize = 4 + 3 + 8 + 32 + 32
+
+var shardMagic = []byte("kRS1")
+
+type shardHeader struct {
+	k, m, index int
+	size        uint64
+	dataHash    [32]byte
+}
+
+// erasureBucket splits every value into k data shards and m parity
+// shards with a Reed-Solomon code, and stores shard i in bucket i.
+type erasureBucket struct {
+	buckets []Bucket
+	code    *erasure.Code
+}
+
+// NewErasureBucket stores each value across the given buckets, so that
+// it can be read back as long as any k of them are available.  The
+// other len(buckets)-k buckets hold parity shards.  A Put must reach
+// every bucket.
+func NewErasureBucket(buckets []Bucket, k int) (Bucket, error) {
+	code, err := erasure.New(k, len(buckets)-k)
+	if err != nil {
+		return nil, err
+	}
+	return &erasureBucket{buckets: buckets, code: code}, nil
+}
+
+func (b *erasureBucket) WithContext(ctx context.Context) Bucket {
+	buckets := make([]Bucket, len(b.buckets))
+	for i, bb := range b.buckets {
+		buckets[i] = WithContext(ctx, bb)
+	}
+	return &erasureBucket{buckets: buckets, code: b.code}
+}
+
+func (b *erasureBucket) Abs(key string) string {
+	return b.buckets[0].Abs(key)
+}
+
+func (b *erasureBucket) Put(key string, data []byte) error {
+	sum := sha256.Sum256(data)
+	shards := b.code.Split(data)
+
+	errs := make([]error, len(b.buckets))
+	var wg sync.WaitGroup
+	for i := range b.buckets {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			h := &shardHeader{
+				k:        b.code.DataShards(),
+				m:        b.code.ParityShards(),
+				index:    i,
+				size:     uint64(len(data)),
+				dataHash: sum,
+			}
+			errs[i] = b.buckets[i].Put(key, h.seal(shards[i]))
+		}(i)
+	}
+	wg.Wait()
+
+	var failed []string
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("shard %d: %s", i, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("Put(%q): %s", key, strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// PutStream reads r into memory, since the code needs the whole value.
+func (b *erasureBucket) PutStream(key string, r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return b.Put(key, data)
+}
+
+// GetStream reconstructs the value in memory, like Get.
+func (b *erasureBucket) GetStream(key string) (io.ReadCloser, error) {
+	data, err := b.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (h *shardHeader) seal(shard []byte) []byte {
+	buf := make([]byte, shardHeaderSize, shardHeaderSize+len(shard))
+	copy(buf, shardMagic)
+	buf[4], buf[5], buf[6] = byte(h.k), byte(h.m), byte(h.index)
+	binary.BigEndian.PutUint64(buf[7:15], h.size)
+	copy(buf[15:47], h.dataHash[:])
+	shardHash := sha256.Sum256(shard)
+	copy(buf[47:79], shardHash[:])
+	return append(buf, shard...)
+}
+
+// openShard checks the header of a shard and returns its payload.
+func openShard(buf []byte) (*shardHeader, []byte, error) {
+	if len(buf) < shardHeaderSize || !bytes.Equal(buf[:4], shardMagic) {
+		return nil, nil, errors.New("not an erasure-coded shard")
+	}
+	h := &shardHeader{
+		k:     int(buf[4]),
+		m:     int(buf[5]),
+		index: int(buf[6]),
+		size:  binary.BigEndian.Uint64(buf[7:15]),
+	}
+	copy(h.dataHash[:], buf[15:47])
+	shard := buf[shardHeaderSize:]
+	if sum := sha256.Sum256(shard); !bytes.Equal(sum[:], buf[47:79]) {
+		return nil, nil, errors.New("shard checksum mismatch")
+	}
+	return h, shard, nil
+}
+
+type shardResult struct {
+	index  int
+	header *shardHeader
+	shard  []byte
+	err    error
+}
+
+// Get fetches the data shards first and falls back to parity shards for
+// the ones that are missing or corrupt.
+func (b *erasureBucket) Get(key string) ([]byte, error) {
+	k := b.code.DataShards()
+	n := len(b.buckets)
+
+	// Shards are grouped by the hash of the data they encode, so
+	// that shards of an older value are not mixed with newer ones.
+	groups := make(map[[32]byte][][]byte)
+	headers := make(map[[32]byte]*shardHeader)
+	var errs []error
+	next := 0
+	for next < n {
+		var need int
+		for _, g := range groups {
+			if c := count(g); c > need {
+				need = c
+			}
+		}
+		need = k - need
+		if need > n-next {
+			need = n - next
+		}
+
+		results := make(chan shardResult, need)
+		for i := next; i < next+need; i++ {
+			go func(i int) {
+				results <- b.getShard(key, i)
+			}(i)
+		}
+		next += need
+
+		for j := 0; j < need; j++ {
+			r := <-results
+			if r.err != nil {
+				errs = append(errs, r.err)
+				continue
+			}
+			g, ok := groups[r.header.dataHash]
+			if !ok {
+				g = make([][]byte, n)
+				groups[r.header.dataHash] = g
+				headers[r.header.dataHash] = r.header
+			}
+			g[r.index] = r.shard
+		}
+
+		for sum, g := range groups {
+			if count(g) < k {
+				continue
+			}
+			if err := b.code.Reconstruct(g); err != nil {
+				return nil, fmt.Errorf("Get(%q): %s", key, err)
+			}
+			data, err := b.code.Join(g, int(headers[sum].size))
+			if err != nil {
+				return nil, fmt.Errorf("Get(%q): %s", key, err)
+			}
+			if sha256.Sum256(data) != sum {
+				return nil, fmt.Errorf("Get(%q): reconstructed data does not match its hash", key)
+			}
+			return data, nil
+		}
+	}
+
+	// Report a missing key as such, so that callers can tell it
+	// apart from a failure.
+	notExist := 0
+	for _, err := range errs {
+		if IsNotExist(err) {
+			notExist++
+		}
+	}
+	if notExist == len(errs) && len(errs) > 0 {
+		return nil, errs[0]
+	}
+	var msgs []string
+	for _, err := range errs {
+		msgs = append(msgs, err.Error())
+	}
+	return nil, fmt.Errorf("Get(%q): fewer than %d of %d shards available: %s", key, k, n, strings.Join(msgs, "; "))
+}
+
+// Stat reports the total size of the shards of key, and the time the
+// last of them was written.  It fails if fewer than k shards exist.
+func (b *erasureBucket) Stat(key string) (*Info, error) {
+	k := b.code.DataShards()
+	infos := make([]*Info, len(b.buckets))
+	errs := make([]error, len(b.buckets))
+	var wg sync.WaitGroup
+	for i, bb := range b.buckets {
+		wg.Add(1)
+		go func(i int, bb Bucket) {
+			defer wg.Done()
+			infos[i], errs[i] = bb.Stat(key)
+		}(i, bb)
+	}
+	wg.Wait()
+
+	info := new(Info)
+	found, notExist := 0, 0
+	var msgs []string
+	for i, err := range errs {
+		if err != nil {
+			if IsNotExist(err) {
+				notExist++
+			}
+			msgs = append(msgs, fmt.Sprintf("shard %d: %s", i, err))
+			continue
+		}
+		found++
+		info.Size += infos[i].Size
+		if infos[i].ModTime.After(info.ModTime) {
+			info.ModTime = infos[i].ModTime
+		}
+	}
+	if found >= k {
+		return info, nil
+	}
+	if notExist == len(errs) {
+		return nil, errs[0]
+	}
+	return nil, fmt.Errorf("Stat(%q): fewer than %d of %d shards available: %s", key, k, len(b.buckets), strings.Join(msgs, "; "))
+}
+
+// Delete deletes every shard of key.
+func (b *erasureBucket) Delete(key string) error {
+	errs := make([]error, len(b.buckets))
+	var wg sync.WaitGroup
+	for i, bb := range b.buckets {
+		wg.Add(1)
+		go func(i int, bb Bucket) {
+			defer wg.Done()
+			errs[i] = bb.Delete(key)
+		}(i, bb)
+	}
+	wg.Wait()
+
+	var failed []string
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("shard %d: %s", i, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("Delete(%q): %s", key, strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+func count(shards [][]byte) int {
+	c := 0
+	for _, s := range shards {
+		if s != nil {
+			c++
+		}
+	}
+	return c
+}
+
+func (b *erasureBucket) getShard(key string, i int) shardResult {
+	buf, err := b.buckets[i].Get(key)
+	if err != nil {
+		return shardResult{index: i, err: err}
+	}
+	h, shard, err := openShard(buf)
+	if err == nil && (h.k != b.code.DataShards() || h.m != b.code.ParityShards() || h.index != i) {
+		err = fmt.Errorf("shard %d/%d+%d found in bucket %d of %d+%d", h.index, h.k, h.m, i, b.code.DataShards(), b.code.ParityShards())
+	}
+	if err != nil {
+		return shardResult{index: i, err: fmt.Errorf("shard %d: %s", i, err)}
+	}
+	return shardResult{index: i, header: h, shard: shard}
+}
+
+// List merges the listings of the buckets.  It fails if fewer than k
+// buckets can be listed, since the keys could not be read anyway.
+func (b *erasureBucket) List() (keys, children []string, err error) {
+	keySet := make(map[string]bool)
+	childSet := make(map[string]bool)
+	var errs []string
+	for i, bb := range b.buckets {
+		ks, cs, err := bb.List()
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("shard %d: %s", i, err))
+			continue
+		}
+		for _, k := range ks {
+			keySet[k] = true
+		}
+		for _, c := range cs {
+			childSet[c] = true
+		}
+	}
+	if len(b.buckets)-len(errs) < b.code.DataShards() {
+		return nil, nil, fmt.Errorf("List: %s", strings.Join(errs, "; "))
+	}
+	return sortedSet(keySet), sortedSet(childSet), nil
+}
+
+func (b *erasureBucket) Descend(child string) (Bucket, error) {
+	buckets := make([]Bucket, len(b.buckets))
+	for i, bb := range b.buckets {
+		var err error
+		buckets[i], err = bb.Descend(child)
+		if err != nil {
+			return nil, fmt.Errorf("shard %d: Descend(%q): %s", i, child, err)
+		}
+	}
+	return &erasureBucket{buckets: buckets, code: b.code}, nil
+}
+
+func (b *erasureBucket) Destroy() error {
+	errs := make([]error, len(b.buckets))
+	var wg sync.WaitGroup
+	for i, bb := range b.buckets {
+		wg.Add(1)
+		go func(i int, bb Bucket) {
+			defer wg.Done()
+			errs[i] = bb.Destroy()
+		}(i, bb)
+	}
+	wg.Wait()
+
+	var failed []string
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("shard %d: %s", i, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("Destroy: %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
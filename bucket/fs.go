@@ -2,18 +2,195 @@ package bucket
 
 import (
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 type fileBucket struct {
 	root string
+	opts FileOptions
+}
+
+// FileOptions configure a file bucket.
+type FileOptions struct {
+	// NoOverwrite makes Put fail if the key already exists, with an
+	// error that satisfies os.IsExist.  On file systems without hard
+	// links, values are then copied into place, so a crash may leave
+	// a truncated value behind.
+	NoOverwrite bool
+}
+
+func init() {
+	Register("file", openFileURL)
+}
+
+// openFileURL opens a location of the form file:///path, or file:path
+// for a path relative to the working directory.  The query parameter
+// nooverwrite=true sets FileOptions.NoOverwrite.
+func openFileURL(u *url.URL) (Bucket, error) {
+	if u.Host != "" && u.Host != "localhost" {
+		return nil, fmt.Errorf("file URL with remote host %q", u.Host)
+	}
+	p := u.Path
+	if u.Opaque != "" {
+		p = u.Opaque
+	}
+	if p == "" {
+		return nil, fmt.Errorf("missing path")
+	}
+	var opts FileOptions
+	if v := u.Query().Get("nooverwrite"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid nooverwrite parameter: %q", v)
+		}
+		opts.NoOverwrite = b
+	}
+	return NewFileBucketWithOptions(filepath.FromSlash(p), opts)
 }
 
 func NewFileBucket(path string) (Bucket, error) {
+	return NewFileBucketWithOptions(path, FileOptions{})
+}
+
+// NewFileBucketWithOptions is like NewFileBucket, with options.
+func NewFileBucketWithOptions(path string, opts FileOptions) (Bucket, error) {
 	// TODO check if path is a file
-	return &fileBucket{root: path}, nil
+	return &fileBucket{root: path, opts: opts}, nil
+}
+
+// Values are written to a temporary file next to their key, which is
+// renamed into place once it is complete and synced, so that a crash
+// or a full disk never leaves a truncated value behind.  The names of
+// temporary files start with a dot and contain tempFileInfix, so they
+// are not listed.
+const tempFileInfix = ".tmp-"
+
+// tempFileMaxAge is the age after which temporary files are assumed to
+// be left over from a crash, rather than being written right now.
+const tempFileMaxAge = 24 * time.Hour
+
+func isTempFile(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.Contains(name, tempFileInfix)
+}
+
+// cleanedDirs holds the directories that removeTempFiles has looked at.
+var cleanedDirs sync.Map
+
+// removeTempFiles removes the temporary files in dir that were last
+// modified before cutoff.  It is called before writing to dir, and
+// looks at each directory once per process, so that opening a bucket
+// does not walk all of it.  Errors are ignored, since the files are
+// only wasted space.
+func removeTempFiles(dir string, cutoff time.Time) {
+	if _, done := cleanedDirs.LoadOrStore(dir, true); done {
+		return
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, info := range infos {
+		if info.Mode().IsRegular() && isTempFile(info.Name()) && info.ModTime().Before(cutoff) {
+			os.Remove(filepath.Join(dir, info.Name()))
+		}
+	}
+}
+
+// writeFile atomically writes the contents produced by write to p.
+func (b *fileBucket) writeFile(p string, write func(io.Writer) error) error {
+	dir := filepath.Dir(p)
+	if err := os.MkdirAll(dir, os.ModeDir|0700); err != nil {
+		return err
+	}
+	removeTempFiles(dir, time.Now().Add(-tempFileMaxAge))
+	if b.opts.NoOverwrite {
+		if _, err := os.Lstat(p); err == nil {
+			return &os.PathError{Op: "put", Path: p, Err: os.ErrExist}
+		}
+	}
+	f, err := ioutil.TempFile(dir, "."+filepath.Base(p)+tempFileInfix)
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	err = write(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		if b.opts.NoOverwrite {
+			// Unlike rename, link fails if p exists.  Some file
+			// systems, such as FAT and SMB shares, have no links.
+			err = link(tmp, p)
+			if err != nil && !os.IsExist(err) {
+				err = copyNew(tmp, p)
+			}
+			if os.IsExist(err) {
+				err = &os.PathError{Op: "put", Path: p, Err: os.ErrExist}
+			}
+		} else {
+			err = os.Rename(tmp, p)
+		}
+	}
+	if err != nil || b.opts.NoOverwrite {
+		os.Remove(tmp)
+	}
+	if err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// link is os.Link, replaced by tests.
+var link = os.Link
+
+// copyNew copies src to dst, failing if dst exists.  Unlike a link, it
+// may leave dst partly written if the system crashes.
+func copyNew(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+	return err
+}
+
+// syncDir makes a rename in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
 }
 
 func (b *fileBucket) Abs(key string) string {
@@ -21,17 +198,45 @@ func (b *fileBucket) Abs(key string) string {
 }
 
 func (b *fileBucket) Put(key string, data []byte) error {
-	p := b.Abs(key)
-	if err := os.MkdirAll(filepath.Dir(p), os.ModeDir|0700); err != nil {
+	return b.writeFile(b.Abs(key), func(w io.Writer) error {
+		_, err := w.Write(data)
 		return err
-	}
-	return ioutil.WriteFile(p, data, 0600)
+	})
 }
 
 func (b *fileBucket) Get(key string) ([]byte, error) {
 	return ioutil.ReadFile(b.Abs(key))
 }
 
+func (b *fileBucket) Stat(key string) (*Info, error) {
+	fi, err := os.Stat(b.Abs(key))
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return nil, &os.PathError{Op: "stat", Path: b.Abs(key), Err: os.ErrNotExist}
+	}
+	return &Info{Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+func (b *fileBucket) Delete(key string) error {
+	if err := os.Remove(b.Abs(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (b *fileBucket) PutStream(key string, r io.Reader) error {
+	return b.writeFile(b.Abs(key), func(w io.Writer) error {
+		_, err := io.Copy(w, r)
+		return err
+	})
+}
+
+func (b *fileBucket) GetStream(key string) (io.ReadCloser, error) {
+	return os.Open(b.Abs(key))
+}
+
 func (b *fileBucket) List() (keys, children []string, err error) {
 	list, err := ioutil.ReadDir(b.root)
 	if os.IsNotExist(err) {
@@ -41,6 +246,9 @@ func (b *fileBucket) List() (keys, children []string, err error) {
 	}
 
 	for _, x := range list {
+		if isTempFile(x.Name()) {
+			continue
+		}
 		if x.IsDir() {
 			children = append(children, x.Name())
 		} else {
@@ -52,7 +260,7 @@ func (b *fileBucket) List() (keys, children []string, err error) {
 }
 
 func (b *fileBucket) Descend(child string) (Bucket, error) {
-	return NewFileBucket(b.Abs(child))
+	return &fileBucket{root: b.Abs(child), opts: b.opts}, nil
 }
 
 func (b *fileBucket) Destroy() error {
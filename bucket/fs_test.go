@@ -0,0 +1,39 @@
+package bucket
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestNoOverwriteWithoutLinks(t *testing.T) {
+	defer func(f func(string, string) error) { link = f }(link)
+	link = func(oldname, newname string) error {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: syscall.EPERM}
+	}
+
+	dir, err := ioutil.TempDir("", "kebab_testing_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	b, err := NewFileBucketWithOptions(dir, FileOptions{NoOverwrite: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Put("key", []byte("hello")); err != nil {
+		t.Fatalf("Put: %s", err)
+	}
+	if err := b.Put("key", []byte("world")); !os.IsExist(err) {
+		t.Fatalf("expected an exist error when overwriting, got %v", err)
+	}
+	if data, err := b.Get("key"); err != nil || string(data) != "hello" {
+		t.Fatalf("Get: %q, %v", data, err)
+	}
+	names, err := filepath.Glob(filepath.Join(dir, ".*"))
+	if err != nil || len(names) != 0 {
+		t.Fatalf("temp files left behind: %v %v", names, err)
+	}
+}
@@ -0,0 +1,151 @@
+package bucket
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/davidlazar/kebab/gcs"
+)
+
+type gcsBucket struct {
+	bucket *gcs.Bucket
+	prefix string
+}
+
+func init() {
+	Register("gs", openGCSURL)
+}
+
+// openGCSURL opens a location of the form gs://name/prefix?config=<file>,
+// where the config file is as for NewGCSBucketFromFile and need not name
+// a bucket.
+func openGCSURL(u *url.URL) (Bucket, error) {
+	config, err := configParam(u)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("missing bucket name")
+	}
+	conf, err := gcs.ReadConfigFile(config)
+	if err != nil {
+		return nil, err
+	}
+	conf.Bucket = u.Host
+	b, err := gcs.NewBucket(conf)
+	if err != nil {
+		return nil, err
+	}
+	return DescendPath(NewGCSBucket(b), u.Path)
+}
+
+func NewGCSBucket(b *gcs.Bucket) Bucket {
+	return &gcsBucket{bucket: b}
+}
+
+func NewGCSBucketFromFile(path string) (Bucket, error) {
+	b, err := gcs.NewBucketFromFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewGCSBucket(b), nil
+}
+
+func (b *gcsBucket) WithContext(ctx context.Context) Bucket {
+	return &gcsBucket{bucket: b.bucket.WithContext(ctx), prefix: b.prefix}
+}
+
+func (b *gcsBucket) Abs(key string) string {
+	return b.prefix + key
+}
+
+func (b *gcsBucket) Put(key string, data []byte) error {
+	return b.bucket.Put(b.Abs(key), data)
+}
+
+func (b *gcsBucket) Get(key string) ([]byte, error) {
+	return b.bucket.Get(b.Abs(key))
+}
+
+func (b *gcsBucket) Stat(key string) (*Info, error) {
+	obj, err := b.bucket.Stat(b.Abs(key))
+	if err != nil {
+		return nil, err
+	}
+	size, err := strconv.ParseInt(obj.Size, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Stat(%q): invalid size: %q", key, obj.Size)
+	}
+	return &Info{Size: size, ModTime: obj.Updated}, nil
+}
+
+// Delete uses a batch request, which ignores objects that do not exist.
+func (b *gcsBucket) Delete(key string) error {
+	return b.bucket.Delete([]string{b.Abs(key)})
+}
+
+func (b *gcsBucket) List() (keys []string, children []string, err error) {
+	return listAll(b.ListPages())
+}
+
+func (b *gcsBucket) ListPages() PageIterator {
+	return &pageIterator{
+		next: func(token string) (keys, children []string, next string, err error) {
+			list, err := b.bucket.List(b.prefix, "/", token)
+			if err != nil {
+				return nil, nil, "", fmt.Errorf("List(%q, %q): %s", b.prefix, "/", err)
+			}
+			for _, obj := range list.Items {
+				keys = append(keys, strings.TrimPrefix(obj.Name, b.prefix))
+			}
+			for _, p := range list.Prefixes {
+				children = append(children, strings.TrimPrefix(strings.TrimSuffix(p, "/"), b.prefix))
+			}
+			return keys, children, list.NextPageToken, nil
+		},
+	}
+}
+
+func (b *gcsBucket) Descend(child string) (Bucket, error) {
+	if !strings.HasSuffix(child, "/") {
+		child += "/"
+	}
+	return &gcsBucket{
+		bucket: b.bucket,
+		prefix: b.prefix + child,
+	}, nil
+}
+
+func (b *gcsBucket) Destroy() error {
+	if b.prefix == "" {
+		return fmt.Errorf("refusing to destroy top-level bucket %q", b.bucket.Name)
+	}
+	var last []string
+	for {
+		list, err := b.bucket.List(b.prefix, "", "")
+		if err != nil {
+			return fmt.Errorf("List(%q, %q): %s", b.prefix, "", err)
+		}
+		if len(list.Items) == 0 {
+			return nil
+		}
+
+		names := make([]string, len(list.Items))
+		for i, obj := range list.Items {
+			names[i] = obj.Name
+		}
+		// Listing the same objects again means that deleting them
+		// did nothing, and would do nothing again.
+		if reflect.DeepEqual(names, last) {
+			return fmt.Errorf("Destroy(%q): %d objects are still listed after they were deleted", b.prefix, len(names))
+		}
+		last = names
+		if err := b.bucket.Delete(names); err != nil {
+			return fmt.Errorf("Delete(%q, ...): %s", names[0], err)
+		}
+	}
+}
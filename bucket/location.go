@@ -0,0 +1,115 @@
+package bucket
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// An Opener opens the bucket at a location URL.  The path of the URL,
+// if any, is handled by the opener.
+type Opener func(u *url.URL) (Bucket, error)
+
+var (
+	openersMu sync.RWMutex
+	openers   = make(map[string]Opener)
+)
+
+// Register makes a backend available to Open under a URL scheme.  It
+// panics if the scheme is already registered.
+func Register(scheme string, open Opener) {
+	openersMu.Lock()
+	defer openersMu.Unlock()
+	if open == nil {
+		panic("bucket: Register opener is nil")
+	}
+	if _, dup := openers[scheme]; dup {
+		panic("bucket: Register called twice for scheme " + scheme)
+	}
+	openers[scheme] = open
+}
+
+// Schemes returns the sorted list of registered schemes.
+func Schemes() []string {
+	openersMu.RLock()
+	defer openersMu.RUnlock()
+	var schemes []string
+	for s := range openers {
+		schemes = append(schemes, s)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// IsLocation reports whether s looks like a location URL rather than a
+// path.
+func IsLocation(s string) bool {
+	i := strings.Index(s, "://")
+	if i <= 0 {
+		return false
+	}
+	for _, c := range s[:i] {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '+' || c == '-' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// Open opens the bucket at a location URL such as file:///backups or
+// s3://name/prefix?config=s3.json, using the opener registered for its
+// scheme.  The bucket need not exist yet.
+func Open(location string) (Bucket, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	openersMu.RLock()
+	open, ok := openers[strings.ToLower(u.Scheme)]
+	openersMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown bucket scheme %q (known: %s)", u.Scheme, strings.Join(Schemes(), ", "))
+	}
+	b, err := open(u)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", redact(u), err)
+	}
+	return b, nil
+}
+
+// redact removes the password, if any, from a URL for error messages.
+func redact(u *url.URL) string {
+	if _, ok := u.User.Password(); ok {
+		c := *u
+		c.User = url.User(u.User.Username())
+		return c.String()
+	}
+	return u.String()
+}
+
+// DescendPath descends into each /-separated component of p, so that
+// the path of a location URL names a prefix of the bucket.
+func DescendPath(b Bucket, p string) (Bucket, error) {
+	for _, child := range strings.Split(p, "/") {
+		if child == "" {
+			continue
+		}
+		var err error
+		b, err = b.Descend(child)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// configParam returns the config file named in the query of u.
+func configParam(u *url.URL) (string, error) {
+	path := u.Query().Get("config")
+	if path == "" {
+		return "", fmt.Errorf("missing config parameter")
+	}
+	return path, nil
+}
@@ -0,0 +1,143 @@
+package bucket
+
+import (
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type memoryStore struct {
+	mu       sync.RWMutex
+	objects  map[string][]byte
+	modified map[string]time.Time
+}
+
+// MemoryBucket is a bucket that keeps its contents in memory.  It is
+// safe for concurrent use, and buckets returned by Descend share the
+// same storage.
+type MemoryBucket struct {
+	store  *memoryStore
+	prefix string // empty or ends with a slash
+}
+
+func NewMemoryBucket() *MemoryBucket {
+	return &MemoryBucket{
+		store: &memoryStore{
+			objects:  make(map[string][]byte),
+			modified: make(map[string]time.Time),
+		},
+	}
+}
+
+func (b *MemoryBucket) Abs(key string) string {
+	return b.prefix + key
+}
+
+func (b *MemoryBucket) Put(key string, data []byte) error {
+	x := make([]byte, len(data))
+	copy(x, data)
+
+	b.store.mu.Lock()
+	b.store.objects[b.Abs(key)] = x
+	b.store.modified[b.Abs(key)] = time.Now()
+	b.store.mu.Unlock()
+	return nil
+}
+
+func (b *MemoryBucket) Get(key string) ([]byte, error) {
+	b.store.mu.RLock()
+	data, ok := b.store.objects[b.Abs(key)]
+	b.store.mu.RUnlock()
+	if !ok {
+		return nil, &os.PathError{Op: "get", Path: b.Abs(key), Err: os.ErrNotExist}
+	}
+
+	x := make([]byte, len(data))
+	copy(x, data)
+	return x, nil
+}
+
+func (b *MemoryBucket) Stat(key string) (*Info, error) {
+	b.store.mu.RLock()
+	defer b.store.mu.RUnlock()
+	data, ok := b.store.objects[b.Abs(key)]
+	if !ok {
+		return nil, &os.PathError{Op: "stat", Path: b.Abs(key), Err: os.ErrNotExist}
+	}
+	return &Info{Size: int64(len(data)), ModTime: b.store.modified[b.Abs(key)]}, nil
+}
+
+func (b *MemoryBucket) Delete(key string) error {
+	b.store.mu.Lock()
+	delete(b.store.objects, b.Abs(key))
+	delete(b.store.modified, b.Abs(key))
+	b.store.mu.Unlock()
+	return nil
+}
+
+func (b *MemoryBucket) List() (keys, children []string, err error) {
+	b.store.mu.RLock()
+	defer b.store.mu.RUnlock()
+
+	seen := make(map[string]bool)
+	for k := range b.store.objects {
+		if !strings.HasPrefix(k, b.prefix) {
+			continue
+		}
+		name := k[len(b.prefix):]
+		if i := strings.Index(name, "/"); i >= 0 {
+			child := name[:i]
+			if !seen[child] {
+				seen[child] = true
+				children = append(children, child)
+			}
+		} else {
+			keys = append(keys, name)
+		}
+	}
+	sort.Strings(keys)
+	sort.Strings(children)
+	return keys, children, nil
+}
+
+func (b *MemoryBucket) Descend(child string) (Bucket, error) {
+	if !strings.HasSuffix(child, "/") {
+		child += "/"
+	}
+	return &MemoryBucket{
+		store:  b.store,
+		prefix: b.prefix + child,
+	}, nil
+}
+
+func (b *MemoryBucket) Destroy() error {
+	b.store.mu.Lock()
+	defer b.store.mu.Unlock()
+
+	for k := range b.store.objects {
+		if strings.HasPrefix(k, b.prefix) {
+			delete(b.store.objects, k)
+			delete(b.store.modified, k)
+		}
+	}
+	return nil
+}
+
+// Snapshot returns a copy of the contents of the bucket, including the
+// contents of its children, keyed by their path relative to the bucket.
+func (b *MemoryBucket) Snapshot() map[string][]byte {
+	b.store.mu.RLock()
+	defer b.store.mu.RUnlock()
+
+	m := make(map[string][]byte)
+	for k, data := range b.store.objects {
+		if strings.HasPrefix(k, b.prefix) {
+			x := make([]byte, len(data))
+			copy(x, data)
+			m[k[len(b.prefix):]] = x
+		}
+	}
+	return m
+}
@@ -0,0 +1,608 @@
+package bucket
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Replicated is implemented by buckets that store a copy of every key in
+// several underlying buckets, and by wrappers of such buckets.  The
+// encrypted bucket uses it to find an intact copy of a box that fails
+// the integrity check.
+type Replicated interface {
+	Replicas() []Bucket
+}
+
+// Replicas returns the replicas of b, or of the mirror that b wraps, or
+// nil if there is none.
+func Replicas(b Bucket) []Bucket {
+	if r, ok := b.(Replicated); ok {
+		return r.Replicas()
+	}
+	return nil
+}
+
+// Replica is one of the buckets of a mirror.  The name identifies the
+// replica in the journal, so it should not change between runs.
+type Replica struct {
+	Name   string
+	Bucket Bucket
+}
+
+// MirrorBucket writes every key to several replicas.  A Put succeeds
+// once quorum replicas have the key; the replicas that missed the write
+// are recorded in the journal, if any, and Repair fills them in later.
+type MirrorBucket struct {
+	replicas []Replica
+	quorum   int
+	journal  *Journal
+	prefix   string // path of this bucket relative to the root mirror
+}
+
+// NewMirrorBucket returns a mirror of the given replicas.  A quorum of
+// 0 means that every Put must reach all replicas.  The journal may be
+// nil, in which case missed writes are not recorded.
+func NewMirrorBucket(replicas []Replica, quorum int, journal *Journal) (*MirrorBucket, error) {
+	if len(replicas) == 0 {
+		return nil, fmt.Errorf("mirror needs at least one replica")
+	}
+	if quorum == 0 {
+		quorum = len(replicas)
+	}
+	if quorum < 1 || quorum > len(replicas) {
+		return nil, fmt.Errorf("invalid quorum %d for %d replicas", quorum, len(replicas))
+	}
+	names := make(map[string]bool)
+	for _, r := range replicas {
+		if names[r.Name] {
+			return nil, fmt.Errorf("duplicate replica %q", r.Name)
+		}
+		names[r.Name] = true
+	}
+	return &MirrorBucket{
+		replicas: replicas,
+		quorum:   quorum,
+		journal:  journal,
+	}, nil
+}
+
+func (b *MirrorBucket) Replicas() []Bucket {
+	bs := make([]Bucket, len(b.replicas))
+	for i, r := range b.replicas {
+		bs[i] = r.Bucket
+	}
+	return bs
+}
+
+func (b *MirrorBucket) WithContext(ctx context.Context) Bucket {
+	replicas := make([]Replica, len(b.replicas))
+	for i, r := range b.replicas {
+		replicas[i] = Replica{Name: r.Name, Bucket: WithContext(ctx, r.Bucket)}
+	}
+	return &MirrorBucket{
+		replicas: replicas,
+		quorum:   b.quorum,
+		journal:  b.journal,
+		prefix:   b.prefix,
+	}
+}
+
+func (b *MirrorBucket) Abs(key string) string {
+	return b.replicas[0].Bucket.Abs(key)
+}
+
+func (b *MirrorBucket) Put(key string, data []byte) error {
+	errs := make([]error, len(b.replicas))
+	var wg sync.WaitGroup
+	for i, r := range b.replicas {
+		wg.Add(1)
+		go func(i int, r Replica) {
+			defer wg.Done()
+			errs[i] = r.Bucket.Put(key, data)
+		}(i, r)
+	}
+	wg.Wait()
+	return b.putDone(key, errs)
+}
+
+// PutStream writes r to the replicas one after another, rewinding it in
+// between, if r is an io.Seeker.  Other readers are read into memory
+// and written to the replicas at once, like Put.
+func (b *MirrorBucket) PutStream(key string, r io.Reader) error {
+	rewind := rewinder(r)
+	if rewind == nil {
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		return b.Put(key, data)
+	}
+	errs := make([]error, len(b.replicas))
+	for i, rp := range b.replicas {
+		if i > 0 {
+			if err := rewind(); err != nil {
+				return err
+			}
+		}
+		errs[i] = Stream(rp.Bucket).PutStream(key, r)
+	}
+	return b.putDone(key, errs)
+}
+
+// putDone checks the quorum of a Put, given the error of each replica,
+// and records the missed writes.
+func (b *MirrorBucket) putDone(key string, errs []error) error {
+	ok := 0
+	var failed []string
+	for i, err := range errs {
+		if err == nil {
+			ok++
+		} else {
+			failed = append(failed, fmt.Sprintf("%s: %s", b.replicas[i].Name, err))
+		}
+	}
+	if ok < b.quorum {
+		return fmt.Errorf("Put(%q) reached %d of %d replicas, need %d: %s",
+			key, ok, len(b.replicas), b.quorum, strings.Join(failed, "; "))
+	}
+
+	if b.journal == nil {
+		return nil
+	}
+	for i, err := range errs {
+		name := b.replicas[i].Name
+		if err != nil {
+			if jerr := b.journal.Add(name, b.prefix+key, err); jerr != nil {
+				return fmt.Errorf("Put(%q): recording missed write: %s", key, jerr)
+			}
+		} else if jerr := b.journal.Remove(name, b.prefix+key); jerr != nil {
+			return fmt.Errorf("Put(%q): updating journal: %s", key, jerr)
+		}
+	}
+	return nil
+}
+
+// ordered returns the replicas in the order to read key from.  Replicas
+// that are known to have missed a write of the key come last, since
+// they may have a stale copy.
+func (b *MirrorBucket) ordered(key string) []Replica {
+	var fresh, stale []Replica
+	for _, r := range b.replicas {
+		if b.journal != nil && b.journal.Missed(r.Name, b.prefix+key) {
+			stale = append(stale, r)
+		} else {
+			fresh = append(fresh, r)
+		}
+	}
+	return append(fresh, stale...)
+}
+
+// firstError keeps the first error, preferring errors other than a
+// missing key.
+func firstError(first, err error) error {
+	if first == nil || (IsNotExist(first) && !IsNotExist(err)) {
+		return err
+	}
+	return first
+}
+
+// Get tries the replicas in order.
+func (b *MirrorBucket) Get(key string) ([]byte, error) {
+	var err error
+	for _, r := range b.ordered(key) {
+		data, rerr := r.Bucket.Get(key)
+		if rerr == nil {
+			return data, nil
+		}
+		err = firstError(err, rerr)
+	}
+	return nil, err
+}
+
+// GetStream opens key on the first replica that has it, in the same
+// order as Get.  Errors while reading the stream are not retried on
+// another replica.
+func (b *MirrorBucket) GetStream(key string) (io.ReadCloser, error) {
+	var err error
+	for _, r := range b.ordered(key) {
+		rc, rerr := Stream(r.Bucket).GetStream(key)
+		if rerr == nil {
+			return rc, nil
+		}
+		err = firstError(err, rerr)
+	}
+	return nil, err
+}
+
+// Stat tries the replicas in the same order as Get.
+func (b *MirrorBucket) Stat(key string) (*Info, error) {
+	var err error
+	for _, r := range b.ordered(key) {
+		info, rerr := r.Bucket.Stat(key)
+		if rerr == nil {
+			return info, nil
+		}
+		err = firstError(err, rerr)
+	}
+	return nil, err
+}
+
+// Delete deletes key from every replica.  Missed writes of the key are
+// forgotten for the replicas it was deleted from.
+func (b *MirrorBucket) Delete(key string) error {
+	errs := make([]error, len(b.replicas))
+	var wg sync.WaitGroup
+	for i, r := range b.replicas {
+		wg.Add(1)
+		go func(i int, r Replica) {
+			defer wg.Done()
+			errs[i] = r.Bucket.Delete(key)
+		}(i, r)
+	}
+	wg.Wait()
+
+	var failed []string
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", b.replicas[i].Name, err))
+		} else if b.journal != nil {
+			if err := b.journal.Remove(b.replicas[i].Name, b.prefix+key); err != nil {
+				failed = append(failed, fmt.Sprintf("%s: updating journal: %s", b.replicas[i].Name, err))
+			}
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("Delete(%q): %s", key, strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// List merges the listings of the replicas.  It fails only if no
+// replica can be listed.
+func (b *MirrorBucket) List() (keys, children []string, err error) {
+	keySet := make(map[string]bool)
+	childSet := make(map[string]bool)
+	var errs []string
+	for _, r := range b.replicas {
+		ks, cs, err := r.Bucket.List()
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", r.Name, err))
+			continue
+		}
+		for _, k := range ks {
+			keySet[k] = true
+		}
+		for _, c := range cs {
+			childSet[c] = true
+		}
+	}
+	if len(errs) == len(b.replicas) {
+		return nil, nil, fmt.Errorf("List: %s", strings.Join(errs, "; "))
+	}
+	return sortedSet(keySet), sortedSet(childSet), nil
+}
+
+func sortedSet(m map[string]bool) []string {
+	if len(m) == 0 {
+		return nil
+	}
+	xs := make([]string, 0, len(m))
+	for x := range m {
+		xs = append(xs, x)
+	}
+	sort.Strings(xs)
+	return xs
+}
+
+func (b *MirrorBucket) Descend(child string) (Bucket, error) {
+	replicas := make([]Replica, len(b.replicas))
+	for i, r := range b.replicas {
+		bb, err := r.Bucket.Descend(child)
+		if err != nil {
+			return nil, fmt.Errorf("%s: Descend(%q): %s", r.Name, child, err)
+		}
+		replicas[i] = Replica{Name: r.Name, Bucket: bb}
+	}
+	return &MirrorBucket{
+		replicas: replicas,
+		quorum:   b.quorum,
+		journal:  b.journal,
+		prefix:   b.prefix + strings.TrimSuffix(child, "/") + "/",
+	}, nil
+}
+
+// Destroy destroys every replica.
+func (b *MirrorBucket) Destroy() error {
+	errs := make([]error, len(b.replicas))
+	var wg sync.WaitGroup
+	for i, r := range b.replicas {
+		wg.Add(1)
+		go func(i int, r Replica) {
+			defer wg.Done()
+			errs[i] = r.Bucket.Destroy()
+		}(i, r)
+	}
+	wg.Wait()
+
+	var failed []string
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", b.replicas[i].Name, err))
+		} else if b.journal != nil {
+			if err := b.journal.RemovePrefix(b.replicas[i].Name, b.prefix); err != nil {
+				failed = append(failed, fmt.Sprintf("updating journal: %s", err))
+			}
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("Destroy: %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// Repair copies the keys that replicas missed from a replica that has
+// them, and removes them from the journal.  Keys that no replica has
+// any more are dropped from the journal.  Repair stops at the first
+// error; calling it again resumes where it left off.
+func (b *MirrorBucket) Repair() (repaired int, err error) {
+	if b.journal == nil {
+		return 0, nil
+	}
+	replicas := make(map[string]Bucket)
+	for _, r := range b.replicas {
+		replicas[r.Name] = r.Bucket
+	}
+
+	for _, w := range b.journal.Entries() {
+		if !strings.HasPrefix(w.Key, b.prefix) {
+			continue
+		}
+		key := w.Key[len(b.prefix):]
+		dst, ok := replicas[w.Replica]
+		if !ok {
+			// The replica is not part of this mirror any more.
+			continue
+		}
+
+		// A copy written after the write was missed, for example by a
+		// Repair that was interrupted before it updated the journal,
+		// is up to date, so there is nothing to copy.  This relies on
+		// the clocks of the replica and this machine roughly agreeing.
+		if info, err := dst.Stat(key); err == nil && info.ModTime.After(w.Time) {
+			if err := b.journal.Remove(w.Replica, w.Key); err != nil {
+				return repaired, err
+			}
+			continue
+		}
+
+		var data []byte
+		found := false
+		for _, r := range b.replicas {
+			if r.Name == w.Replica || b.journal.Missed(r.Name, w.Key) {
+				continue
+			}
+			data, err = r.Bucket.Get(key)
+			if err == nil {
+				found = true
+				break
+			}
+			if !IsNotExist(err) {
+				return repaired, fmt.Errorf("%s: Get(%q): %s", r.Name, key, err)
+			}
+		}
+		if found {
+			if err := dst.Put(key, data); err != nil {
+				return repaired, fmt.Errorf("%s: Put(%q): %s", w.Replica, key, err)
+			}
+			repaired++
+		}
+		if err := b.journal.Remove(w.Replica, w.Key); err != nil {
+			return repaired, err
+		}
+	}
+	return repaired, nil
+}
+
+// MissedWrite is a journal entry for a key that a replica does not have.
+type MissedWrite struct {
+	Replica string
+	Key     string
+	Time    time.Time
+	Error   string
+}
+
+// Journal is a local record of missed writes, stored as a JSON file.
+// It is safe for concurrent use, also by several processes sharing the
+// file: each change is merged into the file under a file lock.
+type Journal struct {
+	path string
+
+	mu      sync.Mutex
+	entries []MissedWrite
+}
+
+// OpenJournal reads the journal at path, or returns an empty journal if
+// the file does not exist yet.
+func OpenJournal(path string) (*Journal, error) {
+	j := &Journal{path: path}
+	unlock, err := j.lock(syscall.LOCK_SH)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	if err := j.load(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// Entries returns a copy of the journal entries, oldest first.
+func (j *Journal) Entries() []MissedWrite {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.reload()
+	return append([]MissedWrite(nil), j.entries...)
+}
+
+func (j *Journal) Missed(replica, key string) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.reload()
+	for _, w := range j.entries {
+		if w.Replica == replica && w.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+func (j *Journal) Add(replica, key string, cause error) error {
+	return j.update(func() bool {
+		for i, w := range j.entries {
+			if w.Replica == replica && w.Key == key {
+				j.entries[i].Time = time.Now()
+				j.entries[i].Error = cause.Error()
+				return true
+			}
+		}
+		j.entries = append(j.entries, MissedWrite{
+			Replica: replica,
+			Key:     key,
+			Time:    time.Now(),
+			Error:   cause.Error(),
+		})
+		return true
+	})
+}
+
+func (j *Journal) Remove(replica, key string) error {
+	return j.remove(func(w MissedWrite) bool {
+		return w.Replica == replica && w.Key == key
+	})
+}
+
+func (j *Journal) RemovePrefix(replica, prefix string) error {
+	return j.remove(func(w MissedWrite) bool {
+		return w.Replica == replica && strings.HasPrefix(w.Key, prefix)
+	})
+}
+
+func (j *Journal) remove(match func(MissedWrite) bool) error {
+	return j.update(func() bool {
+		kept := j.entries[:0]
+		for _, w := range j.entries {
+			if !match(w) {
+				kept = append(kept, w)
+			}
+		}
+		if len(kept) == len(j.entries) {
+			return false
+		}
+		j.entries = kept
+		return true
+	})
+}
+
+// update applies change to the entries in the file, which another
+// process may have changed since they were read, and saves them if
+// change reports that it changed them.
+func (j *Journal) update(change func() bool) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	unlock, err := j.lock(syscall.LOCK_EX)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := j.load(); err != nil {
+		return err
+	}
+	if !change() {
+		return nil
+	}
+	return j.save()
+}
+
+// lock takes a file lock next to the journal, shared or exclusive
+// according to how, and returns a function that releases it.
+func (j *Journal) lock(how int) (func(), error) {
+	if err := os.MkdirAll(filepath.Dir(j.path), 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(j.path+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), how); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("flock %s: %s", f.Name(), err)
+	}
+	// Closing the file releases the lock.
+	return func() { f.Close() }, nil
+}
+
+// load reads the entries from the journal file.  The file lock must be
+// held.
+func (j *Journal) load() error {
+	data, err := ioutil.ReadFile(j.path)
+	if os.IsNotExist(err) {
+		j.entries = nil
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var entries []MissedWrite
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("json decoding error: %s: %s", j.path, err)
+	}
+	j.entries = entries
+	return nil
+}
+
+// reload picks up the changes of other processes.  If the file can not
+// be read, the entries read last are kept.
+func (j *Journal) reload() {
+	unlock, err := j.lock(syscall.LOCK_SH)
+	if err != nil {
+		return
+	}
+	defer unlock()
+	entries := j.entries
+	if err := j.load(); err != nil {
+		j.entries = entries
+	}
+}
+
+// save writes the journal to a temporary file and renames it, so the
+// journal is never left half written.  The file lock must be held.
+func (j *Journal) save() error {
+	data, err := json.MarshalIndent(j.entries, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(j.path), filepath.Base(j.path)+".tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), j.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
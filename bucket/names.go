@@ -0,0 +1,114 @@
+package bucket
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/nacl/secretbox"
+
+	"github.com/davidlazar/go-crypto/encoding/base32"
+	"github.com/davidlazar/go-crypto/secretkey"
+)
+
+// nameCipher encrypts key and child names deterministically, so that a
+// name can be found without an index, and a listing can be decrypted.
+// The nonce is a MAC of the name, which makes this an SIV-style scheme:
+// equal names encrypt equally, and nothing else is revealed except the
+// padded length of the name.
+type nameCipher struct {
+	nonceKey []byte
+	boxKey   [32]byte
+}
+
+const namePadding = 16
+
+func newNameCipher(key *secretkey.Key) *nameCipher {
+	c := &nameCipher{
+		nonceKey: hmacSum(key[:], "kebab name nonce"),
+	}
+	copy(c.boxKey[:], hmacSum(key[:], "kebab name box"))
+	return c
+}
+
+func hmacSum(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func (c *nameCipher) nonce(name string) *[24]byte {
+	var nonce [24]byte
+	copy(nonce[:], hmacSum(c.nonceKey, name))
+	return &nonce
+}
+
+func (c *nameCipher) encrypt(name string) string {
+	// Pad with 0x80 followed by zeros to a multiple of namePadding.
+	n := (len(name)/namePadding + 1) * namePadding
+	padded := make([]byte, n)
+	copy(padded, name)
+	padded[len(name)] = 0x80
+
+	nonce := c.nonce(name)
+	box := secretbox.Seal(nonce[:], padded, nonce, &c.boxKey)
+	return base32.EncodeToString(box)
+}
+
+var errBadName = errors.New("not an encrypted name")
+
+func (c *nameCipher) decrypt(s string) (string, error) {
+	box, err := base32.DecodeString(s)
+	if err != nil || len(box) < 24+secretbox.Overhead {
+		return "", errBadName
+	}
+	var nonce [24]byte
+	copy(nonce[:], box[0:24])
+	padded, ok := secretbox.Open(nil, box[24:], &nonce, &c.boxKey)
+	if !ok {
+		return "", errBadName
+	}
+	i := bytes.LastIndexByte(padded, 0x80)
+	if i < 0 || len(padded)-i > namePadding {
+		return "", errBadName
+	}
+	name := string(padded[:i])
+	if *c.nonce(name) != nonce {
+		return "", errBadName
+	}
+	return name, nil
+}
+
+// MaxNameLen is the length of the longest name whose encryption, 218
+// bytes, fits in 255 bytes, the longest file name on most file systems,
+// with room for the temporary file names of file buckets.
+const MaxNameLen = 95
+
+// NameTooLongError is the error for a name that is too long to be
+// encrypted.
+type NameTooLongError struct {
+	Name string
+}
+
+func (e *NameTooLongError) Error() string {
+	return fmt.Sprintf("name %q is %d bytes long, but hidden names can be at most %d bytes", e.Name, len(e.Name), MaxNameLen)
+}
+
+// encryptPath encrypts each "/" separated component of key.  Components
+// longer than MaxNameLen are an error, but are still encrypted.
+func (c *nameCipher) encryptPath(key string) (string, error) {
+	var err error
+	parts := strings.Split(key, "/")
+	for i, p := range parts {
+		if len(p) > MaxNameLen && err == nil {
+			err = &NameTooLongError{Name: p}
+		}
+		if p != "" {
+			parts[i] = c.encrypt(p)
+		}
+	}
+	return strings.Join(parts, "/"), err
+}
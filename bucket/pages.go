@@ -0,0 +1,84 @@
+package bucket
+
+import (
+	"io"
+)
+
+// PageIterator lists a bucket one page at a time, so that a bucket with
+// very many keys or children can be listed without holding every name
+// in memory.
+type PageIterator interface {
+	// Next returns the next page of keys and children, which may be
+	// empty.  It returns io.EOF after the last page.
+	Next() (keys, children []string, err error)
+}
+
+// PagedBucket is implemented by buckets that can list in pages.
+type PagedBucket interface {
+	Bucket
+	ListPages() PageIterator
+}
+
+// ListPages returns an iterator over the listing of b.  Buckets that
+// do not list in pages are listed at once and returned as one page.
+func ListPages(b Bucket) PageIterator {
+	if pb, ok := b.(PagedBucket); ok {
+		return pb.ListPages()
+	}
+	return &pageIterator{
+		next: func(string) (keys, children []string, next string, err error) {
+			keys, children, err = b.List()
+			return keys, children, "", err
+		},
+	}
+}
+
+// listAll collects every page of it, for List methods of paged buckets.
+func listAll(it PageIterator) (keys, children []string, err error) {
+	for {
+		ks, cs, err := it.Next()
+		if err == io.EOF {
+			return keys, children, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		keys = append(keys, ks...)
+		children = append(children, cs...)
+	}
+}
+
+// pageIterator calls next with the token returned by the previous call
+// (initially "") until it returns an empty token.
+type pageIterator struct {
+	next  func(token string) (keys, children []string, next string, err error)
+	token string
+	done  bool
+}
+
+func (it *pageIterator) Next() (keys, children []string, err error) {
+	if it.done {
+		return nil, nil, io.EOF
+	}
+	keys, children, next, err := it.next(it.token)
+	if err != nil {
+		return nil, nil, err
+	}
+	it.token = next
+	it.done = next == ""
+	return keys, children, nil
+}
+
+// mapPages applies f to the keys and children of every page of it.
+type mapPages struct {
+	it PageIterator
+	f  func([]string) []string
+}
+
+func (m *mapPages) Next() (keys, children []string, err error) {
+	keys, children, err = m.it.Next()
+	if err != nil {
+		return nil, nil, err
+	}
+	return m.f(keys), m.f(children), nil
+}
@@ -0,0 +1,273 @@
+package bucket
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// Schedule is a transfer rate that depends on the time of day.
+type Schedule struct {
+	Rate    int64 // bytes per second outside the windows, 0 for unlimited
+	Windows []Window
+}
+
+// Window is a daily period with its own rate.  Start and End are times
+// of day in local time; a window whose End is before its Start wraps
+// around midnight.  Earlier windows take precedence over later ones.
+type Window struct {
+	Start, End time.Duration
+	Rate       int64 // bytes per second, 0 for unlimited
+}
+
+// RateAt returns the rate at time t, or 0 if it is unlimited.
+func (s *Schedule) RateAt(t time.Time) int64 {
+	t = t.Local()
+	y, m, d := t.Date()
+	tod := t.Sub(time.Date(y, m, d, 0, 0, 0, 0, t.Location()))
+	for _, w := range s.Windows {
+		if w.contains(tod) {
+			return w.Rate
+		}
+	}
+	return s.Rate
+}
+
+func (w *Window) contains(tod time.Duration) bool {
+	if w.Start <= w.End {
+		return tod >= w.Start && tod < w.End
+	}
+	return tod >= w.Start || tod < w.End
+}
+
+// maxLimiterSleep bounds how long a Limiter sleeps before it looks at
+// the schedule again, so that a faster window takes effect promptly.
+const maxLimiterSleep = time.Minute
+
+// Limiter is a token bucket that limits a number of bytes per second
+// according to a schedule.  It allows a burst of one second's worth of
+// bytes.  Values are transferred whole, so a transfer larger than the
+// burst is let through and the transfers after it wait until the
+// average rate is back within the limit.  It is safe for concurrent
+// use; waiters are served one at a time.
+type Limiter struct {
+	schedule Schedule
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func NewLimiter(s Schedule) *Limiter {
+	return &Limiter{schedule: s}
+}
+
+// Wait blocks until n bytes may be transferred, or until ctx is done.
+func (l *Limiter) Wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		now := time.Now()
+		rate := float64(l.schedule.RateAt(now))
+		if rate == 0 {
+			l.tokens = 0
+			l.last = now
+			return nil
+		}
+		if !l.last.IsZero() {
+			l.tokens += now.Sub(l.last).Seconds() * rate
+		} else {
+			l.tokens = rate
+		}
+		if l.tokens > rate {
+			l.tokens = rate
+		}
+		l.last = now
+		if l.tokens >= 0 {
+			l.tokens -= float64(n)
+			return nil
+		}
+		d := time.Duration(-l.tokens / rate * float64(time.Second))
+		if d > maxLimiterSleep {
+			d = maxLimiterSleep
+		}
+		t := time.NewTimer(d)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+		}
+	}
+}
+
+type rateLimitedBucket struct {
+	bucket Bucket
+	up     *Limiter
+	down   *Limiter
+	ctx    context.Context
+}
+
+// NewRateLimitedBucket limits the bytes written to b with up and the
+// bytes read from b with down.  Either limiter may be nil.  Buckets
+// returned by Descend share the limiters, so a limiter can be shared
+// by every bucket of a process.
+func NewRateLimitedBucket(b Bucket, up, down *Limiter) Bucket {
+	return &rateLimitedBucket{
+		bucket: b,
+		up:     up,
+		down:   down,
+	}
+}
+
+func (b *rateLimitedBucket) Abs(key string) string {
+	return b.bucket.Abs(key)
+}
+
+func (b *rateLimitedBucket) Put(key string, data []byte) error {
+	if b.up != nil {
+		if err := b.up.Wait(contextOrBackground(b.ctx), len(data)); err != nil {
+			return err
+		}
+	}
+	return b.bucket.Put(key, data)
+}
+
+// Get charges the download limiter after the fact, since the size of
+// the value is not known in advance.
+func (b *rateLimitedBucket) Get(key string) ([]byte, error) {
+	data, err := b.bucket.Get(key)
+	if err == nil && b.down != nil {
+		if err := b.down.Wait(contextOrBackground(b.ctx), len(data)); err != nil {
+			return nil, err
+		}
+	}
+	return data, err
+}
+
+// PutStream charges the upload limiter for each read of r, after the
+// fact, so that a stream is sent at the limited rate.  A backend may
+// read a seekable stream more than once, as S3 does to hash it before
+// the upload, so each byte of the stream is charged only once.
+func (b *rateLimitedBucket) PutStream(key string, r io.Reader) error {
+	sb := Stream(b.bucket)
+	if b.up == nil {
+		return sb.PutStream(key, r)
+	}
+	lr := &limitedReader{ctx: contextOrBackground(b.ctx), l: b.up, r: r}
+	if s, ok := r.(io.Seeker); ok {
+		pos, err := s.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		return sb.PutStream(key, &limitedSeeker{limitedReader: lr, s: s, pos: pos, charged: pos})
+	}
+	return sb.PutStream(key, lr)
+}
+
+func (b *rateLimitedBucket) GetStream(key string) (io.ReadCloser, error) {
+	rc, err := Stream(b.bucket).GetStream(key)
+	if err != nil || b.down == nil {
+		return rc, err
+	}
+	return readCloser{&limitedReader{ctx: contextOrBackground(b.ctx), l: b.down, r: rc}, rc}, nil
+}
+
+// limitedReader charges l for the bytes read from r.
+type limitedReader struct {
+	ctx context.Context
+	l   *Limiter
+	r   io.Reader
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if werr := r.l.Wait(r.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// limitedSeeker is a limitedReader over a seekable stream that
+// charges only for bytes past the furthest point read so far, so that
+// reading the stream again after a Seek is free.
+type limitedSeeker struct {
+	*limitedReader
+	s       io.Seeker
+	pos     int64
+	charged int64
+}
+
+func (r *limitedSeeker) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.pos += int64(n)
+	if r.pos > r.charged {
+		fresh := r.pos - r.charged
+		if fresh > int64(n) {
+			fresh = int64(n)
+		}
+		r.charged = r.pos
+		if werr := r.l.Wait(r.ctx, int(fresh)); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+func (r *limitedSeeker) Seek(offset int64, whence int) (int64, error) {
+	pos, err := r.s.Seek(offset, whence)
+	if err == nil {
+		r.pos = pos
+	}
+	return pos, err
+}
+
+func (b *rateLimitedBucket) Stat(key string) (*Info, error) {
+	return b.bucket.Stat(key)
+}
+
+func (b *rateLimitedBucket) Delete(key string) error {
+	return b.bucket.Delete(key)
+}
+
+func (b *rateLimitedBucket) List() (keys, children []string, err error) {
+	return b.bucket.List()
+}
+
+func (b *rateLimitedBucket) ListPages() PageIterator {
+	return ListPages(b.bucket)
+}
+
+func (b *rateLimitedBucket) Descend(child string) (Bucket, error) {
+	bb, err := b.bucket.Descend(child)
+	if err != nil {
+		return nil, err
+	}
+	return &rateLimitedBucket{bucket: bb, up: b.up, down: b.down, ctx: b.ctx}, nil
+}
+
+func (b *rateLimitedBucket) WithContext(ctx context.Context) Bucket {
+	return &rateLimitedBucket{
+		bucket: WithContext(ctx, b.bucket),
+		up:     b.up,
+		down:   b.down,
+		ctx:    ctx,
+	}
+}
+
+func (b *rateLimitedBucket) Replicas() []Bucket {
+	rs := Replicas(b.bucket)
+	for i, rb := range rs {
+		rs[i] = &rateLimitedBucket{bucket: rb, up: b.up, down: b.down, ctx: b.ctx}
+	}
+	return rs
+}
+
+func (b *rateLimitedBucket) Destroy() error {
+	return b.bucket.Destroy()
+}
@@ -2,32 +2,37 @@ package bucket
 
 import (
 	"bufio"
+	"context"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"sync"
 	"time"
-)
 
-func isRecoverable(err error) bool {
-	if IsNotExist(err) {
-		return false
-	}
-	if err == ErrAuth {
-		return false
-	}
-	return true
-}
+	"golang.org/x/crypto/ssh/terminal"
+)
 
 type recoverableBucket struct {
 	bucket Bucket
 	log    *PromptLogger
+	policy RetryPolicy
+	ctx    context.Context
 }
 
+// NewRecoverableBucket returns a bucket that retries failed operations
+// on b with DefaultRetryPolicy, logging to log.
 func NewRecoverableBucket(b Bucket, log *PromptLogger) Bucket {
+	return NewRecoverableBucketWithPolicy(b, log, DefaultRetryPolicy)
+}
+
+// NewRecoverableBucketWithPolicy is like NewRecoverableBucket, but
+// retries with the given policy.
+func NewRecoverableBucketWithPolicy(b Bucket, log *PromptLogger, policy RetryPolicy) Bucket {
 	return &recoverableBucket{
 		bucket: b,
 		log:    log,
+		policy: policy,
 	}
 }
 
@@ -35,57 +40,138 @@ func (b *recoverableBucket) Abs(key string) string {
 	return b.bucket.Abs(key)
 }
 
-func (b *recoverableBucket) Put(key string, data []byte) error {
-	for {
-		if err := b.bucket.Put(key, data); err == nil {
+// wrap returns a recoverable bucket over bb with the settings of b.
+func (b *recoverableBucket) wrap(bb Bucket) *recoverableBucket {
+	return &recoverableBucket{bucket: bb, log: b.log, policy: b.policy, ctx: b.ctx}
+}
+
+// sleep waits before retrying, unless the context is done first.
+func (b *recoverableBucket) sleep(d time.Duration) error {
+	ctx := contextOrBackground(b.ctx)
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// done reports whether the context is done, in which case there is no
+// point in retrying.
+func (b *recoverableBucket) done() bool {
+	return b.ctx != nil && b.ctx.Err() != nil
+}
+
+// retry calls f until it succeeds, following the policy: errors that
+// are not retryable are returned as they are, and other errors once
+// the attempts are used up and the user, if asked, does not want to
+// go on.  If rewind is not nil, it is called before every retry, and
+// the operation is given up if it fails.
+func (b *recoverableBucket) retry(op, key string, rewind func() error, f func() error) error {
+	for failed := 1; ; failed++ {
+		err := f()
+		if err == nil {
 			return nil
-		} else {
-			b.log.Printf("Put(%q) failed: %s\n... Retrying in 5 seconds.", key, err)
-			time.Sleep(5 * time.Second)
+		} else if !b.policy.retryable(err) {
+			return err
+		} else if b.done() {
+			return fmt.Errorf("%s(%q): %s", op, key, err)
 		}
 
-		if err := b.bucket.Put(key, data); err == nil {
-			return nil
+		if failed >= b.policy.MaxAttempts {
+			if b.policy.Mode != RetryInteractive || !b.log.Retry("%s(%q) failed: %s", op, key, err) {
+				return fmt.Errorf("%s(%q): %s", op, key, err)
+			}
+			// Start over with the full number of attempts.
+			failed = 0
 		} else {
-			if !b.log.Retry("Put(%q) failed: %s", key, err) {
-				return fmt.Errorf("Put(%q): %s", key, err)
+			d := b.policy.wait(failed)
+			b.log.Printf("%s(%q) failed: %s\n... Retrying in %s.", op, key, err, d.Round(100*time.Millisecond))
+			if serr := b.sleep(d); serr != nil {
+				return fmt.Errorf("%s(%q): %s", op, key, err)
 			}
 		}
+		if rewind != nil && rewind() != nil {
+			return fmt.Errorf("%s(%q): %s", op, key, err)
+		}
 	}
 }
 
+func (b *recoverableBucket) Put(key string, data []byte) error {
+	return b.retry("Put", key, nil, func() error {
+		return b.bucket.Put(key, data)
+	})
+}
+
 // TODO don't try to recover if key is a directory
 func (b *recoverableBucket) Get(key string) ([]byte, error) {
-	for {
-		if data, err := b.bucket.Get(key); err == nil {
-			return data, nil
-		} else if !isRecoverable(err) {
-			return nil, err
-		} else {
-			b.log.Printf("Get(%q) failed: %s\n... Retrying in 5 seconds.", key, err)
-			time.Sleep(5 * time.Second)
-		}
+	var data []byte
+	err := b.retry("Get", key, nil, func() (err error) {
+		data, err = b.bucket.Get(key)
+		return err
+	})
+	return data, err
+}
 
-		if data, err := b.bucket.Get(key); err == nil {
-			return data, nil
-		} else {
-			if !b.log.Retry("Get(%q) failed: %s", key, err) {
-				return nil, fmt.Errorf("Get(%q): %s", key, err)
-			}
+func (b *recoverableBucket) Stat(key string) (*Info, error) {
+	var info *Info
+	err := b.retry("Stat", key, nil, func() (err error) {
+		info, err = b.bucket.Stat(key)
+		return err
+	})
+	return info, err
+}
+
+func (b *recoverableBucket) Delete(key string) error {
+	return b.retry("Delete", key, nil, func() error {
+		return b.bucket.Delete(key)
+	})
+}
+
+// PutStream retries like Put if r is an io.Seeker, by seeking back to
+// where it started.  Other readers can not be retried.
+func (b *recoverableBucket) PutStream(key string, r io.Reader) error {
+	sb := Stream(b.bucket)
+	rewind := rewinder(r)
+	if rewind == nil {
+		if err := sb.PutStream(key, r); err != nil {
+			return fmt.Errorf("Put(%q): %s", key, err)
 		}
+		return nil
 	}
+	return b.retry("Put", key, rewind, func() error {
+		return sb.PutStream(key, r)
+	})
+}
+
+// GetStream retries like Get until the stream is opened.  Errors while
+// reading the stream are not retried.
+func (b *recoverableBucket) GetStream(key string) (io.ReadCloser, error) {
+	sb := Stream(b.bucket)
+	var rc io.ReadCloser
+	err := b.retry("Get", key, nil, func() (err error) {
+		rc, err = sb.GetStream(key)
+		return err
+	})
+	return rc, err
 }
 
 func (b *recoverableBucket) List() (keys, children []string, err error) {
 	return b.bucket.List()
 }
 
+func (b *recoverableBucket) ListPages() PageIterator {
+	return ListPages(b.bucket)
+}
+
 func (b *recoverableBucket) Descend(child string) (Bucket, error) {
 	bb, err := b.bucket.Descend(child)
 	if err != nil {
 		return nil, err
 	}
-	return NewRecoverableBucket(bb, b.log), nil
+	return b.wrap(bb), nil
 }
 
 // TODO add recovery?
@@ -93,6 +179,31 @@ func (b *recoverableBucket) Destroy() error {
 	return b.bucket.Destroy()
 }
 
+func (b *recoverableBucket) Uncached() Bucket {
+	bb := uncachedOrNil(b.bucket)
+	if bb == nil {
+		return nil
+	}
+	return b.wrap(bb)
+}
+
+func (b *recoverableBucket) Replicas() []Bucket {
+	rs := Replicas(b.bucket)
+	for i, rb := range rs {
+		rs[i] = b.wrap(rb)
+	}
+	return rs
+}
+
+func (b *recoverableBucket) WithContext(ctx context.Context) Bucket {
+	return &recoverableBucket{
+		bucket: WithContext(ctx, b.bucket),
+		log:    b.log,
+		policy: b.policy,
+		ctx:    ctx,
+	}
+}
+
 type PromptLogger struct {
 	mu     sync.Mutex
 	Logger *log.Logger
@@ -108,10 +219,15 @@ func (l *PromptLogger) Printf(format string, v ...interface{}) {
 	l.output(fmt.Sprintf(format, v...))
 }
 
+// Retry logs a failure and asks the user whether to retry, if stdin is
+// a terminal.  Otherwise there is no one to ask, and it returns false.
 func (l *PromptLogger) Retry(format string, v ...interface{}) bool {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 	l.Logger.Printf(format, v...)
+	if !terminal.IsTerminal(int(os.Stdin.Fd())) {
+		return false
+	}
 
 	fmt.Fprintf(os.Stderr, "--> Retry? [Y/n]: ")
 	buf := bufio.NewReader(os.Stdin)
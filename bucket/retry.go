@@ -0,0 +1,132 @@
+package bucket
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/davidlazar/kebab/azure"
+	"github.com/davidlazar/kebab/gcs"
+	"github.com/davidlazar/kebab/s3"
+)
+
+// RetryMode says what a recoverable bucket does once the attempts of
+// its RetryPolicy are used up.
+type RetryMode int
+
+const (
+	// RetryInteractive asks whether to keep retrying, if stdin is a
+	// terminal, and gives up otherwise.
+	RetryInteractive RetryMode = iota
+
+	// RetryNonInteractive gives up, for cron jobs and scripts.
+	RetryNonInteractive
+
+	// RetryFailFast does not retry at all.
+	RetryFailFast
+)
+
+// A RetryPolicy says which failed operations a recoverable bucket
+// retries, how many times and how long it waits in between.
+type RetryPolicy struct {
+	// MaxAttempts is the number of attempts, including the first,
+	// before giving up or asking.  Zero means one.
+	MaxAttempts int
+
+	// The wait before the first retry is Backoff, and it doubles
+	// after every retry up to MaxBackoff.  Each wait is shortened by
+	// a random fraction of up to Jitter, between 0 and 1, so that
+	// clients that failed together do not retry together.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	Jitter     float64
+
+	Mode RetryMode
+
+	// Retryable reports whether an error may go away on retrying.  If
+	// nil, IsRetryable is used.
+	Retryable func(error) bool
+}
+
+// DefaultRetryPolicy is the policy of NewRecoverableBucket: five
+// attempts over about 15 seconds, and then ask.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 5,
+	Backoff:     time.Second,
+	MaxBackoff:  time.Minute,
+	Jitter:      0.5,
+	Mode:        RetryInteractive,
+}
+
+func (p *RetryPolicy) retryable(err error) bool {
+	if p.Mode == RetryFailFast {
+		return false
+	}
+	if p.Retryable != nil {
+		return p.Retryable(err)
+	}
+	return IsRetryable(err)
+}
+
+// wait returns how long to wait before the next attempt, after the
+// given number of failed attempts.
+func (p *RetryPolicy) wait(failed int) time.Duration {
+	d := p.Backoff
+	for i := 1; i < failed && (p.MaxBackoff <= 0 || d < p.MaxBackoff); i++ {
+		d *= 2
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	if p.Jitter > 0 {
+		d -= time.Duration(rand.Float64() * p.Jitter * float64(d))
+	}
+	return d
+}
+
+// IsRetryable reports whether err may go away if the operation is
+// retried.  Throttling, server errors and network errors may, while
+// missing keys, integrity failures, names that are too long and client
+// errors, such as failed authentication, will not.  Other errors are
+// assumed to be transient, except for permission errors and existing
+// files.
+func IsRetryable(err error) bool {
+	if err == nil || IsNotExist(err) || err == ErrAuth {
+		return false
+	}
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return false
+	}
+	switch e := err.(type) {
+	case *s3.ServiceError:
+		if e.StatusCode == 0 {
+			return s3RetryCodes[e.Code]
+		}
+		return retryableStatus(e.StatusCode)
+	case *azure.Error:
+		return retryableStatus(e.StatusCode)
+	case *gcs.Error:
+		return retryableStatus(e.Code)
+	case *WebDAVError:
+		return retryableStatus(e.StatusCode)
+	case *NameTooLongError:
+		return false
+	}
+	return !os.IsPermission(err) && !os.IsExist(err)
+}
+
+// s3RetryCodes are the transient S3 error codes, for errors without a
+// status code.
+var s3RetryCodes = map[string]bool{
+	"InternalError":      true,
+	"RequestTimeout":     true,
+	"ServiceUnavailable": true,
+	"SlowDown":           true,
+	"Throttling":         true,
+}
+
+func retryableStatus(code int) bool {
+	return code == http.StatusRequestTimeout || code == http.StatusTooManyRequests || code >= 500
+}
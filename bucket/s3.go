@@ -1,7 +1,11 @@
 package bucket
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
 	"strings"
 
 	"github.com/davidlazar/kebab/s3"
@@ -12,6 +16,29 @@ type s3Bucket struct {
 	prefix string
 }
 
+func init() {
+	Register("s3", openS3URL)
+}
+
+// openS3URL opens a location of the form s3://name/prefix?config=<file>,
+// where the config file describes the service as for NewS3BucketFromFile
+// and need not name a bucket.
+func openS3URL(u *url.URL) (Bucket, error) {
+	config, err := configParam(u)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("missing bucket name")
+	}
+	s3b, err := s3.NewBucketFromFile(config)
+	if err != nil {
+		return nil, err
+	}
+	s3b.Name = u.Host
+	return DescendPath(NewS3Bucket(s3b), u.Path)
+}
+
 func NewS3Bucket(b *s3.Bucket) Bucket {
 	return &s3Bucket{bucket: b}
 }
@@ -24,6 +51,10 @@ func NewS3BucketFromFile(path string) (Bucket, error) {
 	return NewS3Bucket(s3b), nil
 }
 
+func (b *s3Bucket) WithContext(ctx context.Context) Bucket {
+	return &s3Bucket{bucket: b.bucket.WithContext(ctx), prefix: b.prefix}
+}
+
 func (b *s3Bucket) Abs(key string) string {
 	return b.prefix + key
 }
@@ -36,23 +67,62 @@ func (b *s3Bucket) Get(key string) ([]byte, error) {
 	return b.bucket.Get(b.Abs(key))
 }
 
-func (b *s3Bucket) List() (keys []string, children []string, err error) {
-	list, err := b.bucket.List(b.prefix, "/")
+func (b *s3Bucket) Stat(key string) (*Info, error) {
+	info, err := b.bucket.Head(b.Abs(key))
 	if err != nil {
-		return nil, nil, fmt.Errorf("List(%q, %q): %s", b.prefix, "/", err)
-	}
-	if list.IsTruncated {
-		err = fmt.Errorf("List(%q, %q): results truncated", b.prefix, "/")
+		return nil, err
 	}
+	return &Info{Size: info.Size, ModTime: info.LastModified}, nil
+}
+
+func (b *s3Bucket) Delete(key string) error {
+	return b.bucket.DeleteObject(b.Abs(key))
+}
 
-	for _, k := range list.Contents {
-		keys = append(keys, strings.TrimPrefix(k, b.prefix))
+// PutStream streams r to S3 if it is an io.ReadSeeker, since S3 needs
+// the size and hash of the value before it is sent, and reads it into
+// memory otherwise.
+func (b *s3Bucket) PutStream(key string, r io.Reader) error {
+	if rs, ok := r.(io.ReadSeeker); ok {
+		return b.bucket.PutReader(b.Abs(key), rs)
 	}
-	for _, d := range list.CommonPrefixes {
-		children = append(children, strings.TrimPrefix(strings.TrimSuffix(d, "/"), b.prefix))
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
 	}
+	return b.Put(key, data)
+}
+
+func (b *s3Bucket) GetStream(key string) (io.ReadCloser, error) {
+	return b.bucket.GetReader(b.Abs(key))
+}
 
-	return
+func (b *s3Bucket) List() (keys []string, children []string, err error) {
+	return listAll(b.ListPages())
+}
+
+func (b *s3Bucket) ListPages() PageIterator {
+	return &pageIterator{
+		next: func(token string) (keys, children []string, next string, err error) {
+			list, err := b.bucket.ListPage(b.prefix, "/", token)
+			if err != nil {
+				return nil, nil, "", fmt.Errorf("List(%q, %q): %s", b.prefix, "/", err)
+			}
+			for _, k := range list.Contents {
+				keys = append(keys, strings.TrimPrefix(k, b.prefix))
+			}
+			for _, d := range list.CommonPrefixes {
+				children = append(children, strings.TrimPrefix(strings.TrimSuffix(d, "/"), b.prefix))
+			}
+			if list.IsTruncated {
+				if list.NextContinuationToken == "" {
+					return nil, nil, "", fmt.Errorf("List(%q, %q): truncated list without a continuation token", b.prefix, "/")
+				}
+				next = list.NextContinuationToken
+			}
+			return keys, children, next, nil
+		},
+	}
 }
 
 func (b *s3Bucket) Descend(child string) (Bucket, error) {
@@ -65,22 +135,35 @@ func (b *s3Bucket) Descend(child string) (Bucket, error) {
 	}, nil
 }
 
+// Destroy deletes the keys one page at a time, in batches of at most
+// s3.MaxDeleteKeys.
 func (b *s3Bucket) Destroy() error {
+	token := ""
 	for {
-		list, err := b.bucket.List(b.prefix, "")
+		list, err := b.bucket.ListPage(b.prefix, "", token)
 		if err != nil {
 			return fmt.Errorf("List(%q, %q): %s", b.prefix, "", err)
 		}
-		if len(list.Contents) == 0 {
-			return nil
+		for keys := list.Contents; len(keys) > 0; {
+			n := len(keys)
+			if n > s3.MaxDeleteKeys {
+				n = s3.MaxDeleteKeys
+			}
+			del, err := b.bucket.Delete(keys[:n])
+			if err != nil {
+				return fmt.Errorf("Delete(%q, ...): %s", keys[0], err)
+			}
+			if err = del.GetError(); err != nil {
+				return err
+			}
+			keys = keys[n:]
 		}
-
-		del, err := b.bucket.Delete(list.Contents)
-		if err != nil {
-			return fmt.Errorf("Delete(%q, ...): %s", list.Contents[0], err)
+		if !list.IsTruncated {
+			return nil
 		}
-		if err = del.GetError(); err != nil {
-			return err
+		if list.NextContinuationToken == "" {
+			return fmt.Errorf("List(%q, %q): truncated list without a continuation token", b.prefix, "")
 		}
+		token = list.NextContinuationToken
 	}
 }
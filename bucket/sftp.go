@@ -0,0 +1,238 @@
+package bucket
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+type sftpBucket struct {
+	client *sftp.Client
+	root   string
+}
+
+func init() {
+	Register("sftp", NewSFTPBucketFromURL)
+}
+
+func NewSFTPBucket(client *sftp.Client, root string) Bucket {
+	return &sftpBucket{client: client, root: root}
+}
+
+// NewSFTPBucketFromURL connects to the server in a URL of the form
+//
+//	sftp://[user@]host[:port]/path[?identity=<file>&known_hosts=<file>]
+//
+// The path is relative to the login directory if it starts with /~/.
+// The server's host key must be in known_hosts, which defaults to
+// ~/.ssh/known_hosts.  Authentication uses the ssh agent, if any, and
+// the given identity file or else the default ~/.ssh identities.
+func NewSFTPBucketFromURL(u *url.URL) (Bucket, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+
+	query := u.Query()
+	knownHosts := query["known_hosts"]
+	if len(knownHosts) == 0 {
+		knownHosts = []string{filepath.Join(home, ".ssh", "known_hosts")}
+	}
+	hostKeyCallback, err := knownhosts.New(knownHosts...)
+	if err != nil {
+		return nil, fmt.Errorf("knownhosts.New: %s", err)
+	}
+
+	var auth []ssh.AuthMethod
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		if conn, err := net.Dial("unix", sock); err == nil {
+			auth = append(auth, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		}
+	}
+	identities := query["identity"]
+	if len(identities) == 0 {
+		for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+			identities = append(identities, filepath.Join(home, ".ssh", name))
+		}
+	}
+	var signers []ssh.Signer
+	for _, id := range identities {
+		data, err := ioutil.ReadFile(id)
+		if os.IsNotExist(err) && len(query["identity"]) == 0 {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(data)
+		if _, ok := err.(*ssh.PassphraseMissingError); ok {
+			continue // hopefully in the agent
+		} else if err != nil {
+			return nil, fmt.Errorf("ssh.ParsePrivateKey(%q): %s", id, err)
+		}
+		signers = append(signers, signer)
+	}
+	if len(signers) > 0 {
+		auth = append(auth, ssh.PublicKeys(signers...))
+	}
+
+	user := u.User.Username()
+	if user == "" {
+		user = os.Getenv("USER")
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "22")
+	}
+
+	conn, err := ssh.Dial("tcp", host, &ssh.ClientConfig{
+		User:            user,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("ssh.Dial(%q): %s", host, err)
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("sftp.NewClient: %s", err)
+	}
+
+	root := u.Path
+	if len(root) >= 3 && root[0:3] == "/~/" {
+		root = root[3:]
+	}
+	return NewSFTPBucket(client, root), nil
+}
+
+func (b *sftpBucket) Abs(key string) string {
+	return path.Join(b.root, key)
+}
+
+func (b *sftpBucket) Put(key string, data []byte) error {
+	p := b.Abs(key)
+	if err := b.client.MkdirAll(path.Dir(p)); err != nil {
+		return err
+	}
+	f, err := b.client.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (b *sftpBucket) PutStream(key string, r io.Reader) error {
+	p := b.Abs(key)
+	if err := b.client.MkdirAll(path.Dir(p)); err != nil {
+		return err
+	}
+	f, err := b.client.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (b *sftpBucket) GetStream(key string) (io.ReadCloser, error) {
+	return b.client.Open(b.Abs(key))
+}
+
+func (b *sftpBucket) Get(key string) ([]byte, error) {
+	f, err := b.client.Open(b.Abs(key))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+func (b *sftpBucket) Stat(key string) (*Info, error) {
+	fi, err := b.client.Stat(b.Abs(key))
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return nil, &os.PathError{Op: "stat", Path: b.Abs(key), Err: os.ErrNotExist}
+	}
+	return &Info{Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+func (b *sftpBucket) Delete(key string) error {
+	if err := b.client.Remove(b.Abs(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (b *sftpBucket) List() (keys, children []string, err error) {
+	list, err := b.client.ReadDir(b.root)
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	} else if err != nil {
+		return
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name() < list[j].Name() })
+
+	for _, x := range list {
+		if x.IsDir() {
+			children = append(children, x.Name())
+		} else {
+			keys = append(keys, x.Name())
+		}
+	}
+
+	return
+}
+
+func (b *sftpBucket) Descend(child string) (Bucket, error) {
+	return NewSFTPBucket(b.client, b.Abs(child)), nil
+}
+
+func (b *sftpBucket) Destroy() error {
+	root := path.Clean(b.root)
+	if root == "." || path.Dir(root) == "/" {
+		return fmt.Errorf("refusing to destroy top-level directory %q", b.root)
+	}
+
+	// Remove files on the way down and directories on the way back up.
+	var dirs []string
+	walker := b.client.Walk(root)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			if os.IsNotExist(err) && walker.Path() == root {
+				return nil
+			}
+			return err
+		}
+		if walker.Stat().IsDir() {
+			dirs = append(dirs, walker.Path())
+		} else if err := b.client.Remove(walker.Path()); err != nil {
+			return fmt.Errorf("Remove(%q): %s", walker.Path(), err)
+		}
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := b.client.RemoveDirectory(dirs[i]); err != nil {
+			return fmt.Errorf("RemoveDirectory(%q): %s", dirs[i], err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package bucket
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+)
+
+// StreamBucket is implemented by buckets that can move values without
+// holding them in memory.  PutStream reads r until EOF.  The caller of
+// GetStream must close the returned reader; an error reading it means
+// the value could not be read in full.
+type StreamBucket interface {
+	Bucket
+	PutStream(key string, r io.Reader) error
+	GetStream(key string) (io.ReadCloser, error)
+}
+
+// Stream returns b as a StreamBucket.  Buckets that only move []byte
+// are adapted by reading values into memory.
+func Stream(b Bucket) StreamBucket {
+	if sb, ok := b.(StreamBucket); ok {
+		return sb
+	}
+	return streamAdapter{b}
+}
+
+type streamAdapter struct {
+	Bucket
+}
+
+func (b streamAdapter) PutStream(key string, r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return b.Put(key, data)
+}
+
+func (b streamAdapter) GetStream(key string) (io.ReadCloser, error) {
+	data, err := b.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// rewinder returns a function that seeks r back to its current
+// position, so that a failed PutStream can be retried, or nil if r is
+// not an io.Seeker.
+func rewinder(r io.Reader) func() error {
+	s, ok := r.(io.Seeker)
+	if !ok {
+		return nil
+	}
+	start, err := s.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil
+	}
+	return func() error {
+		_, err := s.Seek(start, io.SeekStart)
+		return err
+	}
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+type readSeeker struct {
+	io.Reader
+	io.Seeker
+}
+
+// seekThrough returns r, which reads from src, with the Seek method of
+// src, if any.  Wrappers of a stream use it so that the stream can
+// still be retried, or its size found, below them.
+func seekThrough(r, src io.Reader) io.Reader {
+	if s, ok := src.(io.Seeker); ok {
+		return readSeeker{r, s}
+	}
+	return r
+}
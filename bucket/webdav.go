@@ -0,0 +1,289 @@
+package bucket
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+)
+
+// WebDAVConfig describes a WebDAV collection, for example a Nextcloud
+// folder.  Set Token for bearer authentication, or Username and Password
+// for basic authentication.
+type WebDAVConfig struct {
+	URL      string
+	Username string
+	Password string
+	Token    string
+
+	Client *http.Client `json:"-"`
+}
+
+type webdavBucket struct {
+	config *WebDAVConfig
+	base   *url.URL // always ends with a slash
+	ctx    context.Context
+}
+
+func NewWebDAVBucket(config *WebDAVConfig) (Bucket, error) {
+	u, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("expecting http or https URL: %q", config.URL)
+	}
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	u.RawPath = ""
+	return &webdavBucket{config: config, base: u}, nil
+}
+
+// NewWebDAVBucketFromFile reads a JSON file of the form
+//
+//	{"WebDAV": {"URL": "https://...", "Username": "...", "Password": "..."}}
+func NewWebDAVBucketFromFile(path string) (Bucket, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var conf struct {
+		WebDAV *WebDAVConfig
+	}
+	if err := json.Unmarshal(data, &conf); err != nil {
+		return nil, fmt.Errorf("json decoding error: %s", err)
+	}
+	if conf.WebDAV == nil {
+		return nil, fmt.Errorf("missing WebDAV configuration")
+	}
+	return NewWebDAVBucket(conf.WebDAV)
+}
+
+// WebDAVError is an unexpected HTTP response from a WebDAV server.
+type WebDAVError struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Status     string
+}
+
+func (e *WebDAVError) Error() string {
+	return fmt.Sprintf("%s %s: %s", e.Method, e.Path, e.Status)
+}
+
+func (b *webdavBucket) url(key string) *url.URL {
+	u := *b.base
+	u.Path = b.base.Path + key
+	return &u
+}
+
+func (b *webdavBucket) do(method string, u *url.URL, body []byte, header http.Header, ok ...int) (*http.Response, error) {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(contextOrBackground(b.ctx), method, u.String(), r)
+	if err != nil {
+		return nil, err
+	}
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	if b.config.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+b.config.Token)
+	} else if b.config.Username != "" {
+		req.SetBasicAuth(b.config.Username, b.config.Password)
+	}
+
+	client := b.config.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, code := range ok {
+		if resp.StatusCode == code {
+			return resp, nil
+		}
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	return nil, &WebDAVError{Method: method, Path: u.Path, StatusCode: resp.StatusCode, Status: resp.Status}
+}
+
+func (b *webdavBucket) Abs(key string) string {
+	return b.url(key).String()
+}
+
+func (b *webdavBucket) Put(key string, data []byte) error {
+	u := b.url(key)
+	resp, err := b.do("PUT", u, data, nil, http.StatusOK, http.StatusCreated, http.StatusNoContent)
+	if e, ok := err.(*WebDAVError); ok && (e.StatusCode == http.StatusConflict || e.StatusCode == http.StatusNotFound) {
+		// The parent collection is missing.
+		if err := b.mkcol(path.Dir(u.Path)); err != nil {
+			return err
+		}
+		resp, err = b.do("PUT", u, data, nil, http.StatusOK, http.StatusCreated, http.StatusNoContent)
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// mkcol creates the collection p and any missing parents.
+func (b *webdavBucket) mkcol(p string) error {
+	u := *b.base
+	u.Path = p + "/"
+	resp, err := b.do("MKCOL", &u, nil, nil, http.StatusCreated)
+	if e, ok := err.(*WebDAVError); ok {
+		switch e.StatusCode {
+		case http.StatusMethodNotAllowed:
+			return nil // already exists
+		case http.StatusConflict:
+			if parent := path.Dir(p); parent != p {
+				if err := b.mkcol(parent); err != nil {
+					return err
+				}
+				resp, err = b.do("MKCOL", &u, nil, nil, http.StatusCreated)
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (b *webdavBucket) Get(key string) ([]byte, error) {
+	resp, err := b.do("GET", b.url(key), nil, nil, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (b *webdavBucket) Stat(key string) (*Info, error) {
+	resp, err := b.do("HEAD", b.url(key), nil, nil, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	info := &Info{Size: resp.ContentLength}
+	if lm := resp.Header.Get("Last-Modified"); lm != "" {
+		if info.ModTime, err = http.ParseTime(lm); err != nil {
+			return nil, fmt.Errorf("invalid Last-Modified header: %q", lm)
+		}
+	}
+	return info, nil
+}
+
+func (b *webdavBucket) Delete(key string) error {
+	resp, err := b.do("DELETE", b.url(key), nil, nil, http.StatusOK, http.StatusNoContent)
+	if e, ok := err.(*WebDAVError); ok && e.StatusCode == http.StatusNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+type multistatus struct {
+	Responses []struct {
+		Href     string `xml:"href"`
+		Propstat []struct {
+			Status string `xml:"status"`
+			Prop   struct {
+				ResourceType struct {
+					Collection *struct{} `xml:"collection"`
+				} `xml:"resourcetype"`
+			} `xml:"prop"`
+		} `xml:"propstat"`
+	} `xml:"response"`
+}
+
+const propfindBody = `<?xml version="1.0" encoding="utf-8"?><propfind xmlns="DAV:"><prop><resourcetype/></prop></propfind>`
+
+func (b *webdavBucket) List() (keys, children []string, err error) {
+	header := http.Header{"Depth": {"1"}, "Content-Type": {"application/xml"}}
+	resp, err := b.do("PROPFIND", b.base, []byte(propfindBody), header, http.StatusMultiStatus)
+	if e, ok := err.(*WebDAVError); ok && e.StatusCode == http.StatusNotFound {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	var ms multistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return nil, nil, fmt.Errorf("unable to decode response body: %s", err)
+	}
+
+	for _, r := range ms.Responses {
+		href, err := url.Parse(r.Href)
+		if err != nil {
+			return nil, nil, fmt.Errorf("bad href %q: %s", r.Href, err)
+		}
+		p := strings.TrimSuffix(href.Path, "/")
+		if p == strings.TrimSuffix(b.base.Path, "/") {
+			continue // the collection itself
+		}
+		isDir := strings.HasSuffix(href.Path, "/")
+		for _, ps := range r.Propstat {
+			if strings.Contains(ps.Status, " 200 ") && ps.Prop.ResourceType.Collection != nil {
+				isDir = true
+			}
+		}
+		if isDir {
+			children = append(children, path.Base(p))
+		} else {
+			keys = append(keys, path.Base(p))
+		}
+	}
+	sort.Strings(keys)
+	sort.Strings(children)
+	return keys, children, nil
+}
+
+func (b *webdavBucket) WithContext(ctx context.Context) Bucket {
+	return &webdavBucket{config: b.config, base: b.base, ctx: ctx}
+}
+
+// Descend creates the collection child, if it does not exist yet.  A
+// server that already has it answers 405 Method Not Allowed.
+func (b *webdavBucket) Descend(child string) (Bucket, error) {
+	u := b.url(strings.TrimSuffix(child, "/") + "/")
+	if err := b.mkcol(strings.TrimSuffix(u.Path, "/")); err != nil {
+		return nil, err
+	}
+	return &webdavBucket{config: b.config, base: u, ctx: b.ctx}, nil
+}
+
+func (b *webdavBucket) Destroy() error {
+	if b.base.Path == "/" {
+		return fmt.Errorf("refusing to destroy top-level collection %q", b.base)
+	}
+	resp, err := b.do("DELETE", b.base, nil, http.Header{"Depth": {"infinity"}}, http.StatusOK, http.StatusNoContent)
+	if e, ok := err.(*WebDAVError); ok && e.StatusCode == http.StatusNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
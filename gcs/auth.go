@@ -0,0 +1,207 @@
+package gcs
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Scope is the OAuth scope requested for access tokens.
+const Scope = "https://www.googleapis.com/auth/devstorage.read_write"
+
+const jwtGrantType = "urn:ietf:params:oauth:grant-type:jwt-bearer"
+
+// ServiceAccount holds the fields of a service account key file, as
+// downloaded from the Google Cloud console.
+type ServiceAccount struct {
+	Type         string `json:"type"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	ClientEmail  string `json:"client_email"`
+	TokenURI     string `json:"token_uri"`
+}
+
+func ReadServiceAccount(path string) (*ServiceAccount, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	a := new(ServiceAccount)
+	if err := json.Unmarshal(data, a); err != nil {
+		return nil, fmt.Errorf("json decoding error: %s", err)
+	}
+	if a.Type != "service_account" {
+		return nil, fmt.Errorf("%s: expecting a service account key, not %q", path, a.Type)
+	}
+	if a.ClientEmail == "" || a.PrivateKey == "" || a.TokenURI == "" {
+		return nil, fmt.Errorf("%s: missing client_email, private_key or token_uri", path)
+	}
+	return a, nil
+}
+
+// ParsePrivateKey parses the PEM-encoded RSA key of a service account.
+func ParsePrivateKey(data string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, errors.New("private key is not PEM encoded")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key: %s", err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("private key is not an RSA key")
+	}
+	return rsaKey, nil
+}
+
+// Claims are the JWT claims of a token request.
+type Claims struct {
+	Issuer   string `json:"iss"`
+	Scope    string `json:"scope"`
+	Audience string `json:"aud"`
+	IssuedAt int64  `json:"iat"`
+	Expiry   int64  `json:"exp"`
+}
+
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+	KeyID     string `json:"kid,omitempty"`
+}
+
+// SignJWT returns an RS256 JSON Web Token for the given claims.
+func SignJWT(key *rsa.PrivateKey, keyID string, claims *Claims) (string, error) {
+	header, err := json.Marshal(&jwtHeader{Algorithm: "RS256", Type: "JWT", KeyID: keyID})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	msg := enc.EncodeToString(header) + "." + enc.EncodeToString(payload)
+	sum := sha256.Sum256([]byte(msg))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+	return msg + "." + enc.EncodeToString(sig), nil
+}
+
+// VerifyJWT checks the signature of an RS256 JSON Web Token and returns
+// its claims.  It does not check the expiry.
+func VerifyJWT(pub *rsa.PublicKey, token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed JWT")
+	}
+	enc := base64.RawURLEncoding
+	var header jwtHeader
+	data, err := enc.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("malformed JWT header: %s", err)
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return nil, fmt.Errorf("malformed JWT header: %s", err)
+	}
+	if header.Algorithm != "RS256" {
+		return nil, fmt.Errorf("unsupported JWT algorithm %q", header.Algorithm)
+	}
+	sig, err := enc.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed JWT signature: %s", err)
+	}
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, sum[:], sig); err != nil {
+		return nil, errors.New("invalid JWT signature")
+	}
+	claims := new(Claims)
+	data, err = enc.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed JWT claims: %s", err)
+	}
+	if err := json.Unmarshal(data, claims); err != nil {
+		return nil, fmt.Errorf("malformed JWT claims: %s", err)
+	}
+	return claims, nil
+}
+
+// TokenResponse is the reply of the OAuth token endpoint.
+type TokenResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+	TokenType   string `json:"token_type"`
+}
+
+// accessToken returns a cached access token, exchanging a new signed
+// JWT for one when the cached token is about to expire.
+func (s *Service) accessToken(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if s.token != "" && now.Add(time.Minute).Before(s.expiry) {
+		return s.token, nil
+	}
+
+	claims := &Claims{
+		Issuer:   s.account.ClientEmail,
+		Scope:    Scope,
+		Audience: s.account.TokenURI,
+		IssuedAt: now.Unix(),
+		Expiry:   now.Add(time.Hour).Unix(),
+	}
+	jwt, err := SignJWT(s.key, s.account.PrivateKeyID, claims)
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", jwtGrantType)
+	form.Set("assertion", jwt)
+	req, err := http.NewRequestWithContext(ctx, "POST", s.account.TokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := s.client().Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return "", fmt.Errorf("token request failed: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	tok := new(TokenResponse)
+	if err := json.NewDecoder(resp.Body).Decode(tok); err != nil {
+		return "", fmt.Errorf("unable to decode token response: %s", err)
+	}
+	if tok.AccessToken == "" {
+		return "", errors.New("token response without access_token")
+	}
+
+	s.token = tok.AccessToken
+	s.expiry = now.Add(time.Duration(tok.ExpiresIn) * time.Second)
+	return s.token, nil
+}
@@ -0,0 +1,101 @@
+package gcs
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+// MaxBatch is the maximum number of calls in a batch request.
+const MaxBatch = 100
+
+// Delete deletes the named objects using batch requests.  Objects that
+// do not exist are ignored.
+func (b *Bucket) Delete(names []string) error {
+	for len(names) > 0 {
+		n := len(names)
+		if n > MaxBatch {
+			n = MaxBatch
+		}
+		if err := b.deleteBatch(names[:n]); err != nil {
+			return err
+		}
+		names = names[n:]
+	}
+	return nil
+}
+
+func (b *Bucket) deleteBatch(names []string) error {
+	body := new(bytes.Buffer)
+	mw := multipart.NewWriter(body)
+	for i, name := range names {
+		h := make(textproto.MIMEHeader)
+		h.Set("Content-Type", "application/http")
+		h.Set("Content-ID", fmt.Sprintf("<%d>", i))
+		pw, err := mw.CreatePart(h)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(pw, "DELETE %s HTTP/1.1\r\n\r\n", b.objectPath(name))
+	}
+	if err := mw.Close(); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(b.context(), "POST", b.Service.Endpoint+"/batch/storage/v1", body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+
+	resp, err := b.Service.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		return fmt.Errorf("unexpected batch response type %q", resp.Header.Get("Content-Type"))
+	}
+
+	var errs []string
+	replies := 0
+	mr := multipart.NewReader(resp.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return fmt.Errorf("reading batch response: %s", err)
+		}
+		r, err := http.ReadResponse(bufio.NewReader(part), nil)
+		if err != nil {
+			return fmt.Errorf("reading batch response: %s", err)
+		}
+		replies++
+		if r.StatusCode >= 300 && r.StatusCode != http.StatusNotFound {
+			errs = append(errs, responseError(r).Error())
+		}
+		r.Body.Close()
+	}
+	if replies != len(names) {
+		return fmt.Errorf("batch delete: expected %d replies, got %d", len(names), replies)
+	}
+	if len(errs) > 0 {
+		s := fmt.Sprintf("batch delete: %s", errs[0])
+		if len(errs) > 1 {
+			s += fmt.Sprintf(" (+%d more errors)", len(errs)-1)
+		}
+		return errors.New(s)
+	}
+	return nil
+}
@@ -0,0 +1,305 @@
+// Package gcs is a small client for the Google Cloud Storage JSON API
+// using service account authentication.
+package gcs
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DefaultEndpoint = "https://storage.googleapis.com"
+
+type Service struct {
+	Endpoint string       // "https://storage.googleapis.com"
+	Client   *http.Client `json:"-"`
+
+	account *ServiceAccount
+	key     *rsa.PrivateKey
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+func NewService(account *ServiceAccount) (*Service, error) {
+	key, err := ParsePrivateKey(account.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	return &Service{
+		Endpoint: DefaultEndpoint,
+		account:  account,
+		key:      key,
+	}, nil
+}
+
+type Bucket struct {
+	Service *Service
+	Name    string
+
+	ctx context.Context
+}
+
+// WithContext returns a shallow copy of b whose requests use ctx.
+func (b *Bucket) WithContext(ctx context.Context) *Bucket {
+	b2 := *b
+	b2.ctx = ctx
+	return &b2
+}
+
+func (b *Bucket) context() context.Context {
+	if b.ctx == nil {
+		return context.Background()
+	}
+	return b.ctx
+}
+
+// Config is the "GCS" section of a bucket JSON file.  CredentialsFile
+// is a service account key file, relative to the JSON file.
+type Config struct {
+	Bucket          string
+	CredentialsFile string
+	Endpoint        string
+}
+
+// NewBucketFromFile reads a JSON file of the form
+//
+//	{"GCS": {"Bucket": "...", "CredentialsFile": "service-account.json"}}
+func NewBucketFromFile(path string) (*Bucket, error) {
+	conf, err := ReadConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if conf.Bucket == "" {
+		return nil, fmt.Errorf("missing Bucket or CredentialsFile")
+	}
+	return NewBucket(conf)
+}
+
+// ReadConfigFile reads the "GCS" section of a JSON file, with
+// CredentialsFile resolved relative to the file.  Bucket may be empty.
+func ReadConfigFile(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var conf struct {
+		GCS *Config
+	}
+	if err := json.Unmarshal(data, &conf); err != nil {
+		return nil, fmt.Errorf("json decoding error: %s", err)
+	}
+	if conf.GCS == nil {
+		return nil, fmt.Errorf("missing GCS configuration")
+	}
+	if conf.GCS.CredentialsFile == "" {
+		return nil, fmt.Errorf("missing Bucket or CredentialsFile")
+	}
+	if !filepath.IsAbs(conf.GCS.CredentialsFile) {
+		conf.GCS.CredentialsFile = filepath.Join(filepath.Dir(path), conf.GCS.CredentialsFile)
+	}
+	return conf.GCS, nil
+}
+
+// NewBucket returns the bucket described by conf, whose CredentialsFile
+// must be an absolute path or relative to the working directory.
+func NewBucket(conf *Config) (*Bucket, error) {
+	account, err := ReadServiceAccount(conf.CredentialsFile)
+	if err != nil {
+		return nil, err
+	}
+	s, err := NewService(account)
+	if err != nil {
+		return nil, err
+	}
+	if conf.Endpoint != "" {
+		s.Endpoint = strings.TrimSuffix(conf.Endpoint, "/")
+	}
+	return &Bucket{Service: s, Name: conf.Bucket}, nil
+}
+
+func (b *Bucket) objectPath(name string) string {
+	return "/storage/v1/b/" + url.PathEscape(b.Name) + "/o/" + url.PathEscape(name)
+}
+
+// Object is the subset of object metadata that we use.
+type Object struct {
+	Name    string    `json:"name"`
+	Size    string    `json:"size"`
+	MD5Hash string    `json:"md5Hash"`
+	Updated time.Time `json:"updated"`
+}
+
+func (b *Bucket) Put(name string, data []byte) error {
+	vals := url.Values{}
+	vals.Set("uploadType", "media")
+	vals.Set("name", name)
+	u := b.Service.Endpoint + "/upload/storage/v1/b/" + url.PathEscape(b.Name) + "/o?" + vals.Encode()
+	req, err := http.NewRequestWithContext(b.context(), "POST", u, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err := b.Service.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	obj := new(Object)
+	if err := json.NewDecoder(resp.Body).Decode(obj); err != nil {
+		return fmt.Errorf("unable to decode response body: %s", err)
+	}
+	sum := md5.Sum(data)
+	if obj.MD5Hash != "" && obj.MD5Hash != base64.StdEncoding.EncodeToString(sum[:]) {
+		return fmt.Errorf("md5Hash mismatch")
+	}
+	if obj.Size != "" && obj.Size != strconv.Itoa(len(data)) {
+		return fmt.Errorf("size mismatch")
+	}
+	return nil
+}
+
+func (b *Bucket) Get(name string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(b.context(), "GET", b.Service.Endpoint+b.objectPath(name)+"?alt=media", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := b.Service.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+// Stat returns the metadata of the named object.
+func (b *Bucket) Stat(name string) (*Object, error) {
+	req, err := http.NewRequestWithContext(b.context(), "GET", b.Service.Endpoint+b.objectPath(name), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := b.Service.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	obj := new(Object)
+	if err := json.NewDecoder(resp.Body).Decode(obj); err != nil {
+		return nil, fmt.Errorf("unable to decode response body: %s", err)
+	}
+	return obj, nil
+}
+
+type ListResult struct {
+	Items         []*Object `json:"items"`
+	Prefixes      []string  `json:"prefixes"`
+	NextPageToken string    `json:"nextPageToken"`
+}
+
+// List returns one page of the objects whose names start with prefix.
+// Pass the NextPageToken of the previous page to get the next page.
+func (b *Bucket) List(prefix, delimiter, pageToken string) (*ListResult, error) {
+	vals := url.Values{}
+	vals.Set("prefix", prefix)
+	if delimiter != "" {
+		vals.Set("delimiter", delimiter)
+	}
+	if pageToken != "" {
+		vals.Set("pageToken", pageToken)
+	}
+	vals.Set("fields", "items(name,size,md5Hash),prefixes,nextPageToken")
+	u := b.Service.Endpoint + "/storage/v1/b/" + url.PathEscape(b.Name) + "/o?" + vals.Encode()
+	req, err := http.NewRequestWithContext(b.context(), "GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := b.Service.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	list := new(ListResult)
+	if err := json.NewDecoder(resp.Body).Decode(list); err != nil {
+		return nil, fmt.Errorf("unable to decode response body: %s", err)
+	}
+	return list, nil
+}
+
+// Error is an unsuccessful response from the storage API.
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	s := fmt.Sprintf("%d %s (GCS error)", e.Code, http.StatusText(e.Code))
+	if e.Message != "" {
+		s += ": " + e.Message
+	}
+	return s
+}
+
+// responseError turns an unsuccessful response into an *Error.  Media
+// downloads may report errors in plain text instead of JSON.
+func responseError(resp *http.Response) error {
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var e struct {
+		Error *Error `json:"error"`
+	}
+	if json.Unmarshal(body, &e) == nil && e.Error != nil {
+		if e.Error.Code == 0 {
+			e.Error.Code = resp.StatusCode
+		}
+		return e.Error
+	}
+	return &Error{Code: resp.StatusCode, Message: strings.TrimSpace(string(body))}
+}
+
+func (s *Service) client() *http.Client {
+	if s.Client == nil {
+		return http.DefaultClient
+	}
+	return s.Client
+}
+
+func (s *Service) do(req *http.Request) (*http.Response, error) {
+	token, err := s.accessToken(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := s.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	return nil, responseError(resp)
+}
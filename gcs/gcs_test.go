@@ -0,0 +1,109 @@
+package gcs_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/davidlazar/kebab/gcs"
+	"github.com/davidlazar/kebab/internal/testutil"
+)
+
+func TestMain(m *testing.M) {
+	testutil.Setup()
+	r := m.Run()
+	testutil.TearDown()
+	os.Exit(r)
+}
+
+func TestJWT(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := &gcs.Claims{
+		Issuer:   "kebab@example.com",
+		Scope:    gcs.Scope,
+		Audience: "https://oauth2.googleapis.com/token",
+		IssuedAt: 1500000000,
+		Expiry:   1500003600,
+	}
+	jwt, err := gcs.SignJWT(key, "key-id", claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(jwt, ".") != 2 {
+		t.Fatalf("malformed JWT: %s", jwt)
+	}
+
+	got, err := gcs.VerifyJWT(&key.PublicKey, jwt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *got != *claims {
+		t.Fatalf("expected %+v, got %+v", claims, got)
+	}
+
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gcs.VerifyJWT(&other.PublicKey, jwt); err == nil {
+		t.Fatal("expected signature error with the wrong key")
+	}
+	i := strings.Index(jwt, ".")
+	c := "A"
+	if jwt[i+1] == 'A' {
+		c = "B"
+	}
+	tampered := jwt[:i+1] + c + jwt[i+2:]
+	if _, err := gcs.VerifyJWT(&key.PublicKey, tampered); err == nil {
+		t.Fatal("expected signature error for tampered claims")
+	}
+}
+
+func TestBatchDelete(t *testing.T) {
+	fake, server := testutil.StartGCSServer("batch")
+	defer server.Close()
+	b, err := gcs.NewBucketFromFile(testutil.WriteGCSConfig(testutil.TempDir, fake, server, "batch"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for i := 0; i < 2*gcs.MaxBatch+10; i++ {
+		name := fmt.Sprintf("dir/%03d", i)
+		if err := b.Put(name, []byte(name)); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+
+	// Deleting objects that do not exist is not an error.
+	if err := b.Delete(append(names, "dir/nonexistent")); err != nil {
+		t.Fatal(err)
+	}
+	list, err := b.List("dir/", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Items) != 0 {
+		t.Fatalf("expected no objects, got %d", len(list.Items))
+	}
+}
+
+func TestNotFound(t *testing.T) {
+	fake, server := testutil.StartGCSServer("notfound")
+	defer server.Close()
+	b, err := gcs.NewBucketFromFile(testutil.WriteGCSConfig(testutil.TempDir, fake, server, "notfound"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.Get("nonexistent")
+	if e, ok := err.(*gcs.Error); !ok || e.Code != 404 {
+		t.Fatalf("expected 404 error, got %v", err)
+	}
+}
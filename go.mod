@@ -4,5 +4,7 @@ go 1.14
 
 require (
 	github.com/davidlazar/go-crypto v0.0.0-20200604182044-b73af7476f6c
-	golang.org/x/crypto v0.0.0-20200604202706-70a84ac30bf9
+	github.com/pkg/sftp v1.13.1
+	golang.org/x/crypto v0.0.0-20210421170649-83a5a9bb288b
+	golang.org/x/net v0.0.0-20210428140749-89ef3d95e781
 )
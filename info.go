@@ -0,0 +1,59 @@
+package kebab
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/davidlazar/kebab/bucket"
+)
+
+// BackupInfo describes a backup without reading its boxes.
+type BackupInfo struct {
+	Boxes int
+	// Size is the size of the backup, or -1 if the metadata predates
+	// Metadata.Size.  It includes padding in that case.
+	Size int64
+	// Stored is the number of bytes stored for the backup, including
+	// padding, encryption and metadata.
+	Stored int64
+	// Missing lists the boxes that are not in the bucket.
+	Missing []string
+	// Modified is when the metadata was last written, which is when
+	// the backup was completed.
+	Modified time.Time
+}
+
+// Info describes the backup in b, checking that every box exists.  If
+// there is no backup in b, the error satisfies bucket.IsNotExist.
+func Info(b Bucket) (*BackupInfo, error) {
+	mi, err := b.Stat("meta")
+	if err != nil {
+		return nil, err
+	}
+	meta, err := readMeta(b)
+	if err != nil {
+		return nil, err
+	}
+	info := &BackupInfo{
+		Boxes:    len(meta.Boxes),
+		Size:     -1,
+		Stored:   mi.Size,
+		Modified: mi.ModTime,
+	}
+	if meta.Version >= 1 {
+		info.Size = meta.Size
+	}
+
+	for i := range meta.Boxes {
+		key := fmt.Sprintf("%05d", i)
+		bi, err := b.Stat(key)
+		if bucket.IsNotExist(err) {
+			info.Missing = append(info.Missing, key)
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("Stat(%q): %s", key, err)
+		}
+		info.Stored += bi.Size
+	}
+	return info, nil
+}
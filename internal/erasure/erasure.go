@@ -0,0 +1,220 @@
+// Package erasure implements a systematic Reed-Solomon erasure code over
+// GF(256).  Data is split into k data shards, and m parity shards are
+// computed so that the data can be recovered from any k of the k+m
+// shards.
+package erasure
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Arithmetic in GF(256) with the polynomial x^8+x^4+x^3+x^2+1.
+
+var (
+	gfExp [512]byte
+	gfLog [256]int
+	gfMul [256][256]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = i
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < len(gfExp); i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+	for a := 1; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			gfMul[a][b] = gfExp[gfLog[a]+gfLog[b]]
+		}
+	}
+}
+
+func gfInv(a byte) byte {
+	if a == 0 {
+		panic("erasure: inverse of zero")
+	}
+	return gfExp[255-gfLog[a]]
+}
+
+var ErrTooFewShards = errors.New("too few shards to reconstruct the data")
+
+type Code struct {
+	k, m int
+	// matrix is the (k+m)×k encoding matrix: the identity on top of a
+	// Cauchy matrix, so every k×k submatrix is invertible.
+	matrix [][]byte
+}
+
+// New returns a code with k data shards and m parity shards.
+func New(k, m int) (*Code, error) {
+	if k < 1 || m < 0 || k+m > 256 {
+		return nil, fmt.Errorf("invalid erasure code: %d data and %d parity shards", k, m)
+	}
+	matrix := make([][]byte, k+m)
+	for i := range matrix {
+		matrix[i] = make([]byte, k)
+		if i < k {
+			matrix[i][i] = 1
+			continue
+		}
+		// Cauchy matrix 1/(x_i + y_j) with x_i = i and y_j = j,
+		// where x_i ranges over k..k+m-1 and y_j over 0..k-1.
+		for j := 0; j < k; j++ {
+			matrix[i][j] = gfInv(byte(i) ^ byte(j))
+		}
+	}
+	return &Code{k: k, m: m, matrix: matrix}, nil
+}
+
+func (c *Code) DataShards() int   { return c.k }
+func (c *Code) ParityShards() int { return c.m }
+
+// ShardSize returns the size of each shard for data of length n.
+func (c *Code) ShardSize(n int) int {
+	return (n + c.k - 1) / c.k
+}
+
+// Split splits data into k data shards, padding the last one with
+// zeros, and computes m parity shards.
+func (c *Code) Split(data []byte) [][]byte {
+	size := c.ShardSize(len(data))
+	shards := make([][]byte, c.k+c.m)
+	for i := 0; i < c.k; i++ {
+		shards[i] = make([]byte, size)
+		if i*size < len(data) {
+			copy(shards[i], data[i*size:])
+		}
+	}
+	for i := c.k; i < c.k+c.m; i++ {
+		shards[i] = make([]byte, size)
+		mulAdd(shards[i], c.matrix[i], shards[:c.k])
+	}
+	return shards
+}
+
+// mulAdd sets dst to the sum of coeffs[j]*srcs[j].
+func mulAdd(dst []byte, coeffs []byte, srcs [][]byte) {
+	for j, src := range srcs {
+		row := &gfMul[coeffs[j]]
+		for n, x := range src {
+			dst[n] ^= row[x]
+		}
+	}
+}
+
+// Reconstruct fills in the missing (nil) shards from any k present
+// shards, which must all have the same size.
+func (c *Code) Reconstruct(shards [][]byte) error {
+	if len(shards) != c.k+c.m {
+		return fmt.Errorf("expecting %d shards, got %d", c.k+c.m, len(shards))
+	}
+	var present []int
+	size := -1
+	for i, s := range shards {
+		if s == nil {
+			continue
+		}
+		if size >= 0 && len(s) != size {
+			return errors.New("shards have different sizes")
+		}
+		size = len(s)
+		if len(present) < c.k {
+			present = append(present, i)
+		}
+	}
+	if len(present) < c.k {
+		return ErrTooFewShards
+	}
+
+	// Recover the data shards by inverting the rows of the encoding
+	// matrix that correspond to the present shards.
+	sub := make([][]byte, c.k)
+	srcs := make([][]byte, c.k)
+	for r, i := range present {
+		sub[r] = append([]byte(nil), c.matrix[i]...)
+		srcs[r] = shards[i]
+	}
+	inv, err := invert(sub)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < c.k; i++ {
+		if shards[i] == nil {
+			shards[i] = make([]byte, size)
+			mulAdd(shards[i], inv[i], srcs)
+		}
+	}
+
+	for i := c.k; i < c.k+c.m; i++ {
+		if shards[i] == nil {
+			shards[i] = make([]byte, size)
+			mulAdd(shards[i], c.matrix[i], shards[:c.k])
+		}
+	}
+	return nil
+}
+
+// Join concatenates the data shards and truncates the result to n bytes.
+func (c *Code) Join(shards [][]byte, n int) ([]byte, error) {
+	data := make([]byte, 0, n)
+	for i := 0; i < c.k && len(data) < n; i++ {
+		if shards[i] == nil {
+			return nil, ErrTooFewShards
+		}
+		data = append(data, shards[i]...)
+	}
+	if len(data) < n {
+		return nil, errors.New("shards are too short")
+	}
+	return data[:n], nil
+}
+
+// invert returns the inverse of a square matrix using Gauss-Jordan
+// elimination.  It modifies m.
+func invert(m [][]byte) ([][]byte, error) {
+	n := len(m)
+	inv := make([][]byte, n)
+	for i := range inv {
+		inv[i] = make([]byte, n)
+		inv[i][i] = 1
+	}
+	for col := 0; col < n; col++ {
+		pivot := -1
+		for r := col; r < n; r++ {
+			if m[r][col] != 0 {
+				pivot = r
+				break
+			}
+		}
+		if pivot < 0 {
+			return nil, errors.New("singular matrix")
+		}
+		m[col], m[pivot] = m[pivot], m[col]
+		inv[col], inv[pivot] = inv[pivot], inv[col]
+
+		scale := gfInv(m[col][col])
+		for j := 0; j < n; j++ {
+			m[col][j] = gfMul[scale][m[col][j]]
+			inv[col][j] = gfMul[scale][inv[col][j]]
+		}
+		for r := 0; r < n; r++ {
+			if r == col || m[r][col] == 0 {
+				continue
+			}
+			f := m[r][col]
+			for j := 0; j < n; j++ {
+				m[r][j] ^= gfMul[f][m[col][j]]
+				inv[r][j] ^= gfMul[f][inv[col][j]]
+			}
+		}
+	}
+	return inv, nil
+}
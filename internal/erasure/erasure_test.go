@@ -0,0 +1,91 @@
+package erasure
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+// subsets calls f with every subset of {0, ..., n-1} of size r.
+func subsets(n, r int, f func([]int)) {
+	var rec func(start int, chosen []int)
+	rec = func(start int, chosen []int) {
+		if len(chosen) == r {
+			f(chosen)
+			return
+		}
+		for i := start; i < n; i++ {
+			rec(i+1, append(chosen, i))
+		}
+	}
+	rec(0, nil)
+}
+
+func TestReconstruct(t *testing.T) {
+	for _, km := range [][2]int{{1, 0}, {1, 2}, {2, 1}, {3, 2}, {4, 4}, {10, 3}} {
+		k, m := km[0], km[1]
+		c, err := New(k, m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, n := range []int{0, 1, k, 1000, 1001} {
+			data := make([]byte, n)
+			rand.Read(data)
+			shards := c.Split(data)
+			if len(shards) != k+m {
+				t.Fatalf("k=%d m=%d: got %d shards", k, m, len(shards))
+			}
+
+			for lost := 0; lost <= m; lost++ {
+				subsets(k+m, lost, func(missing []int) {
+					partial := make([][]byte, len(shards))
+					copy(partial, shards)
+					for _, i := range missing {
+						partial[i] = nil
+					}
+					if err := c.Reconstruct(partial); err != nil {
+						t.Fatalf("k=%d m=%d n=%d missing=%v: %s", k, m, n, missing, err)
+					}
+					for i := range shards {
+						if !bytes.Equal(partial[i], shards[i]) {
+							t.Fatalf("k=%d m=%d n=%d missing=%v: shard %d differs", k, m, n, missing, i)
+						}
+					}
+					x, err := c.Join(partial, n)
+					if err != nil || !bytes.Equal(x, data) {
+						t.Fatalf("k=%d m=%d n=%d missing=%v: Join: %v", k, m, n, missing, err)
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestTooFewShards(t *testing.T) {
+	c, err := New(3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shards := c.Split([]byte("hello world"))
+	shards[0], shards[2], shards[4] = nil, nil, nil
+	if err := c.Reconstruct(shards); err != ErrTooFewShards {
+		t.Fatalf("expected ErrTooFewShards, got %v", err)
+	}
+}
+
+func TestInvalidCode(t *testing.T) {
+	for _, km := range [][2]int{{0, 1}, {1, -1}, {200, 57}} {
+		if _, err := New(km[0], km[1]); err == nil {
+			t.Errorf("expected error for k=%d m=%d", km[0], km[1])
+		}
+	}
+}
+
+func BenchmarkSplit(b *testing.B) {
+	c, _ := New(4, 2)
+	data := make([]byte, 16*1024*1024)
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		c.Split(data)
+	}
+}
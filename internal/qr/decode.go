@@ -0,0 +1,629 @@
+package qr
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"math"
+	"sort"
+)
+
+var ErrNotFound = errors.New("qr: no QR code found")
+
+// Decode finds a QR code in img, such as a scan of a printed symbol,
+// and returns its contents.  Only byte, numeric and alphanumeric
+// segments are supported.
+func Decode(img image.Image) ([]byte, error) {
+	g := newGrayImage(img)
+	var lastErr error = ErrNotFound
+	for _, bm := range []*bitmap{g.threshold(), g.adaptiveThreshold()} {
+		data, err := bm.decode()
+		if err == nil {
+			return data, nil
+		}
+		if err != ErrNotFound {
+			lastErr = err
+		}
+	}
+	return nil, lastErr
+}
+
+type grayImage struct {
+	w, h int
+	pix  []uint8
+}
+
+func newGrayImage(img image.Image) *grayImage {
+	r := img.Bounds()
+	g := &grayImage{w: r.Dx(), h: r.Dy(), pix: make([]uint8, r.Dx()*r.Dy())}
+	for y := 0; y < g.h; y++ {
+		for x := 0; x < g.w; x++ {
+			c := color.GrayModel.Convert(img.At(r.Min.X+x, r.Min.Y+y)).(color.Gray)
+			g.pix[y*g.w+x] = c.Y
+		}
+	}
+	return g
+}
+
+// threshold binarizes the image with Otsu's method.
+func (g *grayImage) threshold() *bitmap {
+	var hist [256]int
+	for _, v := range g.pix {
+		hist[v]++
+	}
+	total := len(g.pix)
+	sum := 0
+	for i, n := range hist {
+		sum += i * n
+	}
+	best, bestVar := 0, -1.0
+	sumB, wB := 0, 0
+	for t := 0; t < 256; t++ {
+		wB += hist[t]
+		if wB == 0 {
+			continue
+		}
+		wF := total - wB
+		if wF == 0 {
+			break
+		}
+		sumB += t * hist[t]
+		mB := float64(sumB) / float64(wB)
+		mF := float64(sum-sumB) / float64(wF)
+		v := float64(wB) * float64(wF) * (mB - mF) * (mB - mF)
+		if v > bestVar {
+			best, bestVar = t, v
+		}
+	}
+
+	bm := newBitmap(g.w, g.h)
+	for i, v := range g.pix {
+		bm.dark[i] = int(v) <= best
+	}
+	return bm
+}
+
+// adaptiveThreshold binarizes the image against the local mean, which
+// copes better with uneven lighting.
+func (g *grayImage) adaptiveThreshold() *bitmap {
+	w, h := g.w, g.h
+	integral := make([]int64, (w+1)*(h+1))
+	for y := 0; y < h; y++ {
+		var row int64
+		for x := 0; x < w; x++ {
+			row += int64(g.pix[y*w+x])
+			integral[(y+1)*(w+1)+x+1] = integral[y*(w+1)+x+1] + row
+		}
+	}
+
+	r := w
+	if h < r {
+		r = h
+	}
+	r /= 16
+	if r < 4 {
+		r = 4
+	}
+	bm := newBitmap(w, h)
+	for y := 0; y < h; y++ {
+		y0, y1 := clamp(y-r, 0, h), clamp(y+r+1, 0, h)
+		for x := 0; x < w; x++ {
+			x0, x1 := clamp(x-r, 0, w), clamp(x+r+1, 0, w)
+			sum := integral[y1*(w+1)+x1] - integral[y0*(w+1)+x1] - integral[y1*(w+1)+x0] + integral[y0*(w+1)+x0]
+			n := int64((y1 - y0) * (x1 - x0))
+			bm.dark[y*w+x] = int64(g.pix[y*w+x])*n*10 < sum*9
+		}
+	}
+	return bm
+}
+
+type bitmap struct {
+	w, h int
+	dark []bool
+}
+
+func newBitmap(w, h int) *bitmap {
+	return &bitmap{w: w, h: h, dark: make([]bool, w*h)}
+}
+
+func (bm *bitmap) at(x, y int) bool {
+	if x < 0 || y < 0 || x >= bm.w || y >= bm.h {
+		return false
+	}
+	return bm.dark[y*bm.w+x]
+}
+
+type point struct{ x, y float64 }
+
+func (p point) sub(q point) point       { return point{p.x - q.x, p.y - q.y} }
+func (p point) add(q point) point       { return point{p.x + q.x, p.y + q.y} }
+func (p point) scale(s float64) point   { return point{p.x * s, p.y * s} }
+func (p point) dist(q point) float64    { return math.Hypot(p.x-q.x, p.y-q.y) }
+func (p point) cross(q point) float64   { return p.x*q.y - p.y*q.x }
+func (bm *bitmap) atPoint(p point) bool { return bm.at(int(math.Floor(p.x)), int(math.Floor(p.y))) }
+
+type finder struct {
+	center point
+	module float64
+	count  int
+}
+
+// ratioOK checks runs of dark, light, dark, light, dark modules for the
+// 1:1:3:1:1 finder pattern.
+func ratioOK(runs [5]int) (float64, bool) {
+	total := 0
+	for _, r := range runs {
+		if r == 0 {
+			return 0, false
+		}
+		total += r
+	}
+	if total < 7 {
+		return 0, false
+	}
+	m := float64(total) / 7
+	v := m / 2
+	for i, r := range runs {
+		want := m
+		if i == 2 {
+			want = 3 * m
+		}
+		tol := v
+		if i == 2 {
+			tol = 3 * v
+		}
+		if math.Abs(float64(r)-want) >= tol {
+			return 0, false
+		}
+	}
+	return m, true
+}
+
+// crossCheck counts the finder runs through (x, y) along (dx, dy) and
+// returns the refined center coordinate along that direction.
+func (bm *bitmap) crossCheck(x, y, dx, dy int) (center float64, module float64, ok bool) {
+	if !bm.at(x, y) {
+		return 0, 0, false
+	}
+	var runs [5]int
+	// Walk backwards through the center run, the light ring and the outer ring.
+	i := 0
+	for bm.at(x-i*dx, y-i*dy) {
+		runs[2]++
+		i++
+	}
+	for ; !bm.at(x-i*dx, y-i*dy) && runs[1] <= 4*runs[2]; i++ {
+		if !bm.inside(x-i*dx, y-i*dy) {
+			return 0, 0, false
+		}
+		runs[1]++
+	}
+	for ; bm.at(x-i*dx, y-i*dy) && runs[0] <= 4*runs[2]; i++ {
+		runs[0]++
+	}
+	start := -(runs[2] - 1)
+	j := 1
+	for bm.at(x+j*dx, y+j*dy) {
+		runs[2]++
+		j++
+	}
+	for ; !bm.at(x+j*dx, y+j*dy) && runs[3] <= 4*runs[2]; j++ {
+		if !bm.inside(x+j*dx, y+j*dy) {
+			return 0, 0, false
+		}
+		runs[3]++
+	}
+	for ; bm.at(x+j*dx, y+j*dy) && runs[4] <= 4*runs[2]; j++ {
+		runs[4]++
+	}
+	m, ok := ratioOK(runs)
+	if !ok {
+		return 0, 0, false
+	}
+	return float64(start) + float64(runs[2])/2, m, true
+}
+
+func (bm *bitmap) inside(x, y int) bool {
+	return x >= 0 && y >= 0 && x < bm.w && y < bm.h
+}
+
+func (bm *bitmap) findFinders() []*finder {
+	var found []*finder
+	for y := 0; y < bm.h; y++ {
+		var runs [5]int
+		var starts [5]int
+		n := 0 // number of runs seen, runs[4] is the current one
+		for x := 0; x <= bm.w; x++ {
+			d := x < bm.w && bm.dark[y*bm.w+x]
+			if x > 0 && x < bm.w && d == bm.dark[y*bm.w+x-1] {
+				runs[4]++
+				continue
+			}
+			// A run ended at x-1; check the last five if it was dark.
+			if x > 0 && bm.dark[y*bm.w+x-1] && n >= 5 {
+				if _, ok := ratioOK(runs); ok {
+					cx := float64(starts[2]) + float64(runs[2])/2
+					bm.checkCandidate(int(cx), y, &found)
+				}
+			}
+			copy(runs[:], runs[1:])
+			copy(starts[:], starts[1:])
+			runs[4], starts[4] = 1, x
+			n++
+		}
+	}
+
+	var out []*finder
+	for _, f := range found {
+		if f.count >= 2 {
+			out = append(out, f)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].count > out[j].count })
+	return out
+}
+
+func (bm *bitmap) checkCandidate(x, y int, found *[]*finder) {
+	dy, my, ok := bm.crossCheck(x, y, 0, 1)
+	if !ok {
+		return
+	}
+	cy := float64(y) + dy
+	dx, mx, ok := bm.crossCheck(x, int(cy), 1, 0)
+	if !ok {
+		return
+	}
+	cx := float64(x) + dx
+	c := point{cx, cy}
+	m := (mx + my) / 2
+
+	for _, f := range *found {
+		if f.center.dist(c) <= f.module*2 && math.Abs(f.module-m) <= f.module {
+			n := float64(f.count)
+			f.center = f.center.scale(n).add(c).scale(1 / (n + 1))
+			f.module = (f.module*n + m) / (n + 1)
+			f.count++
+			return
+		}
+	}
+	*found = append(*found, &finder{center: c, module: m, count: 1})
+}
+
+func (bm *bitmap) decode() ([]byte, error) {
+	finders := bm.findFinders()
+	if len(finders) > 8 {
+		finders = finders[:8]
+	}
+	var lastErr error = ErrNotFound
+	for i := 0; i < len(finders); i++ {
+		for j := i + 1; j < len(finders); j++ {
+			for k := j + 1; k < len(finders); k++ {
+				data, err := bm.decodeFinders(finders[i], finders[j], finders[k])
+				if err == nil {
+					return data, nil
+				}
+				if err != ErrNotFound {
+					lastErr = err
+				}
+			}
+		}
+	}
+	return nil, lastErr
+}
+
+func (bm *bitmap) decodeFinders(a, b, c *finder) ([]byte, error) {
+	// The top-left finder is opposite the longest side.
+	ab, ac, bc := a.center.dist(b.center), a.center.dist(c.center), b.center.dist(c.center)
+	switch {
+	case bc >= ab && bc >= ac:
+	case ac >= ab && ac >= bc:
+		a, b = b, a
+	default:
+		a, c = c, a
+	}
+	tl, tr, bl := a.center, b.center, c.center
+	if tr.sub(tl).cross(bl.sub(tl)) < 0 {
+		tr, bl = bl, tr
+	}
+
+	legA, legB := tl.dist(tr), tl.dist(bl)
+	if legA < legB*0.7 || legB < legA*0.7 {
+		return nil, ErrNotFound
+	}
+	module := (a.module + b.module + c.module) / 3
+	dim := (legA+legB)/2/module + 7
+	v := int(math.Floor((dim-17)/4 + 0.5))
+
+	var lastErr error = ErrNotFound
+	for _, version := range []int{v, v - 1, v + 1} {
+		if version < 1 || version > maxVersion {
+			continue
+		}
+		data, err := bm.decodeVersion(tl, tr, bl, version)
+		if err == nil {
+			return data, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+func (bm *bitmap) decodeVersion(tl, tr, bl point, version int) ([]byte, error) {
+	size := 17 + 4*version
+	span := float64(size - 7)
+	ux := tr.sub(tl).scale(1 / span)
+	uy := bl.sub(tl).scale(1 / span)
+	affine := func(u, v float64) point {
+		return tl.add(ux.scale(u - 3.5)).add(uy.scale(v - 3.5))
+	}
+
+	transform := affine
+	if version >= 2 {
+		at := float64(size) - 6.5
+		if p, ok := bm.findAlignment(affine(at, at), ux, uy); ok {
+			src := [4]point{{3.5, 3.5}, {float64(size) - 3.5, 3.5}, {3.5, float64(size) - 3.5}, {at, at}}
+			dst := [4]point{tl, tr, bl, p}
+			if h, ok := homography(src, dst); ok {
+				transform = h
+			}
+		}
+	}
+
+	sampled := newCode(version, M)
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			sampled.dark[y*size+x] = bm.atPoint(transform(float64(x)+0.5, float64(y)+0.5))
+		}
+	}
+	return sampled.read()
+}
+
+// findAlignment searches around p for the bottom-right alignment pattern.
+func (bm *bitmap) findAlignment(p, ux, uy point) (point, bool) {
+	module := math.Max(math.Hypot(ux.x, ux.y), math.Hypot(uy.x, uy.y))
+	radius := int(4*module) + 1
+	best := 0
+	var sum point
+	var n float64
+	for dy := -radius; dy <= radius; dy++ {
+		for dx := -radius; dx <= radius; dx++ {
+			q := point{p.x + float64(dx), p.y + float64(dy)}
+			score := 0
+			for j := -2; j <= 2; j++ {
+				for i := -2; i <= 2; i++ {
+					d := abs(i)
+					if abs(j) > d {
+						d = abs(j)
+					}
+					if bm.atPoint(q.add(ux.scale(float64(i))).add(uy.scale(float64(j)))) == (d != 1) {
+						score++
+					}
+				}
+			}
+			if score > best {
+				best, sum, n = score, q, 1
+			} else if score == best {
+				sum, n = sum.add(q), n+1
+			}
+		}
+	}
+	if best < 23 {
+		return point{}, false
+	}
+	return sum.scale(1 / n), true
+}
+
+// homography returns the projective transform mapping src to dst.
+func homography(src, dst [4]point) (func(u, v float64) point, bool) {
+	var a [8][9]float64
+	for i := 0; i < 4; i++ {
+		u, v, x, y := src[i].x, src[i].y, dst[i].x, dst[i].y
+		a[2*i] = [9]float64{u, v, 1, 0, 0, 0, -u * x, -v * x, x}
+		a[2*i+1] = [9]float64{0, 0, 0, u, v, 1, -u * y, -v * y, y}
+	}
+	for col := 0; col < 8; col++ {
+		pivot := col
+		for r := col + 1; r < 8; r++ {
+			if math.Abs(a[r][col]) > math.Abs(a[pivot][col]) {
+				pivot = r
+			}
+		}
+		if math.Abs(a[pivot][col]) < 1e-9 {
+			return nil, false
+		}
+		a[col], a[pivot] = a[pivot], a[col]
+		for r := 0; r < 8; r++ {
+			if r == col {
+				continue
+			}
+			f := a[r][col] / a[col][col]
+			for k := col; k < 9; k++ {
+				a[r][k] -= f * a[col][k]
+			}
+		}
+	}
+	var h [8]float64
+	for i := range h {
+		h[i] = a[i][8] / a[i][i]
+	}
+	return func(u, v float64) point {
+		w := h[6]*u + h[7]*v + 1
+		return point{(h[0]*u + h[1]*v + h[2]) / w, (h[3]*u + h[4]*v + h[5]) / w}
+	}, true
+}
+
+// read decodes a sampled symbol whose function patterns are known from
+// its version.
+func (c *Code) read() ([]byte, error) {
+	first, second := formatPositions(c.Size)
+	bestDist, level, mask := 16, L, 0
+	for _, pos := range [][15][2]int{first, second} {
+		word := 0
+		for i, p := range pos {
+			if c.Black(p[0], p[1]) {
+				word |= 1 << uint(i)
+			}
+		}
+		for l := L; l <= H; l++ {
+			for m := 0; m < 8; m++ {
+				if d := popcount(word ^ formatWord(l, m)); d < bestDist {
+					bestDist, level, mask = d, l, m
+				}
+			}
+		}
+	}
+	if bestDist > 3 {
+		return nil, ErrNotFound
+	}
+
+	info := blockTable[c.Version][level]
+	nblocks := info.n1 + info.n2
+	total := info.dataLen() + nblocks*info.ecLen
+	codewords := make([]byte, total)
+	for i, p := range c.dataPositions() {
+		if i >= total*8 {
+			break
+		}
+		if c.Black(p[0], p[1]) != masked(mask, p[0], p[1]) {
+			codewords[i>>3] |= 0x80 >> uint(i&7)
+		}
+	}
+
+	blocks := make([][]byte, nblocks)
+	for i := range blocks {
+		n := info.d1
+		if i >= info.n1 {
+			n++
+		}
+		blocks[i] = make([]byte, 0, n+info.ecLen)
+	}
+	k := 0
+	for i := 0; i <= info.d1; i++ {
+		for b := range blocks {
+			if i < cap(blocks[b])-info.ecLen {
+				blocks[b] = append(blocks[b], codewords[k])
+				k++
+			}
+		}
+	}
+	for i := 0; i < info.ecLen; i++ {
+		for b := range blocks {
+			blocks[b] = append(blocks[b], codewords[k])
+			k++
+		}
+	}
+
+	var data []byte
+	for _, block := range blocks {
+		if err := rsCorrect(block, info.ecLen); err != nil {
+			return nil, errors.New("qr: " + err.Error())
+		}
+		data = append(data, block[:len(block)-info.ecLen]...)
+	}
+	return parseSegments(data, c.Version)
+}
+
+const alphanumeric = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ $%*+-./:"
+
+func parseSegments(data []byte, version int) ([]byte, error) {
+	r := bitReader{data: data}
+	var out []byte
+	errFormat := errors.New("qr: malformed data")
+	for r.left() >= 4 {
+		switch mode := r.read(4); mode {
+		case 0:
+			return out, nil
+		case 1: // numeric
+			nbits := 10
+			if version >= 10 {
+				nbits = 12
+			}
+			n := r.read(nbits)
+			for ; n >= 3; n -= 3 {
+				v := r.read(10)
+				out = append(out, byte('0'+v/100), byte('0'+v/10%10), byte('0'+v%10))
+			}
+			if n == 2 {
+				v := r.read(7)
+				out = append(out, byte('0'+v/10), byte('0'+v%10))
+			} else if n == 1 {
+				out = append(out, byte('0'+r.read(4)))
+			}
+		case 2: // alphanumeric
+			nbits := 9
+			if version >= 10 {
+				nbits = 11
+			}
+			n := r.read(nbits)
+			for ; n >= 2; n -= 2 {
+				v := r.read(11)
+				if v/45 >= 45 {
+					return nil, errFormat
+				}
+				out = append(out, alphanumeric[v/45], alphanumeric[v%45])
+			}
+			if n == 1 {
+				v := r.read(6)
+				if v >= 45 {
+					return nil, errFormat
+				}
+				out = append(out, alphanumeric[v])
+			}
+		case 4: // byte
+			n := r.read(countBits(version))
+			for i := 0; i < n; i++ {
+				out = append(out, byte(r.read(8)))
+			}
+		case 7: // ECI designator, ignored
+			r.read(8)
+		default:
+			return nil, errFormat
+		}
+		if r.overrun {
+			return nil, errFormat
+		}
+	}
+	return out, nil
+}
+
+type bitReader struct {
+	data    []byte
+	pos     int
+	overrun bool
+}
+
+func (r *bitReader) left() int {
+	return len(r.data)*8 - r.pos
+}
+
+func (r *bitReader) read(n int) int {
+	v := 0
+	for i := 0; i < n; i++ {
+		if r.pos >= len(r.data)*8 {
+			r.overrun = true
+			return 0
+		}
+		bit := (r.data[r.pos>>3] >> uint(7-r.pos&7)) & 1
+		v = v<<1 | int(bit)
+		r.pos++
+	}
+	return v
+}
+
+func popcount(x int) int {
+	n := 0
+	for ; x != 0; x &= x - 1 {
+		n++
+	}
+	return n
+}
+
+func clamp(x, lo, hi int) int {
+	if x < lo {
+		return lo
+	}
+	if x > hi {
+		return hi
+	}
+	return x
+}
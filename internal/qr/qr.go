@@ -0,0 +1,484 @@
+// Package qr encodes and decodes QR codes, versions 1 through 10, in
+// byte mode.  It is just large enough to print a kebab key file and to
+// read a scan of the printout back in.
+package qr
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Level is an error correction level.
+type Level int
+
+const (
+	L Level = iota // recovers 7% of the codewords
+	M              // recovers 15% of the codewords
+	Q              // recovers 25% of the codewords
+	H              // recovers 30% of the codewords
+)
+
+// formatBits is the encoding of each level in the format information.
+var formatBits = [4]int{L: 1, M: 0, Q: 3, H: 2}
+
+const maxVersion = 10
+
+// blockInfo describes the error correction blocks of one version and
+// level: ecLen codewords per block, n1 blocks with d1 data codewords
+// followed by n2 blocks with d1+1 data codewords.
+type blockInfo struct {
+	ecLen, n1, d1, n2 int
+}
+
+var blockTable = [maxVersion + 1][4]blockInfo{
+	1:  {L: {7, 1, 19, 0}, M: {10, 1, 16, 0}, Q: {13, 1, 13, 0}, H: {17, 1, 9, 0}},
+	2:  {L: {10, 1, 34, 0}, M: {16, 1, 28, 0}, Q: {22, 1, 22, 0}, H: {28, 1, 16, 0}},
+	3:  {L: {15, 1, 55, 0}, M: {26, 1, 44, 0}, Q: {18, 2, 17, 0}, H: {22, 2, 13, 0}},
+	4:  {L: {20, 1, 80, 0}, M: {18, 2, 32, 0}, Q: {26, 2, 24, 0}, H: {16, 4, 9, 0}},
+	5:  {L: {26, 1, 108, 0}, M: {24, 2, 43, 0}, Q: {18, 2, 15, 2}, H: {22, 2, 11, 2}},
+	6:  {L: {18, 2, 68, 0}, M: {16, 4, 27, 0}, Q: {24, 4, 19, 0}, H: {28, 4, 15, 0}},
+	7:  {L: {20, 2, 78, 0}, M: {18, 4, 31, 0}, Q: {18, 2, 14, 4}, H: {26, 4, 13, 1}},
+	8:  {L: {24, 2, 97, 0}, M: {22, 2, 38, 2}, Q: {22, 4, 18, 2}, H: {26, 4, 14, 2}},
+	9:  {L: {30, 2, 116, 0}, M: {22, 3, 36, 2}, Q: {20, 4, 16, 4}, H: {24, 4, 12, 4}},
+	10: {L: {18, 2, 68, 2}, M: {26, 4, 43, 1}, Q: {24, 6, 19, 2}, H: {28, 6, 15, 2}},
+}
+
+func (b blockInfo) dataLen() int {
+	return b.n1*b.d1 + b.n2*(b.d1+1)
+}
+
+var alignmentTable = [maxVersion + 1][]int{
+	2:  {6, 18},
+	3:  {6, 22},
+	4:  {6, 26},
+	5:  {6, 30},
+	6:  {6, 34},
+	7:  {6, 22, 38},
+	8:  {6, 24, 42},
+	9:  {6, 26, 46},
+	10: {6, 28, 50},
+}
+
+// A Code is a QR code symbol.
+type Code struct {
+	Size    int // modules per side
+	Version int
+	Level   Level
+
+	dark     []bool
+	function []bool
+}
+
+func newCode(version int, level Level) *Code {
+	size := 17 + 4*version
+	c := &Code{
+		Size:     size,
+		Version:  version,
+		Level:    level,
+		dark:     make([]bool, size*size),
+		function: make([]bool, size*size),
+	}
+	c.drawFunctionPatterns()
+	return c
+}
+
+// Black reports whether the module in column x and row y is dark.
+// Coordinates outside the symbol are light.
+func (c *Code) Black(x, y int) bool {
+	if x < 0 || y < 0 || x >= c.Size || y >= c.Size {
+		return false
+	}
+	return c.dark[y*c.Size+x]
+}
+
+func (c *Code) set(x, y int, dark bool) {
+	c.dark[y*c.Size+x] = dark
+	c.function[y*c.Size+x] = true
+}
+
+func (c *Code) drawFunctionPatterns() {
+	for i := 0; i < c.Size; i++ {
+		c.set(6, i, i%2 == 0)
+		c.set(i, 6, i%2 == 0)
+	}
+
+	c.drawFinder(3, 3)
+	c.drawFinder(c.Size-4, 3)
+	c.drawFinder(3, c.Size-4)
+
+	pos := alignmentTable[c.Version]
+	for i, x := range pos {
+		for j, y := range pos {
+			last := len(pos) - 1
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue // overlaps a finder pattern
+			}
+			c.drawAlignment(x, y)
+		}
+	}
+
+	// Reserve the format and version areas; they are drawn later.
+	c.drawFormat(0)
+	c.drawVersion()
+}
+
+func (c *Code) drawFinder(cx, cy int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			x, y := cx+dx, cy+dy
+			if x < 0 || y < 0 || x >= c.Size || y >= c.Size {
+				continue
+			}
+			d := abs(dx)
+			if abs(dy) > d {
+				d = abs(dy)
+			}
+			c.set(x, y, d != 2 && d != 4)
+		}
+	}
+}
+
+func (c *Code) drawAlignment(cx, cy int) {
+	for dy := -2; dy <= 2; dy++ {
+		for dx := -2; dx <= 2; dx++ {
+			d := abs(dx)
+			if abs(dy) > d {
+				d = abs(dy)
+			}
+			c.set(cx+dx, cy+dy, d != 1)
+		}
+	}
+}
+
+// formatWord returns the 15-bit format information for level and mask.
+func formatWord(level Level, mask int) int {
+	data := formatBits[level]<<3 | mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	return (data<<10 | rem) ^ 0x5412
+}
+
+// formatPositions returns the module coordinates of both copies of the
+// format information, indexed by bit.
+func formatPositions(size int) (first, second [15][2]int) {
+	for i := 0; i < 6; i++ {
+		first[i] = [2]int{8, i}
+	}
+	first[6] = [2]int{8, 7}
+	first[7] = [2]int{8, 8}
+	first[8] = [2]int{7, 8}
+	for i := 9; i < 15; i++ {
+		first[i] = [2]int{14 - i, 8}
+	}
+	for i := 0; i < 8; i++ {
+		second[i] = [2]int{size - 1 - i, 8}
+	}
+	for i := 8; i < 15; i++ {
+		second[i] = [2]int{8, size - 15 + i}
+	}
+	return
+}
+
+func (c *Code) drawFormat(mask int) {
+	bits := formatWord(c.Level, mask)
+	first, second := formatPositions(c.Size)
+	for i := 0; i < 15; i++ {
+		bit := (bits>>uint(i))&1 != 0
+		c.set(first[i][0], first[i][1], bit)
+		c.set(second[i][0], second[i][1], bit)
+	}
+	c.set(8, c.Size-8, true)
+}
+
+// versionPositions returns the module coordinates of both copies of the
+// version information, indexed by bit.
+func versionPositions(size int) (first, second [18][2]int) {
+	for i := 0; i < 18; i++ {
+		a := size - 11 + i%3
+		b := i / 3
+		first[i] = [2]int{a, b}
+		second[i] = [2]int{b, a}
+	}
+	return
+}
+
+func versionWord(version int) int {
+	rem := version
+	for i := 0; i < 12; i++ {
+		rem = (rem << 1) ^ ((rem >> 11) * 0x1f25)
+	}
+	return version<<12 | rem
+}
+
+func (c *Code) drawVersion() {
+	if c.Version < 7 {
+		return
+	}
+	bits := versionWord(c.Version)
+	first, second := versionPositions(c.Size)
+	for i := 0; i < 18; i++ {
+		bit := (bits>>uint(i))&1 != 0
+		c.set(first[i][0], first[i][1], bit)
+		c.set(second[i][0], second[i][1], bit)
+	}
+}
+
+// dataPositions returns the coordinates of the non-function modules in
+// the order codeword bits are placed.
+func (c *Code) dataPositions() [][2]int {
+	var pos [][2]int
+	for right := c.Size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		upward := (right+1)&2 == 0
+		for vert := 0; vert < c.Size; vert++ {
+			y := vert
+			if upward {
+				y = c.Size - 1 - vert
+			}
+			for j := 0; j < 2; j++ {
+				x := right - j
+				if !c.function[y*c.Size+x] {
+					pos = append(pos, [2]int{x, y})
+				}
+			}
+		}
+	}
+	return pos
+}
+
+func masked(mask, x, y int) bool {
+	switch mask {
+	case 0:
+		return (x+y)%2 == 0
+	case 1:
+		return y%2 == 0
+	case 2:
+		return x%3 == 0
+	case 3:
+		return (x+y)%3 == 0
+	case 4:
+		return (x/3+y/2)%2 == 0
+	case 5:
+		return x*y%2+x*y%3 == 0
+	case 6:
+		return (x*y%2+x*y%3)%2 == 0
+	case 7:
+		return ((x+y)%2+x*y%3)%2 == 0
+	}
+	panic("qr: bad mask")
+}
+
+func (c *Code) applyMask(mask int) {
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			if !c.function[y*c.Size+x] && masked(mask, x, y) {
+				c.dark[y*c.Size+x] = !c.dark[y*c.Size+x]
+			}
+		}
+	}
+}
+
+// countBits is the width of the byte mode character count.
+func countBits(version int) int {
+	if version < 10 {
+		return 8
+	}
+	return 16
+}
+
+var ErrTooLong = errors.New("qr: data too long")
+
+// Encode returns the smallest QR code holding data in byte mode.
+func Encode(data []byte, level Level) (*Code, error) {
+	version := 1
+	for ; version <= maxVersion; version++ {
+		capBits := blockTable[version][level].dataLen() * 8
+		if 4+countBits(version)+len(data)*8 <= capBits {
+			break
+		}
+	}
+	if version > maxVersion {
+		return nil, ErrTooLong
+	}
+	info := blockTable[version][level]
+
+	var bb bitBuffer
+	bb.append(0x4, 4)
+	bb.append(len(data), countBits(version))
+	for _, b := range data {
+		bb.append(int(b), 8)
+	}
+	capBits := info.dataLen() * 8
+	for i := 0; i < 4 && len(bb) < capBits; i++ {
+		bb.append(0, 1)
+	}
+	for len(bb)%8 != 0 {
+		bb.append(0, 1)
+	}
+	for pad := 0xec; len(bb) < capBits; pad ^= 0xec ^ 0x11 {
+		bb.append(pad, 8)
+	}
+
+	codewords := interleave(bb.bytes(), info)
+
+	c := newCode(version, level)
+	pos := c.dataPositions()
+	for i, p := range pos {
+		if i < len(codewords)*8 {
+			c.dark[p[1]*c.Size+p[0]] = (codewords[i>>3]>>uint(7-i&7))&1 != 0
+		}
+	}
+
+	best, bestPenalty := -1, 0
+	for mask := 0; mask < 8; mask++ {
+		c.applyMask(mask)
+		c.drawFormat(mask)
+		if p := c.penalty(); best < 0 || p < bestPenalty {
+			best, bestPenalty = mask, p
+		}
+		c.applyMask(mask)
+	}
+	c.applyMask(best)
+	c.drawFormat(best)
+	return c, nil
+}
+
+// interleave splits data into blocks, adds error correction and
+// interleaves the codewords of all blocks.
+func interleave(data []byte, info blockInfo) []byte {
+	nblocks := info.n1 + info.n2
+	blocks := make([][]byte, nblocks)
+	ecs := make([][]byte, nblocks)
+	for i := range blocks {
+		n := info.d1
+		if i >= info.n1 {
+			n++
+		}
+		blocks[i] = data[:n]
+		data = data[n:]
+		ecs[i] = rsEncode(blocks[i], info.ecLen)
+	}
+
+	var out []byte
+	for i := 0; i <= info.d1; i++ {
+		for _, b := range blocks {
+			if i < len(b) {
+				out = append(out, b[i])
+			}
+		}
+	}
+	for i := 0; i < info.ecLen; i++ {
+		for _, e := range ecs {
+			out = append(out, e[i])
+		}
+	}
+	return out
+}
+
+// penalty scores a masked symbol using the rules of ISO/IEC 18004 8.8.2.
+func (c *Code) penalty() int {
+	p := 0
+	n := c.Size
+	at := func(x, y int, transpose bool) bool {
+		if transpose {
+			return c.dark[x*n+y]
+		}
+		return c.dark[y*n+x]
+	}
+
+	for _, t := range []bool{false, true} {
+		for y := 0; y < n; y++ {
+			run := 0
+			for x := 0; x < n; x++ {
+				if x > 0 && at(x, y, t) == at(x-1, y, t) {
+					run++
+				} else {
+					run = 1
+				}
+				if run == 5 {
+					p += 3
+				} else if run > 5 {
+					p++
+				}
+
+				// 1:1:3:1:1 finder-like pattern with light space on one side.
+				if x >= 10 {
+					pattern := true
+					for i, d := range []bool{true, false, true, true, true, false, true} {
+						if at(x-10+i, y, t) != d {
+							pattern = false
+							break
+						}
+					}
+					if pattern {
+						before, after := true, true
+						for i := 7; i < 11; i++ {
+							if at(x-10+i, y, t) {
+								after = false
+							}
+						}
+						for i := 1; i <= 4; i++ {
+							if x-10-i >= 0 && at(x-10-i, y, t) {
+								before = false
+							}
+						}
+						if after || before {
+							p += 40
+						}
+					}
+				}
+			}
+		}
+	}
+
+	dark := 0
+	for y := 0; y < n; y++ {
+		for x := 0; x < n; x++ {
+			d := c.dark[y*n+x]
+			if d {
+				dark++
+			}
+			if x > 0 && y > 0 && d == c.dark[y*n+x-1] && d == c.dark[(y-1)*n+x] && d == c.dark[(y-1)*n+x-1] {
+				p += 3
+			}
+		}
+	}
+	p += abs(dark*20-n*n*10) / (n * n) * 10
+	return p
+}
+
+type bitBuffer []bool
+
+func (b *bitBuffer) append(v, n int) {
+	for i := n - 1; i >= 0; i-- {
+		*b = append(*b, (v>>uint(i))&1 != 0)
+	}
+}
+
+func (b bitBuffer) bytes() []byte {
+	out := make([]byte, len(b)/8)
+	for i, bit := range b {
+		if bit {
+			out[i/8] |= 0x80 >> uint(i%8)
+		}
+	}
+	return out
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+func (l Level) String() string {
+	if l < L || l > H {
+		return fmt.Sprintf("Level(%d)", int(l))
+	}
+	return "LMQH"[l : l+1]
+}
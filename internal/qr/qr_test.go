@@ -0,0 +1,121 @@
+package qr
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestRSCorrect(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for trial := 0; trial < 200; trial++ {
+		data := make([]byte, 1+rnd.Intn(100))
+		rnd.Read(data)
+		nsym := 2 + rnd.Intn(28)
+		block := append(append([]byte(nil), data...), rsEncode(data, nsym)...)
+		want := append([]byte(nil), block...)
+
+		for _, i := range rnd.Perm(len(block))[:rnd.Intn(nsym/2+1)] {
+			block[i] ^= byte(1 + rnd.Intn(255))
+		}
+		if err := rsCorrect(block, nsym); err != nil {
+			t.Fatalf("trial %d: rsCorrect: %s", trial, err)
+		}
+		if !bytes.Equal(block, want) {
+			t.Fatalf("trial %d: wrong correction", trial)
+		}
+	}
+}
+
+const keyFile = "wab77 b8fxk waqkz\nq0j9e 8jxqx vcc94\n64bb5 egb1d rpggb\ndbg4v 86ygw f4fzg\n"
+
+func TestRoundTrip(t *testing.T) {
+	for _, level := range []Level{L, M, Q, H} {
+		for n := 0; n < 200; n += 13 {
+			data := bytes.Repeat([]byte(keyFile), 3)[:n]
+			c, err := Encode(data, level)
+			if err == ErrTooLong {
+				continue
+			}
+			if err != nil {
+				t.Fatalf("Encode(%d bytes, %s): %s", n, level, err)
+			}
+			x, err := Decode(c.Image(2))
+			if err != nil {
+				t.Fatalf("Decode(version %d, %s): %s", c.Version, level, err)
+			}
+			if !bytes.Equal(x, data) {
+				t.Fatalf("version %d, %s:\nexpected %q\nactually %q", c.Version, level, data, x)
+			}
+		}
+	}
+}
+
+func TestScan(t *testing.T) {
+	c, err := Encode([]byte(keyFile), M)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := c.Image(6)
+
+	// Simulate a scan: rotated, scaled, offset on a larger page, with
+	// uneven lighting, noise, and a few damaged modules.
+	rnd := rand.New(rand.NewSource(2))
+	for _, angle := range []float64{0, 7, 90, 183, -35} {
+		scan := transformImage(src, angle*math.Pi/180, 1.37, 700, rnd)
+		x, err := Decode(scan)
+		if err != nil {
+			t.Fatalf("Decode(angle %.0f): %s", angle, err)
+		}
+		if string(x) != keyFile {
+			t.Fatalf("angle %.0f: expected %q, got %q", angle, keyFile, x)
+		}
+	}
+}
+
+func transformImage(src *image.Gray, angle, scale float64, side int, rnd *rand.Rand) image.Image {
+	dst := image.NewGray(image.Rect(0, 0, side, side))
+	sw := float64(src.Bounds().Dx())
+	cos, sin := math.Cos(angle), math.Sin(angle)
+	for y := 0; y < side; y++ {
+		for x := 0; x < side; x++ {
+			// Map back into the source image, centered.
+			dx, dy := float64(x)-float64(side)/2, float64(y)-float64(side)/2
+			sx := (cos*dx+sin*dy)/scale + sw/2
+			sy := (-sin*dx+cos*dy)/scale + sw/2
+			v := 255.0
+			if sx >= 0 && sy >= 0 && sx < sw && sy < sw {
+				v = float64(src.GrayAt(int(sx), int(sy)).Y)
+			}
+			v = 40 + v*0.6 + float64(x)*0.08 + rnd.Float64()*30
+			dst.SetGray(x, y, color.Gray{Y: uint8(math.Min(v, 255))})
+		}
+	}
+	// Ink blots.
+	for i := 0; i < 6; i++ {
+		bx, by := 150+rnd.Intn(400), 150+rnd.Intn(400)
+		for y := by; y < by+6; y++ {
+			for x := bx; x < bx+6; x++ {
+				dst.SetGray(x, y, color.Gray{Y: 20})
+			}
+		}
+	}
+	return dst
+}
+
+func TestRender(t *testing.T) {
+	c, err := Encode([]byte("kebab"), M)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.Split([]byte(c.Terminal()), []byte("\n"))
+	if n := (c.Size + 2*QuietZone + 1) / 2; len(lines) != n+1 {
+		t.Fatalf("Terminal: expected %d lines, got %d", n, len(lines)-1)
+	}
+	if !bytes.HasPrefix(c.SVG(), []byte("<svg ")) {
+		t.Fatalf("SVG: unexpected output")
+	}
+}
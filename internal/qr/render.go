@@ -0,0 +1,67 @@
+package qr
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+)
+
+// QuietZone is the light border, in modules, drawn around a symbol.
+const QuietZone = 4
+
+// Image renders the symbol with scale pixels per module.
+func (c *Code) Image(scale int) *image.Gray {
+	side := (c.Size + 2*QuietZone) * scale
+	img := image.NewGray(image.Rect(0, 0, side, side))
+	for py := 0; py < side; py++ {
+		for px := 0; px < side; px++ {
+			v := color.Gray{Y: 0xff}
+			if c.Black(px/scale-QuietZone, py/scale-QuietZone) {
+				v = color.Gray{Y: 0}
+			}
+			img.SetGray(px, py, v)
+		}
+	}
+	return img
+}
+
+// SVG renders the symbol as an SVG document, one unit per module.
+func (c *Code) SVG() []byte {
+	side := c.Size + 2*QuietZone
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" shape-rendering="crispEdges">`+"\n", side, side)
+	fmt.Fprintf(buf, `<rect width="%d" height="%d" fill="#fff"/>`+"\n", side, side)
+	buf.WriteString(`<path fill="#000" d="`)
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			if c.Black(x, y) {
+				fmt.Fprintf(buf, "M%d %dh1v1h-1z", x+QuietZone, y+QuietZone)
+			}
+		}
+	}
+	buf.WriteString("\"/>\n</svg>\n")
+	return buf.Bytes()
+}
+
+// Terminal renders the symbol with Unicode block characters, two rows
+// of modules per line of text.  Light modules are drawn as blocks, so
+// the output scans when shown as light text on a dark background.
+func (c *Code) Terminal() string {
+	blocks := []string{"█", "▄", "▀", " "} // indexed by top | bottom<<1 dark
+	buf := new(bytes.Buffer)
+	for y := -QuietZone; y < c.Size+QuietZone; y += 2 {
+		for x := -QuietZone; x < c.Size+QuietZone; x++ {
+			i := 0
+			if c.Black(x, y) {
+				i |= 1
+			}
+			if c.Black(x, y+1) {
+				i |= 2
+			}
+			buf.WriteString(blocks[i])
+		}
+		buf.WriteByte('\n')
+	}
+	return buf.String()
+}
@@ -0,0 +1,184 @@
+package qr
+
+import "errors"
+
+// Arithmetic in GF(256) with the QR code polynomial x^8+x^4+x^3+x^2+1.
+
+var (
+	gfExp [512]byte
+	gfLog [256]int
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = i
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < len(gfExp); i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[gfLog[a]+gfLog[b]]
+}
+
+func gfDiv(a, b byte) byte {
+	if b == 0 {
+		panic("qr: division by zero")
+	}
+	if a == 0 {
+		return 0
+	}
+	return gfExp[gfLog[a]+255-gfLog[b]]
+}
+
+// polyEval evaluates p, lowest degree first, at x.
+func polyEval(p []byte, x byte) byte {
+	var y byte
+	for i := len(p) - 1; i >= 0; i-- {
+		y = gfMul(y, x) ^ p[i]
+	}
+	return y
+}
+
+// rsGenerator returns (x - 1)(x - a)...(x - a^(n-1)), highest degree first.
+func rsGenerator(n int) []byte {
+	g := []byte{1}
+	for i := 0; i < n; i++ {
+		next := make([]byte, len(g)+1)
+		for j := range g {
+			next[j] ^= g[j]
+			next[j+1] ^= gfMul(g[j], gfExp[i])
+		}
+		g = next
+	}
+	return g
+}
+
+// rsEncode returns n error correction codewords for data.
+func rsEncode(data []byte, n int) []byte {
+	g := rsGenerator(n)
+	r := make([]byte, n)
+	for _, d := range data {
+		f := d ^ r[0]
+		copy(r, r[1:])
+		r[n-1] = 0
+		for i := 0; i < n; i++ {
+			r[i] ^= gfMul(f, g[i+1])
+		}
+	}
+	return r
+}
+
+var errTooManyErrors = errors.New("too many errors")
+
+// rsCorrect fixes up to nsym/2 errors in the codeword block in place,
+// where the last nsym codewords are error correction codewords.
+func rsCorrect(block []byte, nsym int) error {
+	// Syndromes S_j = block(a^j), block being highest degree first.
+	synd := make([]byte, nsym)
+	clean := true
+	for j := range synd {
+		var s byte
+		for _, c := range block {
+			s = gfMul(s, gfExp[j]) ^ c
+		}
+		synd[j] = s
+		if s != 0 {
+			clean = false
+		}
+	}
+	if clean {
+		return nil
+	}
+
+	// Berlekamp-Massey, polynomials lowest degree first.
+	lambda := []byte{1}
+	prev := []byte{1}
+	l := 0
+	m := 1
+	b := byte(1)
+	for n := 0; n < nsym; n++ {
+		d := synd[n]
+		for i := 1; i <= l && i < len(lambda); i++ {
+			d ^= gfMul(lambda[i], synd[n-i])
+		}
+		if d == 0 {
+			m++
+			continue
+		}
+		coef := gfDiv(d, b)
+		next := make([]byte, max(len(lambda), len(prev)+m))
+		copy(next, lambda)
+		for i, p := range prev {
+			next[i+m] ^= gfMul(coef, p)
+		}
+		if 2*l <= n {
+			prev = lambda
+			l = n + 1 - l
+			b = d
+			m = 1
+		} else {
+			m++
+		}
+		lambda = next
+	}
+	for len(lambda) > 1 && lambda[len(lambda)-1] == 0 {
+		lambda = lambda[:len(lambda)-1]
+	}
+	if l != len(lambda)-1 || 2*l > nsym {
+		return errTooManyErrors
+	}
+
+	// Omega = S(x) * Lambda(x) mod x^nsym.
+	omega := make([]byte, nsym)
+	for i := range synd {
+		for j := 0; j < len(lambda) && i+j < nsym; j++ {
+			omega[i+j] ^= gfMul(synd[i], lambda[j])
+		}
+	}
+
+	// Formal derivative of Lambda: only odd terms survive.
+	deriv := make([]byte, len(lambda))
+	for i := 1; i < len(lambda); i += 2 {
+		deriv[i-1] = lambda[i]
+	}
+
+	// Chien search over every position of the block.
+	found := 0
+	n := len(block)
+	for i := 0; i < n; i++ {
+		p := n - 1 - i // power of x for block[i]
+		xinv := gfExp[(255-p)%255]
+		if polyEval(lambda, xinv) != 0 {
+			continue
+		}
+		den := polyEval(deriv, xinv)
+		if den == 0 {
+			return errTooManyErrors
+		}
+		e := gfMul(gfExp[p], gfDiv(polyEval(omega, xinv), den))
+		block[i] ^= e
+		found++
+	}
+	if found != l {
+		return errTooManyErrors
+	}
+	return nil
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
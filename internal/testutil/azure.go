@@ -0,0 +1,350 @@
+package testutil
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/davidlazar/kebab/azure"
+	"github.com/davidlazar/kebab/bucket"
+)
+
+// Credentials accepted by the fake Azure server.  The account and key
+// are the well-known Azurite development credentials.
+const (
+	AzureAccount   = "devstoreaccount1"
+	AzureAccessKey = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+	AzureSASSig    = "kebab-testing-signature"
+)
+
+// AzureSAS is a SAS token accepted by the fake Azure server.
+var AzureSAS = url.Values{
+	"sv":  {azure.Version},
+	"sp":  {"racwdl"},
+	"sr":  {"c"},
+	"se":  {"2999-01-01T00:00:00Z"},
+	"sig": {AzureSASSig},
+}.Encode()
+
+// FakeAzure is a minimal in-memory stand-in for Azurite, the Azure
+// Storage emulator.  Blob URLs are path-style, as in Azurite:
+// http://host:port/<account>/<container>/<blob>.  It checks Shared Key
+// signatures independently of the azure package, accepts the AzureSAS
+// token, and implements Put Blob, Put Block, Put Block List, Get Blob,
+// Get Blob Properties, Delete Blob and List Blobs.
+type FakeAzure struct {
+	// MaxResults limits the number of entries in each list response.
+	MaxResults int
+
+	mu         sync.Mutex
+	containers map[string]map[string][]byte
+	blocks     map[string][]byte    // uncommitted blocks by blob and block ID
+	modified   map[string]time.Time // by container/blob
+}
+
+func NewFakeAzure(containers ...string) *FakeAzure {
+	s := &FakeAzure{
+		MaxResults: 5000,
+		containers: make(map[string]map[string][]byte),
+		blocks:     make(map[string][]byte),
+		modified:   make(map[string]time.Time),
+	}
+	for _, c := range containers {
+		s.containers[c] = make(map[string][]byte)
+	}
+	return s
+}
+
+func StartAzureServer(name string) (*FakeAzure, *httptest.Server) {
+	s := NewFakeAzure(name)
+	return s, httptest.NewServer(s)
+}
+
+// WriteAzureConfig writes a bucket JSON file for the given server to dir
+// and returns its path.  The file uses the SAS token if sas is set, and
+// the account key otherwise.
+func WriteAzureConfig(dir string, server *httptest.Server, name string, sas bool) string {
+	conf := &azure.Config{
+		Account:   AzureAccount,
+		Container: name,
+		Endpoint:  server.URL + "/" + AzureAccount,
+	}
+	if sas {
+		conf.SAS = AzureSAS
+	} else {
+		conf.AccessKey = AzureAccessKey
+	}
+	path := filepath.Join(dir, name+".json")
+	writeJSON(path, map[string]*azure.Config{"Azure": conf})
+	return path
+}
+
+// TempAzureBucket returns a bucket for a container on a new fake Azure
+// server, using blocks of blockSize bytes for larger blobs.
+func TempAzureBucket(name string, sas bool, blockSize int) (bucket.Bucket, *FakeAzure, *httptest.Server) {
+	fake, server := StartAzureServer(name)
+	c, err := azure.NewContainerFromFile(WriteAzureConfig(TempDir, server, name, sas))
+	if err != nil {
+		panic(err)
+	}
+	c.BlockSize = blockSize
+	return bucket.NewAzureBucket(c), fake, server
+}
+
+func writeAzureError(w http.ResponseWriter, status int, code, msg string) {
+	w.Header().Set("x-ms-error-code", code)
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+		Message string
+	}{Code: code, Message: msg})
+}
+
+func (s *FakeAzure) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeAzureError(w, http.StatusBadRequest, "InvalidInput", err.Error())
+		return
+	}
+	if code, msg := checkAzureAuth(r); code != "" {
+		writeAzureError(w, http.StatusForbidden, code, msg)
+		return
+	}
+	if md5sum := r.Header.Get("Content-MD5"); md5sum != "" {
+		sum := md5.Sum(body)
+		if md5sum != base64.StdEncoding.EncodeToString(sum[:]) {
+			writeAzureError(w, http.StatusBadRequest, "Md5Mismatch", "Content-MD5 mismatch")
+			return
+		}
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 3)
+	if len(parts) < 2 || parts[0] != AzureAccount {
+		writeAzureError(w, http.StatusBadRequest, "InvalidUri", r.URL.Path)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	blobs, ok := s.containers[parts[1]]
+	if !ok {
+		writeAzureError(w, http.StatusNotFound, "ContainerNotFound", parts[1])
+		return
+	}
+	query := r.URL.Query()
+	if len(parts) == 2 {
+		if r.Method == "GET" && query.Get("restype") == "container" && query.Get("comp") == "list" {
+			s.list(w, blobs, query)
+		} else {
+			writeAzureError(w, http.StatusNotImplemented, "NotImplemented", r.Method+" "+r.URL.Path)
+		}
+		return
+	}
+
+	name := parts[2]
+	switch {
+	case r.Method == "PUT" && query.Get("comp") == "block":
+		id := query.Get("blockid")
+		if _, err := base64.StdEncoding.DecodeString(id); err != nil || id == "" {
+			writeAzureError(w, http.StatusBadRequest, "InvalidQueryParameterValue", "blockid")
+			return
+		}
+		s.blocks[parts[1]+"/"+name+"\x00"+id] = body
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == "PUT" && query.Get("comp") == "blocklist":
+		var list struct {
+			Latest []string
+		}
+		if err := xml.Unmarshal(body, &list); err != nil {
+			writeAzureError(w, http.StatusBadRequest, "InvalidXmlDocument", err.Error())
+			return
+		}
+		var data []byte
+		for _, id := range list.Latest {
+			block, ok := s.blocks[parts[1]+"/"+name+"\x00"+id]
+			if !ok {
+				writeAzureError(w, http.StatusBadRequest, "InvalidBlockList", id)
+				return
+			}
+			data = append(data, block...)
+		}
+		for k := range s.blocks {
+			if strings.HasPrefix(k, parts[1]+"/"+name+"\x00") {
+				delete(s.blocks, k)
+			}
+		}
+		blobs[name] = data
+		s.modified[parts[1]+"/"+name] = time.Now()
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == "PUT" && query.Get("comp") == "":
+		if r.Header.Get("x-ms-blob-type") != "BlockBlob" {
+			writeAzureError(w, http.StatusBadRequest, "MissingRequiredHeader", "x-ms-blob-type")
+			return
+		}
+		blobs[name] = body
+		s.modified[parts[1]+"/"+name] = time.Now()
+		w.WriteHeader(http.StatusCreated)
+	case (r.Method == "GET" || r.Method == "HEAD") && query.Get("comp") == "":
+		data, ok := blobs[name]
+		if !ok {
+			writeAzureError(w, http.StatusNotFound, "BlobNotFound", "The specified blob does not exist.")
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Header().Set("Last-Modified", s.modified[parts[1]+"/"+name].UTC().Format(http.TimeFormat))
+		w.Header().Set("x-ms-blob-type", "BlockBlob")
+		if r.Method == "GET" {
+			w.Write(data)
+		}
+	case r.Method == "DELETE":
+		if _, ok := blobs[name]; !ok {
+			writeAzureError(w, http.StatusNotFound, "BlobNotFound", "The specified blob does not exist.")
+			return
+		}
+		delete(blobs, name)
+		delete(s.modified, parts[1]+"/"+name)
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		writeAzureError(w, http.StatusNotImplemented, "NotImplemented", r.Method+" "+r.URL.Path)
+	}
+}
+
+type azureListResult struct {
+	XMLName    xml.Name `xml:"EnumerationResults"`
+	Prefix     string
+	Marker     string
+	MaxResults int
+	Delimiter  string
+	Blobs      struct {
+		Blob       []azureName
+		BlobPrefix []azureName
+	}
+	NextMarker string
+}
+
+type azureName struct {
+	Name string
+}
+
+func (s *FakeAzure) list(w http.ResponseWriter, blobs map[string][]byte, query url.Values) {
+	max := s.MaxResults
+	if m := query.Get("maxresults"); m != "" {
+		n, err := strconv.Atoi(m)
+		if err != nil || n <= 0 {
+			writeAzureError(w, http.StatusBadRequest, "InvalidQueryParameterValue", "maxresults")
+			return
+		}
+		if n < max {
+			max = n
+		}
+	}
+	start := ""
+	if marker := query.Get("marker"); marker != "" {
+		b, err := base64.RawURLEncoding.DecodeString(marker)
+		if err != nil {
+			writeAzureError(w, http.StatusBadRequest, "InvalidQueryParameterValue", "marker")
+			return
+		}
+		start = string(b)
+	}
+
+	page := listObjects(blobs, query.Get("prefix"), query.Get("delimiter"), start, max)
+	result := &azureListResult{
+		Prefix:     query.Get("prefix"),
+		Marker:     query.Get("marker"),
+		MaxResults: max,
+		Delimiter:  query.Get("delimiter"),
+	}
+	for _, k := range page.keys {
+		result.Blobs.Blob = append(result.Blobs.Blob, azureName{k})
+	}
+	for _, p := range page.prefixes {
+		result.Blobs.BlobPrefix = append(result.Blobs.BlobPrefix, azureName{p})
+	}
+	if page.next != "" {
+		result.NextMarker = base64.RawURLEncoding.EncodeToString([]byte(page.next))
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
+
+// checkAzureAuth verifies the Shared Key signature or SAS token of a
+// request and returns an error code and message if it is invalid.
+func checkAzureAuth(r *http.Request) (code, msg string) {
+	query := r.URL.Query()
+	if sig := query.Get("sig"); sig != "" {
+		if sig != AzureSASSig {
+			return "AuthenticationFailed", "invalid SAS signature"
+		}
+		expiry, err := time.Parse(time.RFC3339, query.Get("se"))
+		if err != nil || time.Now().After(expiry) {
+			return "AuthenticationFailed", "SAS expired"
+		}
+		return "", ""
+	}
+
+	auth := r.Header.Get("Authorization")
+	prefix := "SharedKey " + AzureAccount + ":"
+	if !strings.HasPrefix(auth, prefix) {
+		return "AuthenticationFailed", "missing Shared Key authorization"
+	}
+	date, err := time.Parse(http.TimeFormat, r.Header.Get("x-ms-date"))
+	if err != nil || time.Since(date) > 15*time.Minute || time.Until(date) > 15*time.Minute {
+		return "AuthenticationFailed", "invalid x-ms-date"
+	}
+
+	var sts bytes.Buffer
+	sts.WriteString(r.Method + "\n")
+	for _, h := range []string{"Content-Encoding", "Content-Language", "Content-Length", "Content-MD5", "Content-Type",
+		"Date", "If-Modified-Since", "If-Match", "If-None-Match", "If-Unmodified-Since", "Range"} {
+		v := r.Header.Get(h)
+		if h == "Content-Length" {
+			v = ""
+			if r.ContentLength > 0 {
+				v = strconv.FormatInt(r.ContentLength, 10)
+			}
+		}
+		sts.WriteString(v + "\n")
+	}
+	var msHeaders []string
+	for k, vs := range r.Header {
+		if k = strings.ToLower(k); strings.HasPrefix(k, "x-ms-") {
+			msHeaders = append(msHeaders, k+":"+strings.TrimSpace(strings.Join(vs, ","))+"\n")
+		}
+	}
+	sort.Strings(msHeaders)
+	sts.WriteString(strings.Join(msHeaders, ""))
+	sts.WriteString("/" + AzureAccount + r.URL.EscapedPath())
+	var params []string
+	for k, vs := range query {
+		sort.Strings(vs)
+		params = append(params, "\n"+strings.ToLower(k)+":"+strings.Join(vs, ","))
+	}
+	sort.Strings(params)
+	sts.WriteString(strings.Join(params, ""))
+
+	key, _ := base64.StdEncoding.DecodeString(AzureAccessKey)
+	h := hmac.New(sha256.New, key)
+	h.Write(sts.Bytes())
+	want := base64.StdEncoding.EncodeToString(h.Sum(nil))
+	if !hmac.Equal([]byte(auth[len(prefix):]), []byte(want)) {
+		return "AuthenticationFailed", "signature mismatch for string to sign " + strconv.Quote(sts.String())
+	}
+	return "", ""
+}
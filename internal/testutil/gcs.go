@@ -0,0 +1,366 @@
+package testutil
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/davidlazar/kebab/bucket"
+	"github.com/davidlazar/kebab/gcs"
+)
+
+// GCSClientEmail is the service account accepted by the fake GCS server.
+const GCSClientEmail = "kebab@kebab-testing.iam.gserviceaccount.com"
+
+// FakeGCS is a minimal in-memory Google Cloud Storage server.  It
+// implements the OAuth token endpoint for service accounts at /token and
+// enough of the JSON API for kebab: media uploads and downloads, object
+// listing with pagination, and batched deletes.
+type FakeGCS struct {
+	// MaxResults limits the number of entries in each list response.
+	MaxResults int
+	// KeepDeleted makes deletes succeed without removing the objects.
+	KeepDeleted bool
+
+	key      *rsa.PrivateKey
+	tokens   map[string]time.Time
+	mu       sync.Mutex
+	buckets  map[string]map[string][]byte
+	modified map[string]time.Time // by bucket/object
+}
+
+func NewFakeGCS(buckets ...string) *FakeGCS {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	s := &FakeGCS{
+		MaxResults: 1000,
+		key:        key,
+		tokens:     make(map[string]time.Time),
+		buckets:    make(map[string]map[string][]byte),
+		modified:   make(map[string]time.Time),
+	}
+	for _, b := range buckets {
+		s.buckets[b] = make(map[string][]byte)
+	}
+	return s
+}
+
+func StartGCSServer(name string) (*FakeGCS, *httptest.Server) {
+	s := NewFakeGCS(name)
+	return s, httptest.NewServer(s)
+}
+
+// WriteGCSConfig writes a service account key file and a bucket JSON
+// file for the given server to dir and returns the path of the latter.
+func WriteGCSConfig(dir string, s *FakeGCS, server *httptest.Server, name string) string {
+	der, err := x509.MarshalPKCS8PrivateKey(s.key)
+	if err != nil {
+		panic(err)
+	}
+	account := &gcs.ServiceAccount{
+		Type:         "service_account",
+		PrivateKeyID: "kebab-testing-key",
+		PrivateKey:   string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		ClientEmail:  GCSClientEmail,
+		TokenURI:     server.URL + "/token",
+	}
+	writeJSON(filepath.Join(dir, name+"-credentials.json"), account)
+
+	path := filepath.Join(dir, name+".json")
+	writeJSON(path, map[string]*gcs.Config{
+		"GCS": {
+			Bucket:          name,
+			CredentialsFile: name + "-credentials.json",
+			Endpoint:        server.URL,
+		},
+	})
+	return path
+}
+
+func writeJSON(path string, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		panic(err)
+	}
+}
+
+func TempGCSBucket(name string) (bucket.Bucket, *FakeGCS, *httptest.Server) {
+	fake, server := StartGCSServer(name)
+	b, err := bucket.NewGCSBucketFromFile(WriteGCSConfig(TempDir, fake, server, name))
+	if err != nil {
+		panic(err)
+	}
+	b, err = b.Descend(name)
+	if err != nil {
+		panic(err)
+	}
+	return b, fake, server
+}
+
+func writeGCSError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{"code": code, "message": msg},
+	})
+}
+
+func (s *FakeGCS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/token" {
+		s.serveToken(w, r)
+		return
+	}
+
+	s.mu.Lock()
+	expiry, ok := s.tokens[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")]
+	s.mu.Unlock()
+	if !ok || time.Now().After(expiry) {
+		writeGCSError(w, http.StatusUnauthorized, "invalid credentials")
+		return
+	}
+
+	if r.Method == "POST" && r.URL.Path == "/batch/storage/v1" {
+		s.serveBatch(w, r)
+		return
+	}
+	s.serveStorage(w, r)
+}
+
+func (s *FakeGCS) serveToken(w http.ResponseWriter, r *http.Request) {
+	if r.FormValue("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" {
+		http.Error(w, `{"error":"unsupported_grant_type"}`, http.StatusBadRequest)
+		return
+	}
+	claims, err := gcs.VerifyJWT(&s.key.PublicKey, r.FormValue("assertion"))
+	if err != nil {
+		http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+		return
+	}
+	now := time.Now().Unix()
+	aud := "http://" + r.Host + "/token"
+	if claims.Issuer != GCSClientEmail || claims.Audience != aud || claims.Scope != gcs.Scope ||
+		claims.IssuedAt > now+60 || claims.Expiry < now || claims.Expiry-claims.IssuedAt > 3600 {
+		http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+		return
+	}
+
+	token := hex.EncodeToString(RandomBytes(16))
+	s.mu.Lock()
+	s.tokens[token] = time.Now().Add(time.Hour)
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&gcs.TokenResponse{
+		AccessToken: token,
+		ExpiresIn:   3600,
+		TokenType:   "Bearer",
+	})
+}
+
+func gcsObject(name string, data []byte, updated time.Time) *gcs.Object {
+	sum := md5.Sum(data)
+	return &gcs.Object{
+		Name:    name,
+		Size:    strconv.Itoa(len(data)),
+		MD5Hash: base64.StdEncoding.EncodeToString(sum[:]),
+		Updated: updated,
+	}
+}
+
+// serveStorage handles the JSON API paths:
+//
+//	POST   /upload/storage/v1/b/<bucket>/o?uploadType=media&name=<object>
+//	GET    /storage/v1/b/<bucket>/o
+//	GET    /storage/v1/b/<bucket>/o/<object>[?alt=media]
+//	DELETE /storage/v1/b/<bucket>/o/<object>
+func (s *FakeGCS) serveStorage(w http.ResponseWriter, r *http.Request) {
+	upload := strings.HasPrefix(r.URL.Path, "/upload/")
+	p := strings.TrimPrefix(r.URL.EscapedPath(), "/upload")
+	parts := strings.Split(strings.TrimPrefix(p, "/storage/v1/b/"), "/")
+	if !strings.HasPrefix(p, "/storage/v1/b/") || len(parts) < 2 || len(parts) > 3 || parts[1] != "o" {
+		writeGCSError(w, http.StatusNotFound, "not found: "+r.URL.Path)
+		return
+	}
+	name, err := url.PathUnescape(parts[0])
+	if err != nil {
+		writeGCSError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	object := ""
+	if len(parts) == 3 {
+		if object, err = url.PathUnescape(parts[2]); err != nil {
+			writeGCSError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	objects, ok := s.buckets[name]
+	if !ok {
+		writeGCSError(w, http.StatusNotFound, "bucket not found: "+name)
+		return
+	}
+
+	query := r.URL.Query()
+	switch {
+	case upload && r.Method == "POST" && len(parts) == 2:
+		if query.Get("uploadType") != "media" || query.Get("name") == "" {
+			writeGCSError(w, http.StatusBadRequest, "expecting uploadType=media and name")
+			return
+		}
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeGCSError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		objects[query.Get("name")] = data
+		now := time.Now()
+		s.modified[name+"/"+query.Get("name")] = now
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(gcsObject(query.Get("name"), data, now))
+	case !upload && r.Method == "GET" && len(parts) == 2:
+		s.list(w, objects, query)
+	case !upload && r.Method == "GET":
+		data, ok := objects[object]
+		if !ok {
+			writeGCSError(w, http.StatusNotFound, "No such object: "+name+"/"+object)
+			return
+		}
+		if query.Get("alt") == "media" {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Write(data)
+		} else {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(gcsObject(object, data, s.modified[name+"/"+object]))
+		}
+	case !upload && r.Method == "DELETE" && len(parts) == 3:
+		if _, ok := objects[object]; !ok {
+			writeGCSError(w, http.StatusNotFound, "No such object: "+name+"/"+object)
+			return
+		}
+		if !s.KeepDeleted {
+			delete(objects, object)
+			delete(s.modified, name+"/"+object)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeGCSError(w, http.StatusNotImplemented, r.Method+" "+r.URL.Path)
+	}
+}
+
+func (s *FakeGCS) list(w http.ResponseWriter, objects map[string][]byte, query url.Values) {
+	start := ""
+	if token := query.Get("pageToken"); token != "" {
+		b, err := base64.URLEncoding.DecodeString(token)
+		if err != nil {
+			writeGCSError(w, http.StatusBadRequest, "invalid pageToken")
+			return
+		}
+		start = string(b)
+	}
+	max := s.MaxResults
+	if m := query.Get("maxResults"); m != "" {
+		n, err := strconv.Atoi(m)
+		if err != nil || n <= 0 {
+			writeGCSError(w, http.StatusBadRequest, "invalid maxResults")
+			return
+		}
+		if n < max {
+			max = n
+		}
+	}
+
+	page := listObjects(objects, query.Get("prefix"), query.Get("delimiter"), start, max)
+	result := new(gcs.ListResult)
+	for _, k := range page.keys {
+		result.Items = append(result.Items, gcsObject(k, objects[k], time.Time{}))
+	}
+	result.Prefixes = page.prefixes
+	if page.next != "" {
+		result.NextPageToken = base64.URLEncoding.EncodeToString([]byte(page.next))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// serveBatch runs each application/http part of a multipart/mixed batch
+// request and replies with the responses in the same order.
+func (s *FakeGCS) serveBatch(w http.ResponseWriter, r *http.Request) {
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" {
+		writeGCSError(w, http.StatusBadRequest, "expecting multipart/mixed")
+		return
+	}
+
+	var replies []*httptest.ResponseRecorder
+	var ids []string
+	mr := multipart.NewReader(r.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+		if part.Header.Get("Content-Type") != "application/http" {
+			writeGCSError(w, http.StatusBadRequest, "expecting application/http parts")
+			return
+		}
+		req, err := http.ReadRequest(bufio.NewReader(part))
+		if err != nil {
+			writeGCSError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if len(replies) == gcs.MaxBatch {
+			writeGCSError(w, http.StatusBadRequest, "too many requests in batch")
+			return
+		}
+		rec := httptest.NewRecorder()
+		s.serveStorage(rec, req)
+		replies = append(replies, rec)
+		ids = append(ids, part.Header.Get("Content-ID"))
+	}
+
+	body := new(bytes.Buffer)
+	mw := multipart.NewWriter(body)
+	for i, rec := range replies {
+		h := make(textproto.MIMEHeader)
+		h.Set("Content-Type", "application/http")
+		h.Set("Content-ID", "response-"+ids[i])
+		pw, _ := mw.CreatePart(h)
+		resp := rec.Result()
+		fmt.Fprintf(pw, "HTTP/1.1 %s\r\n", resp.Status)
+		resp.Header.Write(pw)
+		fmt.Fprintf(pw, "Content-Length: %d\r\n\r\n", rec.Body.Len())
+		pw.Write(rec.Body.Bytes())
+	}
+	mw.Close()
+
+	w.Header().Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+	w.Write(body.Bytes())
+}
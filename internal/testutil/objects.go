@@ -0,0 +1,51 @@
+package testutil
+
+import (
+	"sort"
+	"strings"
+)
+
+// objectPage is one page of a prefix/delimiter listing, as returned by
+// the fake object stores.
+type objectPage struct {
+	keys     []string
+	prefixes []string
+	next     string // start of the next page, or "" if this is the last
+}
+
+// listObjects lists up to max keys and common prefixes that start with
+// prefix and sort after start.  Keys containing delimiter after the
+// prefix are rolled up into a common prefix ending with the delimiter.
+func listObjects(objects map[string][]byte, prefix, delimiter, start string, max int) *objectPage {
+	keys := make([]string, 0, len(objects))
+	for k := range objects {
+		if strings.HasPrefix(k, prefix) && k > start {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	page := new(objectPage)
+	last := ""
+	for _, k := range keys {
+		if k <= last {
+			// Already covered by the previous common prefix.
+			continue
+		}
+		if len(page.keys)+len(page.prefixes) == max {
+			page.next = last
+			break
+		}
+		if i := strings.Index(k[len(prefix):], delimiter); delimiter != "" && i >= 0 {
+			p := k[:len(prefix)+i+len(delimiter)]
+			page.prefixes = append(page.prefixes, p)
+			// Skip every key starting with p; keys are UTF-8, so
+			// they never contain 0xff.
+			last = p + "\xff"
+		} else {
+			page.keys = append(page.keys, k)
+			last = k
+		}
+	}
+	return page
+}
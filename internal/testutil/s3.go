@@ -0,0 +1,421 @@
+package testutil
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/davidlazar/kebab/bucket"
+	"github.com/davidlazar/kebab/s3"
+)
+
+// Credentials accepted by the fake S3 server.
+const (
+	S3Region      = "us-east-1"
+	S3AccessKeyId = "AKIDKEBAB"
+	S3AccessKey   = "kebab/secret/access/key"
+)
+
+// FakeS3 is a minimal in-memory S3 server.  It supports path-style and
+// virtual-host addressing, checks request signatures independently of
+// the s3 package, and implements enough of the API for kebab: PUT, GET,
+// HEAD and DELETE of objects, ListObjects (V1 and V2) and multi-object
+// delete.
+type FakeS3 struct {
+	// MaxKeys limits the number of entries in each list response.
+	MaxKeys int
+	// NoContinuationToken leaves the token out of truncated V2
+	// list responses, as a broken service might.
+	NoContinuationToken bool
+
+	mu       sync.Mutex
+	buckets  map[string]map[string][]byte
+	modified map[string]time.Time // by bucket/key
+}
+
+func NewFakeS3(buckets ...string) *FakeS3 {
+	s := &FakeS3{
+		MaxKeys:  1000,
+		buckets:  make(map[string]map[string][]byte),
+		modified: make(map[string]time.Time),
+	}
+	for _, b := range buckets {
+		s.buckets[b] = make(map[string][]byte)
+	}
+	return s
+}
+
+// StartS3Server starts a fake S3 server with the given bucket over plain
+// HTTP, or over HTTPS with a self-signed certificate if useTLS is set.
+func StartS3Server(name string, useTLS bool) (*FakeS3, *httptest.Server) {
+	s := NewFakeS3(name)
+	if useTLS {
+		return s, httptest.NewTLSServer(s)
+	}
+	return s, httptest.NewServer(s)
+}
+
+// WriteS3Config writes a bucket JSON file for the given server to dir and
+// returns its path.  For TLS servers, the server's certificate is written
+// next to it and referenced as the CA file.
+func WriteS3Config(dir string, server *httptest.Server, name string, pathStyle bool) string {
+	service := map[string]interface{}{
+		"Endpoint":    server.URL,
+		"Region":      S3Region,
+		"AccessKey":   S3AccessKey,
+		"AccessKeyId": S3AccessKeyId,
+		"PathStyle":   pathStyle,
+	}
+	if server.TLS != nil {
+		cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+		caFile := name + "-ca.pem"
+		if err := ioutil.WriteFile(filepath.Join(dir, caFile), cert, 0600); err != nil {
+			panic(err)
+		}
+		service["CAFile"] = caFile
+	}
+	data, err := json.Marshal(map[string]interface{}{
+		"Service": service,
+		"Bucket":  name,
+	})
+	if err != nil {
+		panic(err)
+	}
+	path := filepath.Join(dir, name+".json")
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		panic(err)
+	}
+	return path
+}
+
+// VirtualHostClient returns a client that sends every request to the
+// given plain HTTP server, so virtual-host URLs like
+// http://bucket.127.0.0.1:port/ reach it without DNS.
+func VirtualHostClient(server *httptest.Server) *http.Client {
+	addr := server.Listener.Addr().String()
+	transport := server.Client().Transport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	}
+	return &http.Client{Transport: transport}
+}
+
+type s3Error struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string
+	Message string
+}
+
+func writeS3Error(w http.ResponseWriter, status int, code, msg string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(s3Error{Code: code, Message: msg})
+}
+
+func (s *FakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeS3Error(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return
+	}
+	if err := checkS3Signature(r, body); err != nil {
+		writeS3Error(w, http.StatusForbidden, "SignatureDoesNotMatch", err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	name, key := s.route(r)
+	objects, ok := s.buckets[name]
+	if !ok {
+		writeS3Error(w, http.StatusNotFound, "NoSuchBucket", name)
+		return
+	}
+
+	query := r.URL.Query()
+	switch {
+	case r.Method == "PUT" && key != "":
+		objects[key] = body
+		s.modified[name+"/"+key] = time.Now()
+		w.Header().Set("ETag", fmt.Sprintf(`"%x"`, md5.Sum(body)))
+	case (r.Method == "GET" || r.Method == "HEAD") && key != "":
+		data, ok := objects[key]
+		if !ok {
+			if r.Method == "HEAD" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			writeS3Error(w, http.StatusNotFound, "NoSuchKey", key)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Header().Set("ETag", fmt.Sprintf(`"%x"`, md5.Sum(data)))
+		w.Header().Set("Last-Modified", s.modified[name+"/"+key].UTC().Format(http.TimeFormat))
+		if r.Method == "GET" {
+			w.Write(data)
+		}
+	case r.Method == "DELETE" && key != "":
+		delete(objects, key)
+		delete(s.modified, name+"/"+key)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == "GET" && key == "":
+		s.list(w, objects, query)
+	case r.Method == "POST" && key == "" && query["delete"] != nil:
+		s.delete(w, name, objects, r, body)
+	default:
+		writeS3Error(w, http.StatusNotImplemented, "NotImplemented", r.Method+" "+r.URL.Path)
+	}
+}
+
+// route splits the request into a bucket name and key, using the host
+// name for virtual-host requests and the first path segment otherwise.
+func (s *FakeS3) route(r *http.Request) (name, key string) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if i := strings.Index(host, "."); i > 0 {
+		if _, ok := s.buckets[host[:i]]; ok {
+			return host[:i], strings.TrimPrefix(r.URL.Path, "/")
+		}
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	if i := strings.Index(path, "/"); i >= 0 {
+		return path[:i], path[i+1:]
+	}
+	return path, ""
+}
+
+type s3ListResult struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Prefix                string
+	Delimiter             string `xml:",omitempty"`
+	MaxKeys               int
+	KeyCount              int `xml:",omitempty"`
+	IsTruncated           bool
+	NextMarker            string `xml:",omitempty"`
+	NextContinuationToken string `xml:",omitempty"`
+	Contents              []s3ListEntry
+	CommonPrefixes        []s3ListPrefix
+}
+
+type s3ListEntry struct {
+	Key  string
+	Size int
+}
+
+type s3ListPrefix struct {
+	Prefix string
+}
+
+func (s *FakeS3) list(w http.ResponseWriter, objects map[string][]byte, query map[string][]string) {
+	get := func(k string) string {
+		if v := query[k]; len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+	prefix, delimiter := get("prefix"), get("delimiter")
+	v2 := get("list-type") == "2"
+	start := get("marker")
+	if v2 {
+		start = get("start-after")
+		if token := get("continuation-token"); token != "" {
+			b, err := base64.URLEncoding.DecodeString(token)
+			if err != nil {
+				writeS3Error(w, http.StatusBadRequest, "InvalidArgument", "bad continuation token")
+				return
+			}
+			start = string(b)
+		}
+	}
+	maxKeys := s.MaxKeys
+	if m := get("max-keys"); m != "" {
+		n, err := strconv.Atoi(m)
+		if err != nil || n < 0 {
+			writeS3Error(w, http.StatusBadRequest, "InvalidArgument", "bad max-keys")
+			return
+		}
+		if n < maxKeys {
+			maxKeys = n
+		}
+	}
+
+	page := listObjects(objects, prefix, delimiter, start, maxKeys)
+	result := &s3ListResult{
+		Prefix:      prefix,
+		Delimiter:   delimiter,
+		MaxKeys:     maxKeys,
+		KeyCount:    len(page.keys) + len(page.prefixes),
+		IsTruncated: page.next != "",
+	}
+	for _, k := range page.keys {
+		result.Contents = append(result.Contents, s3ListEntry{k, len(objects[k])})
+	}
+	for _, p := range page.prefixes {
+		result.CommonPrefixes = append(result.CommonPrefixes, s3ListPrefix{p})
+	}
+	if result.IsTruncated {
+		if v2 && !s.NoContinuationToken {
+			result.NextContinuationToken = base64.URLEncoding.EncodeToString([]byte(page.next))
+		} else if !v2 {
+			result.NextMarker = page.next
+		}
+	}
+	if !v2 {
+		result.KeyCount = 0
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
+
+type s3DeleteResult struct {
+	XMLName xml.Name `xml:"DeleteResult"`
+	Deleted []s3ListEntry
+}
+
+func (s *FakeS3) delete(w http.ResponseWriter, name string, objects map[string][]byte, r *http.Request, body []byte) {
+	sum := md5.Sum(body)
+	if r.Header.Get("Content-MD5") != base64.StdEncoding.EncodeToString(sum[:]) {
+		writeS3Error(w, http.StatusBadRequest, "BadDigest", "Content-MD5 mismatch")
+		return
+	}
+	var del struct {
+		Object []struct{ Key string }
+	}
+	if err := xml.Unmarshal(body, &del); err != nil {
+		writeS3Error(w, http.StatusBadRequest, "MalformedXML", err.Error())
+		return
+	}
+	if len(del.Object) > 1000 {
+		writeS3Error(w, http.StatusBadRequest, "MalformedXML", "too many keys")
+		return
+	}
+	result := new(s3DeleteResult)
+	for _, o := range del.Object {
+		delete(objects, o.Key)
+		delete(s.modified, name+"/"+o.Key)
+		result.Deleted = append(result.Deleted, s3ListEntry{Key: o.Key})
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
+
+// checkS3Signature verifies an AWS Signature Version 4 Authorization
+// header the way S3 does: the path is signed without normalization.
+func checkS3Signature(r *http.Request, body []byte) error {
+	auth := r.Header.Get("Authorization")
+	const algorithm = "AWS4-HMAC-SHA256 "
+	if !strings.HasPrefix(auth, algorithm) {
+		return fmt.Errorf("unsupported authorization %q", auth)
+	}
+	fields := make(map[string]string)
+	for _, f := range strings.Split(auth[len(algorithm):], ",") {
+		kv := strings.SplitN(strings.TrimSpace(f), "=", 2)
+		if len(kv) == 2 {
+			fields[kv[0]] = kv[1]
+		}
+	}
+	cred := strings.Split(fields["Credential"], "/")
+	if len(cred) != 5 || cred[0] != S3AccessKeyId || cred[2] != S3Region || cred[3] != "s3" || cred[4] != "aws4_request" {
+		return fmt.Errorf("invalid credential %q", fields["Credential"])
+	}
+
+	date, err := time.Parse("20060102T150405Z", r.Header.Get("x-amz-date"))
+	if err != nil {
+		return fmt.Errorf("invalid x-amz-date: %s", err)
+	}
+	if cred[1] != date.Format("20060102") {
+		return fmt.Errorf("credential date %q does not match x-amz-date", cred[1])
+	}
+
+	payload := r.Header.Get("x-amz-content-sha256")
+	if payload != fmt.Sprintf("%x", sha256.Sum256(body)) {
+		return fmt.Errorf("x-amz-content-sha256 does not match body")
+	}
+
+	var cr bytes.Buffer
+	cr.WriteString(r.Method + "\n")
+	cr.WriteString(awsEncode(r.URL.Path, false) + "\n")
+	var qs []string
+	for k, vs := range r.URL.Query() {
+		for _, v := range vs {
+			qs = append(qs, awsEncode(k, true)+"="+awsEncode(v, true))
+		}
+	}
+	sort.Strings(qs)
+	cr.WriteString(strings.Join(qs, "&") + "\n")
+	signed := strings.Split(fields["SignedHeaders"], ";")
+	for _, h := range signed {
+		v := strings.Join(r.Header[http.CanonicalHeaderKey(h)], ",")
+		if h == "host" {
+			v = r.Host
+		}
+		cr.WriteString(h + ":" + strings.TrimSpace(v) + "\n")
+	}
+	cr.WriteString("\n" + fields["SignedHeaders"] + "\n" + payload)
+
+	crHash := sha256.Sum256(cr.Bytes())
+	sts := fmt.Sprintf("AWS4-HMAC-SHA256\n%s\n%s\n%x",
+		r.Header.Get("x-amz-date"), strings.Join(cred[1:], "/"), crHash)
+
+	key := []byte("AWS4" + S3AccessKey)
+	for _, s := range []string{cred[1], S3Region, "s3", "aws4_request", sts} {
+		h := hmac.New(sha256.New, key)
+		h.Write([]byte(s))
+		key = h.Sum(nil)
+	}
+	sig, err := hex.DecodeString(fields["Signature"])
+	if err != nil || !hmac.Equal(sig, key) {
+		return fmt.Errorf("signature mismatch for canonical request %q", cr.String())
+	}
+	return nil
+}
+
+func awsEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// TempFakeS3Bucket returns a bucket named name on a new fake S3 server.
+func TempFakeS3Bucket(name string, useTLS, pathStyle bool) (bucket.Bucket, *FakeS3, *httptest.Server) {
+	fake, server := StartS3Server(name, useTLS)
+	path := WriteS3Config(TempDir, server, name, pathStyle)
+	s3b, err := s3.NewBucketFromFile(path)
+	if err != nil {
+		panic(err)
+	}
+	if !pathStyle {
+		s3b.Service.Client = VirtualHostClient(server)
+	}
+	return bucket.NewS3Bucket(s3b), fake, server
+}
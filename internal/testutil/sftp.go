@@ -0,0 +1,147 @@
+package testutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/url"
+	"path/filepath"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/davidlazar/kebab/bucket"
+)
+
+var sftpURL *url.URL
+
+// StartSFTPServer starts an in-process SFTP server that serves the local
+// file system to a single client key, and returns a URL for
+// bucket.NewSFTPBucketFromURL that points to dir.  The host key and
+// client key are written to TempDir.
+func StartSFTPServer(dir string) *url.URL {
+	if sftpURL != nil {
+		u := *sftpURL
+		u.Path = dir
+		return &u
+	}
+
+	hostKey := newSigner()
+	clientKey, clientPEM := newKey()
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) == string(clientKey.PublicKey().Marshal()) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("unknown public key for %q", c.User())
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatalf("net.Listen: %s", err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveSSH(conn, config)
+		}
+	}()
+
+	identity := filepath.Join(TempDir, "sftp_id")
+	if err := ioutil.WriteFile(identity, clientPEM, 0600); err != nil {
+		log.Fatalf("ioutil.WriteFile: %s", err)
+	}
+	knownHosts := filepath.Join(TempDir, "sftp_known_hosts")
+	line := knownhosts.Line([]string{l.Addr().String()}, hostKey.PublicKey()) + "\n"
+	if err := ioutil.WriteFile(knownHosts, []byte(line), 0600); err != nil {
+		log.Fatalf("ioutil.WriteFile: %s", err)
+	}
+
+	sftpURL = &url.URL{
+		Scheme:   "sftp",
+		User:     url.User("kebab"),
+		Host:     l.Addr().String(),
+		RawQuery: url.Values{"identity": {identity}, "known_hosts": {knownHosts}}.Encode(),
+	}
+	return StartSFTPServer(dir)
+}
+
+func TempSFTPBucket(name string) bucket.Bucket {
+	b, err := bucket.NewSFTPBucketFromURL(StartSFTPServer(filepath.Join(TempDir, name)))
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func serveSSH(conn net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for newChan := range chans {
+		if newChan.ChannelType() != "session" {
+			newChan.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		ch, requests, err := newChan.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range requests {
+				ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if !ok {
+					continue
+				}
+				server, err := sftp.NewServer(ch)
+				if err != nil {
+					ch.Close()
+					return
+				}
+				go func() {
+					server.Serve()
+					server.Close()
+				}()
+			}
+		}()
+	}
+}
+
+func newKey() (ssh.Signer, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		panic(err)
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	signer, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		panic(err)
+	}
+	return signer, data
+}
+
+func newSigner() ssh.Signer {
+	s, _ := newKey()
+	return s
+}
@@ -10,6 +10,7 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 
@@ -17,13 +18,15 @@ import (
 	"github.com/davidlazar/kebab/bucket"
 )
 
-var s3conf = flag.String("s3", "", "s3 configuration")
+var s3conf = flag.String("s3", "", "s3 configuration (default: a local fake S3 server)")
 
 var (
 	TempDir   string
 	TempS3    bucket.Bucket
 	SkipS3    = true
 	PromptLog *bucket.PromptLogger
+
+	s3Server *httptest.Server
 )
 
 func Setup() {
@@ -42,8 +45,13 @@ func Setup() {
 	stdlog := log.New(os.Stderr, "RecoverableBucketLog: ", 0)
 	PromptLog = &bucket.PromptLogger{Logger: stdlog}
 
-	if *s3conf != "" {
-		s3b, err := bucket.NewS3BucketFromFile(*s3conf)
+	conf := *s3conf
+	if conf == "" {
+		_, s3Server = StartS3Server("kebab-testing", false)
+		conf = WriteS3Config(TempDir, s3Server, "kebab-testing", true)
+	}
+	if conf != "" {
+		s3b, err := bucket.NewS3BucketFromFile(conf)
 		if err != nil {
 			log.Fatalf("bucket.NewS3BucketFromFile: %s", err)
 		}
@@ -66,6 +74,9 @@ func TearDown() {
 			log.Printf("tempS3.Destroy(): %s", err)
 		}
 	}
+	if s3Server != nil {
+		s3Server.Close()
+	}
 }
 
 func TempFileBucket(name string) bucket.Bucket {
@@ -93,6 +104,14 @@ func Upgrade(b bucket.Bucket) bucket.Bucket {
 	)
 }
 
+func UpgradeNames(b bucket.Bucket) bucket.Bucket {
+	key := secretkey.New()
+	return bucket.NewRecoverableBucket(
+		bucket.NewEncryptedNamesBucket(b, key),
+		PromptLog,
+	)
+}
+
 func RandomBytes(n int) []byte {
 	x := make([]byte, n)
 	if _, err := rand.Read(x); err != nil {
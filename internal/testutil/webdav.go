@@ -0,0 +1,45 @@
+package testutil
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	"golang.org/x/net/webdav"
+
+	"github.com/davidlazar/kebab/bucket"
+)
+
+// WebDAV credentials accepted by StartWebDAVServer.
+const (
+	WebDAVUser     = "kebab"
+	WebDAVPassword = "secret"
+	WebDAVToken    = "bearer-secret"
+)
+
+// StartWebDAVServer starts an in-memory WebDAV server that accepts basic
+// and bearer authentication.
+func StartWebDAVServer() *httptest.Server {
+	dav := &webdav.Handler{
+		FileSystem: webdav.NewMemFS(),
+		LockSystem: webdav.NewMemLS(),
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		basic := ok && user == WebDAVUser && pass == WebDAVPassword
+		bearer := r.Header.Get("Authorization") == "Bearer "+WebDAVToken
+		if !basic && !bearer {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		dav.ServeHTTP(w, r)
+	}))
+}
+
+func TempWebDAVBucket(server *httptest.Server, name string, config bucket.WebDAVConfig) bucket.Bucket {
+	config.URL = server.URL + "/" + name
+	b, err := bucket.NewWebDAVBucket(&config)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
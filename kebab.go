@@ -2,9 +2,11 @@ package kebab
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"os"
 	"os/exec"
+	"sort"
 	"strings"
 
 	"github.com/davidlazar/kebab/bucket"
@@ -27,14 +29,26 @@ func (e *TarError) Error() string {
 }
 
 func Put(b Bucket, srcPath string, files []string) (int64, error) {
+	return PutPadded(b, srcPath, files, nil)
+}
+
+// PutPadded is like Put, but hides the size of the backup with pad.
+// See Padding.
+func PutPadded(b Bucket, srcPath string, files []string, pad Padding) (int64, error) {
+	return PutContext(context.Background(), b, srcPath, files, pad)
+}
+
+// PutContext is like PutPadded, but gives up once ctx is done: tar is
+// killed and the bucket operations in progress are cancelled.
+func PutContext(ctx context.Context, b Bucket, srcPath string, files []string, pad Padding) (int64, error) {
 	args := []string{"-c", "-z", "-p"}
 	if srcPath != "" {
 		args = append(args, "-C", srcPath)
 	}
 	args = append(args, files...)
-	cmd := exec.Command("tar", args...)
+	cmd := exec.CommandContext(ctx, "tar", args...)
 
-	w := NewWriter(b, 64*1024*1024)
+	w := NewPaddedWriter(bucket.WithContext(ctx, b), 64*1024*1024, pad)
 	cmd.Stdout = w
 
 	var buf bytes.Buffer
@@ -42,6 +56,9 @@ func Put(b Bucket, srcPath string, files []string) (int64, error) {
 
 	err := cmd.Run()
 	if err != nil {
+		if ctx.Err() != nil {
+			return w.Size(), ctx.Err()
+		}
 		return w.Size(), &TarError{Err: err, Stderr: string(buf.Bytes())}
 	}
 
@@ -53,7 +70,12 @@ func Put(b Bucket, srcPath string, files []string) (int64, error) {
 }
 
 func Get(b Bucket, destPath string) (int64, error) {
-	r, err := NewReader(b)
+	return GetContext(context.Background(), b, destPath)
+}
+
+// GetContext is like Get, but gives up once ctx is done.
+func GetContext(ctx context.Context, b Bucket, destPath string) (int64, error) {
+	r, err := NewReader(bucket.WithContext(ctx, b))
 	if err != nil {
 		return 0, err
 	}
@@ -62,13 +84,62 @@ func Get(b Bucket, destPath string) (int64, error) {
 		return 0, err
 	}
 
-	cmd := exec.Command("tar", "-x", "-z", "-f", "-", "-C", destPath)
+	cmd := exec.CommandContext(ctx, "tar", "-x", "-z", "-f", "-", "-C", destPath)
 	cmd.Stdin = r
 
 	out, err := cmd.CombinedOutput()
 	if err != nil {
+		if ctx.Err() != nil {
+			return r.Size(), ctx.Err()
+		}
 		return r.Size(), &TarError{Err: err, Stderr: string(out)}
 	}
 
 	return r.Size(), nil
 }
+
+// MoveBackup moves the backup from in root to the unused id to, by
+// copying its keys through this host, metadata last, and then
+// destroying the original.  If the copy fails, the original is kept.
+func MoveBackup(ctx context.Context, root Bucket, from, to string) (err error) {
+	b := bucket.WithContext(ctx, root)
+	src, err := b.Descend(from)
+	if err != nil {
+		return fmt.Errorf("Descend(%q): %s", from, err)
+	}
+	dst, err := b.Descend(to)
+	if err != nil {
+		return fmt.Errorf("Descend(%q): %s", to, err)
+	}
+	if keys, _, err := dst.List(); err != nil {
+		return fmt.Errorf("List: %s", err)
+	} else if len(keys) > 0 {
+		return fmt.Errorf("backup %q already exists", to)
+	}
+
+	keys, _, err := src.List()
+	if err != nil {
+		return fmt.Errorf("List: %s", err)
+	}
+	sort.SliceStable(keys, func(i, j int) bool {
+		return keys[j] == "meta" && keys[i] != "meta"
+	})
+	defer func() {
+		if err != nil {
+			dst.Destroy()
+		}
+	}()
+	for _, key := range keys {
+		data, err := src.Get(key)
+		if err != nil {
+			return fmt.Errorf("Get(%q): %s", key, err)
+		}
+		if err := dst.Put(key, data); err != nil {
+			return fmt.Errorf("Put(%q): %s", key, err)
+		}
+	}
+	if err := src.Destroy(); err != nil {
+		return fmt.Errorf("Destroy: %s", err)
+	}
+	return nil
+}
@@ -2,14 +2,28 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/davidlazar/go-crypto/secretkey"
+	"github.com/davidlazar/kebab"
 	"github.com/davidlazar/kebab/bucket"
 )
 
+// openBucket opens a bucket location URL, or else a path: a directory
+// is a file bucket and a file describes a bucket.
 func openBucket(bucketPath string) (bucket.Bucket, error) {
+	if bucket.IsLocation(bucketPath) {
+		return bucket.Open(bucketPath)
+	}
+
 	file, err := os.Open(bucketPath)
 	if err != nil {
 		return nil, err
@@ -22,20 +36,165 @@ func openBucket(bucketPath string) (bucket.Bucket, error) {
 	if fi.IsDir() {
 		return bucket.NewFileBucket(bucketPath)
 	} else {
-		b, err := bucket.NewS3BucketFromFile(bucketPath)
+		return openConfigFile(bucketPath)
+	}
+}
+
+// openMirror opens the buckets at paths as replicas of a mirror.  The
+// journal of missed writes defaults to a file in the user cache
+// directory named after the bucket paths.
+func openMirror(paths []string, quorum int, journalPath string, wrap func(bucket.Bucket) bucket.Bucket) (*bucket.MirrorBucket, error) {
+	replicas := make([]bucket.Replica, len(paths))
+	for i, path := range paths {
+		b, err := openBucket(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		replicas[i] = bucket.Replica{Name: path, Bucket: wrap(b)}
+	}
+
+	if journalPath == "" {
+		dir, err := os.UserCacheDir()
+		if err != nil {
+			return nil, err
+		}
+		h := sha256.Sum256([]byte(strings.Join(paths, "\x00")))
+		journalPath = filepath.Join(dir, "kebab", fmt.Sprintf("mirror-%x.json", h[:8]))
+	}
+	journal, err := bucket.OpenJournal(journalPath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading journal: %s", err)
+	}
+	return bucket.NewMirrorBucket(replicas, quorum, journal)
+}
+
+// openErasure opens the buckets at paths for erasure coding with k data
+// shards.
+func openErasure(paths []string, k int, wrap func(bucket.Bucket) bucket.Bucket) (bucket.Bucket, error) {
+	buckets := make([]bucket.Bucket, len(paths))
+	for i, path := range paths {
+		b, err := openBucket(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		buckets[i] = wrap(b)
+	}
+	return bucket.NewErasureBucket(buckets, k)
+}
+
+// rateLimiter returns a function that wraps buckets in limiters shared
+// by every bucket of the process, so the limits apply to the total
+// traffic of concurrent commands and of every mirror replica.
+func rateLimiter(up, down bucket.Schedule) func(bucket.Bucket) bucket.Bucket {
+	if up.Rate == 0 && len(up.Windows) == 0 && down.Rate == 0 && len(down.Windows) == 0 {
+		return func(b bucket.Bucket) bucket.Bucket { return b }
+	}
+	upLimiter := bucket.NewLimiter(up)
+	downLimiter := bucket.NewLimiter(down)
+	return func(b bucket.Bucket) bucket.Bucket {
+		return bucket.NewRateLimitedBucket(b, upLimiter, downLimiter)
+	}
+}
+
+// openCache wraps b in a read cache in a subdirectory of dir named
+// after the bucket paths, so that several buckets can share dir.
+func openCache(b bucket.Bucket, paths []string, dir string, size int64) (bucket.Bucket, error) {
+	h := sha256.Sum256([]byte(strings.Join(paths, "\x00")))
+	cache, err := bucket.OpenCache(filepath.Join(dir, fmt.Sprintf("%x", h[:8])), size)
+	if err != nil {
+		return nil, err
+	}
+	return bucket.NewCacheBucket(b, cache), nil
+}
+
+// openConfigFile opens the bucket described by a JSON file.  The top
+// level names the kind of bucket, except for S3 buckets.
+func openConfigFile(path string) (bucket.Bucket, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var conf map[string]json.RawMessage
+	if err := json.Unmarshal(data, &conf); err != nil {
+		return nil, fmt.Errorf("json decoding error: %s", err)
+	}
+
+	if _, ok := conf["WebDAV"]; ok {
+		b, err := bucket.NewWebDAVBucketFromFile(path)
 		if err != nil {
-			return nil, fmt.Errorf("bucket.NewS3BucketFromFile: %s", err)
+			return nil, fmt.Errorf("bucket.NewWebDAVBucketFromFile: %s", err)
 		}
 		return b, nil
 	}
+
+	if _, ok := conf["GCS"]; ok {
+		b, err := bucket.NewGCSBucketFromFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("bucket.NewGCSBucketFromFile: %s", err)
+		}
+		return b, nil
+	}
+
+	if _, ok := conf["Azure"]; ok {
+		b, err := bucket.NewAzureBucketFromFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("bucket.NewAzureBucketFromFile: %s", err)
+		}
+		return b, nil
+	}
+
+	b, err := bucket.NewS3BucketFromFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("bucket.NewS3BucketFromFile: %s", err)
+	}
+	return b, nil
 }
 
-func upgradeBucket(b bucket.Bucket, key *secretkey.Key) bucket.Bucket {
-	return bucket.NewRecoverableBucket(bucket.NewEncryptedBucket(b, key), plog)
+func upgradeBucket(b bucket.Bucket, key *secretkey.Key, hideNames bool, policy bucket.RetryPolicy) bucket.Bucket {
+	if hideNames {
+		b = bucket.NewEncryptedNamesBucket(b, key)
+	} else {
+		b = bucket.NewEncryptedBucket(b, key)
+	}
+	return bucket.NewRecoverableBucketWithPolicy(b, plog, policy)
 }
 
-func deleteBuckets(root bucket.Bucket, names []string) error {
-	_, children, err := root.List()
+// lockBackup locks backup id in root for a command, reporting a stale
+// lock that it takes over.
+func lockBackup(ctx context.Context, root bucket.Bucket, id string) (*kebab.BackupLock, error) {
+	lock, err := kebab.LockBackup(ctx, root, id)
+	if err != nil {
+		if _, ok := err.(*kebab.LockedError); ok {
+			return nil, fmt.Errorf("%s (see -unlock)", err)
+		}
+		return nil, err
+	}
+	if lock.Broken != nil {
+		plog.Printf("took over the stale lock on %q held by %s", id, lock.Broken)
+	}
+	return lock, nil
+}
+
+// breakLocks removes the locks on the backups with the given names.
+func breakLocks(root bucket.Bucket, names []string) error {
+	for _, name := range names {
+		info, err := kebab.ReadLock(root, name)
+		if bucket.IsNotExist(err) {
+			fmt.Printf("%s: not locked\n", name)
+			continue
+		} else if err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+		if err := kebab.BreakLock(root, name); err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+		fmt.Printf("%s: removed lock held by %s\n", name, info)
+	}
+	return nil
+}
+
+func deleteBuckets(ctx context.Context, root bucket.Bucket, names []string) error {
+	_, children, err := bucket.WithContext(ctx, root).List()
 	if err != nil {
 		return fmt.Errorf("List: %s", err)
 	}
@@ -50,45 +209,121 @@ func deleteBuckets(root bucket.Bucket, names []string) error {
 			continue
 		}
 
-		child, err := root.Descend(name)
-		if err != nil {
-			return fmt.Errorf("Descend(%q): %s", name, err)
+		if ok, err := deleteBucket(ctx, root, name); err != nil || !ok {
+			return err
 		}
+	}
+	return nil
+}
 
-		keys, children, err := child.List()
-		if err != nil {
-			return fmt.Errorf("List: %s", err)
+// deleteBucket deletes the backup with the given name while holding its
+// lock, after asking.  It reports whether the user went ahead.
+func deleteBucket(ctx context.Context, root bucket.Bucket, name string) (ok bool, err error) {
+	lock, err := lockBackup(ctx, root, name)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		if uerr := lock.Unlock(); uerr != nil && (err == nil || lock.Err() != nil) {
+			err = fmt.Errorf("lock: %s", uerr)
 		}
+	}()
 
-		fmt.Printf("\nGoing to delete %q:\n", name)
-		for _, s := range summary(keys) {
-			fmt.Println("  ", s)
-		}
-		for _, s := range summary(children) {
-			fmt.Println("  ", s)
-		}
-		fmt.Printf("Continue? [y/N]: ")
+	child, err := bucket.WithContext(lock.Context(), root).Descend(name)
+	if err != nil {
+		return false, fmt.Errorf("Descend(%q): %s", name, err)
+	}
+
+	keys, children, err := child.List()
+	if err != nil {
+		return false, fmt.Errorf("List: %s", err)
+	}
 
-		buf := bufio.NewReader(os.Stdin)
-		line, err := buf.ReadString('\n')
+	fmt.Printf("\nGoing to delete %q:\n", name)
+	for _, s := range summary(keys) {
+		fmt.Println("  ", s)
+	}
+	for _, s := range summary(children) {
+		fmt.Println("  ", s)
+	}
+	fmt.Printf("Continue? [y/N]: ")
+
+	buf := bufio.NewReader(os.Stdin)
+	line, err := buf.ReadString('\n')
+	if err != nil {
+		return false, fmt.Errorf("ReadString: %s", err)
+	}
+	if line == "" || (line[0] != 'y' && line[0] != 'Y') {
+		fmt.Println("Delete cancelled!")
+		return false, nil
+	}
+
+	err = child.Destroy()
+	if err != nil {
+		return false, fmt.Errorf("Destroy: %s", err)
+	}
+
+	fmt.Printf("Deleted %q\n", name)
+	return true, nil
+}
+
+func printInfo(root bucket.Bucket, names []string) error {
+	for _, name := range names {
+		child, err := root.Descend(name)
 		if err != nil {
-			return fmt.Errorf("ReadString: %s", err)
+			return fmt.Errorf("Descend(%q): %s", name, err)
 		}
-		if line == "" || (line[0] != 'y' && line[0] != 'Y') {
-			fmt.Println("Delete cancelled!")
-			return nil
+		info, err := kebab.Info(child)
+		if bucket.IsNotExist(err) {
+			// A put in progress has not written its metadata yet.
+			fmt.Printf("%s: not found\n", name)
+			if err := printLock(root, name); err != nil {
+				return fmt.Errorf("%s: %s", name, err)
+			}
+			continue
+		} else if err != nil {
+			return fmt.Errorf("%s: %s", name, err)
 		}
 
-		err = child.Destroy()
-		if err != nil {
-			return fmt.Errorf("Destroy: %s", err)
+		size := "unknown size"
+		if info.Size >= 0 {
+			size = fmt.Sprintf("%.2f MB", float64(info.Size)/1e6)
 		}
+		fmt.Printf("%s: %d box%s, %s (%.2f MB stored), completed %s\n",
+			name, info.Boxes, pluralES(info.Boxes), size, float64(info.Stored)/1e6,
+			info.Modified.Local().Format("2006-01-02 15:04:05"))
+		if n := len(info.Missing); n > 0 {
+			fmt.Printf("   %d box%s missing: %s\n", n, pluralES(n), strings.Join(summary(info.Missing), " "))
+		}
+		if err := printLock(root, name); err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+	}
+	return nil
+}
 
-		fmt.Printf("Deleted %q\n", name)
+func printLock(root bucket.Bucket, name string) error {
+	lock, err := kebab.ReadLock(root, name)
+	if bucket.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	stale := ""
+	if lock.Stale(time.Now()) {
+		stale = " (stale)"
 	}
+	fmt.Printf("   locked by %s%s\n", lock, stale)
 	return nil
 }
 
+func pluralES(count int) string {
+	if count == 1 {
+		return ""
+	}
+	return "es"
+}
+
 func summary(xs []string) []string {
 	if len(xs) <= 6 {
 		return xs
@@ -1,10 +1,18 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"io/ioutil"
 	"os"
 
 	"github.com/davidlazar/go-crypto/secretkey"
+	"github.com/davidlazar/kebab/internal/qr"
+	"github.com/davidlazar/kebab/keyfile"
 )
 
 func Keygen(keyPath string) error {
@@ -39,3 +47,105 @@ func Keygen(keyPath string) error {
 	fmt.Fprintf(os.Stderr, "You should now write down your key file and store it somewhere safe!\n")
 	return nil
 }
+
+func checkKeyFile(data []byte) ([]byte, error) {
+	ctxt, err := secretkey.Decode(data)
+	if err != nil {
+		return nil, fmt.Errorf("secretkey.Decode: %s", err)
+	}
+	if len(ctxt) != secretkey.EncryptedKeyLength {
+		return nil, fmt.Errorf("invalid key size")
+	}
+	return ctxt, nil
+}
+
+// ExportKey writes a copy of the passphrase-protected key file in the
+// given format, to stdout if outPath is empty.
+func ExportKey(keyPath string, format string, outPath string) error {
+	data, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return err
+	}
+	ctxt, err := checkKeyFile(data)
+	if err != nil {
+		return err
+	}
+
+	var out []byte
+	switch format {
+	case "paper":
+		out = keyfile.EncodePaper(ctxt)
+	case "qr", "png", "svg":
+		// The QR code holds the key file byte for byte.
+		code, err := qr.Encode(data, qr.M)
+		if err != nil {
+			return fmt.Errorf("qr.Encode: %s", err)
+		}
+		switch format {
+		case "qr":
+			out = []byte(code.Terminal())
+		case "png":
+			buf := new(bytes.Buffer)
+			if err := png.Encode(buf, code.Image(8)); err != nil {
+				return fmt.Errorf("png.Encode: %s", err)
+			}
+			out = buf.Bytes()
+		case "svg":
+			out = code.SVG()
+		}
+	default:
+		return fmt.Errorf("unknown export format: %q", format)
+	}
+
+	if outPath == "" {
+		_, err = os.Stdout.Write(out)
+		return err
+	}
+	return ioutil.WriteFile(outPath, out, 0600)
+}
+
+// ImportKey recreates a key file from a copy made by ExportKey.
+func ImportKey(keyPath string, inPath string) error {
+	data, err := ioutil.ReadFile(inPath)
+	if err != nil {
+		return err
+	}
+
+	var out []byte
+	if img, _, err := image.Decode(bytes.NewReader(data)); err == nil {
+		out, err = qr.Decode(img)
+		if err != nil {
+			return fmt.Errorf("%s: %s", inPath, err)
+		}
+		if _, err := checkKeyFile(out); err != nil {
+			return fmt.Errorf("%s: QR code does not hold a key file: %s", inPath, err)
+		}
+	} else {
+		ctxt, fixes, err := keyfile.DecodePaper(data)
+		for _, fix := range fixes {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", inPath, fix)
+		}
+		if err != nil {
+			return fmt.Errorf("%s:\n%s", inPath, err)
+		}
+		if len(ctxt) != secretkey.EncryptedKeyLength {
+			return fmt.Errorf("%s: invalid key size", inPath)
+		}
+		out = secretkey.Encode(ctxt)
+	}
+
+	f, err := os.OpenFile(keyPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(out); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "\nKey file imported successfully: %s\n", keyPath)
+	return nil
+}
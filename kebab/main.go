@@ -1,19 +1,29 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	golog "log"
+	"math"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
-	"github.com/davidlazar/go-crypto/secretkey"
 	"github.com/davidlazar/kebab"
 	"github.com/davidlazar/kebab/bucket"
+	"github.com/davidlazar/kebab/keyfile"
 )
 
 const version = "0.1"
 const shortUsage = "usage: %s <flags>\n"
+
+// maxHiddenIDLen is the length of the longest backup id that can be put
+// with -hide-names: the name of the lock on the copy that -force moves
+// aside, "<id>.old.lock", must itself be short enough to hide.
+const maxHiddenIDLen = bucket.MaxNameLen - len(".old.lock")
 const longUsage = `
 List bucket contents:
 
@@ -32,21 +42,223 @@ Get/Put files:
 	The -putfrom command puts files relative to <dir> by invoking
 	the tar command with the flag -C <dir>
 
+	A put fails if the backup <id> already exists, unless -force is
+	given: then the old backup is moved to <id>.old, by copying it
+	through this host, and removed once the new backup is complete,
+	or moved back if the put fails.  A put that failed partway, and
+	left a backup without metadata, is resumed by putting the same
+	files again: boxes that are already stored are not uploaded.
+
 	Multiple commands are executed concurrently.
 
+Describe backups:
+
+	-bucket <bucket> -key <file> -info <id>...
+
+	Prints the size of each backup, the space it takes in the bucket
+	and when it was completed, and lists any missing boxes, without
+	downloading the boxes.
+
+Check backups for bit rot:
+
+	-bucket <bucket> -key <file> -scrub [<id>...] [-scrub-state <file>]
+
+	Reads every box of the given backups, or of every backup, and
+	checks it against the backup's metadata, bypassing the cache.
+	Each replica of a mirror is read on its own.
+	Missing and corrupt boxes are reported with their paths, and the
+	exit status is nonzero if there are any.  The time of each scrub
+	is recorded in the state file (by default in the user cache
+	directory), and scrubbing every backup starts with the ones
+	scrubbed longest ago, so that with -timeout, successive runs take
+	turns.  Limit the read rate with -ratelimit 0 <down>.  Backups
+	locked by a put are skipped.
+
 Delete backups:
 
 	-bucket <bucket> -key -delete <id>...
 
+Locks: a put or delete locks its backup, by writing <id>.lock in the
+bucket, so that overlapping runs (say, cron jobs) do not write the
+same backup at once.  The lock is refreshed while the command runs
+and expires 15 minutes after it stops.  A lock whose holder ran on
+the same host and exited is taken over right away.  To remove a lock
+left behind, after checking that its holder is gone:
+
+	-bucket <bucket> -key <file> -unlock <id>...
+
+	The -info command shows who holds the lock on a backup.
+
+Mirror backups to several buckets:
+
+	-bucket <bucket> <bucket>... [-quorum <n>] [-journal <file>]
+
+	Boxes are encrypted once and written to every bucket.  A put
+	succeeds once <n> buckets (default: all) have each box; gets fall
+	back to the next bucket on errors.  Writes that some buckets missed
+	are recorded in the journal file (by default in the user cache
+	directory), and the -repair command copies them over later:
+
+	-bucket <bucket> <bucket>... -repair [-journal <file>]
+
+	The journal identifies buckets by their <bucket> argument, so give
+	the same arguments every time.
+
+Erasure-code backups across several buckets:
+
+	-bucket <bucket> <bucket>... -erasure <k>
+
+	Each box is split into <k> data shards and parity shards, one per
+	bucket, so it can be read back from any <k> of the buckets.  Give
+	the buckets in the same order every time.
+
+Limit bandwidth:
+
+	-ratelimit <up> <down>
+	-ratewindow <HH:MM>-<HH:MM> <up> <down>
+
+	Uploads and downloads are limited to <up> and <down> bytes per
+	second (with an optional K, M or G suffix, or 0 for unlimited),
+	in total across all commands and buckets.  The -ratewindow flag,
+	which may be repeated, sets other rates during a daily window in
+	local time; for example, -ratewindow 01:00-06:00 0 0 lifts the
+	limits at night.  Boxes are transferred whole, so the limits hold
+	on average over several boxes.
+
+Give up after a while:
+
+	-timeout <duration>
+
+	Each command (and each delete, listing or repair) is cancelled if
+	it takes longer than <duration>, such as 30m or 2h, and fails.  An
+	interrupt (Ctrl-C) cancels the commands in progress the same way;
+	interrupt again to quit immediately.
+
+Retry failed transfers:
+
+	-retry <mode> [-retry-attempts <n>]
+
+	Transfers that fail with a network error, a server error or
+	throttling are attempted up to <n> times (default 5), waiting
+	about 1, 2, 4, 8... seconds in between.  Errors such as a missing
+	key, a failed integrity check or denied access are not retried.
+	Then, depending on <mode>:
+
+	interactive	ask whether to keep trying, if stdin is a
+			terminal, and give up otherwise (the default)
+	noninteractive	give up, without asking
+	failfast	do not retry at all, and give up on the first error
+
+Cache downloaded boxes locally:
+
+	-cache <dir> <size>
+
+	Encrypted boxes read from the bucket are kept in <dir>, up to
+	<size> bytes (with an optional K, M or G suffix), so that getting
+	the same backup again does not download it again.  The least
+	recently used boxes are evicted first.  Cached boxes are checked
+	against the backup's metadata, which is always read from the
+	bucket, and downloaded again if they do not match.
+
 Generate key file or update passphrase:
 
 	-keygen -key <file>
 
+Export a key file for safekeeping, or import it again:
+
+	-keygen -key <file> -export <format> [<output>]
+	-keygen -key <file> -import <input>
+
+	where <format> is one of:
+
+	paper	text with a check group on every line, so a single
+		mistyped character per line is found and corrected
+		on import
+	qr	a QR code drawn with block characters, for terminals
+		with light text on a dark background
+	png	a QR code image
+	svg	a QR code image
+
+	The -import command reads a paper copy, or a PNG, JPEG or GIF
+	image (such as a scan) of a QR code.
+
 Print help or version:
 
 	-help | -version
 
-Buckets: <bucket> is a directory or a JSON file describing an S3 bucket.
+Unlock the key file without a terminal, for cron jobs and CI:
+
+	-passphrase-env <variable>
+	-passphrase-fd <fd>
+	-passphrase-file <file>
+	-passphrase-command <command>
+
+	A passphrase file must be a regular file owned by the current user
+	and not accessible by anyone else.  A passphrase command is run with
+	/bin/sh, and the first line of its output is the passphrase.
+
+Hide backup ids and key names in the bucket:
+
+	-hide-names
+
+	Names are encrypted with the key, so the same flag must be given
+	every time the bucket is used.  Backups stored without the flag are
+	not listed when it is given, and without it, backups stored with it
+	are listed under their encrypted names.  Backup ids can be at most
+	86 bytes long.
+
+Hide the size of new backups:
+
+	-pad <scheme>
+
+	where <scheme> is one of:
+
+	box	pad the last box to the full box size (64 MB)
+	pow2	also round the number of boxes up to a power of two
+	<n>	also round the number of boxes up to a multiple of n
+
+	The padding is encrypted along with the backup and removed on -get.
+
+Buckets: <bucket> is a location URL, a directory, or a JSON file
+describing an S3 bucket, a Google Cloud Storage bucket, an Azure Blob
+Storage container or a WebDAV collection.  Location URLs are:
+
+	file:///path[?nooverwrite=true]
+	s3://<bucket>/<prefix>?config=<file>
+	gs://<bucket>/<prefix>?config=<file>
+	azure://<account>/<container>/<prefix>?config=<file>
+	sftp://[user@]host[:port]/path[?identity=<file>&known_hosts=<file>]
+
+	where the config file is a JSON file as below, which need not
+	name the bucket, and the optional prefix is a path within the
+	bucket.  The bucket or directory need not have any backups yet.
+	With nooverwrite=true, a directory refuses to replace files.
+
+	A Google Cloud Storage bucket is described by:
+
+	{"GCS": {"Bucket": "...", "CredentialsFile": "service-account.json"}}
+
+	where the credentials file is a service account key, relative to
+	the JSON file.  An Azure container is described by:
+
+	{"Azure": {"Account": "...", "Container": "...", "AccessKey": "..."}}
+
+	or with "SAS" set to a shared access signature instead of the
+	account key.  Set "Endpoint" to use Azurite or another endpoint.
+
+	A WebDAV collection is described by:
+
+	{"WebDAV": {"URL": "https://...", "Username": "...", "Password": "..."}}
+
+	or with "Token" instead of "Username" and "Password" for bearer
+	authentication.  For SFTP locations, the host key must be in
+	~/.ssh/known_hosts (or the given file), and paths starting with
+	/~/ are relative to the login directory.
+
+	For S3-compatible services such as MinIO, set the "Endpoint" of
+	the "Service" to a URL like "http://localhost:9000", set
+	"PathStyle" to true if the service does not support bucket host
+	names, and set "CAFile" to a PEM file to trust a private CA.
 `
 
 var log *golog.Logger
@@ -66,12 +278,31 @@ const (
 )
 
 type Command struct {
-	kind cmdKind
-	args []string
+	kind  cmdKind
+	args  []string
+	pad   kebab.Padding
+	force bool
 }
 
-func (c *Command) Run(b bucket.Bucket) (int64, error) {
+// Run runs the command on root.  Puts hold the lock on their backup,
+// and are cancelled if they lose it.
+func (c *Command) Run(ctx context.Context, root bucket.Bucket) (n int64, err error) {
 	childName := c.args[0]
+	var lock *kebab.BackupLock
+	if c.kind == cmdPut || c.kind == cmdPutFrom {
+		lock, err = lockBackup(ctx, root, childName)
+		if err != nil {
+			return 0, err
+		}
+		defer func() {
+			if uerr := lock.Unlock(); uerr != nil && (err == nil || lock.Err() != nil) {
+				err = fmt.Errorf("lock: %s", uerr)
+			}
+		}()
+		ctx = lock.Context()
+	}
+
+	b := bucket.WithContext(ctx, root)
 	child, err := b.Descend(childName)
 	if err != nil {
 		return 0, fmt.Errorf("error descending into bucket %q: %s", childName, err)
@@ -79,16 +310,97 @@ func (c *Command) Run(b bucket.Bucket) (int64, error) {
 
 	switch c.kind {
 	case cmdPut:
-		return kebab.Put(child, "", c.args[1:])
+		return c.put(ctx, root, child, lock, "", c.args[1:])
 	case cmdPutFrom:
-		return kebab.Put(child, c.args[1], c.args[2:])
+		return c.put(ctx, root, child, lock, c.args[1], c.args[2:])
 	case cmdGet:
-		return kebab.Get(child, childName)
+		return kebab.GetContext(ctx, child, childName)
 	default:
 		return 0, fmt.Errorf("unexpected command type: %d", c.kind)
 	}
 }
 
+// put puts files into child, the backup c.args[0] of root, held by
+// lock.  A backup without metadata is left by a put that failed, and
+// is resumed.  An existing backup is only replaced with -force: it is
+// moved aside, and removed once the new backup is complete or restored
+// if the put fails.
+func (c *Command) put(ctx context.Context, root, child bucket.Bucket, lock *kebab.BackupLock, srcPath string, files []string) (n int64, err error) {
+	id := c.args[0]
+	keys, _, err := child.List()
+	if err != nil {
+		return 0, fmt.Errorf("List: %s", err)
+	}
+	if len(keys) == 0 {
+		return kebab.PutContext(ctx, child, srcPath, files, c.pad)
+	}
+	if !hasKey(keys, "meta") {
+		plog.Printf("%s: resuming an unfinished backup", c.String())
+		return kebab.PutContext(ctx, child, srcPath, files, c.pad)
+	}
+	if !c.force {
+		return 0, fmt.Errorf("backup %q already exists (use -force to replace it)", id)
+	}
+
+	aside := id + ".old"
+	asideLock, err := lockBackup(ctx, root, aside)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if uerr := asideLock.Unlock(); uerr != nil && err == nil {
+			err = fmt.Errorf("lock: %s", uerr)
+		}
+	}()
+	if err := kebab.MoveBackup(ctx, root, id, aside); err != nil {
+		return 0, fmt.Errorf("moving the old backup aside: %s", err)
+	}
+	n, err = kebab.PutContext(ctx, child, srcPath, files, c.pad)
+	if err != nil {
+		if lock.Err() != nil {
+			// Someone else holds id now, so leave it to them.
+			return n, fmt.Errorf("%s; the old backup is in %q", err, aside)
+		}
+		// ctx may be done, so restore without it.
+		plog.Printf("%s failed, restoring the old backup", c.String())
+		if rerr := restoreBackup(root, id, aside); rerr != nil {
+			return n, fmt.Errorf("%s; the old backup is in %q: %s", err, aside, rerr)
+		}
+		return n, err
+	}
+
+	old, err := bucket.WithContext(ctx, root).Descend(aside)
+	if err == nil {
+		err = old.Destroy()
+	}
+	if err != nil {
+		return n, fmt.Errorf("removing the old backup %q: %s", aside, err)
+	}
+	return n, nil
+}
+
+func hasKey(keys []string, key string) bool {
+	for _, k := range keys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// restoreBackup replaces the partial backup id in root with the backup
+// moved aside, whether or not the command was cancelled.
+func restoreBackup(root bucket.Bucket, id, aside string) error {
+	partial, err := root.Descend(id)
+	if err != nil {
+		return fmt.Errorf("Descend(%q): %s", id, err)
+	}
+	if err := partial.Destroy(); err != nil {
+		return fmt.Errorf("Destroy: %s", err)
+	}
+	return kebab.MoveBackup(context.Background(), root, aside, id)
+}
+
 func (c *Command) String() string {
 	switch c.kind {
 	case cmdPut:
@@ -120,26 +432,115 @@ func main() {
 	}
 
 	if c.keygen {
-		if err = Keygen(c.keyPath); err != nil {
+		switch {
+		case len(c.export) > 0:
+			out := ""
+			if len(c.export) > 1 {
+				out = c.export[1]
+			}
+			err = ExportKey(c.keyPath, c.export[0], out)
+		case c.importPath != "":
+			err = ImportKey(c.keyPath, c.importPath)
+		default:
+			err = Keygen(c.keyPath)
+		}
+		if err != nil {
 			log.Fatalf("keygen error: %s", err)
 		}
 		return
 	}
 
-	bb, err := openBucket(c.bucketPath)
-	if err != nil {
-		log.Fatalf("error opening bucket: %s", err)
+	ctx := interruptContext()
+
+	limit := rateLimiter(c.upRate, c.downRate)
+	var bb bucket.Bucket
+	if c.erasure > 0 {
+		bb, err = openErasure(c.bucketPaths, c.erasure, limit)
+		if err != nil {
+			log.Fatalf("error opening buckets: %s", err)
+		}
+	} else if len(c.bucketPaths) > 1 {
+		m, err := openMirror(c.bucketPaths, c.quorum, c.journalPath, limit)
+		if err != nil {
+			log.Fatalf("error opening mirror: %s", err)
+		}
+		if c.repair {
+			rctx, cancel := c.withTimeout(ctx)
+			defer cancel()
+			n, err := m.WithContext(rctx).(*bucket.MirrorBucket).Repair()
+			if n > 0 {
+				plog.Printf("repaired %d missed write%s", n, plural(n))
+			}
+			if err != nil {
+				log.Fatalf("error repairing mirror: %s", err)
+			}
+			return
+		}
+		bb = m
+	} else {
+		bb, err = openBucket(c.bucketPaths[0])
+		if err != nil {
+			log.Fatalf("error opening bucket: %s", err)
+		}
+		bb = limit(bb)
 	}
 
-	key, err := secretkey.ReadFile(c.keyPath)
+	key, err := keyfile.ReadFile(c.keyPath, c.passphrase)
 	if err != nil {
 		log.Fatalf("error reading key file: %s", err)
 	}
+	if c.passphrase != nil {
+		plog.Printf("unlocked key file %s with the passphrase from %s", c.keyPath, c.passphrase)
+	}
+
+	if c.cacheDir != "" {
+		bb, err = openCache(bb, c.bucketPaths, c.cacheDir, c.cacheSize)
+		if err != nil {
+			log.Fatalf("error opening cache: %s", err)
+		}
+	}
 
-	b := upgradeBucket(bb, key)
+	b := upgradeBucket(bb, key, c.hideNames, c.retry)
+
+	if len(c.infos) > 0 {
+		ictx, cancel := c.withTimeout(ctx)
+		defer cancel()
+		if err := printInfo(bucket.WithContext(ictx, b), c.infos); err != nil {
+			log.Fatalf("error describing backups: %s", err)
+		}
+		return
+	}
+
+	if c.scrub {
+		state, err := openScrubState(c.scrubState, c.bucketPaths)
+		if err != nil {
+			log.Fatalf("error reading scrub state: %s", err)
+		}
+		sctx, cancel := c.withTimeout(ctx)
+		defer cancel()
+		bad, err := scrubBuckets(sctx, b, c.scrubs, state)
+		if err != nil {
+			log.Fatalf("error scrubbing backups: %s", err)
+		}
+		if bad > 0 {
+			log.Fatalf("found bad boxes in %d backup%s", bad, plural(bad))
+		}
+		return
+	}
+
+	if len(c.unlocks) > 0 {
+		uctx, cancel := c.withTimeout(ctx)
+		defer cancel()
+		if err := breakLocks(bucket.WithContext(uctx, b), c.unlocks); err != nil {
+			log.Fatalf("error breaking locks: %s", err)
+		}
+		return
+	}
 
 	if len(c.deletes) > 0 {
-		err := deleteBuckets(b, c.deletes)
+		dctx, cancel := c.withTimeout(ctx)
+		defer cancel()
+		err := deleteBuckets(dctx, b, c.deletes)
 		if err != nil {
 			log.Fatalf("error deleting backups: %s", err)
 		}
@@ -147,7 +548,9 @@ func main() {
 	}
 
 	if len(c.commands) == 0 {
-		_, children, err := b.List()
+		lctx, cancel := c.withTimeout(ctx)
+		defer cancel()
+		_, children, err := bucket.WithContext(lctx, b).List()
 		if err != nil {
 			log.Fatalf("error listing bucket: %s", err)
 		}
@@ -164,7 +567,9 @@ func main() {
 			defer wg.Done()
 			start := time.Now()
 
-			n, err := cmd.Run(b)
+			cctx, cancel := c.withTimeout(ctx)
+			defer cancel()
+			n, err := cmd.Run(cctx, b)
 			if err != nil {
 				plog.Printf("command %q failed: %s", cmd.String(), err.Error())
 				return
@@ -182,19 +587,65 @@ func main() {
 	wg.Wait()
 }
 
+// interruptContext returns a context that is cancelled on the first
+// interrupt, so that commands in progress give up cleanly.  A second
+// interrupt kills the process as usual.
+func interruptContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	go func() {
+		<-sig
+		signal.Stop(sig)
+		plog.Printf("interrupted: cancelling (interrupt again to quit now)")
+		cancel()
+	}()
+	return ctx
+}
+
+// withTimeout applies the -timeout flag, if given, to ctx.
+func (c *Conf) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.timeout > 0 {
+		return context.WithTimeout(ctx, c.timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
 type Conf struct {
-	help       bool
-	version    bool
-	keygen     bool
-	commands   []Command
-	deletes    []string
-	bucketPath string
-	keyPath    string
+	help        bool
+	version     bool
+	keygen      bool
+	commands    []Command
+	deletes     []string
+	infos       []string
+	unlocks     []string
+	scrub       bool
+	scrubs      []string
+	scrubState  string
+	bucketPaths []string
+	quorum      int
+	erasure     int
+	journalPath string
+	repair      bool
+	cacheDir    string
+	cacheSize   int64
+	timeout     time.Duration
+	retry       bucket.RetryPolicy
+	upRate      bucket.Schedule
+	downRate    bucket.Schedule
+	keyPath     string
+	export      []string
+	importPath  string
+	passphrase  keyfile.Source
+	hideNames   bool
+	padding     kebab.Padding
+	force       bool
 }
 
 func parseArgs(args []string) (*Conf, error) {
 	conf := &Conf{
 		commands: make([]Command, 0, 8),
+		retry:    bucket.DefaultRetryPolicy,
 	}
 	for len(args) > 0 {
 		s := args[0]
@@ -217,18 +668,157 @@ func parseArgs(args []string) (*Conf, error) {
 			return conf, nil
 		case s == "-keygen":
 			conf.keygen = true
+		case s == "-hide-names":
+			conf.hideNames = true
+		case s == "-force":
+			conf.force = true
 		case s == "-key":
 			flagArgs, args, err = exactly("-key", 1, args)
 			if err != nil {
 				return nil, err
 			}
 			conf.keyPath = flagArgs[0]
+		case s == "-export":
+			flagArgs, args, err = atleast("-export", 1, args)
+			if err != nil {
+				return nil, err
+			}
+			if len(flagArgs) > 2 {
+				return nil, fmt.Errorf("flag -export: expecting at most 2 arguments")
+			}
+			conf.export = flagArgs
+		case s == "-import":
+			flagArgs, args, err = exactly("-import", 1, args)
+			if err != nil {
+				return nil, err
+			}
+			conf.importPath = flagArgs[0]
+		case s == "-passphrase-env" || s == "-passphrase-fd" || s == "-passphrase-file" || s == "-passphrase-command":
+			flagArgs, args, err = exactly(s, 1, args)
+			if err != nil {
+				return nil, err
+			}
+			if conf.passphrase != nil {
+				return nil, fmt.Errorf("flag %s: passphrase source already given", s)
+			}
+			switch s {
+			case "-passphrase-env":
+				conf.passphrase = keyfile.EnvSource(flagArgs[0])
+			case "-passphrase-fd":
+				fd, err := strconv.Atoi(flagArgs[0])
+				if err != nil || fd < 0 {
+					return nil, fmt.Errorf("flag %s: invalid file descriptor: %q", s, flagArgs[0])
+				}
+				conf.passphrase = keyfile.FDSource(fd)
+			case "-passphrase-file":
+				conf.passphrase = keyfile.FileSource(flagArgs[0])
+			case "-passphrase-command":
+				conf.passphrase = keyfile.CommandSource(flagArgs[0])
+			}
+		case s == "-pad":
+			flagArgs, args, err = exactly("-pad", 1, args)
+			if err != nil {
+				return nil, err
+			}
+			conf.padding, err = parsePadding(flagArgs[0])
+			if err != nil {
+				return nil, fmt.Errorf("flag -pad: %s", err)
+			}
 		case s == "-bucket":
-			flagArgs, args, err = exactly("-bucket", 1, args)
+			flagArgs, args, err = atleast("-bucket", 1, args)
+			if err != nil {
+				return nil, err
+			}
+			conf.bucketPaths = append(conf.bucketPaths, flagArgs...)
+		case s == "-quorum":
+			flagArgs, args, err = exactly("-quorum", 1, args)
+			if err != nil {
+				return nil, err
+			}
+			conf.quorum, err = strconv.Atoi(flagArgs[0])
+			if err != nil || conf.quorum < 1 {
+				return nil, fmt.Errorf("flag -quorum: invalid number: %q", flagArgs[0])
+			}
+		case s == "-erasure":
+			flagArgs, args, err = exactly("-erasure", 1, args)
+			if err != nil {
+				return nil, err
+			}
+			conf.erasure, err = strconv.Atoi(flagArgs[0])
+			if err != nil || conf.erasure < 1 {
+				return nil, fmt.Errorf("flag -erasure: invalid number: %q", flagArgs[0])
+			}
+		case s == "-journal":
+			flagArgs, args, err = exactly("-journal", 1, args)
+			if err != nil {
+				return nil, err
+			}
+			conf.journalPath = flagArgs[0]
+		case s == "-repair":
+			conf.repair = true
+		case s == "-cache":
+			flagArgs, args, err = exactly("-cache", 2, args)
+			if err != nil {
+				return nil, err
+			}
+			conf.cacheDir = flagArgs[0]
+			conf.cacheSize, err = parseSize(flagArgs[1])
+			if err != nil {
+				return nil, fmt.Errorf("flag -cache: %s", err)
+			}
+		case s == "-timeout":
+			flagArgs, args, err = exactly("-timeout", 1, args)
+			if err != nil {
+				return nil, err
+			}
+			conf.timeout, err = time.ParseDuration(flagArgs[0])
+			if err != nil || conf.timeout <= 0 {
+				return nil, fmt.Errorf("flag -timeout: invalid duration: %q", flagArgs[0])
+			}
+		case s == "-retry":
+			flagArgs, args, err = exactly("-retry", 1, args)
+			if err != nil {
+				return nil, err
+			}
+			switch flagArgs[0] {
+			case "interactive":
+				conf.retry.Mode = bucket.RetryInteractive
+			case "noninteractive":
+				conf.retry.Mode = bucket.RetryNonInteractive
+			case "failfast":
+				conf.retry.Mode = bucket.RetryFailFast
+			default:
+				return nil, fmt.Errorf("flag -retry: unknown mode: %q", flagArgs[0])
+			}
+		case s == "-retry-attempts":
+			flagArgs, args, err = exactly("-retry-attempts", 1, args)
+			if err != nil {
+				return nil, err
+			}
+			conf.retry.MaxAttempts, err = strconv.Atoi(flagArgs[0])
+			if err != nil || conf.retry.MaxAttempts < 1 {
+				return nil, fmt.Errorf("flag -retry-attempts: invalid number: %q", flagArgs[0])
+			}
+		case s == "-ratelimit":
+			flagArgs, args, err = exactly("-ratelimit", 2, args)
+			if err != nil {
+				return nil, err
+			}
+			conf.upRate.Rate, conf.downRate.Rate, err = parseRates(flagArgs)
+			if err != nil {
+				return nil, fmt.Errorf("flag -ratelimit: %s", err)
+			}
+		case s == "-ratewindow":
+			flagArgs, args, err = exactly("-ratewindow", 3, args)
 			if err != nil {
 				return nil, err
 			}
-			conf.bucketPath = flagArgs[0]
+			up, down, err := parseWindow(flagArgs)
+			if err != nil {
+				return nil, fmt.Errorf("flag -ratewindow: %s", err)
+			}
+			conf.upRate.Windows = append(conf.upRate.Windows, up)
+			conf.downRate.Windows = append(conf.downRate.Windows, down)
 		case s == "-get":
 			flagArgs, args, err = exactly("-get", 1, args)
 			if err != nil {
@@ -247,6 +837,31 @@ func parseArgs(args []string) (*Conf, error) {
 				return nil, err
 			}
 			conf.commands = append(conf.commands, Command{kind: cmdPutFrom, args: flagArgs})
+		case s == "-info":
+			flagArgs, args, err = atleast("-info", 1, args)
+			if err != nil {
+				return nil, err
+			}
+			conf.infos = append(conf.infos, flagArgs...)
+		case s == "-scrub":
+			flagArgs, args, err = atleast("-scrub", 0, args)
+			if err != nil {
+				return nil, err
+			}
+			conf.scrub = true
+			conf.scrubs = append(conf.scrubs, flagArgs...)
+		case s == "-scrub-state":
+			flagArgs, args, err = exactly("-scrub-state", 1, args)
+			if err != nil {
+				return nil, err
+			}
+			conf.scrubState = flagArgs[0]
+		case s == "-unlock":
+			flagArgs, args, err = atleast("-unlock", 1, args)
+			if err != nil {
+				return nil, err
+			}
+			conf.unlocks = append(conf.unlocks, flagArgs...)
 		case s == "-delete":
 			flagArgs, args, err = atleast("-delete", 1, args)
 			if err != nil {
@@ -257,18 +872,151 @@ func parseArgs(args []string) (*Conf, error) {
 			return nil, fmt.Errorf("unrecognized flag: %q", s)
 		}
 	}
-	if conf.keyPath == "" {
+	if conf.keyPath == "" && !conf.repair {
 		return nil, fmt.Errorf("flag -key required")
 	}
-	if !conf.keygen && conf.bucketPath == "" {
+	if !conf.keygen && len(conf.bucketPaths) == 0 {
 		return nil, fmt.Errorf("flag -bucket required")
 	}
+	if len(conf.bucketPaths) < 2 && (conf.quorum > 0 || conf.journalPath != "" || conf.repair) {
+		return nil, fmt.Errorf("flags -quorum, -journal and -repair require several buckets")
+	}
+	if conf.quorum > len(conf.bucketPaths) {
+		return nil, fmt.Errorf("flag -quorum: more than the %d buckets given", len(conf.bucketPaths))
+	}
+	if conf.erasure > 0 && (conf.quorum > 0 || conf.journalPath != "" || conf.repair) {
+		return nil, fmt.Errorf("flag -erasure can not be combined with -quorum, -journal or -repair")
+	}
+	if conf.erasure > len(conf.bucketPaths) {
+		return nil, fmt.Errorf("flag -erasure: more than the %d buckets given", len(conf.bucketPaths))
+	}
+	if conf.repair && (len(conf.commands) > 0 || len(conf.deletes) > 0) {
+		return nil, fmt.Errorf("can not repair and put/get/delete at the same time")
+	}
+	if !conf.keygen && (len(conf.export) > 0 || conf.importPath != "") {
+		return nil, fmt.Errorf("flags -export and -import require -keygen")
+	}
+	if len(conf.export) > 0 && conf.importPath != "" {
+		return nil, fmt.Errorf("can not export and import at the same time")
+	}
 	if len(conf.deletes) > 0 && len(conf.commands) > 0 {
 		return nil, fmt.Errorf("can not delete and put/get at the same time")
 	}
+	if len(conf.infos) > 0 && (len(conf.deletes) > 0 || len(conf.commands) > 0 || conf.repair) {
+		return nil, fmt.Errorf("flag -info can not be combined with other commands")
+	}
+	if conf.scrub && (len(conf.unlocks) > 0 || len(conf.infos) > 0 || len(conf.deletes) > 0 || len(conf.commands) > 0 || conf.repair) {
+		return nil, fmt.Errorf("flag -scrub can not be combined with other commands")
+	}
+	if conf.scrubState != "" && !conf.scrub {
+		return nil, fmt.Errorf("flag -scrub-state requires -scrub")
+	}
+	if len(conf.unlocks) > 0 && (len(conf.infos) > 0 || len(conf.deletes) > 0 || len(conf.commands) > 0 || conf.repair) {
+		return nil, fmt.Errorf("flag -unlock can not be combined with other commands")
+	}
+	if conf.force && !conf.hasPuts() {
+		return nil, fmt.Errorf("flag -force requires -put or -putfrom")
+	}
+	for i := range conf.commands {
+		cmd := &conf.commands[i]
+		isPut := cmd.kind == cmdPut || cmd.kind == cmdPutFrom
+		if isPut && conf.hideNames && len(cmd.args[0]) > maxHiddenIDLen {
+			return nil, fmt.Errorf("%s: backup ids can be at most %d bytes long with -hide-names", cmd, maxHiddenIDLen)
+		}
+	}
+	for i := range conf.commands {
+		conf.commands[i].pad = conf.padding
+		conf.commands[i].force = conf.force
+	}
 	return conf, nil
 }
 
+func (c *Conf) hasPuts() bool {
+	for _, cmd := range c.commands {
+		if cmd.kind == cmdPut || cmd.kind == cmdPutFrom {
+			return true
+		}
+	}
+	return false
+}
+
+func parsePadding(s string) (kebab.Padding, error) {
+	switch s {
+	case "box":
+		return kebab.PadBox, nil
+	case "pow2":
+		return kebab.PadPowerOfTwo, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("unknown padding scheme: %q", s)
+	}
+	return kebab.PadQuantum(n), nil
+}
+
+// parseSize parses a number of bytes with an optional K, M or G suffix.
+func parseSize(s string) (int64, error) {
+	mult := int64(1)
+	if n := len(s); n > 0 {
+		switch s[n-1] {
+		case 'K', 'k':
+			mult = 1 << 10
+		case 'M', 'm':
+			mult = 1 << 20
+		case 'G', 'g':
+			mult = 1 << 30
+		}
+		if mult > 1 {
+			s = s[:n-1]
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 1 || n > math.MaxInt64/mult {
+		return 0, fmt.Errorf("invalid size: %q", s)
+	}
+	return n * mult, nil
+}
+
+// parseRates parses upload and download rates in bytes per second,
+// where 0 means unlimited.
+func parseRates(args []string) (up, down int64, err error) {
+	rates := make([]int64, 2)
+	for i, arg := range args {
+		if arg == "0" {
+			continue
+		}
+		rates[i], err = parseSize(arg)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	return rates[0], rates[1], nil
+}
+
+// parseWindow parses a time window HH:MM-HH:MM and its upload and
+// download rates.
+func parseWindow(args []string) (up, down bucket.Window, err error) {
+	times := strings.Split(args[0], "-")
+	if len(times) != 2 {
+		return up, down, fmt.Errorf("invalid window: %q", args[0])
+	}
+	var tods [2]time.Duration
+	for i, s := range times {
+		t, err := time.Parse("15:04", s)
+		if err != nil {
+			return up, down, fmt.Errorf("invalid window: %q", args[0])
+		}
+		tods[i] = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+	upRate, downRate, err := parseRates(args[1:])
+	if err != nil {
+		return up, down, err
+	}
+	up = bucket.Window{Start: tods[0], End: tods[1], Rate: upRate}
+	down = bucket.Window{Start: tods[0], End: tods[1], Rate: downRate}
+	return up, down, nil
+}
+
 func exactly(flag string, count int, args []string) (flagArgs, rest []string, err error) {
 	for rest = args; len(rest) > 0 && len(flagArgs) < count; rest = rest[1:] {
 		arg := rest[0]
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/davidlazar/kebab"
+	"github.com/davidlazar/kebab/bucket"
+	"github.com/davidlazar/kebab/internal/testutil"
+)
+
+func TestMain(m *testing.M) {
+	testutil.Setup()
+	r := m.Run()
+	testutil.TearDown()
+	os.Exit(r)
+}
+
+// failingMeta fails the next Put of the metadata of backup id with the
+// error returned by fail.
+type failingMeta struct {
+	bucket.Bucket
+	id   string
+	name string
+	fail *func() error
+}
+
+func (b *failingMeta) Put(key string, data []byte) error {
+	if f := *b.fail; key == "meta" && b.name == b.id && f != nil {
+		*b.fail = nil
+		return f()
+	}
+	return b.Bucket.Put(key, data)
+}
+
+func (b *failingMeta) Descend(child string) (bucket.Bucket, error) {
+	bb, err := b.Bucket.Descend(child)
+	if err != nil {
+		return nil, err
+	}
+	return &failingMeta{Bucket: bb, id: b.id, name: child, fail: b.fail}, nil
+}
+
+func TestForcedPutRestores(t *testing.T) {
+	src := filepath.Join(testutil.TempDir, "src")
+	if err := os.Mkdir(src, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "a"), testutil.RandomBytes(1000), 0600); err != nil {
+		t.Fatal(err)
+	}
+	put := Command{kind: cmdPutFrom, args: []string{"x", src, "a"}, force: true}
+
+	var cancel context.CancelFunc
+	failures := map[string]func() error{
+		"failed": func() error {
+			return &os.PathError{Op: "open", Path: "meta", Err: os.ErrPermission}
+		},
+		"cancelled": func() error {
+			cancel()
+			return context.Canceled
+		},
+	}
+	for what, f := range failures {
+		upgraded := testutil.Upgrade(testutil.TempFileBucket("ForcedPut-" + what))
+		var fail func() error
+		root := &failingMeta{Bucket: upgraded, id: "x", fail: &fail}
+		var ctx context.Context
+		ctx, cancel = context.WithCancel(context.Background())
+		defer cancel()
+
+		if _, err := put.Run(ctx, root); err != nil {
+			t.Fatalf("%s: first put: %s", what, err)
+		}
+		x, _ := upgraded.Descend("x")
+		meta, err := x.Get("meta")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fail = f
+		if _, err := put.Run(ctx, root); err == nil {
+			t.Fatalf("%s: forced put succeeded", what)
+		}
+		if m, err := x.Get("meta"); err != nil || !bytes.Equal(m, meta) {
+			t.Fatalf("%s: old backup not restored: %v", what, err)
+		}
+		keys, children, err := upgraded.List()
+		if err != nil || len(keys) != 0 || !reflect.DeepEqual(children, []string{"x"}) {
+			t.Fatalf("%s: expected only backup x, got %q %q (err %v)", what, keys, children, err)
+		}
+	}
+}
+
+func TestScrubTimeout(t *testing.T) {
+	root := testutil.Upgrade(testutil.TempFileBucket("ScrubTimeout"))
+	for _, id := range []string{"x", "y"} {
+		child, _ := root.Descend(id)
+		w := kebab.NewWriter(child, 1000)
+		if _, err := w.Write(testutil.RandomBytes(1500)); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	state := &scrubState{
+		path:    filepath.Join(testutil.TempDir, "scrub-timeout.json"),
+		Backups: make(map[string]*scrubRecord),
+	}
+	if bad, err := scrubBuckets(context.Background(), root, []string{"x"}, state); bad != 0 || err != nil {
+		t.Fatalf("scrubBuckets: %d bad, err %v", bad, err)
+	}
+
+	// Running out of time is not an error; the backups that are left
+	// are scrubbed by the next run.
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now())
+	defer cancel()
+	if bad, err := scrubBuckets(ctx, root, []string{"y", "x"}, state); bad != 0 || err != nil {
+		t.Fatalf("scrubBuckets after the deadline: %d bad, err %v", bad, err)
+	}
+	if _, ok := state.Backups["y"]; ok || state.Backups["x"] == nil {
+		t.Fatalf("unexpected scrub state: %+v", state.Backups)
+	}
+}
+
+func TestHiddenIDLen(t *testing.T) {
+	for _, n := range []int{maxHiddenIDLen, maxHiddenIDLen + 1} {
+		id := strings.Repeat("x", n)
+		_, err := parseArgs([]string{"-bucket", "b", "-key", "k", "-hide-names", "-put", id, "file"})
+		if n <= maxHiddenIDLen && err != nil {
+			t.Fatalf("id of %d bytes: %s", n, err)
+		}
+		if n > maxHiddenIDLen && err == nil {
+			t.Fatalf("id of %d bytes: expected an error", n)
+		}
+		if _, err := parseArgs([]string{"-bucket", "b", "-key", "k", "-put", id, "file"}); err != nil {
+			t.Fatalf("id of %d bytes without -hide-names: %s", n, err)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/davidlazar/kebab"
+	"github.com/davidlazar/kebab/bucket"
+)
+
+// scrubState records when each backup was last scrubbed, so that
+// scrubbing every backup starts with the ones checked longest ago.
+type scrubState struct {
+	path    string
+	Backups map[string]*scrubRecord
+}
+
+type scrubRecord struct {
+	Time     time.Time
+	Boxes    int
+	Problems int
+}
+
+// openScrubState reads the scrub state file, which defaults to a file
+// in the user cache directory named after the bucket paths.
+func openScrubState(path string, bucketPaths []string) (*scrubState, error) {
+	if path == "" {
+		dir, err := os.UserCacheDir()
+		if err != nil {
+			return nil, err
+		}
+		h := sha256.Sum256([]byte(strings.Join(bucketPaths, "\x00")))
+		path = filepath.Join(dir, "kebab", fmt.Sprintf("scrub-%x.json", h[:8]))
+	}
+	s := &scrubState{path: path, Backups: make(map[string]*scrubRecord)}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("%s: json decoding error: %s", path, err)
+	}
+	if s.Backups == nil {
+		s.Backups = make(map[string]*scrubRecord)
+	}
+	return s, nil
+}
+
+func (s *scrubState) save() error {
+	data, err := json.MarshalIndent(s, "", "\t")
+	if err != nil {
+		panic(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// scrubBuckets scrubs the backups with the given names, or else every
+// backup, least recently scrubbed first.  It returns the number of
+// backups with problems.  Once ctx reaches its deadline, the backups
+// that are left are left for the next run.
+func scrubBuckets(ctx context.Context, root bucket.Bucket, names []string, state *scrubState) (int, error) {
+	if len(names) == 0 {
+		_, children, err := bucket.WithContext(ctx, root).List()
+		if err != nil {
+			return 0, fmt.Errorf("List: %s", err)
+		}
+		names = children
+		sort.SliceStable(names, func(i, j int) bool {
+			return state.last(names[i]).Before(state.last(names[j]))
+		})
+	}
+
+	bad := 0
+	for i, name := range names {
+		if lock, err := kebab.ReadLock(root, name); err == nil && !lock.Stale(time.Now()) {
+			// The boxes may not match the metadata while a put is
+			// in progress.
+			fmt.Printf("%s: skipped, locked by %s\n", name, lock)
+			continue
+		}
+		child, err := root.Descend(name)
+		if err != nil {
+			return bad, fmt.Errorf("Descend(%q): %s", name, err)
+		}
+		report, err := kebab.Scrub(ctx, child)
+		if err != nil && ctx.Err() == context.DeadlineExceeded {
+			left := len(names) - i
+			fmt.Printf("timeout reached: %d backup%s left for the next run, starting with %s\n", left, plural(left), name)
+			return bad, nil
+		}
+		if bucket.IsNotExist(err) {
+			fmt.Printf("%s: not found\n", name)
+			continue
+		} else if err != nil {
+			return bad, fmt.Errorf("%s: %s", name, err)
+		}
+
+		if n := len(report.Problems); n > 0 {
+			bad++
+			fmt.Printf("%s: %d of %d box%s bad:\n", name, n, report.Boxes, pluralES(report.Boxes))
+			for _, p := range report.Problems {
+				fmt.Printf("   %s\n", p)
+			}
+		} else {
+			on := ""
+			if report.Replicas > 1 {
+				on = fmt.Sprintf(" on %d replicas", report.Replicas)
+			}
+			fmt.Printf("%s: %d box%s ok%s (%.2f MB)\n", name, report.Boxes, pluralES(report.Boxes), on, float64(report.Bytes)/1e6)
+		}
+		state.Backups[name] = &scrubRecord{
+			Time:     time.Now(),
+			Boxes:    report.Boxes,
+			Problems: len(report.Problems),
+		}
+		if err := state.save(); err != nil {
+			return bad, fmt.Errorf("saving scrub state: %s", err)
+		}
+	}
+	return bad, nil
+}
+
+// last returns when the backup was last scrubbed, or the zero time.
+func (s *scrubState) last(name string) time.Time {
+	if r, ok := s.Backups[name]; ok {
+		return r.Time
+	}
+	return time.Time{}
+}
@@ -2,13 +2,18 @@ package kebab
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"reflect"
 	"testing"
+	"time"
 
+	"github.com/davidlazar/go-crypto/secretkey"
 	"github.com/davidlazar/kebab/bucket"
 	"github.com/davidlazar/kebab/internal/testutil"
 )
@@ -81,6 +86,27 @@ func TestFSGet(t *testing.T) {
 	}
 }
 
+func TestCancelledPutGet(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	b := testutil.Upgrade(testutil.TempFileBucket("CancelledPutGet"))
+	if _, err := PutContext(ctx, b, testutil.TempDir, []string{"data"}, nil); err != context.Canceled {
+		t.Fatalf("expected cancelled Put, got %v", err)
+	}
+	if keys, _, err := b.List(); err != nil || len(keys) != 0 {
+		t.Fatalf("cancelled Put wrote %d keys (err %v)", len(keys), err)
+	}
+
+	if !fsPutOk {
+		t.Skipf("did not run TestFSPut")
+	}
+	destDir := filepath.Join(testutil.TempDir, "cancelled")
+	if _, err := GetContext(ctx, fsBucket, destDir); err == nil {
+		t.Fatalf("cancelled Get succeeded")
+	}
+}
+
 func TestS3Put(t *testing.T) {
 	if testutil.SkipS3 {
 		t.SkipNow()
@@ -120,6 +146,558 @@ func TestS3Get(t *testing.T) {
 	}
 }
 
+func TestPadding(t *testing.T) {
+	const boxSize = 1000
+	data := testutil.RandomBytes(2500)
+
+	tests := []struct {
+		pad   Padding
+		boxes int
+	}{
+		{nil, 3},
+		{PadBox, 3},
+		{PadPowerOfTwo, 4},
+		{PadQuantum(5), 5},
+	}
+	for i, test := range tests {
+		b := testutil.TempFileBucket(fmt.Sprintf("Padding%d", i))
+		w := NewPaddedWriter(b, boxSize, test.pad)
+		if _, err := w.Write(data); err != nil {
+			t.Fatalf("Write: %s", err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Close: %s", err)
+		}
+
+		keys, _, err := b.List()
+		if err != nil {
+			t.Fatalf("List: %s", err)
+		}
+		if len(keys) != test.boxes+1 {
+			t.Fatalf("test %d: expected %d boxes, got keys %v", i, test.boxes, keys)
+		}
+		last, err := b.Get(keys[len(keys)-2])
+		if err != nil {
+			t.Fatalf("Get: %s", err)
+		}
+		if padded := test.pad != nil; padded != (len(last) == boxSize) {
+			t.Fatalf("test %d: last box has size %d", i, len(last))
+		}
+		meta, err := b.Get("meta")
+		if err != nil {
+			t.Fatalf("Get: %s", err)
+		}
+		if padded := test.pad != nil; padded != (len(meta)%MetaQuantum == 0) {
+			t.Fatalf("test %d: meta has size %d", i, len(meta))
+		}
+
+		r, err := NewReader(b)
+		if err != nil {
+			t.Fatalf("NewReader: %s", err)
+		}
+		x, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("ReadAll: %s", err)
+		}
+		if !bytes.Equal(x, data) {
+			t.Fatalf("test %d: read %d bytes, expected %d", i, len(x), len(data))
+		}
+	}
+}
+
+func TestInfoAndStaleBoxes(t *testing.T) {
+	const boxSize = 1000
+	b := testutil.Upgrade(testutil.TempFileBucket("InfoAndStaleBoxes"))
+	for _, n := range []int{4500, 1500} {
+		w := NewWriter(b, boxSize)
+		if _, err := w.Write(testutil.RandomBytes(n)); err != nil {
+			t.Fatalf("Write: %s", err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Close: %s", err)
+		}
+	}
+
+	// The boxes of the first, larger backup are gone.
+	keys, _, err := b.List()
+	if err != nil {
+		t.Fatalf("List: %s", err)
+	}
+	if !reflect.DeepEqual(keys, []string{"00000", "00001", "meta"}) {
+		t.Fatalf("unexpected keys: %q", keys)
+	}
+
+	info, err := Info(b)
+	if err != nil {
+		t.Fatalf("Info: %s", err)
+	}
+	if info.Boxes != 2 || info.Size != 1500 || len(info.Missing) != 0 || info.Stored <= 1500 {
+		t.Fatalf("unexpected info: %+v", info)
+	}
+	if d := time.Since(info.Modified); d < 0 || d > time.Minute {
+		t.Fatalf("backup modified %s ago", d)
+	}
+
+	if err := b.Delete("00001"); err != nil {
+		t.Fatalf("Delete: %s", err)
+	}
+	info, err = Info(b)
+	if err != nil {
+		t.Fatalf("Info: %s", err)
+	}
+	if !reflect.DeepEqual(info.Missing, []string{"00001"}) {
+		t.Fatalf("expected box 00001 missing, got %q", info.Missing)
+	}
+}
+
+// putCounter records the keys put into a bucket.
+type putCounter struct {
+	Bucket
+	puts []string
+}
+
+func (b *putCounter) Put(key string, data []byte) error {
+	b.puts = append(b.puts, key)
+	return b.Bucket.Put(key, data)
+}
+
+func TestResume(t *testing.T) {
+	const boxSize = 1000
+	data := testutil.RandomBytes(3500)
+	changed := append([]byte(nil), data...)
+	changed[1500] ^= 1
+	tests := []struct {
+		data []byte
+		puts []string
+	}{
+		{data, []string{"00002", "00003", "meta"}},
+		{changed, []string{"00001", "00002", "00003", "meta"}},
+	}
+	for i, test := range tests {
+		b := testutil.Upgrade(testutil.TempFileBucket(fmt.Sprintf("Resume%d", i)))
+		// A put that failed after two boxes.
+		w := NewWriter(b, boxSize)
+		if _, err := w.Write(data[:2500]); err != nil {
+			t.Fatalf("Write: %s", err)
+		}
+
+		pc := &putCounter{Bucket: b}
+		w = NewWriter(pc, boxSize)
+		if _, err := w.Write(test.data); err != nil {
+			t.Fatalf("Write: %s", err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Close: %s", err)
+		}
+		if !reflect.DeepEqual(pc.puts, test.puts) {
+			t.Fatalf("test %d: expected puts %q, got %q", i, test.puts, pc.puts)
+		}
+		r, err := NewReader(b)
+		if err != nil {
+			t.Fatalf("NewReader: %s", err)
+		}
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("ReadAll: %s", err)
+		}
+		if !bytes.Equal(got, test.data) {
+			t.Fatalf("test %d: resumed backup differs", i)
+		}
+	}
+}
+
+func TestLock(t *testing.T) {
+	defer func(ttl time.Duration) { lockTTL = ttl }(lockTTL)
+	lockTTL = 90 * time.Millisecond
+
+	root := testutil.Upgrade(testutil.TempFileBucket("Lock"))
+	lock, err := LockBackup(context.Background(), root, "x")
+	if err != nil {
+		t.Fatalf("LockBackup: %s", err)
+	}
+	if _, err := LockBackup(context.Background(), root, "x"); err == nil {
+		t.Fatalf("locked a backup twice")
+	} else if e, ok := err.(*LockedError); !ok || e.Lock.PID != os.Getpid() {
+		t.Fatalf("expected a LockedError, got %v", err)
+	}
+
+	// The lock is refreshed, so it outlives its ttl.
+	time.Sleep(4 * lockTTL)
+	info, err := ReadLock(root, "x")
+	if err != nil {
+		t.Fatalf("ReadLock: %s", err)
+	}
+	if info.Stale(time.Now()) || lock.Context().Err() != nil {
+		t.Fatalf("lock expired while held: %+v", info)
+	}
+	if err := lock.Unlock(); err != nil {
+		t.Fatalf("Unlock: %s", err)
+	}
+	if _, err := ReadLock(root, "x"); !bucket.IsNotExist(err) {
+		t.Fatalf("lock remains after Unlock: %v", err)
+	}
+
+	// A broken lock is lost at the next refresh.
+	lock, err = LockBackup(context.Background(), root, "x")
+	if err != nil {
+		t.Fatalf("LockBackup: %s", err)
+	}
+	if err := BreakLock(root, "x"); err != nil {
+		t.Fatalf("BreakLock: %s", err)
+	}
+	select {
+	case <-lock.Context().Done():
+	case <-time.After(time.Second):
+		t.Fatalf("lock not lost after BreakLock")
+	}
+	if lock.Err() == nil || lock.Unlock() == nil {
+		t.Fatalf("expected an error for the lost lock")
+	}
+
+	// Stale locks are taken over.
+	host, _ := os.Hostname()
+	stale := []*LockInfo{
+		{Host: "elsewhere", PID: os.Getpid(), Expires: time.Now().Add(-time.Second)},
+		{Host: host, PID: 1 << 30, Expires: time.Now().Add(time.Hour)},
+	}
+	for _, info := range stale {
+		data, _ := json.Marshal(info)
+		if err := root.Put("x.lock", data); err != nil {
+			t.Fatalf("Put: %s", err)
+		}
+		lock, err = LockBackup(context.Background(), root, "x")
+		if err != nil {
+			t.Fatalf("LockBackup over %+v: %s", info, err)
+		}
+		if lock.Broken == nil || lock.Broken.PID != info.PID {
+			t.Fatalf("stale lock %+v not reported: %+v", info, lock.Broken)
+		}
+		if err := lock.Unlock(); err != nil {
+			t.Fatalf("Unlock: %s", err)
+		}
+	}
+}
+
+func TestLockNoOverwrite(t *testing.T) {
+	defer func(ttl time.Duration) { lockTTL = ttl }(lockTTL)
+	lockTTL = 90 * time.Millisecond
+
+	dir, err := ioutil.TempDir(testutil.TempDir, "LockNoOverwrite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fb, err := bucket.NewFileBucketWithOptions(dir, bucket.FileOptions{NoOverwrite: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := testutil.Upgrade(fb)
+	lock, err := LockBackup(context.Background(), root, "x")
+	if err != nil {
+		t.Fatalf("LockBackup: %s", err)
+	}
+	// The lock is refreshed several times, outliving its ttl.
+	time.Sleep(4 * lockTTL)
+	if err := lock.Context().Err(); err != nil {
+		t.Fatalf("lock lost: %v", lock.Err())
+	}
+	if err := lock.Unlock(); err != nil {
+		t.Fatalf("Unlock: %s", err)
+	}
+
+	// A stale lock is taken over.
+	info := newLockInfo()
+	info.Host = "elsewhere"
+	info.Expires = time.Now().Add(-time.Second)
+	data, _ := json.Marshal(info)
+	if err := root.Put("y.lock", data); err != nil {
+		t.Fatalf("Put: %s", err)
+	}
+	other, err := LockBackup(context.Background(), root, "y")
+	if err != nil {
+		t.Fatalf("LockBackup over a stale lock: %s", err)
+	}
+	if other.Broken == nil || other.Broken.Token != info.Token {
+		t.Fatalf("expected the stale lock to be broken, got %+v", other.Broken)
+	}
+	if err := other.Unlock(); err != nil {
+		t.Fatalf("Unlock: %s", err)
+	}
+}
+
+func TestLockCached(t *testing.T) {
+	defer func(ttl time.Duration) { lockTTL = ttl }(lockTTL)
+	lockTTL = 90 * time.Millisecond
+
+	cache, err := bucket.OpenCache(filepath.Join(testutil.TempDir, "LockCachedCache"), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := testutil.TempFileBucket("LockCached")
+	key := secretkey.New()
+	root := bucket.NewEncryptedBucket(bucket.NewCacheBucket(raw, cache), key)
+	// Another host, which shares the bucket but not the cache.
+	other := bucket.NewEncryptedBucket(raw, key)
+
+	// A stale lock that is in our cache is not trusted.
+	stale := &LockInfo{Host: "elsewhere", Expires: time.Now().Add(-time.Second)}
+	data, _ := json.Marshal(stale)
+	if err := root.Put("x.lock", data); err != nil {
+		t.Fatalf("Put: %s", err)
+	}
+	if _, err := root.Get("x.lock"); err != nil {
+		t.Fatalf("Get: %s", err)
+	}
+	live := &LockInfo{Host: "elsewhere", Token: "live", Expires: time.Now().Add(time.Hour)}
+	data, _ = json.Marshal(live)
+	if err := other.Put("x.lock", data); err != nil {
+		t.Fatalf("Put: %s", err)
+	}
+	if _, err := LockBackup(context.Background(), root, "x"); err == nil {
+		t.Fatalf("took over a live lock")
+	} else if e, ok := err.(*LockedError); !ok || e.Lock.Token != "live" {
+		t.Fatalf("expected a LockedError, got %v", err)
+	}
+
+	// A lock taken over by another host is lost at the next refresh.
+	if err := BreakLock(other, "x"); err != nil {
+		t.Fatalf("BreakLock: %s", err)
+	}
+	lock, err := LockBackup(context.Background(), root, "x")
+	if err != nil {
+		t.Fatalf("LockBackup: %s", err)
+	}
+	if err := other.Put("x.lock", data); err != nil {
+		t.Fatalf("Put: %s", err)
+	}
+	select {
+	case <-lock.Context().Done():
+	case <-time.After(time.Second):
+		t.Fatalf("lock not lost after it was taken over")
+	}
+	if _, ok := lock.Err().(*LockedError); !ok {
+		t.Fatalf("expected a LockedError, got %v", lock.Err())
+	}
+	if info, err := ReadLock(other, "x"); err != nil || info.Token != "live" {
+		t.Fatalf("the new holder's lock was overwritten: %+v, %v", info, err)
+	}
+}
+
+func TestMoveBackup(t *testing.T) {
+	root := testutil.Upgrade(testutil.TempFileBucket("MoveBackup"))
+	src, _ := root.Descend("x")
+	data := testutil.RandomBytes(2500)
+	w := NewWriter(src, 1000)
+	if _, err := w.Write(data); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+
+	if err := MoveBackup(context.Background(), root, "x", "y"); err != nil {
+		t.Fatalf("MoveBackup: %s", err)
+	}
+	if _, children, err := root.List(); err != nil || !reflect.DeepEqual(children, []string{"y"}) {
+		t.Fatalf("expected only y, got %q (err %v)", children, err)
+	}
+	dst, _ := root.Descend("y")
+	r, err := NewReader(dst)
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	if x, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(x, data) {
+		t.Fatalf("moved backup differs (err %v)", err)
+	}
+
+	// The destination must be unused.
+	if err := src.Put("meta", []byte("{}")); err != nil {
+		t.Fatalf("Put: %s", err)
+	}
+	if err := MoveBackup(context.Background(), root, "x", "y"); err == nil {
+		t.Fatalf("MoveBackup overwrote an existing backup")
+	}
+	if _, err := Info(dst); err != nil {
+		t.Fatalf("Info: %s", err)
+	}
+}
+
+func TestScrub(t *testing.T) {
+	raw := testutil.TempFileBucket("Scrub")
+	b := testutil.Upgrade(raw)
+	w := NewWriter(b, 1000)
+	if _, err := w.Write(testutil.RandomBytes(3500)); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+
+	report, err := Scrub(context.Background(), b)
+	if err != nil {
+		t.Fatalf("Scrub: %s", err)
+	}
+	if report.Boxes != 4 || report.Bytes != 3500 || len(report.Problems) != 0 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+
+	box, err := raw.Get("00001")
+	if err != nil {
+		t.Fatalf("Get: %s", err)
+	}
+	box[len(box)/2] ^= 1
+	if err := raw.Put("00001", box); err != nil {
+		t.Fatalf("Put: %s", err)
+	}
+	if err := raw.Delete("00003"); err != nil {
+		t.Fatalf("Delete: %s", err)
+	}
+	// A box that decrypts fine but is not the one in the metadata.
+	if err := b.Put("00002", []byte("not the original box")); err != nil {
+		t.Fatalf("Put: %s", err)
+	}
+
+	report, err = Scrub(context.Background(), b)
+	if err != nil {
+		t.Fatalf("Scrub: %s", err)
+	}
+	expected := []BoxProblem{
+		{Key: "00001", Path: raw.Abs("00001"), Err: bucket.ErrAuth},
+		{Key: "00002", Path: raw.Abs("00002"), Err: ErrHashMismatch},
+		{Key: "00003", Path: raw.Abs("00003"), Missing: true},
+	}
+	if len(report.Problems) != len(expected) {
+		t.Fatalf("expected %d problems, got %v", len(expected), report.Problems)
+	}
+	for i, p := range report.Problems {
+		e := expected[i]
+		if p.Key != e.Key || p.Path != e.Path || p.Missing != e.Missing || (e.Err != nil && p.Err != e.Err) {
+			t.Fatalf("problem %d: expected %v, got %v", i, e, p)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := Scrub(ctx, b); err == nil {
+		t.Fatalf("cancelled Scrub succeeded")
+	}
+}
+
+func TestScrubReplicas(t *testing.T) {
+	a := testutil.TempFileBucket("ScrubReplicasA")
+	b := testutil.TempFileBucket("ScrubReplicasB")
+	m, err := bucket.NewMirrorBucket([]bucket.Replica{{Name: "a", Bucket: a}, {Name: "b", Bucket: b}}, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := testutil.Upgrade(m)
+	x, _ := root.Descend("x")
+	w := NewWriter(x, 1000)
+	if _, err := w.Write(testutil.RandomBytes(3500)); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+
+	// Reads through the mirror fall back to the intact copies, but a
+	// scrub reads each replica.
+	bx, _ := b.Descend("x")
+	box, err := bx.Get("00001")
+	if err != nil {
+		t.Fatalf("Get: %s", err)
+	}
+	box[len(box)/2] ^= 1
+	if err := bx.Put("00001", box); err != nil {
+		t.Fatalf("Put: %s", err)
+	}
+	if err := bx.Delete("meta"); err != nil {
+		t.Fatalf("Delete: %s", err)
+	}
+	r, err := NewReader(x)
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	if _, err := ioutil.ReadAll(r); err != nil {
+		t.Fatalf("Read: %s", err)
+	}
+
+	report, err := Scrub(context.Background(), x)
+	if err != nil {
+		t.Fatalf("Scrub: %s", err)
+	}
+	if report.Boxes != 4 || report.Replicas != 2 || report.Bytes != 2*3500-1000 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	expected := []BoxProblem{
+		{Key: "meta", Path: bx.Abs("meta"), Missing: true},
+		{Key: "00001", Path: bx.Abs("00001"), Err: bucket.ErrAuth},
+	}
+	if len(report.Problems) != len(expected) {
+		t.Fatalf("expected %d problems, got %v", len(expected), report.Problems)
+	}
+	for i, p := range report.Problems {
+		e := expected[i]
+		if p.Key != e.Key || p.Path != e.Path || p.Missing != e.Missing || (e.Err != nil && p.Err != e.Err) {
+			t.Fatalf("problem %d: expected %v, got %v", i, e, p)
+		}
+	}
+}
+
+func TestCachedReader(t *testing.T) {
+	const boxSize = 1000
+	cache, err := bucket.OpenCache(filepath.Join(testutil.TempDir, "CachedReader"), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mem := bucket.NewMemoryBucket()
+	key := secretkey.New()
+	raw := bucket.NewEncryptedBucket(mem, key)
+	cached := bucket.NewEncryptedBucket(bucket.NewCacheBucket(mem, cache), key)
+
+	read := func(b Bucket, data []byte) {
+		r, err := NewReader(b)
+		if err != nil {
+			t.Fatalf("NewReader: %s", err)
+		}
+		x, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("ReadAll: %s", err)
+		}
+		if !bytes.Equal(x, data) {
+			t.Fatalf("read %d bytes, expected %d", len(x), len(data))
+		}
+	}
+	write := func(data []byte) {
+		w := NewWriter(raw, boxSize)
+		if _, err := w.Write(data); err != nil {
+			t.Fatalf("Write: %s", err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Close: %s", err)
+		}
+	}
+
+	old := testutil.RandomBytes(2500)
+	write(old)
+	read(cached, old)
+	if cache.Size() == 0 {
+		t.Fatal("nothing was cached")
+	}
+
+	// Replace the backup behind the cache's back: the metadata is
+	// read from the bucket, and the stale boxes are downloaded again.
+	data := testutil.RandomBytes(2500)
+	write(data)
+	read(cached, data)
+
+	// Corrupt cached boxes are downloaded again too.
+	for name, box := range mem.Snapshot() {
+		box[len(box)-1] ^= 1
+		cache.Put(name, box)
+	}
+	read(cached, data)
+}
+
 var (
 	benchBucket bucket.Bucket
 	benchPutOk  bool
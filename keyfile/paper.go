@@ -0,0 +1,297 @@
+package keyfile
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/davidlazar/go-crypto/encoding/base32"
+)
+
+// The paper format is meant to be retyped by hand.  Each line holds
+// three groups of five base32 characters followed by a three character
+// check group.  The check group makes every line a Reed-Solomon codeword
+// over GF(32), so a single mistyped character in a line is corrected
+// and anything worse is reported against that line.  The line number
+// and whether it is the last line are also covered by the checksum, so
+// lines that are swapped or missing are caught too.
+
+const (
+	paperGroup    = 5
+	paperLine     = 3 * paperGroup
+	paperCheck    = 3
+	paperVirtual  = 2 // line number and last-line flag
+	paperMaxLines = 32
+)
+
+const alphabet = "0123456789abcdefghjkmnpqrstvwxyz"
+
+var (
+	gfExp [62]byte
+	gfLog [32]byte
+	value [256]int8
+)
+
+func init() {
+	// GF(32) with primitive polynomial x^5 + x^2 + 1.
+	x := 1
+	for i := 0; i < 31; i++ {
+		gfExp[i] = byte(x)
+		gfExp[i+31] = byte(x)
+		gfLog[x] = byte(i)
+		x <<= 1
+		if x&0x20 != 0 {
+			x ^= 0x25
+		}
+	}
+
+	for i := range value {
+		value[i] = -1
+	}
+	for i := 0; i < len(alphabet); i++ {
+		c := alphabet[i]
+		value[c] = int8(i)
+		if c >= 'a' && c <= 'z' {
+			value[c-'a'+'A'] = int8(i)
+		}
+	}
+	// Letters left out of the alphabet are read as the symbols they
+	// are most easily confused with.
+	for _, p := range []string{"o0", "O0", "i1", "I1", "l1", "L1", "uv", "Uv"} {
+		value[p[0]] = value[p[1]]
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfDiv(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+31-int(gfLog[b])]
+}
+
+// generator is (x - 1)(x - a)(x - a^2), highest degree first.
+var generator = []byte{1, 0, 0, 0}
+
+func init() {
+	for j := 0; j < paperCheck; j++ {
+		root := gfExp[j]
+		next := make([]byte, len(generator))
+		for i := 0; i < len(generator); i++ {
+			next[i] = generator[i]
+			if i > 0 {
+				next[i] ^= gfMul(generator[i-1], root)
+			}
+		}
+		generator = next
+	}
+}
+
+// checkSymbols returns the systematic Reed-Solomon parity of msg.
+func checkSymbols(msg []byte) []byte {
+	r := make([]byte, paperCheck)
+	for _, m := range msg {
+		f := m ^ r[0]
+		copy(r, r[1:])
+		r[paperCheck-1] = 0
+		for i := 0; i < paperCheck; i++ {
+			r[i] ^= gfMul(f, generator[i+1])
+		}
+	}
+	return r
+}
+
+// syndromes evaluates the codeword c at 1, a and a^2.
+func syndromes(c []byte) (s [paperCheck]byte) {
+	for j := range s {
+		for _, x := range c {
+			s[j] = gfMul(s[j], gfExp[j]) ^ x
+		}
+	}
+	return s
+}
+
+func virtual(line int, last bool) []byte {
+	v := []byte{byte(line), 0}
+	if last {
+		v[1] = 1
+	}
+	return v
+}
+
+// EncodePaper formats an encrypted key file (see secretkey.Decode) in the
+// paper format.
+func EncodePaper(ctxt []byte) []byte {
+	s := base32.EncodeToString(ctxt)
+	nlines := (len(s) + paperLine - 1) / paperLine
+	if nlines > paperMaxLines {
+		panic("keyfile: data too long for paper format")
+	}
+
+	buf := new(bytes.Buffer)
+	for n := 0; n < nlines; n++ {
+		line := s[n*paperLine:]
+		if len(line) > paperLine {
+			line = line[:paperLine]
+		}
+
+		msg := virtual(n, n == nlines-1)
+		for i := 0; i < len(line); i++ {
+			msg = append(msg, byte(value[line[i]]))
+			if i > 0 && i%paperGroup == 0 {
+				buf.WriteByte(' ')
+			}
+			buf.WriteByte(line[i])
+		}
+		buf.WriteString("  ")
+		for _, c := range checkSymbols(msg) {
+			buf.WriteByte(alphabet[c])
+		}
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+// A Correction describes a mistyped character that DecodePaper fixed.
+type Correction struct {
+	Line  int // 1-based line number
+	Group int // 1-based group number, the check group is last
+	Index int // 1-based character index within the group
+	Old   byte
+	New   byte
+}
+
+func (c Correction) String() string {
+	return fmt.Sprintf("line %d, group %d, character %d: corrected %q to %q", c.Line, c.Group, c.Index, c.Old, c.New)
+}
+
+// A LineError reports a line of a paper key that could not be decoded.
+type LineError struct {
+	Line int // 1-based line number
+	Text string
+	Err  string
+}
+
+func (e *LineError) Error() string {
+	return fmt.Sprintf("line %d %q: %s", e.Line, e.Text, e.Err)
+}
+
+// PaperError lists every bad line of a paper key.
+type PaperError []*LineError
+
+func (e PaperError) Error() string {
+	s := make([]string, len(e))
+	for i := range e {
+		s[i] = e[i].Error()
+	}
+	return strings.Join(s, "\n")
+}
+
+// DecodePaper parses a key in the paper format, correcting at most one
+// mistyped character per line.  Blank lines are ignored.  The returned
+// corrections should be shown to the user.
+func DecodePaper(paper []byte) ([]byte, []Correction, error) {
+	var lines []string
+	for _, l := range strings.Split(string(paper), "\n") {
+		if strings.TrimSpace(l) != "" {
+			lines = append(lines, strings.TrimSpace(l))
+		}
+	}
+	if len(lines) == 0 {
+		return nil, nil, fmt.Errorf("empty paper key")
+	}
+	if len(lines) > paperMaxLines {
+		return nil, nil, fmt.Errorf("too many lines in paper key: %d", len(lines))
+	}
+
+	var errs PaperError
+	var fixes []Correction
+	s := new(bytes.Buffer)
+	for n, text := range lines {
+		last := n == len(lines)-1
+		data, fix, err := decodeLine(text, n, last)
+		if err != "" {
+			errs = append(errs, &LineError{Line: n + 1, Text: text, Err: err})
+			continue
+		}
+		if fix != nil {
+			fixes = append(fixes, *fix)
+		}
+		s.WriteString(data)
+	}
+	if len(errs) > 0 {
+		return nil, fixes, errs
+	}
+
+	ctxt, err := base32.DecodeString(s.String())
+	if err != nil {
+		return nil, fixes, fmt.Errorf("base32.DecodeString: %s", err)
+	}
+	return ctxt, fixes, nil
+}
+
+func decodeLine(text string, n int, last bool) (string, *Correction, string) {
+	groups := strings.Fields(text)
+	if len(groups) < 2 {
+		return "", nil, "expecting data groups followed by a check group"
+	}
+
+	// Remember where each symbol was typed, to report corrections.
+	type pos struct{ group, index int }
+	var positions []pos
+	msg := virtual(n, last)
+	for g, group := range groups {
+		if g == len(groups)-1 && len(group) != paperCheck {
+			return "", nil, fmt.Sprintf("check group %q should have %d characters", group, paperCheck)
+		}
+		for i := 0; i < len(group); i++ {
+			v := value[group[i]]
+			if v < 0 {
+				return "", nil, fmt.Sprintf("invalid character %q in group %d", group[i], g+1)
+			}
+			msg = append(msg, byte(v))
+			positions = append(positions, pos{g + 1, i + 1})
+		}
+	}
+	ndata := len(msg) - paperVirtual - paperCheck
+	if ndata > paperLine || (!last && ndata != paperLine) {
+		return "", nil, fmt.Sprintf("expecting %d characters before the check group, got %d (missing or extra character?)", paperLine, ndata)
+	}
+
+	var fix *Correction
+	s := syndromes(msg)
+	if s != [paperCheck]byte{} {
+		// A single error e at locator X gives syndromes e, eX, eX^2.
+		if s[0] == 0 || s[1] == 0 || gfMul(s[0], s[2]) != gfMul(s[1], s[1]) {
+			return "", nil, "checksum mismatch: more than one mistyped character"
+		}
+		i := len(msg) - 1 - int(gfLog[gfDiv(s[1], s[0])])
+		if i < 0 {
+			return "", nil, "checksum mismatch: more than one mistyped character"
+		}
+		if i < paperVirtual {
+			return "", nil, "checksum mismatch: line is out of order, or a line is missing"
+		}
+		msg[i] ^= s[0]
+		p := positions[i-paperVirtual]
+		fix = &Correction{
+			Line:  n + 1,
+			Group: p.group,
+			Index: p.index,
+			Old:   groups[p.group-1][p.index-1],
+			New:   alphabet[msg[i]],
+		}
+	}
+
+	data := make([]byte, ndata)
+	for i := range data {
+		data[i] = alphabet[msg[paperVirtual+i]]
+	}
+	return string(data), fix, ""
+}
@@ -0,0 +1,107 @@
+package keyfile
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/davidlazar/go-crypto/secretkey"
+)
+
+func testKey() []byte {
+	key := make([]byte, secretkey.EncryptedKeyLength)
+	for i := range key {
+		key[i] = byte(i * 37)
+	}
+	return key
+}
+
+func TestPaperRoundTrip(t *testing.T) {
+	for n := 1; n <= 60; n++ {
+		data := bytes.Repeat([]byte{0xa5, 0x17, 0x3c}, n)[:n]
+		paper := EncodePaper(data)
+		x, fixes, err := DecodePaper(paper)
+		if err != nil {
+			t.Fatalf("DecodePaper(%q): %s", paper, err)
+		}
+		if len(fixes) > 0 {
+			t.Fatalf("unexpected corrections: %v", fixes)
+		}
+		if !bytes.Equal(x, data) {
+			t.Fatalf("expected %x, got %x", data, x)
+		}
+	}
+}
+
+func TestPaperCorrection(t *testing.T) {
+	ctxt := testKey()
+	paper := EncodePaper(ctxt)
+	for i, c := range paper {
+		if c == ' ' || c == '\n' {
+			continue
+		}
+		for _, typo := range []byte("0z") {
+			if typo == c {
+				continue
+			}
+			bad := append([]byte(nil), paper...)
+			bad[i] = typo
+
+			x, fixes, err := DecodePaper(bad)
+			if err != nil {
+				t.Fatalf("DecodePaper with typo at %d: %s", i, err)
+			}
+			if !bytes.Equal(x, ctxt) {
+				t.Fatalf("typo at %d: wrong key", i)
+			}
+			if len(fixes) != 1 || fixes[0].Old != typo || fixes[0].New != c {
+				t.Fatalf("typo at %d: unexpected corrections: %v", i, fixes)
+			}
+			if line := bytes.Count(paper[:i], []byte("\n")) + 1; fixes[0].Line != line {
+				t.Fatalf("typo at %d: expected line %d, got %v", i, line, fixes[0])
+			}
+		}
+	}
+}
+
+func TestPaperErrors(t *testing.T) {
+	paper := string(EncodePaper(testKey()))
+	lines := strings.SplitAfter(paper, "\n")
+
+	// Two typos in the second line.
+	b := []byte(lines[1])
+	b[0] ^= 1
+	b[7] ^= 1
+	checkLineError(t, lines[0]+string(b)+lines[2]+lines[3], 2)
+
+	// Swapped lines.
+	checkLineError(t, lines[0]+lines[2]+lines[1]+lines[3], 2, 3)
+
+	// Missing last line.
+	checkLineError(t, lines[0]+lines[1]+lines[2], 3)
+
+	// Missing character.
+	checkLineError(t, lines[0]+lines[1]+lines[2][1:]+lines[3], 3)
+
+	// Confusable letters are not errors.
+	fixed := strings.NewReplacer("0", "O", "1", "l").Replace(strings.ToUpper(paper))
+	if _, fixes, err := DecodePaper([]byte(fixed)); err != nil || len(fixes) != 0 {
+		t.Fatalf("DecodePaper(%q): %v %s", fixed, fixes, err)
+	}
+}
+
+func checkLineError(t *testing.T, paper string, lines ...int) {
+	_, _, err := DecodePaper([]byte(paper))
+	perr, ok := err.(PaperError)
+	if !ok {
+		t.Fatalf("DecodePaper(%q): expected PaperError, got %v", paper, err)
+	}
+	if len(perr) != len(lines) {
+		t.Fatalf("DecodePaper(%q): expected errors on lines %v, got %s", paper, lines, perr)
+	}
+	for i := range lines {
+		if perr[i].Line != lines[i] {
+			t.Fatalf("DecodePaper(%q): expected errors on lines %v, got %s", paper, lines, perr)
+		}
+	}
+}
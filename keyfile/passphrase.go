@@ -0,0 +1,174 @@
+package keyfile
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/davidlazar/go-crypto/secretkey"
+)
+
+// A Source supplies the passphrase of a key file without prompting,
+// so that keys can be unlocked by cron jobs and CI.
+type Source interface {
+	Passphrase() ([]byte, error)
+
+	// String describes the source for logging.  It never includes the
+	// passphrase.
+	String() string
+}
+
+// EnvSource reads the passphrase from the named environment variable.
+// The variable is removed from the environment once read, so it is not
+// inherited by tar.
+type EnvSource string
+
+func (s EnvSource) Passphrase() ([]byte, error) {
+	p, ok := os.LookupEnv(string(s))
+	if !ok {
+		return nil, fmt.Errorf("environment variable %s is not set", string(s))
+	}
+	os.Unsetenv(string(s))
+	return []byte(p), nil
+}
+
+func (s EnvSource) String() string {
+	return fmt.Sprintf("environment variable %s", string(s))
+}
+
+// FDSource reads the passphrase from an open file descriptor, up to the
+// first newline.  It does not wait for the end of the file, so the
+// writer need not close its end.
+type FDSource int
+
+func (s FDSource) Passphrase() ([]byte, error) {
+	f := os.NewFile(uintptr(s), s.String())
+	if f == nil {
+		return nil, fmt.Errorf("invalid file descriptor %d", int(s))
+	}
+	defer f.Close()
+	// Read a byte at a time, so that nothing after the first line is
+	// taken from a descriptor that is shared with another reader.
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		n, err := f.Read(b)
+		if n > 0 {
+			if b[0] == '\n' {
+				break
+			}
+			line = append(line, b[0])
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("reading %s: %s", s, err)
+		}
+	}
+	return firstLine(line), nil
+}
+
+func (s FDSource) String() string {
+	return fmt.Sprintf("file descriptor %d", int(s))
+}
+
+// FileSource reads the passphrase from a file, up to the first newline.
+// The file must be a regular file owned by the current user, and not
+// accessible by anyone else.
+type FileSource string
+
+func (s FileSource) Passphrase() ([]byte, error) {
+	f, err := os.Open(string(s))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not a regular file", string(s))
+	}
+	if fi.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("%s has permissions %04o, expecting 0600 or stricter", string(s), fi.Mode().Perm())
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && int(st.Uid) != os.Getuid() {
+		return nil, fmt.Errorf("%s is owned by uid %d, not the current user", string(s), st.Uid)
+	}
+
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	return firstLine(data), nil
+}
+
+func (s FileSource) String() string {
+	return fmt.Sprintf("passphrase file %s", string(s))
+}
+
+// CommandSource runs a helper command with the shell, for example
+// "pass show kebab", and reads the passphrase from the first line of
+// its output.  The command's stderr and stdin are passed through so it
+// can talk to the user or an agent.
+type CommandSource string
+
+func (s CommandSource) Passphrase() ([]byte, error) {
+	cmd := exec.Command("/bin/sh", "-c", string(s))
+	cmd.Stdin = os.Stdin
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s failed: %s", s, err)
+	}
+	return firstLine(out), nil
+}
+
+func (s CommandSource) String() string {
+	return fmt.Sprintf("command %q", string(s))
+}
+
+func firstLine(data []byte) []byte {
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		data = data[:i]
+	}
+	return bytes.TrimSuffix(data, []byte{'\r'})
+}
+
+// ReadFile reads and decrypts a key file using the passphrase from src.
+// Unlike secretkey.ReadFile, a wrong passphrase is an error instead of
+// a reason to ask again.  If src is nil, ReadFile prompts on the
+// terminal with secretkey.ReadFile.
+func ReadFile(path string, src Source) (*secretkey.Key, error) {
+	if src == nil {
+		return secretkey.ReadFile(path)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	ctxt, err := secretkey.Decode(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(ctxt) != secretkey.EncryptedKeyLength {
+		return nil, fmt.Errorf("invalid key size")
+	}
+
+	passphrase, err := src.Passphrase()
+	if err != nil {
+		return nil, fmt.Errorf("passphrase from %s: %s", src, err)
+	}
+	key, ok := secretkey.Decrypt(ctxt, passphrase)
+	if !ok {
+		return nil, fmt.Errorf("incorrect passphrase from %s", src)
+	}
+	return key, nil
+}
@@ -0,0 +1,104 @@
+package keyfile
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/davidlazar/go-crypto/secretkey"
+)
+
+func TestSources(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kebab_keyfile_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.Setenv("KEBAB_TEST_PASSPHRASE", "from env")
+	checkPassphrase(t, EnvSource("KEBAB_TEST_PASSPHRASE"), "from env")
+	if _, ok := os.LookupEnv("KEBAB_TEST_PASSPHRASE"); ok {
+		t.Fatalf("EnvSource did not unset the variable")
+	}
+	if _, err := EnvSource("KEBAB_TEST_PASSPHRASE").Passphrase(); err == nil {
+		t.Fatalf("expected error for unset variable")
+	}
+
+	path := filepath.Join(dir, "passphrase")
+	if err := ioutil.WriteFile(path, []byte("from file\nignored\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	checkPassphrase(t, FileSource(path), "from file")
+	os.Chmod(path, 0640)
+	if _, err := FileSource(path).Passphrase(); err == nil {
+		t.Fatalf("expected error for group readable passphrase file")
+	}
+	if _, err := FileSource(dir).Passphrase(); err == nil {
+		t.Fatalf("expected error for directory")
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only the first line is read, without waiting for the writer to
+	// close the pipe, and the rest is left for other readers.
+	w.Write([]byte("from fd\r\nsecond line\n"))
+	fd, err := syscall.Dup(int(r.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPassphrase(t, FDSource(fd), "from fd")
+	w.Close()
+	if rest, err := ioutil.ReadAll(r); err != nil || string(rest) != "second line\n" {
+		t.Fatalf("expected the second line to be left, got %q (err %v)", rest, err)
+	}
+	r.Close()
+
+	checkPassphrase(t, CommandSource("echo 'from command'"), "from command")
+	if _, err := CommandSource("exit 3").Passphrase(); err == nil {
+		t.Fatalf("expected error for failing command")
+	}
+}
+
+func checkPassphrase(t *testing.T, src Source, expected string) {
+	p, err := src.Passphrase()
+	if err != nil {
+		t.Fatalf("%s: %s", src, err)
+	}
+	if string(p) != expected {
+		t.Fatalf("%s: expected %q, got %q", src, expected, p)
+	}
+}
+
+func TestReadFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kebab_keyfile_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key := secretkey.New()
+	path := filepath.Join(dir, "kebab.key")
+	data := secretkey.Encode(secretkey.Encrypt(key, []byte("correct horse")))
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("KEBAB_TEST_PASSPHRASE", "correct horse")
+	k, err := ReadFile(path, EnvSource("KEBAB_TEST_PASSPHRASE"))
+	if err != nil {
+		t.Fatalf("ReadFile: %s", err)
+	}
+	if !bytes.Equal(k[:], key[:]) {
+		t.Fatalf("ReadFile: wrong key")
+	}
+
+	os.Setenv("KEBAB_TEST_PASSPHRASE", "wrong horse")
+	if _, err := ReadFile(path, EnvSource("KEBAB_TEST_PASSPHRASE")); err == nil {
+		t.Fatalf("ReadFile: expected error for wrong passphrase")
+	}
+}
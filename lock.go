@@ -0,0 +1,270 @@
+package kebab
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/davidlazar/kebab/bucket"
+)
+
+// Locks are advisory: a backup is locked by a lock object named
+// "<id>.lock" next to it, which writers of the backup check before
+// starting.  Buckets have no atomic create, so two writers that start
+// at the same moment may both take the lock, but the loser finds out
+// when it next refreshes the lock and gives up.
+
+// lockTTL is how long a lock lasts without being refreshed.  Holders
+// refresh their lock every lockTTL/3.
+var lockTTL = 15 * time.Minute
+
+// LockInfo is the content of a lock object.
+type LockInfo struct {
+	Owner string
+	Host  string
+	PID   int
+
+	// Token identifies the holder, since Owner, Host and PID need not
+	// be unique.
+	Token string
+
+	Created time.Time
+	Expires time.Time
+}
+
+func (l *LockInfo) String() string {
+	return fmt.Sprintf("%s@%s (pid %d) since %s", l.Owner, l.Host, l.PID, l.Created.Local().Format("2006-01-02 15:04:05"))
+}
+
+// Stale reports whether the lock was abandoned: it expired at now, or
+// its holder ran on this host and is no longer running.  Expiry relies
+// on the clocks of the holder and of this host roughly agreeing.
+func (l *LockInfo) Stale(now time.Time) bool {
+	if now.After(l.Expires) {
+		return true
+	}
+	if host, err := os.Hostname(); err == nil && host == l.Host {
+		return !processExists(l.PID)
+	}
+	return false
+}
+
+func processExists(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || err == syscall.EPERM
+}
+
+// LockedError is returned when a backup is locked by someone else.
+type LockedError struct {
+	ID   string
+	Lock *LockInfo
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("backup %q is locked by %s", e.ID, e.Lock)
+}
+
+func lockKey(id string) string {
+	return id + ".lock"
+}
+
+// ReadLock returns the lock on backup id in root.  If the backup is
+// not locked, the error satisfies bucket.IsNotExist.  Locks change
+// under other holders, so they are never read from a cache.
+func ReadLock(root Bucket, id string) (*LockInfo, error) {
+	fresh, _ := bucket.Uncached(root)
+	data, err := fresh.Get(lockKey(id))
+	if err != nil {
+		return nil, err
+	}
+	l := new(LockInfo)
+	if err := json.Unmarshal(data, l); err != nil {
+		return nil, fmt.Errorf("invalid lock %q: %s", lockKey(id), err)
+	}
+	return l, nil
+}
+
+// BreakLock removes the lock on backup id in root, whoever holds it.
+// The holder, if it is still running, gives up when it next refreshes
+// the lock.
+func BreakLock(root Bucket, id string) error {
+	return root.Delete(lockKey(id))
+}
+
+// A BackupLock is a lock held on a backup.
+type BackupLock struct {
+	// Broken is the stale lock that was taken over, if any.
+	Broken *LockInfo
+
+	root Bucket
+	id   string
+	info LockInfo
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu  sync.Mutex
+	err error
+}
+
+// LockBackup locks backup id in root, taking over a stale lock.  The
+// lock is refreshed in the background until Unlock is called or ctx is
+// done.  If the backup is locked by someone else, the error is a
+// *LockedError.
+func LockBackup(ctx context.Context, root Bucket, id string) (*BackupLock, error) {
+	l := &BackupLock{
+		root: root,
+		id:   id,
+		done: make(chan struct{}),
+	}
+	old, err := ReadLock(root, id)
+	if err == nil {
+		if !old.Stale(time.Now()) {
+			return nil, &LockedError{ID: id, Lock: old}
+		}
+		l.Broken = old
+	} else if !bucket.IsNotExist(err) {
+		return nil, fmt.Errorf("reading lock: %s", err)
+	}
+
+	l.info = newLockInfo()
+	if err := l.write(); err != nil {
+		return nil, fmt.Errorf("writing lock: %s", err)
+	}
+	// Check that a concurrent writer did not overwrite our lock.
+	if err := l.check(); err != nil {
+		return nil, err
+	}
+
+	l.ctx, l.cancel = context.WithCancel(ctx)
+	go l.refresh()
+	return l, nil
+}
+
+func newLockInfo() LockInfo {
+	var token [16]byte
+	if _, err := rand.Read(token[:]); err != nil {
+		panic(err)
+	}
+	info := LockInfo{
+		Owner:   os.Getenv("USER"),
+		PID:     os.Getpid(),
+		Token:   hex.EncodeToString(token[:]),
+		Created: time.Now(),
+	}
+	if u, err := user.Current(); err == nil {
+		info.Owner = u.Username
+	}
+	info.Host, _ = os.Hostname()
+	return info
+}
+
+// write replaces the lock object.  Buckets that refuse to overwrite
+// keys (see bucket.FileOptions) need it deleted first, which leaves it
+// missing for a moment, so that is only done when the put fails.
+func (l *BackupLock) write() error {
+	info := l.info
+	info.Expires = time.Now().Add(lockTTL)
+	data, err := json.Marshal(info)
+	if err != nil {
+		panic(err)
+	}
+	err = l.root.Put(lockKey(l.id), data)
+	if os.IsExist(err) {
+		if err = l.root.Delete(lockKey(l.id)); err == nil {
+			err = l.root.Put(lockKey(l.id), data)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	l.info = info
+	return nil
+}
+
+// check returns a *LockedError if the lock is no longer ours.
+func (l *BackupLock) check() error {
+	cur, err := ReadLock(l.root, l.id)
+	if bucket.IsNotExist(err) {
+		return fmt.Errorf("lock on backup %q was broken", l.id)
+	} else if err != nil {
+		return fmt.Errorf("reading lock: %s", err)
+	}
+	if cur.Token != l.info.Token {
+		return &LockedError{ID: l.id, Lock: cur}
+	}
+	return nil
+}
+
+func (l *BackupLock) refresh() {
+	defer close(l.done)
+	t := time.NewTicker(lockTTL / 3)
+	defer t.Stop()
+	failed := false
+	for {
+		select {
+		case <-l.ctx.Done():
+			return
+		case <-t.C:
+		}
+		// After a failed write, the lock may be missing because of us.
+		var err error
+		if !failed {
+			err = l.check()
+		}
+		if err == nil {
+			err = l.write()
+			failed = err != nil
+		}
+		if err == nil {
+			continue
+		}
+		// Transient errors are retried until the lock expires.
+		if _, lost := err.(*LockedError); !lost && time.Now().Before(l.info.Expires) {
+			continue
+		}
+		l.mu.Lock()
+		l.err = err
+		l.mu.Unlock()
+		l.cancel()
+		return
+	}
+}
+
+// Context returns a context that is done once the lock is released or
+// lost, for the operations done under the lock.
+func (l *BackupLock) Context() context.Context {
+	return l.ctx
+}
+
+// Err returns why the lock was lost, or nil.
+func (l *BackupLock) Err() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.err
+}
+
+// Unlock stops refreshing the lock and removes it, unless it was lost.
+func (l *BackupLock) Unlock() error {
+	l.cancel()
+	<-l.done
+	if err := l.Err(); err != nil {
+		return err
+	}
+	if err := l.check(); err != nil {
+		return err
+	}
+	return l.root.Delete(lockKey(l.id))
+}
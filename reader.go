@@ -6,6 +6,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+
+	"github.com/davidlazar/kebab/bucket"
 )
 
 type Reader struct {
@@ -17,29 +19,60 @@ type Reader struct {
 	boxes []boxhash
 	bn    int
 
+	size  int64 // -1 if the backup is not padded
 	total int64
 }
 
-func NewReader(bucket Bucket) (*Reader, error) {
+func NewReader(b Bucket) (*Reader, error) {
 	r := &Reader{
-		bucket: bucket,
+		bucket: b,
 	}
 
-	metajson, err := r.bucket.Get("meta")
+	meta, err := readMeta(b)
+	if err != nil {
+		return nil, err
+	}
+	r.boxes = meta.Boxes
+	r.size = -1
+	if meta.Version >= 1 {
+		r.size = meta.Size
+	}
+	return r, nil
+}
+
+// readMeta reads the metadata of the backup in b.  The metadata decides
+// which boxes are valid, so it is never read from a cache.
+func readMeta(b Bucket) (*Metadata, error) {
+	fresh, _ := bucket.Uncached(b)
+	metajson, err := fresh.Get("meta")
 	if err != nil {
 		return nil, fmt.Errorf("Get(%q): %s", "meta", err)
 	}
-	var meta Metadata
-	if err := json.Unmarshal(metajson, &meta); err != nil {
+	return parseMeta(metajson)
+}
+
+func parseMeta(metajson []byte) (*Metadata, error) {
+	meta := new(Metadata)
+	if err := json.Unmarshal(metajson, meta); err != nil {
 		return nil, fmt.Errorf("failed to parse metadata: %s", err)
 	}
-	r.boxes = meta.Boxes
-	return r, nil
+	if meta.Version > Version {
+		return nil, fmt.Errorf("unsupported metadata version: %d", meta.Version)
+	}
+	return meta, nil
 }
 
 func (r *Reader) Read(p []byte) (n int, err error) {
 	defer func() { r.total += int64(n) }()
 
+	if r.size >= 0 {
+		if r.total >= r.size {
+			return 0, io.EOF
+		}
+		if int64(len(p)) > r.size-r.total {
+			p = p[:r.size-r.total]
+		}
+	}
 	if r.n == len(r.buf) {
 		if err = r.fill(); err != nil {
 			return 0, err
@@ -50,23 +83,76 @@ func (r *Reader) Read(p []byte) (n int, err error) {
 	return n, nil
 }
 
-func (r *Reader) fill() (err error) {
+func (r *Reader) fill() error {
 	if r.bn == len(r.boxes) {
 		return io.EOF
 	}
 	key := fmt.Sprintf("%05d", r.bn)
-	if r.buf, err = r.bucket.Get(key); err != nil {
-		return err
-	}
-	h := sha256.Sum256(r.buf)
-	if !bytes.Equal(h[:], r.boxes[r.bn][:]) {
-		return fmt.Errorf("Get(%q): hash mismatch", key)
+	err := r.get(r.bucket, key)
+	// A cached box may be stale or corrupt, so check the bucket itself
+	// before giving up.
+	if err != nil && !bucket.IsNotExist(err) {
+		if fresh, ok := bucket.Uncached(r.bucket); ok {
+			err = r.get(fresh, key)
+		}
 	}
 	r.n = 0
+	if err != nil {
+		return err
+	}
 	r.bn += 1
 	return nil
 }
 
+// get reads box key from b into r.buf, reusing its memory.  A box is
+// checked before any of it is returned, so it is held in memory in
+// full, but the buckets below stream it rather than copy it.
+func (r *Reader) get(b Bucket, key string) error {
+	// Every box but the last has the same size, so only the first box
+	// needs a buffer.  The size of the stored box is at least that of
+	// its content.
+	if r.buf == nil {
+		if info, err := b.Stat(key); err == nil {
+			r.buf = make([]byte, 0, info.Size+1)
+		}
+	}
+	rc, err := bucket.Stream(b).GetStream(key)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	r.buf, err = readAll(r.buf[:0], rc)
+	if err == nil && !r.valid() {
+		err = ErrHashMismatch
+	}
+	if err != nil {
+		r.buf = r.buf[:0]
+		return fmt.Errorf("Get(%q): %s", key, err)
+	}
+	return nil
+}
+
+// readAll appends what is read from rc until EOF to buf.
+func readAll(buf []byte, rc io.Reader) ([]byte, error) {
+	for {
+		if len(buf) == cap(buf) {
+			buf = append(buf, 0)[:len(buf)]
+		}
+		n, err := rc.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		if err == io.EOF {
+			return buf, nil
+		} else if err != nil {
+			return buf, err
+		}
+	}
+}
+
+func (r *Reader) valid() bool {
+	h := sha256.Sum256(r.buf)
+	return bytes.Equal(h[:], r.boxes[r.bn][:])
+}
+
 func (r *Reader) Size() int64 {
 	return r.total
 }
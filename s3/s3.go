@@ -2,30 +2,55 @@ package s3
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
 	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
 	"encoding/xml"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
 type Service struct {
 	Name        string       // "s3", "iam", ...
-	Endpoint    string       // "s3.amazonaws.com"
+	Endpoint    string       // "s3.amazonaws.com" or "http://localhost:9000"
 	Region      string       // "us-east-1"
 	AccessKey   string       // Secret Access Key
 	AccessKeyId string       // Access Key Id
+	PathStyle   bool         // https://endpoint/bucket/key instead of https://bucket.endpoint/key
+	CAFile      string       // PEM certificates to trust instead of the system roots
 	Client      *http.Client `json:"-"`
 }
 
 type Bucket struct {
 	Service *Service
 	Name    string `json:"Bucket"`
+
+	ctx context.Context
+}
+
+// WithContext returns a shallow copy of b whose requests use ctx.
+func (b *Bucket) WithContext(ctx context.Context) *Bucket {
+	b2 := *b
+	b2.ctx = ctx
+	return &b2
+}
+
+func (b *Bucket) context() context.Context {
+	if b.ctx == nil {
+		return context.Background()
+	}
+	return b.ctx
 }
 
 func NewBucketFromFile(path string) (*Bucket, error) {
@@ -43,20 +68,84 @@ func NewBucketFromFile(path string) (*Bucket, error) {
 		return nil, fmt.Errorf("json decoding error: %s", err)
 	}
 	// TODO check for missing fields?
+	if _, err := b.Service.endpointURL(); err != nil {
+		return nil, err
+	}
+	if b.Service.CAFile != "" {
+		caFile := b.Service.CAFile
+		if !filepath.IsAbs(caFile) {
+			caFile = filepath.Join(filepath.Dir(path), caFile)
+		}
+		b.Service.Client, err = clientWithCAFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+	}
 	return b, nil
 }
 
+// clientWithCAFile returns an HTTP client that only trusts the
+// certificates in the given PEM file.
+func clientWithCAFile(path string) (*http.Client, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in CA file %q", path)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	return &http.Client{Transport: transport}, nil
+}
+
+// endpointURL parses the service endpoint, which is either a bare host
+// name (implying https) or a URL with a scheme and optional port and path.
+func (s *Service) endpointURL() (*url.URL, error) {
+	if !strings.Contains(s.Endpoint, "://") {
+		return &url.URL{Scheme: "https", Host: s.Endpoint}, nil
+	}
+	u, err := url.Parse(s.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid endpoint %q: %s", s.Endpoint, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid endpoint %q: unsupported scheme %q", s.Endpoint, u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid endpoint %q: missing host", s.Endpoint)
+	}
+	return u, nil
+}
+
 func (b *Bucket) URL(path string, values url.Values) *url.URL {
+	u, err := b.Service.endpointURL()
+	if err != nil {
+		u = &url.URL{Scheme: "https", Host: b.Service.Endpoint}
+	}
+	base := strings.TrimSuffix(u.Path, "/")
+	if b.Service.PathStyle {
+		return &url.URL{
+			Scheme:   u.Scheme,
+			Host:     u.Host,
+			Path:     base + "/" + b.Name + "/" + path,
+			RawQuery: values.Encode(),
+		}
+	}
 	return &url.URL{
-		Scheme:   "https",
-		Host:     b.Name + "." + b.Service.Endpoint,
-		Path:     "/" + path,
+		Scheme:   u.Scheme,
+		Host:     b.Name + "." + u.Host,
+		Path:     base + "/" + path,
 		RawQuery: values.Encode(),
 	}
 }
 
 func (b *Bucket) Put(key string, data []byte) error {
-	req, _ := http.NewRequest("PUT", b.URL(key, nil).String(), bytes.NewBuffer(data))
+	req, err := http.NewRequestWithContext(b.context(), "PUT", b.URL(key, nil).String(), bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
 	req.Header.Set("x-amz-content-sha256", fmt.Sprintf("%x", sha256.Sum256(data)))
 	b.Service.sign(req)
 
@@ -78,8 +167,72 @@ func (b *Bucket) Put(key string, data []byte) error {
 	return nil
 }
 
+// PutReader uploads the rest of r.  It reads r twice: once to find the
+// hashes that S3 needs before the upload, and once to upload it.
+func (b *Bucket) PutReader(key string, r io.ReadSeeker) error {
+	start, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	sha := sha256.New()
+	md := md5.New()
+	size, err := io.Copy(io.MultiWriter(sha, md), r)
+	if err != nil {
+		return err
+	}
+	if _, err := r.Seek(start, io.SeekStart); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(b.context(), "PUT", b.URL(key, nil).String(), ioutil.NopCloser(io.LimitReader(r, size)))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("x-amz-content-sha256", fmt.Sprintf("%x", sha.Sum(nil)))
+	b.Service.sign(req)
+
+	resp, err := b.Service.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected http status code: %d", resp.StatusCode)
+	}
+
+	etag := fmt.Sprintf(`"%x"`, md.Sum(nil))
+	if resp.Header.Get("ETag") != etag {
+		return fmt.Errorf("ETag mismatch")
+	}
+
+	return nil
+}
+
+// GetReader returns the body of the object, which the caller must close.
+func (b *Bucket) GetReader(key string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(b.context(), "GET", b.URL(key, nil).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("x-amz-content-sha256", fmt.Sprintf("%x", sha256.Sum256(nil)))
+	b.Service.sign(req)
+
+	resp, err := b.Service.do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected http status code: %d", resp.StatusCode)
+	}
+	return resp.Body, nil
+}
+
 func (b *Bucket) Get(key string) ([]byte, error) {
-	req, err := http.NewRequest("GET", b.URL(key, nil).String(), nil)
+	req, err := http.NewRequestWithContext(b.context(), "GET", b.URL(key, nil).String(), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -104,19 +257,104 @@ func (b *Bucket) Get(key string) ([]byte, error) {
 	return data, nil
 }
 
+// ObjectInfo is the metadata of an object.
+type ObjectInfo struct {
+	Size         int64
+	LastModified time.Time
+}
+
+// Head returns the metadata of key without its body.
+func (b *Bucket) Head(key string) (*ObjectInfo, error) {
+	req, err := http.NewRequestWithContext(b.context(), "HEAD", b.URL(key, nil).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("x-amz-content-sha256", fmt.Sprintf("%x", sha256.Sum256(nil)))
+	b.Service.sign(req)
+
+	resp, err := b.Service.do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected http status code: %d", resp.StatusCode)
+	}
+	info := &ObjectInfo{Size: resp.ContentLength}
+	if lm := resp.Header.Get("Last-Modified"); lm != "" {
+		if info.LastModified, err = http.ParseTime(lm); err != nil {
+			return nil, fmt.Errorf("invalid Last-Modified header: %q", lm)
+		}
+	}
+	return info, nil
+}
+
+// DeleteObject deletes key.  S3 does not report whether it existed.
+func (b *Bucket) DeleteObject(key string) error {
+	req, err := http.NewRequestWithContext(b.context(), "DELETE", b.URL(key, nil).String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("x-amz-content-sha256", fmt.Sprintf("%x", sha256.Sum256(nil)))
+	b.Service.sign(req)
+
+	resp, err := b.Service.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected http status code: %d", resp.StatusCode)
+	}
+	return nil
+}
+
 type ListBucketResult struct {
-	IsTruncated    bool
-	Contents       []string `xml:">Key"`
-	CommonPrefixes []string `xml:">Prefix"`
+	IsTruncated           bool
+	NextContinuationToken string
+	Contents              []string `xml:">Key"`
+	CommonPrefixes        []string `xml:">Prefix"`
 }
 
+// List returns every key starting with prefix, following continuation
+// tokens until the listing is complete.  Use ListPage for buckets too
+// large to list at once.
 func (b *Bucket) List(prefix, delimiter string) (*ListBucketResult, error) {
+	list := new(ListBucketResult)
+	token := ""
+	for {
+		page, err := b.ListPage(prefix, delimiter, token)
+		if err != nil {
+			return nil, err
+		}
+		list.Contents = append(list.Contents, page.Contents...)
+		list.CommonPrefixes = append(list.CommonPrefixes, page.CommonPrefixes...)
+		if !page.IsTruncated {
+			return list, nil
+		}
+		if page.NextContinuationToken == "" {
+			return nil, fmt.Errorf("truncated list without a continuation token")
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+// ListPage returns one page (at most 1000 entries) of the keys starting
+// with prefix, using ListObjectsV2.  Pass the NextContinuationToken of
+// the previous page to get the next page.
+func (b *Bucket) ListPage(prefix, delimiter, token string) (*ListBucketResult, error) {
 	vals := url.Values{}
+	vals.Set("list-type", "2")
 	vals.Set("prefix", prefix)
 	if delimiter != "" {
 		vals.Set("delimiter", delimiter)
 	}
-	req, err := http.NewRequest("GET", b.URL("", vals).String(), nil)
+	if token != "" {
+		vals.Set("continuation-token", token)
+	}
+	req, err := http.NewRequestWithContext(b.context(), "GET", b.URL("", vals).String(), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -173,7 +411,13 @@ type DeleteError struct {
 	Message string
 }
 
+// MaxDeleteKeys is the most keys that Delete accepts at once.
+const MaxDeleteKeys = 1000
+
 func (b *Bucket) Delete(keys []string) (*DeleteResult, error) {
+	if len(keys) > MaxDeleteKeys {
+		return nil, fmt.Errorf("deleting %d keys: at most %d at once", len(keys), MaxDeleteKeys)
+	}
 	del := Delete{Keys: make([]deleteKey, len(keys))}
 	for i := range keys {
 		del.Keys[i].Key = keys[i]
@@ -187,7 +431,7 @@ func (b *Bucket) Delete(keys []string) (*DeleteResult, error) {
 	vals := url.Values{}
 	vals.Set("delete", "")
 	body := bytes.NewReader(data)
-	req, err := http.NewRequest("POST", b.URL("", vals).String(), body)
+	req, err := http.NewRequestWithContext(b.context(), "POST", b.URL("", vals).String(), body)
 	if err != nil {
 		return nil, err
 	}
@@ -219,6 +463,9 @@ type ServiceError struct {
 	Message   string
 	Resource  string
 	RequestId string
+
+	// StatusCode is the HTTP status of the response.
+	StatusCode int `xml:"-"`
 }
 
 func (e *ServiceError) Error() string {
@@ -244,12 +491,23 @@ func (s *Service) do(req *http.Request) (*http.Response, error) {
 
 	if resp.StatusCode < 300 {
 		return resp, nil
+	} else if req.Method == "HEAD" {
+		// HEAD responses have no body to decode.
+		resp.Body.Close()
+		e := &ServiceError{Code: strings.Replace(http.StatusText(resp.StatusCode), " ", "", -1), StatusCode: resp.StatusCode}
+		if resp.StatusCode == http.StatusNotFound {
+			e.Code = "NoSuchKey"
+		}
+		return resp, e
 	} else {
-		e := new(ServiceError)
+		e := &ServiceError{StatusCode: resp.StatusCode}
 		err := xml.NewDecoder(resp.Body).Decode(e)
 		resp.Body.Close()
 		if err != nil {
-			return resp, fmt.Errorf("unable to decode response body: %s", err)
+			// Proxies and load balancers answer with other bodies,
+			// and the status still says what went wrong.
+			e.Code = strings.Replace(http.StatusText(resp.StatusCode), " ", "", -1)
+			e.Message = fmt.Sprintf("unable to decode response body: %s", err)
 		}
 		return resp, e
 	}
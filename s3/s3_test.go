@@ -0,0 +1,69 @@
+package s3
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestURL(t *testing.T) {
+	tests := []struct {
+		endpoint  string
+		pathStyle bool
+		key       string
+		url       string
+	}{
+		{"s3.amazonaws.com", false, "foo/bar", "https://kebab.s3.amazonaws.com/foo/bar"},
+		{"s3.amazonaws.com", true, "foo/bar", "https://s3.amazonaws.com/kebab/foo/bar"},
+		{"http://localhost:9000", true, "foo/bar", "http://localhost:9000/kebab/foo/bar"},
+		{"http://localhost:9000/", true, "", "http://localhost:9000/kebab/"},
+		{"https://minio.example.com:9000", false, "", "https://kebab.minio.example.com:9000/"},
+		{"https://example.com/s3/", true, "foo", "https://example.com/s3/kebab/foo"},
+		{"http://localhost:9000", true, "世界 ", "http://localhost:9000/kebab/%E4%B8%96%E7%95%8C%20"},
+	}
+	for _, test := range tests {
+		b := &Bucket{
+			Service: &Service{Name: "s3", Endpoint: test.endpoint, PathStyle: test.pathStyle},
+			Name:    "kebab",
+		}
+		if u := b.URL(test.key, nil).String(); u != test.url {
+			t.Errorf("endpoint %q, path style %v: expected %s, got %s", test.endpoint, test.pathStyle, test.url, u)
+		}
+	}
+}
+
+func TestInvalidEndpoint(t *testing.T) {
+	for _, endpoint := range []string{"ftp://localhost", "http://", "http://[::1"} {
+		s := &Service{Endpoint: endpoint}
+		if _, err := s.endpointURL(); err == nil {
+			t.Errorf("expected error for endpoint %q", endpoint)
+		}
+	}
+}
+
+func TestCanonicalPath(t *testing.T) {
+	tests := []struct {
+		url  string
+		path string
+	}{
+		{"https://kebab.s3.amazonaws.com/", "/"},
+		{"https://kebab.s3.amazonaws.com/a//b/../c", "/a//b/../c"},
+		{"http://localhost:9000/kebab/a//b/./c", "/kebab/a//b/./c"},
+		{"http://localhost:9000/kebab/%E4%B8%96%E7%95%8C%20", "/kebab/%E4%B8%96%E7%95%8C%20"},
+	}
+	s := &Service{Name: "s3"}
+	for _, test := range tests {
+		req, err := http.NewRequest("GET", test.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("x-amz-date", "20150830T123600Z")
+		buf := new(bytes.Buffer)
+		s.canonicalRequest(buf, req)
+		lines := strings.Split(buf.String(), "\n")
+		if lines[1] != test.path {
+			t.Errorf("%s: expected canonical path %q, got %q", test.url, test.path, lines[1])
+		}
+	}
+}
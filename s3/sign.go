@@ -9,6 +9,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"path"
 	"sort"
 	"strings"
 	"time"
@@ -84,18 +85,17 @@ func (s *Service) stringToSign(w io.Writer, r *http.Request, now time.Time) []st
 	w.Write([]byte{'\n'})
 
 	h := sha256.New()
-	signedHeaders := canonicalRequest(h, r)
+	signedHeaders := s.canonicalRequest(h, r)
 	fmt.Fprintf(w, "%x", h.Sum(nil))
 
 	return signedHeaders
 }
 
-func canonicalRequest(w io.Writer, r *http.Request) []string {
+func (s *Service) canonicalRequest(w io.Writer, r *http.Request) []string {
 	io.WriteString(w, r.Method)
 	w.Write([]byte{'\n'})
 
-	u := r.URL.ResolveReference(r.URL)
-	io.WriteString(w, uriEncode(u.Path, false))
+	io.WriteString(w, uriEncode(s.canonicalPath(r.URL.Path), false))
 	w.Write([]byte{'\n'})
 
 	canonicalQueryString(w, r.URL.Query())
@@ -114,6 +114,24 @@ func canonicalRequest(w io.Writer, r *http.Request) []string {
 	return signedHeaders
 }
 
+// canonicalPath returns the path used in the canonical request.  S3
+// signs the object key exactly as it appears in the request, since keys
+// like "a//b" or "a/../b" are distinct objects.  Other services sign the
+// normalized path, without dot segments and repeated slashes.
+func (s *Service) canonicalPath(p string) string {
+	if p == "" {
+		return "/"
+	}
+	if s.Name == "s3" {
+		return p
+	}
+	clean := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && clean != "/" {
+		clean += "/"
+	}
+	return clean
+}
+
 func canonicalQueryString(w io.Writer, m url.Values) {
 	qs := make([]string, 0, len(m))
 	for k, vs := range m {
@@ -0,0 +1,113 @@
+package kebab
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/davidlazar/kebab/bucket"
+)
+
+// ErrHashMismatch is the error of a box whose hash does not match the
+// metadata.
+var ErrHashMismatch = errors.New("hash mismatch")
+
+// A BoxProblem is a box that failed a scrub.
+type BoxProblem struct {
+	Key string
+	// Path is where the box is stored, as given by Bucket.Abs.
+	Path string
+	// Missing is set if the box does not exist.  Otherwise Err says
+	// why it is corrupt or could not be read: bucket.ErrAuth if it
+	// failed decryption, or ErrHashMismatch.  For the metadata of a
+	// replica, ErrHashMismatch means it differs from the metadata the
+	// boxes were checked against.
+	Missing bool
+	Err     error
+}
+
+func (p BoxProblem) String() string {
+	if p.Missing {
+		return fmt.Sprintf("%s: missing", p.Path)
+	}
+	return fmt.Sprintf("%s: %s", p.Path, p.Err)
+}
+
+// ScrubReport is the result of scrubbing a backup.
+type ScrubReport struct {
+	Boxes int
+	// Replicas is the number of copies of each box that were read.
+	Replicas int
+	// Bytes is the size of the boxes that were read.
+	Bytes    int64
+	Problems []BoxProblem
+}
+
+// Scrub reads every box of the backup in b, bypassing any cache, and
+// checks it against the hash in the metadata.  If b is a mirror, every
+// replica is read on its own, so that a bad copy is not hidden by a
+// good one; the metadata of each replica must then match too.  Boxes
+// are decrypted but not decompressed.  Bad boxes are reported rather
+// than returned as errors, so that one scrub finds all of them.  The
+// error is for reading the metadata, or ctx being done.
+func Scrub(ctx context.Context, b Bucket) (*ScrubReport, error) {
+	b = bucket.WithContext(ctx, b)
+	meta, err := readMeta(b)
+	if err != nil {
+		return nil, err
+	}
+	fresh, _ := bucket.Uncached(b)
+	replicas := bucket.Replicas(fresh)
+	if replicas == nil {
+		replicas = []bucket.Bucket{fresh}
+	}
+
+	report := &ScrubReport{Boxes: len(meta.Boxes), Replicas: len(replicas)}
+	problem := func(rb bucket.Bucket, key string, err error) {
+		report.Problems = append(report.Problems, BoxProblem{
+			Key:     key,
+			Path:    rb.Abs(key),
+			Missing: bucket.IsNotExist(err),
+			Err:     err,
+		})
+	}
+	if len(replicas) > 1 {
+		for _, rb := range replicas {
+			data, err := rb.Get("meta")
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if err == nil {
+				var m *Metadata
+				if m, err = parseMeta(data); err == nil && !reflect.DeepEqual(m, meta) {
+					err = ErrHashMismatch
+				}
+			}
+			if err != nil {
+				problem(rb, "meta", err)
+			}
+		}
+	}
+	for i, hash := range meta.Boxes {
+		key := fmt.Sprintf("%05d", i)
+		for _, rb := range replicas {
+			data, err := rb.Get(key)
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			report.Bytes += int64(len(data))
+			if err == nil {
+				if h := sha256.Sum256(data); !bytes.Equal(h[:], hash[:]) {
+					err = ErrHashMismatch
+				}
+			}
+			if err != nil {
+				problem(rb, key, err)
+			}
+		}
+	}
+	return report, nil
+}
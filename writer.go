@@ -1,36 +1,89 @@
 package kebab
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+
+	"github.com/davidlazar/kebab/bucket"
 )
 
-const Version = 0
+// Version 1 added Metadata.Size, for padded backups.
+const Version = 1
 
 type boxhash [sha256.Size]byte
 
+// A Padding hides the size of a backup by rounding up its number of
+// boxes.  When a Writer has a Padding, the last box is also padded to
+// the full box size, and the metadata to a multiple of MetaQuantum
+// bytes.  Padding is stored encrypted like the data, so it is
+// authenticated, and a Reader strips it.
+type Padding func(boxes int) int
+
+// MetaQuantum is the size that metadata is padded to a multiple of.
+const MetaQuantum = 4096
+
+// PadBox pads only the last box, hiding the exact size of the backup.
+func PadBox(boxes int) int {
+	return boxes
+}
+
+// PadPowerOfTwo rounds the number of boxes up to a power of two.
+func PadPowerOfTwo(boxes int) int {
+	n := 1
+	for n < boxes {
+		n *= 2
+	}
+	return n
+}
+
+// PadQuantum rounds the number of boxes up to a multiple of q.
+func PadQuantum(q int) Padding {
+	return func(boxes int) int {
+		if boxes == 0 {
+			return q
+		}
+		return (boxes + q - 1) / q * q
+	}
+}
+
 type Writer struct {
 	err error
 
 	bucket Bucket
 	boxes  []boxhash
+	pad    Padding
 
 	buf []byte
 	n   int
 
-	total int64
+	total  int64
+	resume bool
 }
 
+// NewWriter returns a Writer that stores a backup in bucket in boxes of
+// boxSize bytes.  If bucket holds the boxes of an unfinished backup of
+// the same data, the Writer resumes it: boxes that are already stored
+// are not uploaded again.
 func NewWriter(bucket Bucket, boxSize int) *Writer {
 	w := &Writer{
 		bucket: bucket,
 		buf:    make([]byte, boxSize),
+		resume: true,
 	}
 	return w
 }
 
+// NewPaddedWriter returns a Writer that pads the backup with pad.
+func NewPaddedWriter(bucket Bucket, boxSize int, pad Padding) *Writer {
+	w := NewWriter(bucket, boxSize)
+	w.pad = pad
+	return w
+}
+
 func (w *Writer) Write(p []byte) (n int, err error) {
 	if w.err != nil {
 		return n, w.err
@@ -55,18 +108,51 @@ func (w *Writer) flush() error {
 	if w.n == 0 {
 		return nil
 	}
+	// The reader is seekable, so the box can be retried, and buckets
+	// that stream do not copy it.
 	key := fmt.Sprintf("%05d", len(w.boxes))
-	if err := w.bucket.Put(key, w.buf[0:w.n]); err != nil {
-		return err
+	sum := sha256.Sum256(w.buf[0:w.n])
+	if !w.stored(key, sum) {
+		if err := bucket.Stream(w.bucket).PutStream(key, bytes.NewReader(w.buf[0:w.n])); err != nil {
+			return err
+		}
 	}
-	w.boxes = append(w.boxes, sha256.Sum256(w.buf[0:w.n]))
+	w.boxes = append(w.boxes, sum)
 	w.n = 0
 	return nil
 }
 
+// stored reports whether box key is already in the bucket with hash
+// sum.  Once a box is missing or differs, the boxes after it will too,
+// so the Writer stops looking.  Errors only mean the box is uploaded
+// again.
+func (w *Writer) stored(key string, sum boxhash) bool {
+	if !w.resume {
+		return false
+	}
+	w.resume = false
+	rc, err := bucket.Stream(w.bucket).GetStream(key)
+	if err != nil {
+		return false
+	}
+	defer rc.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, rc); err != nil {
+		return false
+	}
+	if !bytes.Equal(h.Sum(nil), sum[:]) {
+		return false
+	}
+	w.resume = true
+	return true
+}
+
 type Metadata struct {
 	Version int
 	Boxes   []boxhash
+
+	// Size is the number of bytes written, not counting padding.
+	Size int64
 }
 
 func (w *Writer) Close() error {
@@ -74,26 +160,65 @@ func (w *Writer) Close() error {
 		return w.err
 	}
 
+	if w.pad != nil && w.n > 0 {
+		for i := w.n; i < len(w.buf); i++ {
+			w.buf[i] = 0
+		}
+		w.n = len(w.buf)
+	}
 	if w.err = w.flush(); w.err != nil {
 		return w.err
 	}
+	if w.pad != nil {
+		for i := range w.buf {
+			w.buf[i] = 0
+		}
+		for n := w.pad(len(w.boxes)); len(w.boxes) < n; {
+			w.n = len(w.buf)
+			if w.err = w.flush(); w.err != nil {
+				return w.err
+			}
+		}
+	}
 
 	m := Metadata{
 		Version: Version,
 		Boxes:   w.boxes,
+		Size:    w.total,
 	}
 	metajson, err := json.Marshal(m)
 	if err != nil {
 		panic(err)
 	}
+	if w.pad != nil {
+		// Trailing whitespace is valid JSON.
+		n := (len(metajson)/MetaQuantum + 1) * MetaQuantum
+		metajson = append(metajson, bytes.Repeat([]byte{' '}, n-len(metajson))...)
+	}
 	if w.err = w.bucket.Put("meta", metajson); w.err != nil {
 		return w.err
 	}
+	w.removeStaleBoxes()
 
 	w.err = errors.New("already closed")
 	return nil
 }
 
+// removeStaleBoxes deletes the boxes after the last one written, left
+// over from an earlier, larger backup with the same id.  They are only
+// wasted space, so errors are ignored.
+func (w *Writer) removeStaleBoxes() {
+	for i := len(w.boxes); ; i++ {
+		key := fmt.Sprintf("%05d", i)
+		if ok, err := bucket.Exists(w.bucket, key); !ok || err != nil {
+			return
+		}
+		if err := w.bucket.Delete(key); err != nil {
+			return
+		}
+	}
+}
+
 func (w *Writer) Size() int64 {
 	return w.total
 }